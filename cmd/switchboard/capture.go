@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+	"github.com/fd/switchboard/pkg/pcap"
+)
+
+func capturePackets(ctx context.Context, apiAddr, output, host, direction string, filter []string) {
+	conn, err := grpc.Dial(apiAddr)
+	assert(err)
+	defer conn.Close()
+
+	client := protocol.NewPacketsClient(conn)
+
+	in := protocol.CaptureReq{
+		Host:      host,
+		Filter:    strings.Join(filter, " "),
+		Direction: protocol.CaptureDirection(protocol.CaptureDirection_value[strings.ToUpper(direction)]),
+	}
+	stream, err := client.Capture(ctx, &in)
+	assert(err)
+
+	var (
+		w       *pcap.Writer
+		dropped uint64
+	)
+
+	if output != "" {
+		w, err = pcap.Create(output)
+		assert(err)
+		defer func() {
+			assert(w.Close())
+			fmt.Fprintf(os.Stderr, "%d packets captured (%d dropped)\n", w.Count(), dropped)
+		}()
+	}
+
+	for {
+		out, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			assert(err)
+		}
+
+		dropped = out.Dropped
+		ts := time.Unix(0, out.Time)
+
+		if w != nil {
+			assert(w.WritePacket(ts, out.Data))
+			continue
+		}
+
+		fmt.Printf("%s %-3s %-8s %s\n", ts.Format("15:04:05.000000"), strings.ToLower(out.Direction.String()), shortID(out.HostId), summarizePacket(out.Data))
+	}
+}
+
+func summarizePacket(data []byte) string {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	var names []string
+	for _, l := range pkt.Layers() {
+		if l.LayerType() == gopacket.LayerTypePayload {
+			continue
+		}
+		names = append(names, l.LayerType().String())
+	}
+
+	summary := strings.Join(names, "/")
+
+	switch {
+	case pkt.TransportLayer() != nil && pkt.NetworkLayer() != nil:
+		src, dst := pkt.NetworkLayer().NetworkFlow().Endpoints()
+		sport, dport := pkt.TransportLayer().TransportFlow().Endpoints()
+		summary += fmt.Sprintf(" %s:%s > %s:%s", src, sport, dst, dport)
+	case pkt.NetworkLayer() != nil:
+		src, dst := pkt.NetworkLayer().NetworkFlow().Endpoints()
+		summary += fmt.Sprintf(" %s > %s", src, dst)
+	case pkt.LinkLayer() != nil:
+		src, dst := pkt.LinkLayer().LinkFlow().Endpoints()
+		summary += fmt.Sprintf(" %s > %s", src, dst)
+	}
+
+	return fmt.Sprintf("%s len=%d", summary, len(data))
+}
+
+func shortID(id string) string {
+	if id == "" {
+		return "-"
+	}
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+)
+
+func listDrops(ctx context.Context, apiAddr, host string) {
+	conn, err := grpc.Dial(apiAddr)
+	assert(err)
+	defer conn.Close()
+
+	client := protocol.NewPacketsClient(conn)
+
+	in := protocol.DropsReq{Host: host}
+	out, err := client.Drops(ctx, &in)
+	assert(err)
+
+	tabw := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+	defer tabw.Flush()
+	fmt.Fprintf(tabw, "%s\t%s\t%s\t%s\n", "REASON", "HOST", "RULE", "COUNT")
+	for _, drop := range out.Drops {
+		fmt.Fprintf(tabw, "%s\t%s\t%s\t%d\n", drop.Reason, shortID(drop.HostId), shortID(drop.RuleId), drop.Count)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+)
+
+func listFlows(ctx context.Context, apiAddr, host, proto, addr string) {
+	conn, err := grpc.Dial(apiAddr)
+	assert(err)
+	defer conn.Close()
+
+	client := protocol.NewRoutesClient(conn)
+
+	in := protocol.RouteListReq{Host: host, Protocol: parseProtocol(proto), Addr: addr}
+	out, err := client.List(ctx, &in)
+	assert(err)
+
+	printFlows(os.Stdout, out.Routes)
+}
+
+func killFlows(ctx context.Context, apiAddr, host, proto, addr string) {
+	conn, err := grpc.Dial(apiAddr)
+	assert(err)
+	defer conn.Close()
+
+	client := protocol.NewRoutesClient(conn)
+
+	in := protocol.RouteKillReq{Host: host, Protocol: parseProtocol(proto), Addr: addr}
+	out, err := client.Kill(ctx, &in)
+	assert(err)
+
+	printFlows(os.Stdout, out.Routes)
+	fmt.Fprintf(os.Stderr, "%d flows killed\n", len(out.Routes))
+}
+
+func printFlows(w io.Writer, routes []*protocol.Route) {
+	now := time.Now()
+
+	tabw := tabwriter.NewWriter(w, 8, 8, 2, ' ', 0)
+	defer tabw.Flush()
+	fmt.Fprintf(tabw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		"PROTO", "HOST", "INBOUND", "OUTBOUND", "STATE", "RX", "TX", "IDLE")
+	for _, route := range routes {
+		stats := route.GetStats()
+		if stats == nil {
+			stats = &protocol.RouteStats{}
+		}
+
+		state := route.TcpState
+		if state == "" {
+			state = "-"
+		}
+
+		idle := now.Sub(time.Unix(0, stats.LastSeen)) / time.Second * time.Second
+
+		fmt.Fprintf(tabw, "%s\t%s\t%s\t%s\t%s\t%d/%d\t%d/%d\t%s\n",
+			strings.ToLower(route.Protocol.String()),
+			shortID(route.HostId),
+			formatStream(route.GetInbound()),
+			formatStream(route.GetOutbound()),
+			strings.ToLower(state),
+			stats.RxPackets, stats.RxBytes,
+			stats.TxPackets, stats.TxBytes,
+			idle)
+	}
+}
+
+func formatStream(s *protocol.RouteStream) string {
+	if s == nil {
+		return "-"
+	}
+	return net.JoinHostPort(s.SrcIp, strconv.Itoa(int(s.SrcPort))) +
+		" -> " + net.JoinHostPort(s.DstIp, strconv.Itoa(int(s.DstPort)))
+}
+
+func parseProtocol(proto string) protocol.Protocol {
+	switch proto {
+	case "tcp":
+		return protocol.Protocol_TCP
+	case "udp":
+		return protocol.Protocol_UDP
+	default:
+		return protocol.Protocol_UNSET
+	}
+}
@@ -0,0 +1,14 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	// link drivers
+	_ "github.com/fd/switchboard/pkg/vmnet"
+)
+
+const (
+	defaultLinkDriver = "vmnet"
+	defaultLinkID     = "31fbf731-e896-4d03-9bc8-7a6221b91860"
+)
@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	// link drivers
+	_ "github.com/fd/switchboard/pkg/tap"
+)
+
+const (
+	defaultLinkDriver = "tap"
+	defaultLinkID     = "switchboard0"
+)
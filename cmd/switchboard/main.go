@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"sort"
+	"strings"
 	"syscall"
 	"text/tabwriter"
 
@@ -14,9 +15,16 @@ import (
 
 	"github.com/fd/switchboard/pkg/api/protocol"
 	"github.com/fd/switchboard/pkg/api/server"
+	"github.com/fd/switchboard/pkg/config"
 	"github.com/fd/switchboard/pkg/dispatcher"
 	"github.com/fd/switchboard/pkg/dns"
+	"github.com/fd/switchboard/pkg/link"
+	"github.com/fd/switchboard/pkg/metrics"
 	"github.com/fd/switchboard/pkg/plugin/driver"
+
+	// link drivers
+	_ "github.com/fd/switchboard/pkg/pcap"
+	_ "github.com/fd/switchboard/pkg/qemu"
 )
 
 func main() {
@@ -26,43 +34,119 @@ func main() {
 
 	app := kingpin.New("switchboard", "").Version("1.0a").Author("Simon Menke")
 
+	configFile := app.Flag("config", "configuration file").String()
+
 	daemon := app.Command("daemon", "run the daemon")
+	daemonLink := daemon.Flag("link", "link driver (overrides the configuration)").String()
+	daemonLinkID := daemon.Flag("link-id", "link identifier (driver specific, overrides the configuration)").String()
 	hosts := app.Command("hosts", "list the hosts")
 	addresses := app.Command("addresses", "list the routed addresses")
+	capture := app.Command("capture", "capture packets")
+	captureOutput := capture.Flag("write", "write packets to a pcap file (pcapng when it ends in .pcapng)").Short('w').String()
+	captureHost := capture.Flag("host", "only capture packets for this host (name or ID)").String()
+	captureDirection := capture.Flag("direction", "only capture packets in this direction").Default("any").Enum("any", "in", "out")
+	captureFilter := capture.Arg("filter", "filter expression (eg. 'tcp port 80')").Strings()
+	drops := app.Command("drops", "list the dropped packet counters")
+	dropsHost := drops.Flag("host", "only list the counters for this host (name or ID)").String()
+	trace := app.Command("trace", "trace the decisions made for packets")
+	traceFilter := trace.Arg("filter", "filter expression (eg. 'tcp port 80')").Strings()
+	flows := app.Command("flows", "list or kill the routed flows")
+	flowsList := flows.Command("list", "list the routed flows").Default()
+	flowsListHost := flowsList.Flag("host", "only list the flows of this host (name or ID)").String()
+	flowsListProtocol := flowsList.Flag("protocol", "only list the flows of this protocol").Enum("tcp", "udp")
+	flowsListAddr := flowsList.Arg("addr", "only list the flows with this address (eg. '10.0.0.2', '10.0.0.2:80' or ':80')").String()
+	flowsKill := flows.Command("kill", "kill the matching flows")
+	flowsKillHost := flowsKill.Flag("host", "only kill the flows of this host (name or ID)").String()
+	flowsKillProtocol := flowsKill.Flag("protocol", "only kill the flows of this protocol").Enum("tcp", "udp")
+	flowsKillAddr := flowsKill.Arg("addr", "only kill the flows with this address (eg. '10.0.0.2', '10.0.0.2:80' or ':80')").String()
+	portsCmd := app.Command("ports", "list the allocated ports")
+	portsHost := portsCmd.Flag("host", "only list the ports of this host (name or ID)").String()
+	portsOwner := portsCmd.Flag("owner", "only list the ports allocated for rules or routes").Enum("rule", "route")
+
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		app.Fatalf("%s", err)
+	}
 
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	switch cmd {
 	case daemon.FullCommand():
-		runServer(ctx)
+		if *daemonLink != "" {
+			conf.Link.Driver = *daemonLink
+		}
+		if *daemonLinkID != "" {
+			conf.Link.ID = *daemonLinkID
+		}
+		runServer(ctx, conf)
 	case hosts.FullCommand():
-		listHosts(ctx)
+		listHosts(ctx, conf.APIAddr())
 	case addresses.FullCommand():
-		listAddresses(ctx)
+		listAddresses(ctx, conf.APIAddr())
+	case capture.FullCommand():
+		capturePackets(ctx, conf.APIAddr(), *captureOutput, *captureHost, *captureDirection, *captureFilter)
+	case drops.FullCommand():
+		listDrops(ctx, conf.APIAddr(), *dropsHost)
+	case trace.FullCommand():
+		tracePackets(ctx, conf.APIAddr(), *traceFilter)
+	case flowsList.FullCommand():
+		listFlows(ctx, conf.APIAddr(), *flowsListHost, *flowsListProtocol, *flowsListAddr)
+	case flowsKill.FullCommand():
+		killFlows(ctx, conf.APIAddr(), *flowsKillHost, *flowsKillProtocol, *flowsKillAddr)
+	case portsCmd.FullCommand():
+		listPorts(ctx, conf.APIAddr(), *portsHost, *portsOwner)
 	}
 }
 
-func runServer(ctx context.Context) {
-	vnet, err := dispatcher.Run(ctx)
+func loadConfig(name string) (*config.Config, error) {
+	var (
+		conf *config.Config
+		err  error
+	)
+
+	if name == "" {
+		conf = config.Default()
+	} else {
+		conf, err = config.Load(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Link.Driver == "" {
+		conf.Link.Driver = defaultLinkDriver
+		if conf.Link.ID == "" {
+			conf.Link.ID = defaultLinkID
+		}
+	}
+
+	return conf, nil
+}
+
+func runServer(ctx context.Context, conf *config.Config) {
+	l, err := link.Open(conf.Link.Driver, conf.Link.ID)
 	assert(err)
 
-	err = server.Run(ctx, vnet)
+	vnet, err := dispatcher.Run(ctx, l, conf)
 	assert(err)
 
-	// export DOCKER_TLS_VERIFY="1"
-	// export DOCKER_HOST="tcp://192.168.99.100:2376"
-	// export DOCKER_CERT_PATH="/Users/fd/.docker/machine/machines/default"
-	driver.Run(ctx, "docker", map[string]interface{}{
-		"host":       "tcp://192.168.99.100:2376",
-		"verify-tls": true,
-		"cert-path":  "/Users/fd/.docker/machine/machines/default",
-	})
+	err = server.Run(ctx, vnet, conf.API)
+	assert(err)
+
+	err = metrics.Run(ctx, vnet, conf.Metrics)
+	assert(err)
+
+	for name, pluginConfig := range conf.Plugins {
+		driver.Run(ctx, name, "tcp://"+conf.APIAddr(), pluginConfig)
+	}
 
 	dns.Run(ctx, vnet)
 
 	defer vnet.Wait()
 }
 
-func listHosts(ctx context.Context) {
-	conn, err := grpc.Dial("172.18.0.1:8080")
+func listHosts(ctx context.Context, apiAddr string) {
+	conn, err := grpc.Dial(apiAddr)
 	assert(err)
 	defer conn.Close()
 
@@ -74,19 +158,19 @@ func listHosts(ctx context.Context) {
 
 	tabw := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
 	defer tabw.Flush()
-	fmt.Fprintf(tabw, "%s\t%s\t%s\n", "ID", "NAME", "STATE")
+	fmt.Fprintf(tabw, "%s\t%s\t%s\t%s\n", "ID", "NAME", "STATE", "POLICY")
 	for _, host := range out.Hosts {
 		state := "down"
 		if host.Up {
 			state = "up"
 		}
 
-		fmt.Fprintf(tabw, "%s\t%s\t%v\n", host.Id[:8], host.Name, state)
+		fmt.Fprintf(tabw, "%s\t%s\t%v\t%s\n", host.Id[:8], host.Name, state, strings.ToLower(host.Policy.String()))
 	}
 }
 
-func listAddresses(ctx context.Context) {
-	conn, err := grpc.Dial("172.18.0.1:8080")
+func listAddresses(ctx context.Context, apiAddr string) {
+	conn, err := grpc.Dial(apiAddr)
 	assert(err)
 	defer conn.Close()
 
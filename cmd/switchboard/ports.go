@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+)
+
+func listPorts(ctx context.Context, apiAddr, host, owner string) {
+	conn, err := grpc.Dial(apiAddr)
+	assert(err)
+	defer conn.Close()
+
+	client := protocol.NewPortsClient(conn)
+
+	in := protocol.PortListReq{Host: host}
+	switch owner {
+	case "rule":
+		in.Owner = protocol.PortOwner_RULE
+	case "route":
+		in.Owner = protocol.PortOwner_ROUTE
+	}
+	out, err := client.List(ctx, &in)
+	assert(err)
+
+	tabw := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+	defer tabw.Flush()
+	fmt.Fprintf(tabw, "%s\t%s\t%s\t%s\n", "HOST", "PROTO", "PORT", "OWNER")
+	for _, p := range out.Ports {
+		fmt.Fprintf(tabw, "%s\t%s\t%d\t%s\n",
+			shortID(p.HostId), strings.ToLower(p.Protocol.String()), p.Port, strings.ToLower(p.Owner.String()))
+	}
+}
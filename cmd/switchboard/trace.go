@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+)
+
+func tracePackets(ctx context.Context, apiAddr string, filter []string) {
+	conn, err := grpc.Dial(apiAddr)
+	assert(err)
+	defer conn.Close()
+
+	client := protocol.NewPacketsClient(conn)
+
+	in := protocol.TraceReq{Filter: strings.Join(filter, " ")}
+	stream, err := client.Trace(ctx, &in)
+	assert(err)
+
+	var dropped uint64
+	defer func() {
+		if dropped > 0 {
+			fmt.Fprintf(os.Stderr, "%d traces dropped\n", dropped)
+		}
+	}()
+
+	for {
+		out, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			assert(err)
+		}
+
+		dropped = out.Dropped
+		ts := time.Unix(0, out.Time)
+
+		fmt.Printf("%s %-8s %s\n", ts.Format("15:04:05.000000"), shortID(out.HostId), out.Summary)
+		for _, step := range out.Steps {
+			fmt.Printf("    %s\n", step)
+		}
+	}
+}
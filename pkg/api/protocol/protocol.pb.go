@@ -17,10 +17,29 @@ It has these top-level messages:
 	HostRemoveRes
 	HostSetStatusReq
 	HostSetStatusRes
+	HostSetPolicyReq
+	HostSetPolicyRes
 	RuleAddReq
 	RuleAddRes
 	RuleClearReq
 	RuleClearRes
+	CaptureReq
+	CaptureRes
+	DropsReq
+	DropsRes
+	Drop
+	TraceReq
+	TraceRes
+	RouteListReq
+	RouteListRes
+	RouteKillReq
+	RouteKillRes
+	Route
+	RouteStream
+	RouteStats
+	PortListReq
+	PortListRes
+	Port
 	Host
 */
 package protocol
@@ -62,6 +81,75 @@ func (x Protocol) String() string {
 	return proto.EnumName(Protocol_name, int32(x))
 }
 
+type HostPolicy int32
+
+const (
+	HostPolicy_DEFAULT HostPolicy = 0
+	HostPolicy_DROP    HostPolicy = 1
+	HostPolicy_REJECT  HostPolicy = 2
+)
+
+var HostPolicy_name = map[int32]string{
+	0: "DEFAULT",
+	1: "DROP",
+	2: "REJECT",
+}
+var HostPolicy_value = map[string]int32{
+	"DEFAULT": 0,
+	"DROP":    1,
+	"REJECT":  2,
+}
+
+func (x HostPolicy) String() string {
+	return proto.EnumName(HostPolicy_name, int32(x))
+}
+
+type CaptureDirection int32
+
+const (
+	CaptureDirection_ANY CaptureDirection = 0
+	CaptureDirection_IN  CaptureDirection = 1
+	CaptureDirection_OUT CaptureDirection = 2
+)
+
+var CaptureDirection_name = map[int32]string{
+	0: "ANY",
+	1: "IN",
+	2: "OUT",
+}
+var CaptureDirection_value = map[string]int32{
+	"ANY": 0,
+	"IN":  1,
+	"OUT": 2,
+}
+
+func (x CaptureDirection) String() string {
+	return proto.EnumName(CaptureDirection_name, int32(x))
+}
+
+type PortOwner int32
+
+const (
+	PortOwner_ANY_OWNER PortOwner = 0
+	PortOwner_ROUTE     PortOwner = 1
+	PortOwner_RULE      PortOwner = 2
+)
+
+var PortOwner_name = map[int32]string{
+	0: "ANY_OWNER",
+	1: "ROUTE",
+	2: "RULE",
+}
+var PortOwner_value = map[string]int32{
+	"ANY_OWNER": 0,
+	"ROUTE":     1,
+	"RULE":      2,
+}
+
+func (x PortOwner) String() string {
+	return proto.EnumName(PortOwner_name, int32(x))
+}
+
 type HostListReq struct {
 }
 
@@ -85,8 +173,9 @@ func (m *HostListRes) GetHosts() []*Host {
 }
 
 type HostAddReq struct {
-	Name         string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
-	AllocateIPv4 bool   `protobuf:"varint,2,opt,name=allocateIPv4" json:"allocateIPv4,omitempty"`
+	Name         string     `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	AllocateIPv4 bool       `protobuf:"varint,2,opt,name=allocateIPv4" json:"allocateIPv4,omitempty"`
+	Policy       HostPolicy `protobuf:"varint,3,opt,name=policy,enum=protocol.HostPolicy" json:"policy,omitempty"`
 }
 
 func (m *HostAddReq) Reset()         { *m = HostAddReq{} }
@@ -139,6 +228,22 @@ func (m *HostSetStatusRes) Reset()         { *m = HostSetStatusRes{} }
 func (m *HostSetStatusRes) String() string { return proto.CompactTextString(m) }
 func (*HostSetStatusRes) ProtoMessage()    {}
 
+type HostSetPolicyReq struct {
+	Id     string     `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Policy HostPolicy `protobuf:"varint,2,opt,name=policy,enum=protocol.HostPolicy" json:"policy,omitempty"`
+}
+
+func (m *HostSetPolicyReq) Reset()         { *m = HostSetPolicyReq{} }
+func (m *HostSetPolicyReq) String() string { return proto.CompactTextString(m) }
+func (*HostSetPolicyReq) ProtoMessage()    {}
+
+type HostSetPolicyRes struct {
+}
+
+func (m *HostSetPolicyRes) Reset()         { *m = HostSetPolicyRes{} }
+func (m *HostSetPolicyRes) String() string { return proto.CompactTextString(m) }
+func (*HostSetPolicyRes) ProtoMessage()    {}
+
 type RuleAddReq struct {
 	Protocol  Protocol `protobuf:"varint,1,opt,name=protocol,enum=protocol.Protocol" json:"protocol,omitempty"`
 	SrcHostId string   `protobuf:"bytes,2,opt,name=srcHostId" json:"srcHostId,omitempty"`
@@ -173,12 +278,233 @@ func (m *RuleClearRes) Reset()         { *m = RuleClearRes{} }
 func (m *RuleClearRes) String() string { return proto.CompactTextString(m) }
 func (*RuleClearRes) ProtoMessage()    {}
 
+type CaptureReq struct {
+	Host      string           `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+	Filter    string           `protobuf:"bytes,2,opt,name=filter" json:"filter,omitempty"`
+	Direction CaptureDirection `protobuf:"varint,3,opt,name=direction,enum=protocol.CaptureDirection" json:"direction,omitempty"`
+}
+
+func (m *CaptureReq) Reset()         { *m = CaptureReq{} }
+func (m *CaptureReq) String() string { return proto.CompactTextString(m) }
+func (*CaptureReq) ProtoMessage()    {}
+
+type CaptureRes struct {
+	Time      int64            `protobuf:"varint,1,opt,name=time" json:"time,omitempty"`
+	Direction CaptureDirection `protobuf:"varint,2,opt,name=direction,enum=protocol.CaptureDirection" json:"direction,omitempty"`
+	HostId    string           `protobuf:"bytes,3,opt,name=hostId" json:"hostId,omitempty"`
+	Data      []byte           `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Dropped   uint64           `protobuf:"varint,5,opt,name=dropped" json:"dropped,omitempty"`
+}
+
+func (m *CaptureRes) Reset()         { *m = CaptureRes{} }
+func (m *CaptureRes) String() string { return proto.CompactTextString(m) }
+func (*CaptureRes) ProtoMessage()    {}
+
+type DropsReq struct {
+	Host string `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+}
+
+func (m *DropsReq) Reset()         { *m = DropsReq{} }
+func (m *DropsReq) String() string { return proto.CompactTextString(m) }
+func (*DropsReq) ProtoMessage()    {}
+
+type DropsRes struct {
+	Drops []*Drop `protobuf:"bytes,1,rep,name=drops" json:"drops,omitempty"`
+}
+
+func (m *DropsRes) Reset()         { *m = DropsRes{} }
+func (m *DropsRes) String() string { return proto.CompactTextString(m) }
+func (*DropsRes) ProtoMessage()    {}
+
+func (m *DropsRes) GetDrops() []*Drop {
+	if m != nil {
+		return m.Drops
+	}
+	return nil
+}
+
+type Drop struct {
+	Reason string `protobuf:"bytes,1,opt,name=reason" json:"reason,omitempty"`
+	HostId string `protobuf:"bytes,2,opt,name=hostId" json:"hostId,omitempty"`
+	RuleId string `protobuf:"bytes,3,opt,name=ruleId" json:"ruleId,omitempty"`
+	Count  uint64 `protobuf:"varint,4,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *Drop) Reset()         { *m = Drop{} }
+func (m *Drop) String() string { return proto.CompactTextString(m) }
+func (*Drop) ProtoMessage()    {}
+
+type TraceReq struct {
+	Filter string `protobuf:"bytes,1,opt,name=filter" json:"filter,omitempty"`
+}
+
+func (m *TraceReq) Reset()         { *m = TraceReq{} }
+func (m *TraceReq) String() string { return proto.CompactTextString(m) }
+func (*TraceReq) ProtoMessage()    {}
+
+type TraceRes struct {
+	Time       int64    `protobuf:"varint,1,opt,name=time" json:"time,omitempty"`
+	HostId     string   `protobuf:"bytes,2,opt,name=hostId" json:"hostId,omitempty"`
+	Summary    string   `protobuf:"bytes,3,opt,name=summary" json:"summary,omitempty"`
+	Steps      []string `protobuf:"bytes,4,rep,name=steps" json:"steps,omitempty"`
+	DropReason string   `protobuf:"bytes,5,opt,name=dropReason" json:"dropReason,omitempty"`
+	Dropped    uint64   `protobuf:"varint,6,opt,name=dropped" json:"dropped,omitempty"`
+}
+
+func (m *TraceRes) Reset()         { *m = TraceRes{} }
+func (m *TraceRes) String() string { return proto.CompactTextString(m) }
+func (*TraceRes) ProtoMessage()    {}
+
+type RouteListReq struct {
+	Host     string   `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+	Protocol Protocol `protobuf:"varint,2,opt,name=protocol,enum=protocol.Protocol" json:"protocol,omitempty"`
+	Addr     string   `protobuf:"bytes,3,opt,name=addr" json:"addr,omitempty"`
+}
+
+func (m *RouteListReq) Reset()         { *m = RouteListReq{} }
+func (m *RouteListReq) String() string { return proto.CompactTextString(m) }
+func (*RouteListReq) ProtoMessage()    {}
+
+type RouteListRes struct {
+	Routes []*Route `protobuf:"bytes,1,rep,name=routes" json:"routes,omitempty"`
+}
+
+func (m *RouteListRes) Reset()         { *m = RouteListRes{} }
+func (m *RouteListRes) String() string { return proto.CompactTextString(m) }
+func (*RouteListRes) ProtoMessage()    {}
+
+func (m *RouteListRes) GetRoutes() []*Route {
+	if m != nil {
+		return m.Routes
+	}
+	return nil
+}
+
+type RouteKillReq struct {
+	Host     string   `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+	Protocol Protocol `protobuf:"varint,2,opt,name=protocol,enum=protocol.Protocol" json:"protocol,omitempty"`
+	Addr     string   `protobuf:"bytes,3,opt,name=addr" json:"addr,omitempty"`
+}
+
+func (m *RouteKillReq) Reset()         { *m = RouteKillReq{} }
+func (m *RouteKillReq) String() string { return proto.CompactTextString(m) }
+func (*RouteKillReq) ProtoMessage()    {}
+
+type RouteKillRes struct {
+	Routes []*Route `protobuf:"bytes,1,rep,name=routes" json:"routes,omitempty"`
+}
+
+func (m *RouteKillRes) Reset()         { *m = RouteKillRes{} }
+func (m *RouteKillRes) String() string { return proto.CompactTextString(m) }
+func (*RouteKillRes) ProtoMessage()    {}
+
+func (m *RouteKillRes) GetRoutes() []*Route {
+	if m != nil {
+		return m.Routes
+	}
+	return nil
+}
+
+type Route struct {
+	Protocol Protocol     `protobuf:"varint,1,opt,name=protocol,enum=protocol.Protocol" json:"protocol,omitempty"`
+	HostId   string       `protobuf:"bytes,2,opt,name=hostId" json:"hostId,omitempty"`
+	RuleId   string       `protobuf:"bytes,3,opt,name=ruleId" json:"ruleId,omitempty"`
+	Inbound  *RouteStream `protobuf:"bytes,4,opt,name=inbound" json:"inbound,omitempty"`
+	Outbound *RouteStream `protobuf:"bytes,5,opt,name=outbound" json:"outbound,omitempty"`
+	Stats    *RouteStats  `protobuf:"bytes,6,opt,name=stats" json:"stats,omitempty"`
+	TcpState string       `protobuf:"bytes,7,opt,name=tcpState" json:"tcpState,omitempty"`
+}
+
+func (m *Route) Reset()         { *m = Route{} }
+func (m *Route) String() string { return proto.CompactTextString(m) }
+func (*Route) ProtoMessage()    {}
+
+func (m *Route) GetInbound() *RouteStream {
+	if m != nil {
+		return m.Inbound
+	}
+	return nil
+}
+
+func (m *Route) GetOutbound() *RouteStream {
+	if m != nil {
+		return m.Outbound
+	}
+	return nil
+}
+
+func (m *Route) GetStats() *RouteStats {
+	if m != nil {
+		return m.Stats
+	}
+	return nil
+}
+
+type RouteStream struct {
+	SrcIp   string `protobuf:"bytes,1,opt,name=srcIp" json:"srcIp,omitempty"`
+	SrcPort int32  `protobuf:"varint,2,opt,name=srcPort" json:"srcPort,omitempty"`
+	DstIp   string `protobuf:"bytes,3,opt,name=dstIp" json:"dstIp,omitempty"`
+	DstPort int32  `protobuf:"varint,4,opt,name=dstPort" json:"dstPort,omitempty"`
+}
+
+func (m *RouteStream) Reset()         { *m = RouteStream{} }
+func (m *RouteStream) String() string { return proto.CompactTextString(m) }
+func (*RouteStream) ProtoMessage()    {}
+
+type RouteStats struct {
+	LastSeen  int64  `protobuf:"varint,1,opt,name=lastSeen" json:"lastSeen,omitempty"`
+	RxBytes   uint64 `protobuf:"varint,2,opt,name=rxBytes" json:"rxBytes,omitempty"`
+	TxBytes   uint64 `protobuf:"varint,3,opt,name=txBytes" json:"txBytes,omitempty"`
+	RxPackets uint64 `protobuf:"varint,4,opt,name=rxPackets" json:"rxPackets,omitempty"`
+	TxPackets uint64 `protobuf:"varint,5,opt,name=txPackets" json:"txPackets,omitempty"`
+}
+
+func (m *RouteStats) Reset()         { *m = RouteStats{} }
+func (m *RouteStats) String() string { return proto.CompactTextString(m) }
+func (*RouteStats) ProtoMessage()    {}
+
+type PortListReq struct {
+	Host  string    `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+	Owner PortOwner `protobuf:"varint,2,opt,name=owner,enum=protocol.PortOwner" json:"owner,omitempty"`
+}
+
+func (m *PortListReq) Reset()         { *m = PortListReq{} }
+func (m *PortListReq) String() string { return proto.CompactTextString(m) }
+func (*PortListReq) ProtoMessage()    {}
+
+type PortListRes struct {
+	Ports []*Port `protobuf:"bytes,1,rep,name=ports" json:"ports,omitempty"`
+}
+
+func (m *PortListRes) Reset()         { *m = PortListRes{} }
+func (m *PortListRes) String() string { return proto.CompactTextString(m) }
+func (*PortListRes) ProtoMessage()    {}
+
+func (m *PortListRes) GetPorts() []*Port {
+	if m != nil {
+		return m.Ports
+	}
+	return nil
+}
+
+type Port struct {
+	HostId   string    `protobuf:"bytes,1,opt,name=hostId" json:"hostId,omitempty"`
+	Protocol Protocol  `protobuf:"varint,2,opt,name=protocol,enum=protocol.Protocol" json:"protocol,omitempty"`
+	Port     int32     `protobuf:"varint,3,opt,name=port" json:"port,omitempty"`
+	Owner    PortOwner `protobuf:"varint,4,opt,name=owner,enum=protocol.PortOwner" json:"owner,omitempty"`
+}
+
+func (m *Port) Reset()         { *m = Port{} }
+func (m *Port) String() string { return proto.CompactTextString(m) }
+func (*Port) ProtoMessage()    {}
+
 type Host struct {
-	Id   string   `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
-	Name string   `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
-	Ipv4 []string `protobuf:"bytes,3,rep,name=ipv4" json:"ipv4,omitempty"`
-	Ipv6 []string `protobuf:"bytes,4,rep,name=ipv6" json:"ipv6,omitempty"`
-	Up   bool     `protobuf:"varint,5,opt,name=up" json:"up,omitempty"`
+	Id     string     `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Name   string     `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Ipv4   []string   `protobuf:"bytes,3,rep,name=ipv4" json:"ipv4,omitempty"`
+	Ipv6   []string   `protobuf:"bytes,4,rep,name=ipv6" json:"ipv6,omitempty"`
+	Up     bool       `protobuf:"varint,5,opt,name=up" json:"up,omitempty"`
+	Policy HostPolicy `protobuf:"varint,6,opt,name=policy,enum=protocol.HostPolicy" json:"policy,omitempty"`
 }
 
 func (m *Host) Reset()         { *m = Host{} }
@@ -187,6 +513,9 @@ func (*Host) ProtoMessage()    {}
 
 func init() {
 	proto.RegisterEnum("protocol.Protocol", Protocol_name, Protocol_value)
+	proto.RegisterEnum("protocol.HostPolicy", HostPolicy_name, HostPolicy_value)
+	proto.RegisterEnum("protocol.CaptureDirection", CaptureDirection_name, CaptureDirection_value)
+	proto.RegisterEnum("protocol.PortOwner", PortOwner_name, PortOwner_value)
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -200,6 +529,7 @@ type HostsClient interface {
 	Add(ctx context.Context, in *HostAddReq, opts ...grpc.CallOption) (*HostAddRes, error)
 	Remove(ctx context.Context, in *HostRemoveReq, opts ...grpc.CallOption) (*HostRemoveRes, error)
 	SetStatus(ctx context.Context, in *HostSetStatusReq, opts ...grpc.CallOption) (*HostSetStatusRes, error)
+	SetPolicy(ctx context.Context, in *HostSetPolicyReq, opts ...grpc.CallOption) (*HostSetPolicyRes, error)
 }
 
 type hostsClient struct {
@@ -246,6 +576,15 @@ func (c *hostsClient) SetStatus(ctx context.Context, in *HostSetStatusReq, opts
 	return out, nil
 }
 
+func (c *hostsClient) SetPolicy(ctx context.Context, in *HostSetPolicyReq, opts ...grpc.CallOption) (*HostSetPolicyRes, error) {
+	out := new(HostSetPolicyRes)
+	err := grpc.Invoke(ctx, "/protocol.Hosts/SetPolicy", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Hosts service
 
 type HostsServer interface {
@@ -253,6 +592,7 @@ type HostsServer interface {
 	Add(context.Context, *HostAddReq) (*HostAddRes, error)
 	Remove(context.Context, *HostRemoveReq) (*HostRemoveRes, error)
 	SetStatus(context.Context, *HostSetStatusReq) (*HostSetStatusRes, error)
+	SetPolicy(context.Context, *HostSetPolicyReq) (*HostSetPolicyRes, error)
 }
 
 func RegisterHostsServer(s *grpc.Server, srv HostsServer) {
@@ -307,6 +647,18 @@ func _Hosts_SetStatus_Handler(srv interface{}, ctx context.Context, codec grpc.C
 	return out, nil
 }
 
+func _Hosts_SetPolicy_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(HostSetPolicyReq)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(HostsServer).SetPolicy(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _Hosts_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "protocol.Hosts",
 	HandlerType: (*HostsServer)(nil),
@@ -327,6 +679,10 @@ var _Hosts_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SetStatus",
 			Handler:    _Hosts_SetStatus_Handler,
 		},
+		{
+			MethodName: "SetPolicy",
+			Handler:    _Hosts_SetPolicy_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
@@ -414,3 +770,322 @@ var _Rules_serviceDesc = grpc.ServiceDesc{
 	},
 	Streams: []grpc.StreamDesc{},
 }
+
+// Client API for Packets service
+
+type PacketsClient interface {
+	Capture(ctx context.Context, in *CaptureReq, opts ...grpc.CallOption) (Packets_CaptureClient, error)
+	Drops(ctx context.Context, in *DropsReq, opts ...grpc.CallOption) (*DropsRes, error)
+	Trace(ctx context.Context, in *TraceReq, opts ...grpc.CallOption) (Packets_TraceClient, error)
+}
+
+type packetsClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPacketsClient(cc *grpc.ClientConn) PacketsClient {
+	return &packetsClient{cc}
+}
+
+func (c *packetsClient) Capture(ctx context.Context, in *CaptureReq, opts ...grpc.CallOption) (Packets_CaptureClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Packets_serviceDesc.Streams[0], c.cc, "/protocol.Packets/Capture", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &packetsCaptureClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Packets_CaptureClient interface {
+	Recv() (*CaptureRes, error)
+	grpc.ClientStream
+}
+
+type packetsCaptureClient struct {
+	grpc.ClientStream
+}
+
+func (x *packetsCaptureClient) Recv() (*CaptureRes, error) {
+	m := new(CaptureRes)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *packetsClient) Drops(ctx context.Context, in *DropsReq, opts ...grpc.CallOption) (*DropsRes, error) {
+	out := new(DropsRes)
+	err := grpc.Invoke(ctx, "/protocol.Packets/Drops", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *packetsClient) Trace(ctx context.Context, in *TraceReq, opts ...grpc.CallOption) (Packets_TraceClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Packets_serviceDesc.Streams[1], c.cc, "/protocol.Packets/Trace", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &packetsTraceClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Packets_TraceClient interface {
+	Recv() (*TraceRes, error)
+	grpc.ClientStream
+}
+
+type packetsTraceClient struct {
+	grpc.ClientStream
+}
+
+func (x *packetsTraceClient) Recv() (*TraceRes, error) {
+	m := new(TraceRes)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Packets service
+
+type PacketsServer interface {
+	Capture(*CaptureReq, Packets_CaptureServer) error
+	Drops(context.Context, *DropsReq) (*DropsRes, error)
+	Trace(*TraceReq, Packets_TraceServer) error
+}
+
+func RegisterPacketsServer(s *grpc.Server, srv PacketsServer) {
+	s.RegisterService(&_Packets_serviceDesc, srv)
+}
+
+func _Packets_Capture_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CaptureReq)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PacketsServer).Capture(m, &packetsCaptureServer{stream})
+}
+
+type Packets_CaptureServer interface {
+	Send(*CaptureRes) error
+	grpc.ServerStream
+}
+
+type packetsCaptureServer struct {
+	grpc.ServerStream
+}
+
+func (x *packetsCaptureServer) Send(m *CaptureRes) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Packets_Drops_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(DropsReq)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PacketsServer).Drops(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Packets_Trace_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TraceReq)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PacketsServer).Trace(m, &packetsTraceServer{stream})
+}
+
+type Packets_TraceServer interface {
+	Send(*TraceRes) error
+	grpc.ServerStream
+}
+
+type packetsTraceServer struct {
+	grpc.ServerStream
+}
+
+func (x *packetsTraceServer) Send(m *TraceRes) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Packets_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "protocol.Packets",
+	HandlerType: (*PacketsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Drops",
+			Handler:    _Packets_Drops_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Capture",
+			Handler:       _Packets_Capture_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Trace",
+			Handler:       _Packets_Trace_Handler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// Client API for Routes service
+
+type RoutesClient interface {
+	List(ctx context.Context, in *RouteListReq, opts ...grpc.CallOption) (*RouteListRes, error)
+	Kill(ctx context.Context, in *RouteKillReq, opts ...grpc.CallOption) (*RouteKillRes, error)
+}
+
+type routesClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewRoutesClient(cc *grpc.ClientConn) RoutesClient {
+	return &routesClient{cc}
+}
+
+func (c *routesClient) List(ctx context.Context, in *RouteListReq, opts ...grpc.CallOption) (*RouteListRes, error) {
+	out := new(RouteListRes)
+	err := grpc.Invoke(ctx, "/protocol.Routes/List", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routesClient) Kill(ctx context.Context, in *RouteKillReq, opts ...grpc.CallOption) (*RouteKillRes, error) {
+	out := new(RouteKillRes)
+	err := grpc.Invoke(ctx, "/protocol.Routes/Kill", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Routes service
+
+type RoutesServer interface {
+	List(context.Context, *RouteListReq) (*RouteListRes, error)
+	Kill(context.Context, *RouteKillReq) (*RouteKillRes, error)
+}
+
+func RegisterRoutesServer(s *grpc.Server, srv RoutesServer) {
+	s.RegisterService(&_Routes_serviceDesc, srv)
+}
+
+func _Routes_List_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(RouteListReq)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(RoutesServer).List(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Routes_Kill_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(RouteKillReq)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(RoutesServer).Kill(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Routes_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "protocol.Routes",
+	HandlerType: (*RoutesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _Routes_List_Handler,
+		},
+		{
+			MethodName: "Kill",
+			Handler:    _Routes_Kill_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// Client API for Ports service
+
+type PortsClient interface {
+	List(ctx context.Context, in *PortListReq, opts ...grpc.CallOption) (*PortListRes, error)
+}
+
+type portsClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPortsClient(cc *grpc.ClientConn) PortsClient {
+	return &portsClient{cc}
+}
+
+func (c *portsClient) List(ctx context.Context, in *PortListReq, opts ...grpc.CallOption) (*PortListRes, error) {
+	out := new(PortListRes)
+	err := grpc.Invoke(ctx, "/protocol.Ports/List", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Ports service
+
+type PortsServer interface {
+	List(context.Context, *PortListReq) (*PortListRes, error)
+}
+
+func RegisterPortsServer(s *grpc.Server, srv PortsServer) {
+	s.RegisterService(&_Ports_serviceDesc, srv)
+}
+
+func _Ports_List_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(PortListReq)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PortsServer).List(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Ports_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "protocol.Ports",
+	HandlerType: (*PortsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _Ports_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
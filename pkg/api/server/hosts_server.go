@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+
 	"github.com/fd/switchboard/pkg/api/protocol"
 	"github.com/fd/switchboard/pkg/hosts"
 	"golang.org/x/net/context"
@@ -24,6 +26,8 @@ func (s *hostsServer) List(context.Context, *protocol.HostListReq) (*protocol.Ho
 			Ipv4: make([]string, len(h.IPv4Addrs)),
 			Ipv6: make([]string, len(h.IPv6Addrs)),
 			Up:   h.Up,
+
+			Policy: protocol.HostPolicy(h.Policy),
 		}
 
 		for i, ip := range h.IPv4Addrs {
@@ -40,8 +44,13 @@ func (s *hostsServer) List(context.Context, *protocol.HostListReq) (*protocol.Ho
 }
 
 func (s *hostsServer) Add(ctx context.Context, req *protocol.HostAddReq) (*protocol.HostAddRes, error) {
+	if _, valid := protocol.HostPolicy_name[int32(req.Policy)]; !valid {
+		return nil, fmt.Errorf("invalid policy: %d", req.Policy)
+	}
+
 	host := &hosts.Host{}
 	host.Name = req.Name
+	host.Policy = hosts.Policy(req.Policy)
 
 	host, err := s.hosts.AddHost(host)
 	if err != nil {
@@ -62,6 +71,8 @@ func (s *hostsServer) Add(ctx context.Context, req *protocol.HostAddReq) (*proto
 		Ipv4: make([]string, len(host.IPv4Addrs)),
 		Ipv6: make([]string, len(host.IPv6Addrs)),
 		Up:   host.Up,
+
+		Policy: protocol.HostPolicy(host.Policy),
 	}
 
 	for i, ip := range host.IPv4Addrs {
@@ -95,3 +106,16 @@ func (s *hostsServer) SetStatus(ctx context.Context, req *protocol.HostSetStatus
 
 	return &protocol.HostSetStatusRes{}, nil
 }
+
+func (s *hostsServer) SetPolicy(ctx context.Context, req *protocol.HostSetPolicyReq) (*protocol.HostSetPolicyRes, error) {
+	if _, valid := protocol.HostPolicy_name[int32(req.Policy)]; !valid {
+		return nil, fmt.Errorf("invalid policy: %d", req.Policy)
+	}
+
+	err := s.hosts.HostSetPolicy(req.Id, hosts.Policy(req.Policy))
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.HostSetPolicyRes{}, nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+	"github.com/fd/switchboard/pkg/capture"
+	"github.com/fd/switchboard/pkg/dispatcher"
+	"github.com/fd/switchboard/pkg/hosts"
+	"golang.org/x/net/context"
+)
+
+var _ protocol.PacketsServer = (*packetsServer)(nil)
+
+type packetsServer struct {
+	vnet    *dispatcher.VNET
+	hosts   *hosts.Controller
+	capture *capture.Hub
+}
+
+func (s *packetsServer) Capture(req *protocol.CaptureReq, stream protocol.Packets_CaptureServer) error {
+	var hostID string
+	if req.Host != "" {
+		host := s.hosts.GetTable().LookupByNameOrID(req.Host)
+		if host == nil {
+			return fmt.Errorf("unknown host: %q", req.Host)
+		}
+		hostID = host.ID
+	}
+
+	filter, err := capture.ParseFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+
+	sub := s.capture.Subscribe(hostID, capture.Direction(req.Direction), filter, 1024)
+	defer sub.Close()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt := <-sub.C():
+			err := stream.Send(&protocol.CaptureRes{
+				Time:      pkt.Time.UnixNano(),
+				Direction: protocol.CaptureDirection(pkt.Direction),
+				HostId:    pkt.HostID,
+				Data:      pkt.Data,
+				Dropped:   sub.Dropped(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *packetsServer) Drops(ctx context.Context, req *protocol.DropsReq) (*protocol.DropsRes, error) {
+	var hostID string
+	if req.Host != "" {
+		host := s.hosts.GetTable().LookupByNameOrID(req.Host)
+		if host == nil {
+			return nil, fmt.Errorf("unknown host: %q", req.Host)
+		}
+		hostID = host.ID
+	}
+
+	var res protocol.DropsRes
+	for _, c := range s.vnet.Drops(hostID) {
+		res.Drops = append(res.Drops, &protocol.Drop{
+			Reason: c.Reason.String(),
+			HostId: c.HostID,
+			RuleId: c.RuleID,
+			Count:  c.Count,
+		})
+	}
+	return &res, nil
+}
+
+func (s *packetsServer) Trace(req *protocol.TraceReq, stream protocol.Packets_TraceServer) error {
+	filter, err := capture.ParseFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+
+	sub := s.vnet.Trace(filter, 1024)
+	defer sub.Close()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case trace := <-sub.C():
+			res := &protocol.TraceRes{
+				Time:    trace.Time.UnixNano(),
+				HostId:  trace.HostID,
+				Summary: trace.Summary,
+				Steps:   trace.Steps,
+				Dropped: sub.Dropped(),
+			}
+			if trace.Dropped != 0 {
+				res.DropReason = trace.Dropped.String()
+			}
+			err := stream.Send(res)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
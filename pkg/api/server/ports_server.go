@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/fd/switchboard/pkg/ports"
+	"golang.org/x/net/context"
+)
+
+var _ protocol.PortsServer = (*portsServer)(nil)
+
+type portsServer struct {
+	ports *ports.Mapper
+	hosts *hosts.Controller
+}
+
+func (s *portsServer) List(ctx context.Context, req *protocol.PortListReq) (*protocol.PortListRes, error) {
+	if _, valid := protocol.PortOwner_name[int32(req.Owner)]; !valid {
+		return nil, fmt.Errorf("invalid owner: %d", req.Owner)
+	}
+
+	var hostID string
+	if req.Host != "" {
+		host := s.hosts.GetTable().LookupByNameOrID(req.Host)
+		if host == nil {
+			return nil, fmt.Errorf("unknown host: %q", req.Host)
+		}
+		hostID = host.ID
+	}
+
+	res := &protocol.PortListRes{}
+	for _, p := range s.ports.Ports(hostID, ports.Owner(req.Owner)) {
+		res.Ports = append(res.Ports, &protocol.Port{
+			HostId:   p.HostID,
+			Protocol: protocol.Protocol(p.Protocol),
+			Port:     int32(p.Port),
+			Owner:    protocol.PortOwner(p.Owner),
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/fd/switchboard/pkg/api/protocol"
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/fd/switchboard/pkg/protocols"
+	"github.com/fd/switchboard/pkg/routes"
+	"golang.org/x/net/context"
+)
+
+var _ protocol.RoutesServer = (*routesServer)(nil)
+
+type routesServer struct {
+	routes *routes.Controller
+	hosts  *hosts.Controller
+}
+
+func (s *routesServer) List(ctx context.Context, req *protocol.RouteListReq) (*protocol.RouteListRes, error) {
+	filter, err := s.filter(req.Host, req.Protocol, req.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &protocol.RouteListRes{}
+	for _, route := range s.routes.Flows(filter) {
+		res.Routes = append(res.Routes, routeToProtocol(route))
+	}
+	return res, nil
+}
+
+func (s *routesServer) Kill(ctx context.Context, req *protocol.RouteKillReq) (*protocol.RouteKillRes, error) {
+	if req.Host == "" && req.Protocol == protocol.Protocol_UNSET && req.Addr == "" {
+		return nil, fmt.Errorf("refusing to kill all flows: a host, protocol or address is required")
+	}
+
+	filter, err := s.filter(req.Host, req.Protocol, req.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &protocol.RouteKillRes{}
+	for _, route := range s.routes.Flows(filter) {
+		if s.routes.Kill(route) {
+			res.Routes = append(res.Routes, routeToProtocol(route))
+		}
+	}
+	return res, nil
+}
+
+// filter builds a route filter; host is a name or ID and addr is an IP, an
+// IP and port or only a port (eg. "10.0.0.2", "10.0.0.2:80" or ":80").
+func (s *routesServer) filter(host string, proto protocol.Protocol, addr string) (routes.Filter, error) {
+	var filter routes.Filter
+
+	if _, valid := protocol.Protocol_name[int32(proto)]; !valid {
+		return filter, fmt.Errorf("invalid protocol: %d", proto)
+	}
+	filter.Protocol = protocols.Protocol(proto)
+
+	if host != "" {
+		h := s.hosts.GetTable().LookupByNameOrID(host)
+		if h == nil {
+			return filter, fmt.Errorf("unknown host: %q", host)
+		}
+		filter.HostID = h.ID
+	}
+
+	if addr != "" {
+		ip, port, err := parseAddr(addr)
+		if err != nil {
+			return filter, err
+		}
+		filter.IP = ip
+		filter.Port = port
+	}
+
+	return filter, nil
+}
+
+func parseAddr(addr string) (net.IP, uint16, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address: %q", addr)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, 0, fmt.Errorf("invalid port in address: %q", addr)
+	}
+
+	if host == "" {
+		return nil, uint16(port), nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid IP in address: %q", addr)
+	}
+	return ip, uint16(port), nil
+}
+
+func routeToProtocol(route *routes.Route) *protocol.Route {
+	stats := route.Flow().Stats()
+
+	x := &protocol.Route{
+		Protocol: protocol.Protocol(route.Protocol),
+		HostId:   route.HostID,
+		RuleId:   route.RuleID,
+		Inbound:  streamToProtocol(route.Inbound),
+		Outbound: streamToProtocol(route.Outbound),
+		Stats: &protocol.RouteStats{
+			LastSeen:  stats.LastSeen.UnixNano(),
+			RxBytes:   stats.RxBytes,
+			TxBytes:   stats.TxBytes,
+			RxPackets: stats.RxPackets,
+			TxPackets: stats.TxPackets,
+		},
+	}
+
+	if route.Protocol == protocols.TCP {
+		x.TcpState = route.Flow().TCPState().String()
+	}
+
+	return x
+}
+
+func streamToProtocol(s routes.Stream) *protocol.RouteStream {
+	return &protocol.RouteStream{
+		SrcIp:   s.SrcIP.String(),
+		SrcPort: int32(s.SrcPort),
+		DstIp:   s.DstIP.String(),
+		DstPort: int32(s.DstPort),
+	}
+}
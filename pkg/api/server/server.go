@@ -3,62 +3,97 @@ package server
 import (
 	"log"
 	"net"
+	"strconv"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	"github.com/fd/switchboard/pkg/api/protocol"
+	"github.com/fd/switchboard/pkg/config"
 	"github.com/fd/switchboard/pkg/dispatcher"
 	"github.com/fd/switchboard/pkg/protocols"
 	"github.com/fd/switchboard/pkg/rules"
 )
 
-func Run(ctx context.Context, vnet *dispatcher.VNET) error {
+func Run(ctx context.Context, vnet *dispatcher.VNET, conf config.API) error {
 	var (
-		port int
+		port      int
+		listeners []net.Listener
 	)
 
 	vnet.System().WaitForControllerIPv4()
 	vnet.System().WaitForGatewayIPv4()
 
-	l, err := net.Listen("tcp", vnet.System().GatewayIPv4().String()+":0")
-	if err != nil {
-		return err
+	controller := vnet.Hosts().GetTable().LookupByName("controller")
+
+	listen := conf.Listen
+	if vnet.System().GatewayRemote() && len(listen) == 0 {
+		// the gateway is not on this host; serve the API locally by default
+		listen = []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(conf.Port))}
 	}
 
-	controller := vnet.Hosts().GetTable().LookupByName("controller")
+	for _, addr := range listen {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, l)
+		log.Printf("API: %s (local)", l.Addr())
+	}
 
-	port = l.Addr().(*net.TCPAddr).Port
-	_, err = vnet.Rules().AddRule(rules.Rule{
-		Protocol:  protocols.TCP,
-		SrcHostID: controller.ID,
-		SrcPort:   8080,
-		DstPort:   uint16(port),
-	})
-	if err != nil {
-		return err
+	if !vnet.System().GatewayRemote() {
+		l, err := net.Listen("tcp", vnet.System().GatewayIPv4().String()+":0")
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, l)
+
+		port = l.Addr().(*net.TCPAddr).Port
+		_, err = vnet.Rules().AddRule(rules.Rule{
+			Protocol:  protocols.TCP,
+			SrcHostID: controller.ID,
+			SrcPort:   uint16(conf.Port),
+			DstPort:   uint16(port),
+		})
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+
+		for _, ip := range controller.IPv4Addrs {
+			log.Printf("API: %s:%d (external)", ip.String(), conf.Port)
+		}
+		log.Printf("API: %s:%d (internal)", vnet.System().GatewayIPv4(), port)
 	}
 
 	grpcServer := grpc.NewServer()
 	protocol.RegisterHostsServer(grpcServer, &hostsServer{hosts: vnet.Hosts()})
 	protocol.RegisterRulesServer(grpcServer, &rulesServer{rules: vnet.Rules()})
-
-	for _, ip := range controller.IPv4Addrs {
-		log.Printf("API: %s:%d (external)", ip.String(), 8080)
-	}
-	log.Printf("API: %s:%d (internal)", vnet.System().GatewayIPv4(), port)
+	protocol.RegisterPacketsServer(grpcServer, &packetsServer{vnet: vnet, hosts: vnet.Hosts(), capture: vnet.Capture()})
+	protocol.RegisterRoutesServer(grpcServer, &routesServer{routes: vnet.Routes(), hosts: vnet.Hosts()})
+	protocol.RegisterPortsServer(grpcServer, &portsServer{ports: vnet.Ports(), hosts: vnet.Hosts()})
 
 	go func() {
 		<-ctx.Done()
-		l.Close()
+		closeListeners(listeners)
 	}()
 
-	go func() {
-		err := grpcServer.Serve(l)
-		if err != nil {
-			log.Printf("API/error: %s", err)
-		}
-	}()
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := grpcServer.Serve(l)
+			if err != nil {
+				log.Printf("API/error: %s", err)
+			}
+		}(l)
+	}
 
 	return nil
 }
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
@@ -0,0 +1,378 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/bpf"
+)
+
+// offsets in ethernet frames (without VLAN tags)
+const (
+	offEtherType = 12
+
+	offIPv4Flags = 14 + 6
+	offIPv4Proto = 14 + 9
+	offIPv4Src   = 14 + 12
+	offIPv4Dst   = 14 + 16
+
+	offIPv6Next = 14 + 6
+	offIPv6Src  = 14 + 8
+	offIPv6Dst  = 14 + 24
+
+	offARPSenderIP = 14 + 14
+	offARPTargetIP = 14 + 24
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	protoICMPv4 = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// node is a parsed filter expression. It compiles to code which jumps to t
+// when the frame matches and to f otherwise.
+type node interface {
+	compile(a *assembler, t, f label)
+}
+
+// compile compiles the expression n to a BPF program.
+func compile(n node) []bpf.Instruction {
+	a := &assembler{}
+	accept, reject := a.newLabel(), a.newLabel()
+
+	n.compile(a, accept, reject)
+
+	a.place(accept)
+	a.emit(bpf.RetConstant{Val: 0xffff})
+	a.place(reject)
+	a.emit(bpf.RetConstant{Val: 0})
+
+	return a.assemble()
+}
+
+// addrDir selects the source and/or destination address or port
+type addrDir uint8
+
+const (
+	anyDir addrDir = iota
+	srcDir
+	dstDir
+)
+
+type andExpr struct{ a, b node }
+type orExpr struct{ a, b node }
+type notExpr struct{ n node }
+
+func (e andExpr) compile(a *assembler, t, f label) {
+	next := a.newLabel()
+	e.a.compile(a, next, f)
+	a.place(next)
+	e.b.compile(a, t, f)
+}
+
+func (e orExpr) compile(a *assembler, t, f label) {
+	next := a.newLabel()
+	e.a.compile(a, t, next)
+	a.place(next)
+	e.b.compile(a, t, f)
+}
+
+func (e notExpr) compile(a *assembler, t, f label) {
+	e.n.compile(a, f, t)
+}
+
+type protoExpr string
+
+func (e protoExpr) compile(a *assembler, t, f label) {
+	switch e {
+	case "ether":
+		a.jump(t)
+	case "arp":
+		a.etherType(etherTypeARP, t, f)
+	case "ip":
+		a.etherType(etherTypeIPv4, t, f)
+	case "ip6":
+		a.etherType(etherTypeIPv6, t, f)
+	case "tcp":
+		a.ipProto(protoTCP, protoTCP, t, f)
+	case "udp":
+		a.ipProto(protoUDP, protoUDP, t, f)
+	case "icmp":
+		a.ipProto(protoICMPv4, -1, t, f)
+	case "icmp6":
+		a.ipProto(-1, protoICMPv6, t, f)
+	default:
+		a.jump(f)
+	}
+}
+
+type netExpr struct {
+	dir addrDir
+	net *net.IPNet
+}
+
+func (e netExpr) compile(a *assembler, t, f label) {
+	if ip4 := e.net.IP.To4(); ip4 != nil && len(e.net.Mask) == net.IPv4len {
+		ipL, notIPL, arpL := a.newLabel(), a.newLabel(), a.newLabel()
+		a.emit(bpf.LoadAbsolute{Off: offEtherType, Size: 2})
+		a.jumpIf(bpf.JumpEqual, etherTypeIPv4, ipL, notIPL)
+		a.place(notIPL)
+		a.jumpIf(bpf.JumpEqual, etherTypeARP, arpL, f)
+
+		a.place(ipL)
+		a.addrs(e.dir, offIPv4Src, offIPv4Dst, ip4, e.net.Mask, t, f)
+		a.place(arpL)
+		a.addrs(e.dir, offARPSenderIP, offARPTargetIP, ip4, e.net.Mask, t, f)
+		return
+	}
+
+	ipL := a.newLabel()
+	a.etherType(etherTypeIPv6, ipL, f)
+	a.place(ipL)
+	a.addrs(e.dir, offIPv6Src, offIPv6Dst, e.net.IP.To16(), e.net.Mask, t, f)
+}
+
+type portExpr struct {
+	dir   addrDir
+	proto string // tcp, udp or empty for both
+	port  uint16
+}
+
+func (e portExpr) compile(a *assembler, t, f label) {
+	ip4L, notIP4L, ip6L := a.newLabel(), a.newLabel(), a.newLabel()
+	a.emit(bpf.LoadAbsolute{Off: offEtherType, Size: 2})
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv4, ip4L, notIP4L)
+	a.place(notIP4L)
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv6, ip6L, f)
+
+	// IPv4; the ports are behind the (variable length) header of the first
+	// fragment
+	protoL, firstL := a.newLabel(), a.newLabel()
+	a.place(ip4L)
+	a.emit(bpf.LoadAbsolute{Off: offIPv4Proto, Size: 1})
+	e.transport(a, protoL, f)
+	a.place(protoL)
+	a.emit(bpf.LoadAbsolute{Off: offIPv4Flags, Size: 2})
+	a.jumpIf(bpf.JumpBitsSet, 0x1fff, f, firstL)
+	a.place(firstL)
+	a.emit(bpf.LoadMemShift{Off: 14})
+	e.ports(a, bpf.LoadIndirect{Off: 14, Size: 2}, bpf.LoadIndirect{Off: 14 + 2, Size: 2}, t, f)
+
+	// IPv6; extension headers are not followed
+	protoL = a.newLabel()
+	a.place(ip6L)
+	a.emit(bpf.LoadAbsolute{Off: offIPv6Next, Size: 1})
+	e.transport(a, protoL, f)
+	a.place(protoL)
+	e.ports(a, bpf.LoadAbsolute{Off: 14 + 40, Size: 2}, bpf.LoadAbsolute{Off: 14 + 40 + 2, Size: 2}, t, f)
+}
+
+// transport jumps to t when the protocol number in A matches the protocol of
+// e.
+func (e portExpr) transport(a *assembler, t, f label) {
+	switch e.proto {
+	case "tcp":
+		a.jumpIf(bpf.JumpEqual, protoTCP, t, f)
+	case "udp":
+		a.jumpIf(bpf.JumpEqual, protoUDP, t, f)
+	default:
+		next := a.newLabel()
+		a.jumpIf(bpf.JumpEqual, protoTCP, t, next)
+		a.place(next)
+		a.jumpIf(bpf.JumpEqual, protoUDP, t, f)
+	}
+}
+
+func (e portExpr) ports(a *assembler, src, dst bpf.Instruction, t, f label) {
+	switch e.dir {
+	case srcDir:
+		a.emit(src)
+		a.jumpIf(bpf.JumpEqual, uint32(e.port), t, f)
+	case dstDir:
+		a.emit(dst)
+		a.jumpIf(bpf.JumpEqual, uint32(e.port), t, f)
+	default:
+		next := a.newLabel()
+		a.emit(src)
+		a.jumpIf(bpf.JumpEqual, uint32(e.port), t, next)
+		a.place(next)
+		a.emit(dst)
+		a.jumpIf(bpf.JumpEqual, uint32(e.port), t, f)
+	}
+}
+
+// label is a position in a program which is placed after it is jumped to.
+type label int
+
+type assembler struct {
+	insts  []asmInst
+	labels []int // instruction index of each label
+}
+
+type asmInst struct {
+	ins bpf.Instruction
+
+	// jump targets of conditional (both) and unconditional (t) jumps
+	jump bool
+	t, f label
+}
+
+func (a *assembler) newLabel() label {
+	a.labels = append(a.labels, -1)
+	return label(len(a.labels) - 1)
+}
+
+func (a *assembler) place(l label) {
+	a.labels[l] = len(a.insts)
+}
+
+func (a *assembler) emit(ins bpf.Instruction) {
+	a.insts = append(a.insts, asmInst{ins: ins})
+}
+
+func (a *assembler) jump(l label) {
+	a.insts = append(a.insts, asmInst{ins: bpf.Jump{}, jump: true, t: l, f: -1})
+}
+
+func (a *assembler) jumpIf(cond bpf.JumpTest, val uint32, t, f label) {
+	a.insts = append(a.insts, asmInst{ins: bpf.JumpIf{Cond: cond, Val: val}, jump: true, t: t, f: f})
+}
+
+// etherType jumps to t when the frame has type typ.
+func (a *assembler) etherType(typ uint32, t, f label) {
+	a.emit(bpf.LoadAbsolute{Off: offEtherType, Size: 2})
+	a.jumpIf(bpf.JumpEqual, typ, t, f)
+}
+
+// ipProto jumps to t when the frame is an IPv4 packet of protocol v4 or an
+// IPv6 packet with next header v6 (-1 to match no packets of the family).
+func (a *assembler) ipProto(v4, v6 int, t, f label) {
+	ip4L, notIP4L, ip6L := a.newLabel(), a.newLabel(), a.newLabel()
+	a.emit(bpf.LoadAbsolute{Off: offEtherType, Size: 2})
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv4, ip4L, notIP4L)
+	a.place(notIP4L)
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv6, ip6L, f)
+
+	a.place(ip4L)
+	if v4 < 0 {
+		a.jump(f)
+	} else {
+		a.emit(bpf.LoadAbsolute{Off: offIPv4Proto, Size: 1})
+		a.jumpIf(bpf.JumpEqual, uint32(v4), t, f)
+	}
+
+	a.place(ip6L)
+	if v6 < 0 {
+		a.jump(f)
+	} else {
+		a.emit(bpf.LoadAbsolute{Off: offIPv6Next, Size: 1})
+		a.jumpIf(bpf.JumpEqual, uint32(v6), t, f)
+	}
+}
+
+// addrs jumps to t when the source and/or destination address (at srcOff and
+// dstOff) is in the network ip/mask.
+func (a *assembler) addrs(dir addrDir, srcOff, dstOff uint32, ip net.IP, mask net.IPMask, t, f label) {
+	switch dir {
+	case srcDir:
+		a.addr(srcOff, ip, mask, t, f)
+	case dstDir:
+		a.addr(dstOff, ip, mask, t, f)
+	default:
+		next := a.newLabel()
+		a.addr(srcOff, ip, mask, t, next)
+		a.place(next)
+		a.addr(dstOff, ip, mask, t, f)
+	}
+}
+
+// addr compares the address at off with ip/mask, 32 bits at a time.
+func (a *assembler) addr(off uint32, ip net.IP, mask net.IPMask, t, f label) {
+	for i := 0; i < len(ip); i += 4 {
+		m := binary.BigEndian.Uint32(mask[i:])
+		if m == 0 {
+			break
+		}
+
+		a.emit(bpf.LoadAbsolute{Off: off + uint32(i), Size: 4})
+		if m != 0xffffffff {
+			a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: m})
+		}
+
+		next := a.newLabel()
+		a.jumpIf(bpf.JumpEqual, binary.BigEndian.Uint32(ip[i:])&m, next, f)
+		a.place(next)
+	}
+	a.jump(t)
+}
+
+// assemble resolves the jumps to labels. Conditional jumps skip at most 255
+// instructions; longer ones are expanded first.
+func (a *assembler) assemble() []bpf.Instruction {
+	for {
+		i := a.farJump()
+		if i < 0 {
+			break
+		}
+		a.expand(i)
+	}
+
+	prog := make([]bpf.Instruction, len(a.insts))
+
+	for i, in := range a.insts {
+		if !in.jump {
+			prog[i] = in.ins
+			continue
+		}
+
+		skipT := a.labels[in.t] - (i + 1)
+		switch ins := in.ins.(type) {
+		case bpf.Jump:
+			ins.Skip = uint32(skipT)
+			prog[i] = ins
+		case bpf.JumpIf:
+			ins.SkipTrue, ins.SkipFalse = uint8(skipT), uint8(a.labels[in.f]-(i+1))
+			prog[i] = ins
+		}
+	}
+
+	return prog
+}
+
+// farJump returns the index of the first conditional jump which can't reach
+// its targets (-1 when there is none).
+func (a *assembler) farJump() int {
+	for i, in := range a.insts {
+		if _, ok := in.ins.(bpf.JumpIf); !ok {
+			continue
+		}
+		if a.labels[in.t]-(i+1) > 0xff || a.labels[in.f]-(i+1) > 0xff {
+			return i
+		}
+	}
+	return -1
+}
+
+// expand makes the conditional jump at i reach its targets through two
+// unconditional jumps inserted after it.
+func (a *assembler) expand(i int) {
+	in := a.insts[i]
+
+	for l, pos := range a.labels {
+		if pos > i {
+			a.labels[l] = pos + 2
+		}
+	}
+	t, f := a.newLabel(), a.newLabel()
+	a.labels[t], a.labels[f] = i+1, i+2
+
+	a.insts = append(a.insts, asmInst{}, asmInst{})
+	copy(a.insts[i+3:], a.insts[i+1:])
+	a.insts[i+1] = asmInst{ins: bpf.Jump{}, jump: true, t: in.t, f: -1}
+	a.insts[i+2] = asmInst{ins: bpf.Jump{}, jump: true, t: in.f, f: -1}
+	a.insts[i].t, a.insts[i].f = t, f
+}
@@ -0,0 +1,185 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type Direction uint8
+
+const (
+	Inbound Direction = 1 + iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	default:
+		return "any"
+	}
+}
+
+// Packet is a captured ethernet frame
+type Packet struct {
+	Time      time.Time
+	Direction Direction
+	HostID    string
+	Data      []byte
+}
+
+// HostResolver returns the ID of the host a frame belongs to (or an empty
+// string when it doesn't belong to any host).
+type HostResolver func(dir Direction, pkt gopacket.Packet) string
+
+// Hub distributes captured frames to subscriptions.
+type Hub struct {
+	resolve HostResolver
+
+	active int32
+
+	mtx  sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives the frames matching its host, direction and filter.
+type Subscription struct {
+	hub       *Hub
+	hostID    string
+	direction Direction
+	filter    Filter
+	c         chan Packet
+	dropped   uint64
+	closeOnce sync.Once
+}
+
+func NewHub(resolve HostResolver) *Hub {
+	return &Hub{
+		resolve: resolve,
+		subs:    make(map[*Subscription]struct{}),
+	}
+}
+
+// Active returns true when there is at least one subscription. Callers use it
+// to avoid any capture work on the hot path.
+func (h *Hub) Active() bool {
+	return atomic.LoadInt32(&h.active) > 0
+}
+
+// Subscribe to frames for hostID (all hosts when empty) in direction (both
+// when 0) which match filter (all when nil). At most size frames are
+// buffered, additional frames are dropped.
+func (h *Hub) Subscribe(hostID string, direction Direction, filter Filter, size int) *Subscription {
+	sub := &Subscription{
+		hub:       h,
+		hostID:    hostID,
+		direction: direction,
+		filter:    filter,
+		c:         make(chan Packet, size),
+	}
+
+	h.mtx.Lock()
+	h.subs[sub] = struct{}{}
+	atomic.StoreInt32(&h.active, int32(len(h.subs)))
+	h.mtx.Unlock()
+
+	return sub
+}
+
+// Publish a frame to all matching subscriptions. data is copied so the
+// caller may reuse it.
+func (h *Hub) Publish(dir Direction, data []byte) {
+	if !h.Active() {
+		return
+	}
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	var (
+		pkt      gopacket.Packet
+		hostID   string
+		resolved bool
+		captured *Packet
+	)
+
+	for sub := range h.subs {
+		if sub.direction != 0 && sub.direction != dir {
+			continue
+		}
+
+		if pkt == nil {
+			pkt = gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		}
+
+		if sub.hostID != "" {
+			if !resolved {
+				if h.resolve != nil {
+					hostID = h.resolve(dir, pkt)
+				}
+				resolved = true
+			}
+			if hostID != sub.hostID {
+				continue
+			}
+		}
+
+		if sub.filter != nil && !sub.filter.Match(data) {
+			continue
+		}
+
+		if captured == nil {
+			if !resolved {
+				if h.resolve != nil {
+					hostID = h.resolve(dir, pkt)
+				}
+				resolved = true
+			}
+
+			buf := make([]byte, len(data))
+			copy(buf, data)
+			captured = &Packet{
+				Time:      time.Now(),
+				Direction: dir,
+				HostID:    hostID,
+				Data:      buf,
+			}
+		}
+
+		select {
+		case sub.c <- *captured:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// C returns the channel captured frames are delivered on
+func (sub *Subscription) C() <-chan Packet {
+	return sub.c
+}
+
+// Dropped returns the number of frames which were dropped because the
+// subscriber didn't keep up
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close the subscription
+func (sub *Subscription) Close() {
+	sub.closeOnce.Do(func() {
+		h := sub.hub
+
+		h.mtx.Lock()
+		delete(h.subs, sub)
+		atomic.StoreInt32(&h.active, int32(len(h.subs)))
+		h.mtx.Unlock()
+	})
+}
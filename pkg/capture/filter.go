@@ -0,0 +1,260 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// Filter matches captured ethernet frames
+type Filter interface {
+	Match(frame []byte) bool
+}
+
+// ParseFilter compiles a filter expression to a BPF program. The syntax is a
+// subset of the tcpdump/BPF filter syntax:
+//
+//	ether | arp | ip | ip6 | tcp | udp | icmp | icmp6
+//	[src|dst] host ADDR
+//	[src|dst] net CIDR
+//	[src|dst] port PORT
+//	[tcp|udp] [src|dst] port PORT
+//	not EXPR | EXPR and EXPR | EXPR or EXPR | ( EXPR )
+//
+// (!, && and || are accepted as well). An empty expression matches all frames.
+func ParseFilter(expr string) (Filter, error) {
+	p := &parser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("capture: unexpected %q in filter", tok)
+	}
+
+	vm, err := bpf.NewVM(compile(e))
+	if err != nil {
+		return nil, err
+	}
+	return &bpfFilter{vm: vm}, nil
+}
+
+// bpfFilter runs a BPF program on each frame.
+type bpfFilter struct {
+	vm *bpf.VM
+}
+
+func (f *bpfFilter) Match(frame []byte) bool {
+	n, err := f.vm.Run(frame)
+	return err == nil && n > 0
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenize(expr string) []string {
+	var (
+		tokens []string
+		buf    []byte
+	)
+
+	flush := func() {
+		if len(buf) > 0 {
+			tokens = append(tokens, string(buf))
+			buf = buf[:0]
+		}
+	}
+
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '!' && (i+1 == len(expr) || expr[i+1] != '='):
+			flush()
+			tokens = append(tokens, "not")
+		case strings.HasPrefix(expr[i:], "&&"):
+			flush()
+			tokens = append(tokens, "and")
+			i++
+		case strings.HasPrefix(expr[i:], "||"):
+			flush()
+			tokens = append(tokens, "or")
+			i++
+		default:
+			buf = append(buf, c)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (node, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" {
+		p.next()
+		g, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		f = orExpr{f, g}
+	}
+
+	return f, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	f, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" {
+		p.next()
+		g, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		f = andExpr{f, g}
+	}
+
+	return f, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek() == "not" {
+		p.next()
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{f}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("capture: unexpected end of filter")
+
+	case "(":
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("capture: missing ) in filter")
+		}
+		return f, nil
+
+	case "ether", "arp", "ip", "ip6", "tcp", "udp", "icmp", "icmp6":
+		proto := protoExpr(tok)
+		switch p.peek() {
+		case "src", "dst", "host", "net", "port":
+			// eg. "tcp port 80" or "ip src host 10.0.0.1"
+			f, err := p.parseQualified(string(proto))
+			if err != nil {
+				return nil, err
+			}
+			return andExpr{proto, f}, nil
+		}
+		return proto, nil
+
+	case "src", "dst", "host", "net", "port":
+		p.pos--
+		return p.parseQualified("")
+
+	default:
+		return nil, fmt.Errorf("capture: unexpected %q in filter", tok)
+	}
+}
+
+func (p *parser) parseQualified(proto string) (node, error) {
+	var dir addrDir
+
+	switch p.peek() {
+	case "src":
+		p.next()
+		dir = srcDir
+	case "dst":
+		p.next()
+		dir = dstDir
+	}
+
+	kind := p.next()
+	value := p.next()
+	if value == "" {
+		return nil, fmt.Errorf("capture: missing value for %q in filter", kind)
+	}
+
+	switch kind {
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("capture: invalid host address %q in filter", value)
+		}
+		ip = normalizeIP(ip)
+		bits := len(ip) * 8
+		return netExpr{dir: dir, net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+
+	case "net":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("capture: invalid network %q in filter", value)
+		}
+		return netExpr{dir: dir, net: ipnet}, nil
+
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("capture: invalid port %q in filter", value)
+		}
+		return portExpr{dir: dir, proto: proto, port: uint16(port)}, nil
+
+	default:
+		return nil, fmt.Errorf("capture: expected host, net or port in filter (got %q)", kind)
+	}
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
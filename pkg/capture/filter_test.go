@@ -0,0 +1,194 @@
+package capture
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseFilter(t *testing.T) {
+	pkt := tcpPacket(t, "172.18.0.2", "10.0.0.1", 80, 49152)
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"tcp", true},
+		{"udp", false},
+		{"ip", true},
+		{"ip6", false},
+		{"tcp port 80", true},
+		{"udp port 80", false},
+		{"src port 80", true},
+		{"dst port 80", false},
+		{"host 10.0.0.1", true},
+		{"src host 10.0.0.1", false},
+		{"net 172.18.0.0/16", true},
+		{"dst net 172.18.0.0/16", false},
+		{"tcp and not port 22", true},
+		{"udp or (tcp && dst port 49152)", true},
+		{"!tcp || arp", false},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got := f.Match(pkt); got != test.match {
+			t.Errorf("%q: expected match=%v", test.expr, test.match)
+		}
+	}
+
+	f, err := ParseFilter("")
+	if f != nil || err != nil {
+		t.Errorf("expected empty filter to be nil")
+	}
+
+	frames := map[string][]byte{
+		"ip6":      tcpPacket(t, "fd00:1::2", "fd00:2::1", 80, 49152),
+		"arp":      arpPacket(t, "172.18.0.2", "172.18.0.1"),
+		"fragment": fragmentPacket(t, "172.18.0.2", "10.0.0.1"),
+	}
+	frameTests := []struct {
+		frame string
+		expr  string
+		match bool
+	}{
+		{"ip6", "ip6 and tcp", true},
+		{"ip6", "ip", false},
+		{"ip6", "src port 80", true},
+		{"ip6", "net fd00:2::/32", true},
+		{"ip6", "src net fd00:2::/32", false},
+		{"ip6", "host fd00:1::2", true},
+		{"arp", "arp and host 172.18.0.1", true},
+		{"arp", "dst host 172.18.0.2", false},
+		{"arp", "port 80", false},
+		{"fragment", "udp and host 10.0.0.1", true},
+		{"fragment", "port 0", false},
+		{"fragment", "ether", true},
+	}
+	for _, test := range frameTests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got := f.Match(frames[test.frame]); got != test.match {
+			t.Errorf("%s %q: expected match=%v", test.frame, test.expr, test.match)
+		}
+	}
+
+	// truncated frames don't match
+	if f, _ := ParseFilter("tcp port 80"); f.Match(pkt[:20]) {
+		t.Errorf("expected a truncated frame not to match")
+	}
+
+	// long filters need jumps which skip more than 255 instructions
+	var ports []string
+	for port := 1000; port < 1100; port++ {
+		ports = append(ports, "port "+strconv.Itoa(port))
+	}
+	for _, last := range []string{"port 80", "port 81"} {
+		expr := strings.Join(append(ports, last), " or ")
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Fatalf("long filter: unexpected error: %s", err)
+		}
+		if got := f.Match(pkt); got != (last == "port 80") {
+			t.Errorf("long filter ending in %q: unexpected match=%v", last, got)
+		}
+	}
+
+	for _, expr := range []string{"tcp port", "host foo", "(tcp", "port 99999", "tcp tcp"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func tcpPacket(t *testing.T, src, dst string, srcPort, dstPort uint16) []byte {
+	eth := testEthernet(layers.EthernetTypeIPv4)
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		SYN:     true,
+	}
+
+	var ip gopacket.SerializableLayer
+	if srcIP := net.ParseIP(src); srcIP.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolTCP,
+			SrcIP:      srcIP,
+			DstIP:      net.ParseIP(dst),
+		}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	} else {
+		ip4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    net.ParseIP(dst).To4(),
+		}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	}
+
+	return serialize(t, eth, ip, tcp)
+}
+
+func arpPacket(t *testing.T, src, dst string) []byte {
+	eth := testEthernet(layers.EthernetTypeARP)
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   eth.SrcMAC,
+		SourceProtAddress: net.ParseIP(src).To4(),
+		DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstProtAddress:    net.ParseIP(dst).To4(),
+	}
+	return serialize(t, eth, arp)
+}
+
+// fragmentPacket returns a UDP fragment which is not the first one.
+func fragmentPacket(t *testing.T, src, dst string) []byte {
+	ip := &layers.IPv4{
+		Version:    4,
+		TTL:        64,
+		Protocol:   layers.IPProtocolUDP,
+		FragOffset: 100,
+		SrcIP:      net.ParseIP(src).To4(),
+		DstIP:      net.ParseIP(dst).To4(),
+	}
+	return serialize(t, testEthernet(layers.EthernetTypeIPv4), ip, gopacket.Payload(make([]byte, 16)))
+}
+
+func testEthernet(typ layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: typ,
+	}
+}
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
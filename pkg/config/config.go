@@ -0,0 +1,473 @@
+// Package config holds the switchboard daemon configuration.
+//
+// A configuration file looks like this (all values are optional and default
+// to the values shown):
+//
+//	link {
+//	  driver = "vmnet"
+//	  id     = "31fbf731-e896-4d03-9bc8-7a6221b91860"
+//	}
+//
+//	network {
+//	  ipv4          = "172.18.0.0/16"
+//	  ipv6          = "fd4c:bd56:5cee::/48"
+//	  controller-id = "7ce86376-34f0-4951-bead-6152c8291f1c"
+//	  gateway-id    = "d9c62f0c-7936-4384-8d85-4587561a7142"
+//	  policy        = "drop"
+//	}
+//
+//	api {
+//	  port   = 8080
+//	  listen = ["127.0.0.1:8080"]
+//	}
+//
+//	metrics {
+//	  listen = "127.0.0.1:9180"
+//	}
+//
+//	flows {
+//	  max             = 262144
+//	  tcp-syn-sent    = 60
+//	  tcp-established = 7440
+//	  tcp-fin-wait    = 120
+//	  tcp-time-wait   = 10
+//	  tcp-closed      = 5
+//	  udp             = 30
+//	  udp-stream      = 180
+//	}
+//
+//	ports {
+//	  ephemeral  = ["49152-65535"]
+//	  reserved   = []
+//	  host-quota = 0
+//	  tcp-quota  = 0
+//	  udp-quota  = 0
+//	}
+//
+//	plugin "docker" {
+//	  host       = "tcp://192.168.99.100:2376"
+//	  verify-tls = true
+//	  cert-path  = "/path/to/certs"
+//	}
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+)
+
+type Config struct {
+	Link    Link                              `hcl:"link"`
+	Network Network                           `hcl:"network"`
+	API     API                               `hcl:"api"`
+	Metrics Metrics                           `hcl:"metrics"`
+	Flows   Flows                             `hcl:"flows"`
+	Ports   Ports                             `hcl:"ports"`
+	Plugins map[string]map[string]interface{} `hcl:"plugin"`
+}
+
+// Link selects the link driver the dispatcher runs on. The defaults depend
+// on the platform and are set by the caller.
+type Link struct {
+	Driver string `hcl:"driver"`
+	ID     string `hcl:"id"`
+}
+
+// Network describes the address ranges of the virtual network. The IPv6
+// range must be a /48; local hosts are allocated in PREFIX:8000::/64 and
+// remote hosts in PREFIX:0000::/64.
+type Network struct {
+	IPv4         string `hcl:"ipv4"`
+	IPv6         string `hcl:"ipv6"`
+	ControllerID string `hcl:"controller-id"`
+	GatewayID    string `hcl:"gateway-id"`
+
+	// Policy for undeliverable packets; "drop" or "reject" (hosts may
+	// override it)
+	Policy string `hcl:"policy"`
+
+	ipv4 *net.IPNet
+	ipv6 *net.IPNet
+}
+
+// API configures where the API is served. Port is the port on the
+// controller address (inside the virtual network), Listen holds additional
+// addresses on this host.
+type API struct {
+	Port   int      `hcl:"port"`
+	Listen []string `hcl:"listen"`
+}
+
+// Metrics configures the address the Prometheus metrics are served on
+// (at /metrics).
+type Metrics struct {
+	Listen string `hcl:"listen"`
+}
+
+// Flows configures the flow table. Max is the number of flows after which
+// the least recently used flows are evicted. The timeouts are how long idle
+// flows (and their ports) are kept, in seconds. TCP flows are kept by
+// connection state; UDP flows with at most a request and a response use UDP
+// and longer exchanges UDPStream.
+type Flows struct {
+	Max int `hcl:"max"`
+
+	TCPSynSent     int `hcl:"tcp-syn-sent"`
+	TCPEstablished int `hcl:"tcp-established"`
+	TCPFinWait     int `hcl:"tcp-fin-wait"`
+	TCPTimeWait    int `hcl:"tcp-time-wait"`
+	TCPClosed      int `hcl:"tcp-closed"`
+	UDP            int `hcl:"udp"`
+	UDPStream      int `hcl:"udp-stream"`
+}
+
+// Ports configures the ports allocated for hosts. Ephemeral are the ranges
+// ports for flows are taken from and Reserved are ports which are only used
+// when they are requested (by rules). Ranges are a port or two ports
+// separated by a dash (eg. "8080" or "49152-65535"). The quotas limit the
+// number of ports per host; in total and per protocol (0 is unlimited).
+type Ports struct {
+	Ephemeral []string `hcl:"ephemeral"`
+	Reserved  []string `hcl:"reserved"`
+	HostQuota int      `hcl:"host-quota"`
+	TCPQuota  int      `hcl:"tcp-quota"`
+	UDPQuota  int      `hcl:"udp-quota"`
+
+	ephemeral []PortRange
+	reserved  []PortRange
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+const (
+	defaultIPv4         = "172.18.0.0/16"
+	defaultIPv6         = "fd4c:bd56:5cee::/48"
+	defaultControllerID = "7ce86376-34f0-4951-bead-6152c8291f1c"
+	defaultGatewayID    = "d9c62f0c-7936-4384-8d85-4587561a7142"
+	defaultPolicy       = "drop"
+	defaultAPIPort      = 8080
+	defaultMetrics      = "127.0.0.1:9180"
+	defaultEphemeral    = "49152-65535"
+
+	defaultMaxFlows       = 262144
+	defaultTCPSynSent     = 60
+	defaultTCPEstablished = 7440
+	defaultTCPFinWait     = 120
+	defaultTCPTimeWait    = 10
+	defaultTCPClosed      = 5
+	defaultUDP            = 30
+	defaultUDPStream      = 180
+)
+
+// Default returns the default configuration.
+func Default() *Config {
+	c := &Config{}
+	c.setDefaults()
+	if err := c.Validate(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Load reads and validates the configuration file at name.
+func Load(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+
+	c, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %s", name, err)
+	}
+
+	return c, nil
+}
+
+// Parse decodes and validates a configuration.
+func Parse(src string) (*Config, error) {
+	c := &Config{}
+
+	err := hcl.Decode(c, src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setDefaults()
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Network.IPv4 == "" {
+		c.Network.IPv4 = defaultIPv4
+	}
+	if c.Network.IPv6 == "" {
+		c.Network.IPv6 = defaultIPv6
+	}
+	if c.Network.ControllerID == "" {
+		c.Network.ControllerID = defaultControllerID
+	}
+	if c.Network.GatewayID == "" {
+		c.Network.GatewayID = defaultGatewayID
+	}
+	if c.Network.Policy == "" {
+		c.Network.Policy = defaultPolicy
+	}
+	if c.API.Port == 0 {
+		c.API.Port = defaultAPIPort
+	}
+	if c.Metrics.Listen == "" {
+		c.Metrics.Listen = defaultMetrics
+	}
+	setDefaultInt(&c.Flows.Max, defaultMaxFlows)
+	setDefaultInt(&c.Flows.TCPSynSent, defaultTCPSynSent)
+	setDefaultInt(&c.Flows.TCPEstablished, defaultTCPEstablished)
+	setDefaultInt(&c.Flows.TCPFinWait, defaultTCPFinWait)
+	setDefaultInt(&c.Flows.TCPTimeWait, defaultTCPTimeWait)
+	setDefaultInt(&c.Flows.TCPClosed, defaultTCPClosed)
+	setDefaultInt(&c.Flows.UDP, defaultUDP)
+	setDefaultInt(&c.Flows.UDPStream, defaultUDPStream)
+	if len(c.Ports.Ephemeral) == 0 {
+		c.Ports.Ephemeral = []string{defaultEphemeral}
+	}
+}
+
+func setDefaultInt(v *int, def int) {
+	if *v == 0 {
+		*v = def
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	err := c.Network.validate()
+	if err != nil {
+		return err
+	}
+
+	if c.API.Port < 1 || c.API.Port > 65535 {
+		return fmt.Errorf("api.port: must be between 1 and 65535 (got %d)", c.API.Port)
+	}
+	for _, addr := range c.API.Listen {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("api.listen: invalid address %q: %s", addr, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("api.listen: invalid port in %q", addr)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+		return fmt.Errorf("metrics.listen: invalid address %q: %s", c.Metrics.Listen, err)
+	}
+
+	err = c.Flows.validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Ports.validate()
+	if err != nil {
+		return err
+	}
+
+	for name := range c.Plugins {
+		if name == "" {
+			return fmt.Errorf("plugin: name must not be empty")
+		}
+	}
+
+	return nil
+}
+
+func (f *Flows) validate() error {
+	if f.Max < 1 {
+		return fmt.Errorf("flows.max: must be at least 1 (got %d)", f.Max)
+	}
+
+	timeouts := []struct {
+		name string
+		v    int
+	}{
+		{"tcp-syn-sent", f.TCPSynSent},
+		{"tcp-established", f.TCPEstablished},
+		{"tcp-fin-wait", f.TCPFinWait},
+		{"tcp-time-wait", f.TCPTimeWait},
+		{"tcp-closed", f.TCPClosed},
+		{"udp", f.UDP},
+		{"udp-stream", f.UDPStream},
+	}
+	for _, t := range timeouts {
+		if t.v < 1 {
+			return fmt.Errorf("flows.%s: must be at least 1 second (got %d)", t.name, t.v)
+		}
+	}
+	return nil
+}
+
+func (p *Ports) validate() error {
+	var err error
+
+	p.ephemeral, err = parsePortRanges("ports.ephemeral", p.Ephemeral)
+	if err != nil {
+		return err
+	}
+	p.reserved, err = parsePortRanges("ports.reserved", p.Reserved)
+	if err != nil {
+		return err
+	}
+
+	if !p.hasUnreservedPort() {
+		return fmt.Errorf("ports.ephemeral: all ports are reserved")
+	}
+
+	quotas := []struct {
+		name string
+		v    int
+	}{
+		{"host-quota", p.HostQuota},
+		{"tcp-quota", p.TCPQuota},
+		{"udp-quota", p.UDPQuota},
+	}
+	for _, q := range quotas {
+		if q.v < 0 {
+			return fmt.Errorf("ports.%s: must not be negative (got %d)", q.name, q.v)
+		}
+	}
+	return nil
+}
+
+func (p *Ports) hasUnreservedPort() bool {
+	for _, e := range p.ephemeral {
+		for port := int(e.Min); port <= int(e.Max); port++ {
+			reserved := false
+			for _, r := range p.reserved {
+				if port >= int(r.Min) && port <= int(r.Max) {
+					reserved = true
+					break
+				}
+			}
+			if !reserved {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parsePortRanges(name string, ranges []string) ([]PortRange, error) {
+	parsed := make([]PortRange, 0, len(ranges))
+	for _, s := range ranges {
+		min, max := s, s
+		if i := strings.IndexByte(s, '-'); i >= 0 {
+			min, max = s[:i], s[i+1:]
+		}
+
+		lo, err1 := strconv.ParseUint(strings.TrimSpace(min), 10, 16)
+		hi, err2 := strconv.ParseUint(strings.TrimSpace(max), 10, 16)
+		if err1 != nil || err2 != nil || lo < 1 || lo > hi {
+			return nil, fmt.Errorf("%s: invalid port range %q", name, s)
+		}
+
+		parsed = append(parsed, PortRange{Min: uint16(lo), Max: uint16(hi)})
+	}
+	return parsed, nil
+}
+
+// EphemeralRanges returns the parsed ephemeral port ranges.
+func (p *Ports) EphemeralRanges() []PortRange {
+	return p.ephemeral
+}
+
+// ReservedRanges returns the parsed reserved port ranges.
+func (p *Ports) ReservedRanges() []PortRange {
+	return p.reserved
+}
+
+func (n *Network) validate() error {
+	ip, ipnet, err := net.ParseCIDR(n.IPv4)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("network.ipv4: %q is not an IPv4 CIDR", n.IPv4)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > 24 {
+		return fmt.Errorf("network.ipv4: %q is too small (at most /24)", n.IPv4)
+	}
+	n.ipv4 = ipnet
+
+	ip, ipnet, err = net.ParseCIDR(n.IPv6)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("network.ipv6: %q is not an IPv6 CIDR", n.IPv6)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != 48 {
+		return fmt.Errorf("network.ipv6: %q must be a /48", n.IPv6)
+	}
+	n.ipv6 = ipnet
+
+	if n.Policy != "drop" && n.Policy != "reject" {
+		return fmt.Errorf("network.policy: must be drop or reject (got %q)", n.Policy)
+	}
+
+	if n.ControllerID == n.GatewayID {
+		return fmt.Errorf("network: controller-id and gateway-id must differ")
+	}
+
+	return nil
+}
+
+// IPv4Net returns the IPv4 range of the virtual network.
+func (n *Network) IPv4Net() *net.IPNet {
+	return n.ipv4
+}
+
+// IPv6Net returns the IPv6 range of the virtual network.
+func (n *Network) IPv6Net() *net.IPNet {
+	return n.ipv6
+}
+
+// ControllerIPv4 returns the address of the controller (the first address in
+// the IPv4 range).
+func (n *Network) ControllerIPv4() net.IP {
+	ip := make(net.IP, 4)
+	copy(ip, n.ipv4.IP.To4())
+	ip[3]++
+	return ip
+}
+
+// GatewayIPv6 returns the IPv6 address of the gateway (PREFIX:8000::1).
+func (n *Network) GatewayIPv6() net.IP {
+	return n.localIPv6(1)
+}
+
+// ControllerIPv6 returns the IPv6 address of the controller (PREFIX:8000::2).
+func (n *Network) ControllerIPv6() net.IP {
+	return n.localIPv6(2)
+}
+
+func (n *Network) localIPv6(i byte) net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, n.ipv6.IP.To16())
+	ip[6] = 0x80
+	ip[15] = i
+	return ip
+}
+
+// APIAddr returns the address clients use to reach the API.
+func (c *Config) APIAddr() string {
+	return net.JoinHostPort(c.Network.ControllerIPv4().String(), strconv.Itoa(c.API.Port))
+}
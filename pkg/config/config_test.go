@@ -0,0 +1,128 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(`
+link {
+  driver = "tap"
+  id     = "sb0"
+}
+
+network {
+  ipv4 = "10.99.0.0/16"
+}
+
+api {
+  port   = 9090
+  listen = ["127.0.0.1:9090"]
+}
+
+flows {
+  tcp-established = 86400
+}
+
+ports {
+  ephemeral = ["40000-40999", "50000"]
+  reserved  = ["40080"]
+  tcp-quota = 100
+}
+
+plugin "docker" {
+  host       = "tcp://192.168.99.100:2376"
+  verify-tls = true
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Link.Driver != "tap" || c.Link.ID != "sb0" {
+		t.Errorf("unexpected link: %+v", c.Link)
+	}
+	if s := c.Network.IPv4Net().String(); s != "10.99.0.0/16" {
+		t.Errorf("unexpected ipv4 network: %s", s)
+	}
+	if s := c.Network.IPv6Net().String(); s != defaultIPv6 {
+		t.Errorf("unexpected ipv6 network: %s", s)
+	}
+	if s := c.Network.ControllerIPv6().String(); s != "fd4c:bd56:5cee:8000::2" {
+		t.Errorf("unexpected controller ipv6: %s", s)
+	}
+	if s := c.APIAddr(); s != "10.99.0.1:9090" {
+		t.Errorf("unexpected API address: %s", s)
+	}
+	if c.Network.ControllerID != defaultControllerID {
+		t.Errorf("expected default controller id")
+	}
+	if c.Flows.TCPEstablished != 86400 || c.Flows.TCPClosed != defaultTCPClosed {
+		t.Errorf("unexpected flows: %+v", c.Flows)
+	}
+	if r := c.Ports.EphemeralRanges(); len(r) != 2 || r[0] != (PortRange{40000, 40999}) || r[1] != (PortRange{50000, 50000}) {
+		t.Errorf("unexpected ephemeral ports: %v", r)
+	}
+	if r := c.Ports.ReservedRanges(); len(r) != 1 || r[0] != (PortRange{40080, 40080}) {
+		t.Errorf("unexpected reserved ports: %v", r)
+	}
+	if c.Ports.TCPQuota != 100 || c.Ports.HostQuota != 0 {
+		t.Errorf("unexpected ports: %+v", c.Ports)
+	}
+	if v := c.Plugins["docker"]["verify-tls"]; v != true {
+		t.Errorf("unexpected plugin config: %v", c.Plugins)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	c := Default()
+	if s := c.APIAddr(); s != "172.18.0.1:8080" {
+		t.Errorf("unexpected API address: %s", s)
+	}
+	if s := c.Network.GatewayIPv6().String(); s != "fd4c:bd56:5cee:8000::1" {
+		t.Errorf("unexpected gateway ipv6: %s", s)
+	}
+	if c.Metrics.Listen != "127.0.0.1:9180" {
+		t.Errorf("unexpected metrics address: %s", c.Metrics.Listen)
+	}
+	if r := c.Ports.EphemeralRanges(); len(r) != 1 || r[0] != (PortRange{49152, 65535}) {
+		t.Errorf("unexpected ephemeral ports: %v", r)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{`network { ipv4 = "172.18.0.0" }`, "network.ipv4"},
+		{`network { ipv4 = "fd00::/48" }`, "network.ipv4"},
+		{`network { ipv4 = "10.0.0.0/30" }`, "network.ipv4"},
+		{`network { ipv6 = "fd4c:bd56:5cee::/64" }`, "network.ipv6"},
+		{`network { gateway-id = "7ce86376-34f0-4951-bead-6152c8291f1c" }`, "controller-id and gateway-id"},
+		{`network { policy = "deny" }`, "network.policy"},
+		{`api { port = 70000 }`, "api.port"},
+		{`api { listen = ["localhost"] }`, "api.listen"},
+		{`metrics { listen = "localhost" }`, "metrics.listen"},
+		{`flows { udp = -1 }`, "flows.udp"},
+		{`flows { max = -1 }`, "flows.max"},
+		{`ports { ephemeral = ["0-100"] }`, "ports.ephemeral"},
+		{`ports { ephemeral = ["2000-1000"] }`, "ports.ephemeral"},
+		{`ports { reserved = ["http"] }`, "ports.reserved"},
+		{`ports { ephemeral = ["8080"], reserved = ["8000-9000"] }`, "all ports are reserved"},
+		{`ports { host-quota = -1 }`, "ports.host-quota"},
+		{`api {`, ""},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.src)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: unexpected error: %s", test.src, err)
+		}
+	}
+}
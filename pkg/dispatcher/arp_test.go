@@ -0,0 +1,110 @@
+package dispatcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+var testPeerMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x09}
+
+func testARPRequest(t *testing.T, vnet *VNET, target net.IP) *Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       testPeerMAC,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   testPeerMAC,
+		SourceProtAddress: net.IPv4(172, 18, 0, 9).To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    target.To4(),
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, eth, arp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeTestFrame(vnet, buf.Bytes())
+}
+
+// nextARP returns the next ARP packet written by vnet.
+func nextARP(t *testing.T, vnet *VNET, l *testLink) *layers.ARP {
+	p := nextFrame(t, vnet, l)
+	arp, _ := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if arp == nil {
+		t.Fatalf("expected an ARP packet:\n%s", p.Dump())
+	}
+	return arp
+}
+
+func TestProxyARP(t *testing.T) {
+	vnet, l := newTestVNET(t)
+
+	vnet.handleARPRequest(testARPRequest(t, vnet, net.IPv4(172, 18, 0, 7)))
+
+	arp := nextARP(t, vnet, l)
+	if arp.Operation != layers.ARPReply ||
+		!bytes.Equal(arp.SourceHwAddress, testControllerMAC) ||
+		!net.IP(arp.SourceProtAddress).Equal(net.IPv4(172, 18, 0, 7)) ||
+		!bytes.Equal(arp.DstHwAddress, testPeerMAC) {
+		t.Fatalf("unexpected reply: %+v", arp)
+	}
+
+	// hosts which are down and unknown addresses are not answered
+	if err := vnet.hosts.HostSetState("host", false); err != nil {
+		t.Fatal(err)
+	}
+	vnet.handleARPRequest(testARPRequest(t, vnet, net.IPv4(172, 18, 0, 7)))
+	vnet.handleARPRequest(testARPRequest(t, vnet, net.IPv4(172, 18, 0, 8)))
+
+	if n := len(vnet.egress.frames); n != 0 {
+		t.Fatalf("expected no replies, got %d", n)
+	}
+}
+
+func TestGratuitousARP(t *testing.T) {
+	vnet, l := newTestVNET(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vnet.wg.Add(1)
+	go vnet.announceHosts(ctx)
+
+	arp := nextARP(t, vnet, l)
+	if arp.Operation != layers.ARPRequest ||
+		!net.IP(arp.SourceProtAddress).Equal(net.IPv4(172, 18, 0, 7)) ||
+		!net.IP(arp.DstProtAddress).Equal(net.IPv4(172, 18, 0, 7)) ||
+		!bytes.Equal(arp.SourceHwAddress, testControllerMAC) {
+		t.Fatalf("unexpected announcement: %+v", arp)
+	}
+
+	_, err := vnet.hosts.AddHost(&hosts.Host{
+		Name:      "other",
+		IPv4Addrs: []net.IP{net.IPv4(172, 18, 0, 8)},
+		Up:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arp = nextARP(t, vnet, l)
+	if !net.IP(arp.SourceProtAddress).Equal(net.IPv4(172, 18, 0, 8)) {
+		t.Fatalf("unexpected announcement: %+v", arp)
+	}
+
+	cancel()
+	vnet.wg.Wait()
+}
@@ -0,0 +1,47 @@
+package dispatcher
+
+import (
+	"net"
+
+	"github.com/fd/switchboard/pkg/capture"
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// captureHostID returns the ID of the host a captured frame belongs to.
+// Inbound frames are matched on their destination address first, outbound
+// frames on their source address.
+func (vnet *VNET) captureHostID(dir capture.Direction, pkt gopacket.Packet) string {
+	var src, dst net.IP
+
+	if l, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		src, dst = net.IP(l.SourceProtAddress), net.IP(l.DstProtAddress)
+	} else if l, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		src, dst = l.SrcIP, l.DstIP
+	} else if l, ok := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		src, dst = l.SrcIP, l.DstIP
+	} else {
+		return ""
+	}
+
+	if dir == capture.Outbound {
+		src, dst = dst, src
+	}
+
+	table := vnet.hosts.GetTable()
+	if host := lookupHostByIP(table, dst); host != nil {
+		return host.ID
+	}
+	if host := lookupHostByIP(table, src); host != nil {
+		return host.ID
+	}
+	return ""
+}
+
+func lookupHostByIP(table *hosts.Table, ip net.IP) *hosts.Host {
+	if ip4 := ip.To4(); ip4 != nil {
+		return table.LookupByIPv4(ip4)
+	}
+	return table.LookupByIPv6(ip)
+}
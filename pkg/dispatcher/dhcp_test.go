@@ -0,0 +1,186 @@
+package dispatcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/marpie/godhcp"
+	"golang.org/x/net/context"
+)
+
+var (
+	testDHCPServerIP  = net.IPv4(192, 168, 64, 1).To4()
+	testDHCPServerMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x67}
+	testDHCPLeaseIP   = net.IPv4(192, 168, 64, 5).To4()
+)
+
+func nextDHCP(t *testing.T, vnet *VNET, l *testLink) (*layers.Ethernet, *layers.IPv4, *layers.DHCPv4) {
+	select {
+	case f := <-vnet.egress.frames:
+		vnet.egress.write(context.Background(), f)
+	case <-time.After(time.Second):
+		t.Fatal("expected a DHCP packet")
+	}
+
+	p := gopacket.NewPacket(l.frame, layers.LayerTypeEthernet, gopacket.Default)
+	msg, _ := p.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if msg == nil {
+		t.Fatalf("expected a DHCP packet:\n%s", p.Dump())
+	}
+	return p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet), p.Layer(layers.LayerTypeIPv4).(*layers.IPv4), msg
+}
+
+func dhcpMessageType(msg *layers.DHCPv4) layers.DHCPMsgType {
+	for _, opt := range msg.Options {
+		if opt.Type == layers.DHCPOptMessageType && len(opt.Data) == 1 {
+			return layers.DHCPMsgType(opt.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+func testDHCPReply(vnet *VNET, typ uint8, leaseTime uint32) *dhcp.Message {
+	msg := &dhcp.Message{
+		Type:          dhcp.MessageTypeReply,
+		TransactionID: vnet.dhcp.xid,
+		YourIPAddress: testDHCPLeaseIP,
+		Options: map[uint8]*dhcp.Option{
+			dhcp.OptionCodeDHCPMessageType:      {Value: []byte{typ}},
+			dhcp.OptionCodeDHCPServerIdentifier: {Value: testDHCPServerIP},
+			dhcp.OptionCodeRouter:               {Value: testDHCPServerIP},
+			dhcp.OptionCodeDomainNameServer:     {Value: []byte{192, 168, 64, 1, 8, 8, 8, 8}},
+			dhcp.OptionCodeSubnetMask:           {Value: []byte{255, 255, 255, 0}},
+		},
+	}
+	if leaseTime > 0 {
+		msg.Options[dhcpOptionLeaseTime] = &dhcp.Option{
+			Value: []byte{byte(leaseTime >> 24), byte(leaseTime >> 16), byte(leaseTime >> 8), byte(leaseTime)},
+		}
+	}
+	return msg
+}
+
+// bindTestDHCPLease runs the DISCOVER, OFFER, REQUEST, ACK exchange.
+func bindTestDHCPLease(t *testing.T, vnet *VNET, l *testLink, now time.Time) {
+	vnet.dhcpTick(now)
+	_, _, msg := nextDHCP(t, vnet, l)
+	if typ := dhcpMessageType(msg); typ != layers.DHCPMsgTypeDiscover {
+		t.Fatalf("expected a DISCOVER, got %s", typ)
+	}
+
+	vnet.handleDHCPMessage(testDHCPReply(vnet, dhcp.DHCPMessageTypeOffer, 0), testDHCPServerMAC, now)
+	eth, _, msg := nextDHCP(t, vnet, l)
+	if typ := dhcpMessageType(msg); typ != layers.DHCPMsgTypeRequest {
+		t.Fatalf("expected a REQUEST, got %s", typ)
+	}
+	if !bytes.Equal(eth.DstMAC, layers.EthernetBroadcast) {
+		t.Fatalf("expected a broadcast REQUEST, got %s", eth.DstMAC)
+	}
+
+	vnet.handleDHCPMessage(testDHCPReply(vnet, dhcp.DHCPMessageTypeAck, 100), testDHCPServerMAC, now)
+	if vnet.dhcp.state != dhcpBound {
+		t.Fatalf("expected BOUND, got %s", vnet.dhcp.state)
+	}
+}
+
+func TestDHCPLease(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	now := time.Now()
+
+	bindTestDHCPLease(t, vnet, l, now)
+
+	lease := vnet.System().DHCPLease()
+	if lease == nil {
+		t.Fatal("expected a lease")
+	}
+	if !lease.Addr.Equal(testDHCPLeaseIP) || !vnet.System().ControllerIPv4().Equal(testDHCPLeaseIP) {
+		t.Fatalf("unexpected address: %s", lease.Addr)
+	}
+	if !lease.Server.Equal(testDHCPServerIP) || !lease.Router.Equal(testDHCPServerIP) {
+		t.Fatalf("unexpected server: %s router: %s", lease.Server, lease.Router)
+	}
+	if len(lease.DNS) != 2 || !lease.DNS[1].Equal(net.IPv4(8, 8, 8, 8)) {
+		t.Fatalf("unexpected DNS servers: %v", lease.DNS)
+	}
+	if !lease.Renew.Equal(now.Add(50*time.Second)) ||
+		!lease.Rebind.Equal(now.Add(87500*time.Millisecond)) ||
+		!lease.Expiry.Equal(now.Add(100*time.Second)) {
+		t.Fatalf("unexpected times: %+v", lease)
+	}
+
+	// nothing happens before T1
+	vnet.dhcpTick(now.Add(49 * time.Second))
+	if n := len(vnet.egress.frames); n != 0 {
+		t.Fatalf("expected no frames, got %d", n)
+	}
+
+	// RENEWING: unicast to the server
+	vnet.dhcpTick(now.Add(50 * time.Second))
+	eth, ip, msg := nextDHCP(t, vnet, l)
+	if typ := dhcpMessageType(msg); typ != layers.DHCPMsgTypeRequest {
+		t.Fatalf("expected a REQUEST, got %s", typ)
+	}
+	if !bytes.Equal(eth.DstMAC, testDHCPServerMAC) || !ip.DstIP.Equal(testDHCPServerIP) ||
+		!ip.SrcIP.Equal(testDHCPLeaseIP) || !msg.ClientIP.Equal(testDHCPLeaseIP) {
+		t.Fatalf("unexpected renew: %s > %s (%s) ciaddr=%s", ip.SrcIP, ip.DstIP, eth.DstMAC, msg.ClientIP)
+	}
+
+	// REBINDING: broadcast
+	vnet.dhcpTick(now.Add(88 * time.Second))
+	eth, ip, msg = nextDHCP(t, vnet, l)
+	if vnet.dhcp.state != dhcpRebinding {
+		t.Fatalf("expected REBINDING, got %s", vnet.dhcp.state)
+	}
+	if !bytes.Equal(eth.DstMAC, layers.EthernetBroadcast) || !ip.DstIP.Equal(net.IPv4bcast) ||
+		!msg.ClientIP.Equal(testDHCPLeaseIP) {
+		t.Fatalf("unexpected rebind: %s > %s (%s)", ip.SrcIP, ip.DstIP, eth.DstMAC)
+	}
+
+	// the lease expires
+	vnet.dhcpTick(now.Add(100 * time.Second))
+	if vnet.dhcp.state != dhcpInit || vnet.System().DHCPLease() != nil {
+		t.Fatalf("expected the lease to expire, state %s", vnet.dhcp.state)
+	}
+}
+
+func TestDHCPNak(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	now := time.Now()
+
+	bindTestDHCPLease(t, vnet, l, now)
+
+	vnet.dhcpTick(now.Add(50 * time.Second))
+	nextDHCP(t, vnet, l)
+
+	vnet.handleDHCPMessage(testDHCPReply(vnet, dhcp.DHCPMessageTypeNak, 0), testDHCPServerMAC, now)
+	if vnet.dhcp.state != dhcpInit || vnet.System().DHCPLease() != nil {
+		t.Fatalf("expected to start over, state %s", vnet.dhcp.state)
+	}
+
+	vnet.dhcpTick(now.Add(51 * time.Second))
+	_, _, msg := nextDHCP(t, vnet, l)
+	if typ := dhcpMessageType(msg); typ != layers.DHCPMsgTypeDiscover {
+		t.Fatalf("expected a DISCOVER, got %s", typ)
+	}
+}
+
+func TestDHCPRelease(t *testing.T) {
+	vnet, l := newTestVNET(t)
+
+	bindTestDHCPLease(t, vnet, l, time.Now())
+
+	vnet.releaseDHCPLease()
+
+	p := gopacket.NewPacket(l.frame, layers.LayerTypeEthernet, gopacket.Default)
+	msg, _ := p.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if msg == nil || dhcpMessageType(msg) != layers.DHCPMsgTypeRelease {
+		t.Fatalf("expected a RELEASE:\n%s", p.Dump())
+	}
+	if eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !bytes.Equal(eth.DstMAC, testDHCPServerMAC) {
+		t.Fatalf("expected the RELEASE to be sent to the server, got %s", eth.DstMAC)
+	}
+}
@@ -7,67 +7,113 @@ import (
 	"log"
 	"math/rand"
 	"net"
-	"os/exec"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/fd/switchboard/pkg/capture"
+	"github.com/fd/switchboard/pkg/config"
+	"github.com/fd/switchboard/pkg/fragments"
 	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/fd/switchboard/pkg/link"
 	"github.com/fd/switchboard/pkg/peers"
 	"github.com/fd/switchboard/pkg/ports"
-	"github.com/fd/switchboard/pkg/protocols"
 	"github.com/fd/switchboard/pkg/proxy"
 	"github.com/fd/switchboard/pkg/routes"
 	"github.com/fd/switchboard/pkg/rules"
-	"github.com/fd/switchboard/pkg/vmnet"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"golang.org/x/net/context"
 )
 
 type VNET struct {
-	wg     sync.WaitGroup
-	iface  *vmnet.Interface
-	ports  *ports.Mapper
-	hosts  *hosts.Controller
-	rules  *rules.Controller
-	routes *routes.Controller
-	peers  *peers.Controller
-	proxy  *proxy.Proxy
-	system *System
-
-	chanEth  chan<- *Packet
+	wg       sync.WaitGroup
+	link     link.Link
+	ports    *ports.Mapper
+	hosts    *hosts.Controller
+	rules    *rules.Controller
+	routes   *routes.Controller
+	peers    *peers.Controller
+	proxy    *proxy.Proxy
+	system   *System
+	capture  *capture.Hub
+	egress   *egressQueue
+	resolver resolver
+	dhcp     dhcpClient
+	drops    dropCounters
+	tracer   tracer
+
+	fragments *fragments.Reassembler
+
+	network config.Network
+	policy  hosts.Policy
+
+	// staticIPv4 is set when the link provides the controller address (no DHCP)
+	staticIPv4 bool
+	// remoteGateway is set when the gateway is not an interface of this host
+	remoteGateway bool
+
 	chanArp  chan<- *Packet
-	chanIpv4 chan<- *Packet
 	chanICMP chan<- *Packet
-	chanUDP  chan<- *Packet
-	chanTCP  chan<- *Packet
 	chanDHCP chan<- *Packet
+
+	// the data path is handled by pools of workers sharded by flow
+	workersEth  *workerPool
+	workersIpv4 *workerPool
+	workersIpv6 *workerPool
+	workersUDP  *workerPool
+	workersTCP  *workerPool
 }
 
-func Run(ctx context.Context) (*VNET, error) {
+// Run starts dispatching packets from and to l for the virtual network
+// described by conf. The VNET takes ownership of the link and closes it
+// when ctx is done.
+func Run(ctx context.Context, l link.Link, conf *config.Config) (*VNET, error) {
 	rand.Seed(time.Now().Unix())
 
+	network := conf.Network
+
+	policy, err := hosts.ParsePolicy(network.Policy)
+	if err != nil {
+		return nil, err
+	}
+
 	p := ports.NewMapper()
 	r := routes.NewController(p)
 
 	vnet := &VNET{
+		link:   l,
 		ports:  p,
 		routes: r,
-		hosts:  hosts.NewController(p),
+		hosts:  hosts.NewController(p, network.IPv4Net(), network.IPv6Net()),
 		rules:  rules.NewController(p),
 		peers:  peers.NewController(),
 		proxy:  proxy.NewProxy(r),
 		system: &System{},
+
+		fragments: fragments.NewReassembler(fragments.DefaultTimeout),
+
+		network: network,
+		policy:  policy,
+	}
+	vnet.capture = capture.NewHub(vnet.captureHostID)
+	vnet.egress = newEgressQueue(l, egressQueueSize)
+	vnet.configureFlows(conf.Flows)
+	vnet.configurePorts(conf.Ports)
+
+	if c, ok := l.(link.Configurer); ok {
+		err = vnet.configureLink(c.Config())
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	{ // insert controller
 		host, err := vnet.hosts.AddHost(&hosts.Host{
-			ID:    "7ce86376-34f0-4951-bead-6152c8291f1c",
+			ID:    network.ControllerID,
 			Name:  "controller",
 			Local: true,
 
-			IPv6Addrs: []net.IP{net.ParseIP("fd4c:bd56:5cee:8000::2")},
+			IPv6Addrs: []net.IP{network.ControllerIPv6()},
 
 			Up: true,
 		})
@@ -77,66 +123,102 @@ func Run(ctx context.Context) (*VNET, error) {
 		log.Printf("insert %s: %v", host.Name, host)
 	}
 
-	host, err := vnet.hosts.AddHost(&hosts.Host{
-		IPv4Addrs: []net.IP{net.IPv4(172, 18, 0, 2)},
-		Local:     true,
-		Up:        true,
-	})
-	if err != nil {
-		panic(err)
-	}
-	log.Printf("insert %s: %v", host.Name, host)
-
-	rule, err := vnet.rules.AddRule(rules.Rule{
-		Protocol:  protocols.TCP,
-		SrcHostID: host.ID,
-		// SrcPort:   80,
-		// DstPort:   20559,
-		SrcPort: 80,
-		DstIP:   net.IPv4(192, 168, 99, 100),
-		DstPort: 32768,
-		// SrcPort: 80,
-		// DstIP:   net.IPv4(64, 15, 124, 217),
-	})
-	if err != nil {
-		panic(err)
-	}
-	log.Printf("insert: %v", rule)
-
-	iface, err := vmnet.Open("31fbf731-e896-4d03-9bc8-7a6221b91860")
-	if err != nil {
-		return nil, err
-	}
-	vnet.iface = iface
-
-	vnet.chanEth = vnet.dispatchEthernet(ctx)
+	vnet.workersEth = vnet.dispatchEthernet(ctx)
 	vnet.chanArp = vnet.dispatchARP(ctx)
-	vnet.chanIpv4 = vnet.dispatchIPv4(ctx)
+	vnet.workersIpv4 = vnet.dispatchIPv4(ctx)
+	vnet.workersIpv6 = vnet.dispatchIPv6(ctx)
 	vnet.chanICMP = vnet.dispatchICMP(ctx)
-	vnet.chanUDP = vnet.dispatchUDP(ctx)
-	vnet.chanTCP = vnet.dispatchTCP(ctx)
+	vnet.workersUDP = vnet.dispatchUDP(ctx)
+	vnet.workersTCP = vnet.dispatchTCP(ctx)
 	vnet.chanDHCP = vnet.dispatchDHCP(ctx)
 
-	vnet.wg.Add(6)
+	vnet.wg.Add(11)
 	go vnet.runReader(ctx)
-	go vnet.vmnetCloser(ctx)
+	go vnet.runEgress(ctx)
+	go vnet.runResolver(ctx)
+	go vnet.runEvents(ctx)
+	go vnet.linkCloser(ctx)
 	go vnet.gc(ctx)
 	go vnet.addGatewayHost(ctx)
-	go vnet.addIPv6AddressToVMNET(ctx)
-	go vnet.routeIPv4SubnetToController(ctx)
+	go vnet.addIPv6AddressToLink(ctx)
+	go vnet.configureControllerIPv4(ctx)
+	go vnet.detectDuplicateIPv6()
+	go vnet.announceHosts(ctx)
 
 	err = vnet.proxy.Run(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("UUID: %s", vnet.iface.ID())
-	log.Printf("MAC:  %s", vnet.iface.HardwareAddr())
+	log.Printf("MAC:  %s", vnet.link.HardwareAddr())
 
-	vnet.system.SetControllerMAC(vnet.iface.HardwareAddr())
+	vnet.system.SetControllerMAC(vnet.link.HardwareAddr())
 	return vnet, nil
 }
 
+// configureFlows sets the capacity of the flow table and the times idle
+// flows are kept.
+func (vnet *VNET) configureFlows(flows config.Flows) {
+	vnet.routes.SetCapacity(flows.Max)
+	vnet.routes.SetTimeouts(routes.Timeouts{
+		TCPSynSent:     time.Duration(flows.TCPSynSent) * time.Second,
+		TCPEstablished: time.Duration(flows.TCPEstablished) * time.Second,
+		TCPFinWait:     time.Duration(flows.TCPFinWait) * time.Second,
+		TCPTimeWait:    time.Duration(flows.TCPTimeWait) * time.Second,
+		TCPClosed:      time.Duration(flows.TCPClosed) * time.Second,
+		UDP:            time.Duration(flows.UDP) * time.Second,
+		UDPStream:      time.Duration(flows.UDPStream) * time.Second,
+	})
+}
+
+// configurePorts sets the port ranges and quotas of the port mapper.
+func (vnet *VNET) configurePorts(conf config.Ports) {
+	vnet.ports.SetEphemeral(portRanges(conf.EphemeralRanges()))
+	vnet.ports.SetReserved(portRanges(conf.ReservedRanges()))
+	vnet.ports.SetQuotas(ports.Quotas{
+		Host: conf.HostQuota,
+		TCP:  conf.TCPQuota,
+		UDP:  conf.UDPQuota,
+	})
+}
+
+func portRanges(ranges []config.PortRange) []ports.Range {
+	r := make([]ports.Range, len(ranges))
+	for i, x := range ranges {
+		r[i] = ports.Range{Min: x.Min, Max: x.Max}
+	}
+	return r
+}
+
+func (vnet *VNET) configureLink(config link.Config) error {
+	if config.GatewayMAC != nil {
+		vnet.system.SetGatewayMAC(config.GatewayMAC)
+	}
+	if config.GatewayIPv4 != nil {
+		vnet.system.SetGatewayIPv4(config.GatewayIPv4)
+	}
+	if config.ControllerIPv4 != nil {
+		vnet.system.SetControllerIPv4(config.ControllerIPv4)
+		vnet.staticIPv4 = true
+	}
+	if config.RemoteGateway {
+		vnet.remoteGateway = true
+		vnet.system.SetGatewayRemote(true)
+	}
+	if config.PeerIPv4 != nil {
+		host, err := vnet.hosts.AddHost(&hosts.Host{
+			Name:      config.PeerName,
+			IPv4Addrs: []net.IP{config.PeerIPv4},
+			Up:        true,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("insert %s: %v", host.Name, host)
+	}
+	return nil
+}
+
 func (vnet *VNET) Wait() {
 	vnet.wg.Wait()
 }
@@ -153,17 +235,55 @@ func (vnet *VNET) Rules() *rules.Controller {
 	return vnet.rules
 }
 
-func (vnet *VNET) vmnetCloser(ctx context.Context) {
+func (vnet *VNET) Routes() *routes.Controller {
+	return vnet.routes
+}
+
+func (vnet *VNET) Ports() *ports.Mapper {
+	return vnet.ports
+}
+
+func (vnet *VNET) Proxy() *proxy.Proxy {
+	return vnet.proxy
+}
+
+func (vnet *VNET) Network() config.Network {
+	return vnet.network
+}
+
+func (vnet *VNET) Capture() *capture.Hub {
+	return vnet.capture
+}
+
+// EgressStats returns the counters of the queue of frames written to the
+// link.
+func (vnet *VNET) EgressStats() EgressStats {
+	return vnet.egress.Stats()
+}
+
+func (vnet *VNET) linkCloser(ctx context.Context) {
 	defer vnet.wg.Done()
 
 	<-ctx.Done()
 
-	err := vnet.iface.Close()
+	if !vnet.staticIPv4 {
+		vnet.releaseDHCPLease()
+	}
+
+	err := vnet.link.Close()
 	if err != nil {
 		log.Printf("error: %s", err)
 	}
 }
 
+func (vnet *VNET) runEvents(ctx context.Context) {
+	defer vnet.wg.Done()
+
+	for event := range vnet.link.Events() {
+		log.Printf("LINK/event: %d", event.Type)
+	}
+}
+
 func (vnet *VNET) gc(ctx context.Context) {
 	defer vnet.wg.Done()
 
@@ -174,6 +294,7 @@ func (vnet *VNET) gc(ctx context.Context) {
 		select {
 		case <-ticker.C:
 			vnet.routes.Expire()
+			vnet.fragments.Expire(time.Now())
 		case <-ctx.Done():
 			return
 		}
@@ -183,12 +304,12 @@ func (vnet *VNET) gc(ctx context.Context) {
 func (vnet *VNET) runReader(ctx context.Context) {
 	defer vnet.wg.Done()
 
-	var maxPktSize = vnet.iface.MaxPacketSize()
+	var maxPktSize = vnet.link.MaxPacketSize()
 
 	for {
 		var pkt = NewPacket(maxPktSize)
 
-		n, flags, err := vnet.iface.ReadPacket(pkt.buf)
+		n, flags, err := vnet.link.ReadPacket(pkt.buf)
 		if err == io.EOF {
 			pkt.Release()
 			return
@@ -200,9 +321,19 @@ func (vnet *VNET) runReader(ctx context.Context) {
 			continue
 		}
 
-		pkt.Packet = gopacket.NewPacket(pkt.buf[:n], layers.LayerTypeEthernet, gopacket.NoCopy)
+		if vnet.capture.Active() {
+			vnet.capture.Publish(capture.Inbound, pkt.buf[:n])
+		}
+
 		pkt.Flags = flags
-		pkt.layers = pkt.Layers()
+		err = pkt.decode(pkt.buf[:n])
+		if err != nil {
+			log.Printf("error during read: %s", err)
+		}
+
+		if vnet.tracer.Active() {
+			vnet.tracer.start(pkt)
+		}
 
 		vnet.dispatch(ctx, pkt)
 	}
@@ -210,7 +341,8 @@ func (vnet *VNET) runReader(ctx context.Context) {
 
 func (vnet *VNET) dispatch(ctx context.Context, pkt *Packet) {
 	var (
-		dst chan<- *Packet
+		dst     chan<- *Packet
+		workers *workerPool
 	)
 
 	if len(pkt.layers) == 0 {
@@ -219,43 +351,43 @@ func (vnet *VNET) dispatch(ctx context.Context, pkt *Packet) {
 		return
 	}
 
-	z := pkt.layers[0]
+	typ := pkt.layers[0]
 	pkt.layers = pkt.layers[1:]
-	switch l := z.(type) {
-
-	case gopacket.ErrorLayer:
-		log.Printf("error during read: %s", pkt.ErrorLayer().Error())
+	switch typ {
 
-	case *layers.Ethernet:
-		pkt.Eth = l
-		dst = vnet.chanEth
+	case layers.LayerTypeEthernet:
+		workers = vnet.workersEth
 
-	case *layers.ARP:
-		pkt.ARP = l
+	case layers.LayerTypeARP:
 		dst = vnet.chanArp
 
-	case *layers.IPv4:
-		pkt.IPv4 = l
-		dst = vnet.chanIpv4
-	case *layers.IPv6:
-	case *layers.IPv6HopByHop:
+	case layers.LayerTypeIPv4:
+		workers = vnet.workersIpv4
+	case layers.LayerTypeIPv6:
+		workers = vnet.workersIpv6
+	case layers.LayerTypeIPv6HopByHop:
+		// the options are not used; dispatch the layer behind them
+		vnet.dispatch(ctx, pkt)
+		return
 
-	case *layers.ICMPv4:
-		pkt.ICMPv4 = l
-		dst = vnet.chanICMP
-	case *layers.ICMPv6:
-		pkt.ICMPv6 = l
+	case layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
 		dst = vnet.chanICMP
 
-	case *layers.TCP:
-		pkt.TCP = l
-		dst = vnet.chanTCP
-	case *layers.UDP:
-		pkt.UDP = l
-		dst = vnet.chanUDP
+	case layers.LayerTypeTCP:
+		workers = vnet.workersTCP
+	case layers.LayerTypeUDP:
+		workers = vnet.workersUDP
 
 	}
 
+	if workers != nil {
+		if !workers.dispatch(pkt) {
+			vnet.drop(pkt, DropQueueFull, "")
+			pkt.Release()
+		}
+		return
+	}
+
 	if dst == nil {
 		// ignore
 		pkt.Release()
@@ -285,12 +417,22 @@ func (vnet *VNET) writePacket(l ...gopacket.SerializableLayer) error {
 	// opkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.NoCopy)
 	// log.Printf("WRITE: %08x %s\n", 0, opkt.Dump())
 
-	_, err = vnet.iface.WritePacket(buf.Bytes(), 0)
-	if err != nil {
-		return err
+	return vnet.writeFrame(buf.Bytes())
+}
+
+// writeFrame queues a serialized frame to be written to the link. frame is
+// copied.
+func (vnet *VNET) writeFrame(frame []byte) error {
+	if vnet.capture.Active() {
+		vnet.capture.Publish(capture.Outbound, frame)
 	}
 
-	return nil
+	return vnet.egress.enqueue(frame)
+}
+
+func (vnet *VNET) runEgress(ctx context.Context) {
+	defer vnet.wg.Done()
+	vnet.egress.run(ctx)
 }
 
 func (vnet *VNET) addGatewayHost(ctx context.Context) {
@@ -299,12 +441,12 @@ func (vnet *VNET) addGatewayHost(ctx context.Context) {
 	vnet.system.WaitForGatewayIPv4()
 
 	host, err := vnet.hosts.AddHost(&hosts.Host{
-		ID:    "d9c62f0c-7936-4384-8d85-4587561a7142",
+		ID:    vnet.network.GatewayID,
 		Name:  "gateway",
 		Local: true,
 
 		IPv4Addrs: []net.IP{vnet.system.GatewayIPv4()},
-		IPv6Addrs: []net.IP{net.ParseIP("fd4c:bd56:5cee:8000::1")},
+		IPv6Addrs: []net.IP{vnet.network.GatewayIPv6()},
 
 		Up: true,
 	})
@@ -314,96 +456,115 @@ func (vnet *VNET) addGatewayHost(ctx context.Context) {
 	log.Printf("insert gateway: %v", host)
 }
 
-func (vnet *VNET) addIPv6AddressToVMNET(ctx context.Context) {
+func (vnet *VNET) addIPv6AddressToLink(ctx context.Context) {
 	defer vnet.wg.Done()
 
-	vnet.system.WaitForGatewayMAC()
+	if vnet.remoteGateway {
+		return
+	}
 
-	var (
-		iface net.Interface
-		found bool
-	)
+	vnet.system.WaitForGatewayMAC()
 
-	ifaces, err := net.Interfaces()
+	iface, err := vnet.gatewayInterface()
 	if err != nil {
 		panic(err)
 	}
-	for _, i := range ifaces {
-		if bytes.Equal(i.HardwareAddr, vnet.system.GatewayMAC()) {
-			// found iface
-			iface = i
-			found = true
-			break
-		}
-	}
-	if !found {
-		panic(errors.New("unable to find interface"))
-	}
 
-	err = exec.Command("sudo", "ifconfig", iface.Name, "inet6", "fd4c:bd56:5cee:8000::1", "prefixlen", "48").Run()
+	ones, _ := vnet.network.IPv6Net().Mask.Size()
+	err = hostAddIPv6Address(iface.Name, vnet.network.GatewayIPv6().String(), ones)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func (vnet *VNET) routeIPv4SubnetToController(ctx context.Context) {
+// configureControllerIPv4 configures the host for the controller IPv4
+// address and reconfigures it each time the address changes (when the DHCP
+// server hands out a new lease).
+func (vnet *VNET) configureControllerIPv4(ctx context.Context) {
 	defer vnet.wg.Done()
 
 	vnet.system.WaitForControllerIPv4()
 	vnet.system.WaitForGatewayMAC()
 
-	vnet.hosts.HostAddIPv4("controller", net.IPv4(172, 18, 0, 1))
+	var configured net.IP
+
+	for {
+		changed := vnet.system.ControllerIPv4Changed()
+
+		if ip := vnet.system.ControllerIPv4(); !ip.Equal(configured) {
+			if configured != nil {
+				log.Printf("controller IPv4 changed: %s -> %s", configured, ip)
+			}
+			vnet.routeIPv4SubnetToController(configured, ip)
+			configured = ip
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// routeIPv4SubnetToController routes the IPv4 range of the network to ip, the
+// address of the controller on the gateway link, instead of prev (nil the
+// first time).
+//
+// Nothing else follows ip when it changes. The controller host entry holds
+// the controller's address inside the network, which is static, the API is
+// served on the gateway's address and its rule refers to the controller by
+// host ID. The packet handlers read the address from the system each time.
+func (vnet *VNET) routeIPv4SubnetToController(prev, ip net.IP) {
+	controllerIP := vnet.network.ControllerIPv4()
+	if host := vnet.hosts.GetTable().LookupByIPv4(controllerIP); host == nil {
+		err := vnet.hosts.HostAddIPv4("controller", controllerIP)
+		if err != nil {
+			log.Printf("ROUTE/error: %s", err)
+		}
+	}
+
+	vnet.sendGratuitousARP(ip)
 
-	// sudo route -n add -net 172.18.0.0/16 192.168.128.7
-	log.Printf("exec: %v", []string{"route", "-n", "add", "-net", "172.18.0.0/16", vnet.system.ControllerIPv4().String()})
-	err := exec.Command("sudo", "route", "-n", "add", "-net", "172.18.0.0/16", vnet.system.ControllerIPv4().String()).Run()
+	if vnet.remoteGateway {
+		return
+	}
+
+	iface, err := vnet.gatewayInterface()
 	if err != nil {
 		log.Printf("ROUTE/error: %s", err)
 		return
 	}
 
-	var (
-		ifaceName   string
-		coIfaceName string
-	)
-	ifaces, err := net.Interfaces()
+	err = hostRouteIPv4Subnet(iface.Name, vnet.network.IPv4Net().String(), prev, ip)
 	if err != nil {
 		log.Printf("ROUTE/error: %s", err)
 		return
 	}
-	for _, iface := range ifaces {
-		if !bytes.Equal(iface.HardwareAddr, vnet.system.GatewayMAC()) {
-			continue
-		}
-		output, err := exec.Command("ifconfig", iface.Name).Output()
-		if err != nil {
-			log.Printf("ROUTE/error: %s", err)
-			return
-		}
-		for _, line := range strings.Split(string(output), "\n") {
-			line = strings.TrimSpace(line)
-			if !strings.HasPrefix(line, "member:") {
-				continue
-			}
-			line = strings.TrimPrefix(line, "member:")
-			line = strings.TrimSpace(line)
-			if idx := strings.IndexByte(line, ' '); idx > 0 {
-				line = line[:idx]
-			}
-			ifaceName = iface.Name
-			coIfaceName = line
-			break
-		}
-		break
+}
+
+// gatewayIP returns the address of the gateway in the same family as ip.
+func (vnet *VNET) gatewayIP(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return vnet.system.GatewayIPv4()
 	}
+	return vnet.network.GatewayIPv6()
+}
 
-	// sudo ifconfig bridge100 -hostfilter en4
-	log.Printf("exec: %v", []string{"ifconfig", ifaceName, "-hostfilter", coIfaceName})
-	err = exec.Command("sudo", "ifconfig", ifaceName, "-hostfilter", coIfaceName).Run()
+// gatewayInterface returns the host interface which is the gateway side of the link.
+func (vnet *VNET) gatewayInterface() (net.Interface, error) {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		log.Printf("ROUTE/error: %s", err)
-		return
+		return net.Interface{}, err
 	}
+
+	for _, iface := range ifaces {
+		if bytes.Equal(iface.HardwareAddr, vnet.system.GatewayMAC()) {
+			return iface, nil
+		}
+	}
+
+	return net.Interface{}, errors.New("unable to find interface")
 }
 
 // host:  127.0.0.1:5000    -> 192.168.64.25:6000
@@ -0,0 +1,148 @@
+package dispatcher
+
+import (
+	"sort"
+	"sync"
+)
+
+// DropReason is the reason a packet was dropped.
+type DropReason uint8
+
+const (
+	dropNone DropReason = iota
+
+	// DropNoHost is used when the destination host is unknown
+	DropNoHost
+	// DropHostDown is used when the destination host is down
+	DropHostDown
+	// DropNoRule is used when the destination host doesn't accept the port
+	DropNoRule
+	// DropNoGateway is used when a rule needs the gateway but it is down
+	DropNoGateway
+	// DropNoDestination is used when a rule has no destination address
+	DropNoDestination
+	// DropFamilyMismatch is used when the rule destination is of another
+	// address family than the packet
+	DropFamilyMismatch
+	// DropRouteFailed is used when a route could not be created
+	DropRouteFailed
+	// DropTooBig is used when a packet doesn't fit the link
+	DropTooBig
+	// DropFragment is used for invalid or unreassembled fragments
+	DropFragment
+	// DropQueueFull is used when a worker or resolver queue is full
+	DropQueueFull
+	// DropWriteFailed is used when a packet could not be written
+	DropWriteFailed
+	// DropNoNeighbor is used when the MAC address of the next hop could not
+	// be resolved
+	DropNoNeighbor
+)
+
+var dropReasonNames = [...]string{
+	dropNone:           "none",
+	DropNoHost:         "no-host",
+	DropHostDown:       "host-down",
+	DropNoRule:         "no-rule",
+	DropNoGateway:      "no-gateway",
+	DropNoDestination:  "no-destination",
+	DropFamilyMismatch: "family-mismatch",
+	DropRouteFailed:    "route-failed",
+	DropTooBig:         "too-big",
+	DropFragment:       "fragment",
+	DropQueueFull:      "queue-full",
+	DropWriteFailed:    "write-failed",
+	DropNoNeighbor:     "no-neighbor",
+}
+
+func (r DropReason) String() string {
+	if int(r) < len(dropReasonNames) {
+		return dropReasonNames[r]
+	}
+	return "unknown"
+}
+
+// DropCount is the number of packets dropped for a reason, for a host and
+// rule. HostID and RuleID are empty when they were not known.
+type DropCount struct {
+	Reason DropReason
+	HostID string
+	RuleID string
+	Count  uint64
+}
+
+type dropKey struct {
+	reason DropReason
+	hostID string
+	ruleID string
+}
+
+type dropCounters struct {
+	mtx    sync.Mutex
+	counts map[dropKey]uint64
+}
+
+func (c *dropCounters) add(reason DropReason, hostID, ruleID string) {
+	c.mtx.Lock()
+	if c.counts == nil {
+		c.counts = make(map[dropKey]uint64)
+	}
+	c.counts[dropKey{reason, hostID, ruleID}]++
+	c.mtx.Unlock()
+}
+
+// list returns the counters for hostID (all hosts when empty).
+func (c *dropCounters) list(hostID string) []DropCount {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	counts := make([]DropCount, 0, len(c.counts))
+	for key, n := range c.counts {
+		if hostID != "" && key.hostID != hostID {
+			continue
+		}
+		counts = append(counts, DropCount{
+			Reason: key.reason,
+			HostID: key.hostID,
+			RuleID: key.ruleID,
+			Count:  n,
+		})
+	}
+
+	sort.Sort(sortedDropCounts(counts))
+	return counts
+}
+
+type sortedDropCounts []DropCount
+
+func (s sortedDropCounts) Len() int      { return len(s) }
+func (s sortedDropCounts) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortedDropCounts) Less(i, j int) bool {
+	if s[i].HostID != s[j].HostID {
+		return s[i].HostID < s[j].HostID
+	}
+	if s[i].RuleID != s[j].RuleID {
+		return s[i].RuleID < s[j].RuleID
+	}
+	return s[i].Reason < s[j].Reason
+}
+
+// drop counts pkt as dropped for reason. ruleID is the rule which matched
+// pkt, if any.
+func (vnet *VNET) drop(pkt *Packet, reason DropReason, ruleID string) {
+	var hostID string
+	if pkt.DstHost != nil {
+		hostID = pkt.DstHost.ID
+	}
+
+	vnet.drops.add(reason, hostID, ruleID)
+
+	if pkt.trace != nil {
+		pkt.trace.drop(reason)
+	}
+}
+
+// Drops returns the drop counters for hostID (all hosts when empty).
+func (vnet *VNET) Drops(hostID string) []DropCount {
+	return vnet.drops.list(hostID)
+}
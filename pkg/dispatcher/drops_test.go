@@ -0,0 +1,73 @@
+package dispatcher
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/capture"
+	"github.com/fd/switchboard/pkg/protocols"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDropNoRule(t *testing.T) {
+	vnet, _ := newTestVNET(t)
+
+	frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 81, SYN: true}, 0)
+
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	drops := vnet.Drops("")
+	if len(drops) != 1 {
+		t.Fatalf("expected 1 counter, got %+v", drops)
+	}
+	if d := drops[0]; d.Reason != DropNoRule || d.HostID != "host" || d.Count != 2 {
+		t.Fatalf("unexpected counter: %+v", d)
+	}
+
+	if drops := vnet.Drops("other"); len(drops) != 0 {
+		t.Fatalf("expected no counters, got %+v", drops)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	vnet, _ := newTestVNET(t)
+
+	addTestRoute(t, vnet, protocols.TCP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), net.IPv4(10, 0, 0, 1))
+
+	filter, err := capture.ParseFilter("tcp port 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := vnet.Trace(filter, 8)
+	defer sub.Close()
+
+	for _, port := range []layers.TCPPort{80, 81} {
+		frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+			&layers.TCP{SrcPort: 50000, DstPort: port, ACK: true}, 10)
+
+		pkt := decodeTestFrame(vnet, frame)
+		vnet.tracer.start(pkt)
+		vnet.handleTCP(pkt, time.Now())
+	}
+	writeQueued(vnet)
+
+	trace := <-sub.C()
+	if trace.HostID != "host" || trace.Dropped != dropNone {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+	steps := strings.Join(trace.Steps, "\n")
+	if !strings.Contains(steps, "route: reused") || !strings.Contains(steps, "rewritten: ") {
+		t.Fatalf("unexpected steps:\n%s", steps)
+	}
+
+	select {
+	case trace := <-sub.C():
+		t.Fatalf("unexpected trace: %+v", trace)
+	default:
+	}
+}
@@ -0,0 +1,229 @@
+package dispatcher
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fd/switchboard/pkg/link"
+	"golang.org/x/net/context"
+)
+
+const (
+	// egressQueueSize is the number of frames waiting to be written
+	egressQueueSize = 1024
+	// egressBatchSize is the largest number of frames written to the link in
+	// one call (when it is a link.BatchWriter)
+	egressBatchSize = 64
+
+	egressMaxRetries = 8
+	egressMinBackoff = 50 * time.Microsecond
+	egressMaxBackoff = 10 * time.Millisecond
+)
+
+var errEgressQueueFull = errors.New("egress queue is full")
+
+// EgressStats are the counters of the egress queue.
+type EgressStats struct {
+	Written uint64
+	Retried uint64
+
+	// DroppedQueueFull counts frames dropped because the queue was full
+	DroppedQueueFull uint64
+	// DroppedLinkError counts frames dropped because of permanent link errors
+	DroppedLinkError uint64
+	// DroppedRetries counts frames dropped after retrying too often
+	DroppedRetries uint64
+	// DroppedClosed counts frames dropped because the link was closed
+	DroppedClosed uint64
+	// DroppedShutdown counts frames still queued when the queue stopped
+	DroppedShutdown uint64
+}
+
+// egressQueue writes frames to the link from a single goroutine so handlers
+// never block on the link.
+type egressQueue struct {
+	link   link.Link
+	batch  link.BatchWriter // nil when the link can't write batches
+	frames chan *egressFrame
+	pool   sync.Pool
+	stats  EgressStats
+
+	// buffers of run
+	pending []*egressFrame
+	bufs    [][]byte
+}
+
+type egressFrame struct {
+	buf []byte
+}
+
+func newEgressQueue(l link.Link, size int) *egressQueue {
+	q := &egressQueue{
+		link:    l,
+		frames:  make(chan *egressFrame, size),
+		pending: make([]*egressFrame, 0, egressBatchSize),
+		bufs:    make([][]byte, 0, egressBatchSize),
+	}
+	q.batch, _ = l.(link.BatchWriter)
+	return q
+}
+
+// enqueue copies frame to the queue.
+func (q *egressQueue) enqueue(frame []byte) error {
+	f, _ := q.pool.Get().(*egressFrame)
+	if f == nil {
+		f = &egressFrame{}
+	}
+	f.buf = append(f.buf[:0], frame...)
+
+	select {
+	case q.frames <- f:
+		return nil
+	default:
+		q.pool.Put(f)
+		atomic.AddUint64(&q.stats.DroppedQueueFull, 1)
+		return errEgressQueueFull
+	}
+}
+
+func (q *egressQueue) run(ctx context.Context) {
+	for {
+		var f *egressFrame
+
+		select {
+		case f = <-q.frames:
+		case <-ctx.Done():
+			q.drain()
+			return
+		}
+
+		// write whatever else is queued along with f
+		batch := append(q.pending[:0], f)
+	BATCH:
+		for len(batch) < egressBatchSize {
+			select {
+			case f = <-q.frames:
+				batch = append(batch, f)
+			default:
+				break BATCH
+			}
+		}
+
+		q.writeBatch(ctx, batch)
+	}
+}
+
+// drain drops the frames which are still queued.
+func (q *egressQueue) drain() {
+	for {
+		select {
+		case f := <-q.frames:
+			q.pool.Put(f)
+			atomic.AddUint64(&q.stats.DroppedShutdown, 1)
+		default:
+			return
+		}
+	}
+}
+
+// writeBatch writes batch to the link in a single call when the link
+// supports it. The frame a batch write fails on is retried on its own.
+func (q *egressQueue) writeBatch(ctx context.Context, batch []*egressFrame) {
+	for len(batch) > 0 {
+		if q.batch == nil || len(batch) == 1 {
+			q.write(ctx, batch[0])
+			batch = batch[1:]
+			continue
+		}
+
+		bufs := q.bufs[:0]
+		for _, f := range batch {
+			bufs = append(bufs, f.buf)
+		}
+		n, err := q.batch.WritePackets(bufs, 0)
+		for i := range bufs {
+			bufs[i] = nil
+		}
+
+		atomic.AddUint64(&q.stats.Written, uint64(n))
+		for _, f := range batch[:n] {
+			q.pool.Put(f)
+		}
+		if n == len(batch) {
+			return
+		}
+
+		q.retry(ctx, batch[n], err)
+		batch = batch[n+1:]
+	}
+}
+
+// write writes f to the link.
+func (q *egressQueue) write(ctx context.Context, f *egressFrame) {
+	_, err := q.link.WritePacket(f.buf, 0)
+	q.retry(ctx, f, err)
+}
+
+// retry handles err, the result of writing f. Transient errors are retried
+// with an exponential backoff.
+func (q *egressQueue) retry(ctx context.Context, f *egressFrame, err error) {
+	defer q.pool.Put(f)
+
+	backoff := egressMinBackoff
+	for attempt := 0; ; attempt++ {
+		if err == nil {
+			atomic.AddUint64(&q.stats.Written, 1)
+			return
+		}
+
+		if err == io.EOF {
+			atomic.AddUint64(&q.stats.DroppedClosed, 1)
+			return
+		}
+
+		if !link.IsTemporary(err) {
+			atomic.AddUint64(&q.stats.DroppedLinkError, 1)
+			log.Printf("LINK/error: %s", err)
+			return
+		}
+
+		if attempt == egressMaxRetries {
+			atomic.AddUint64(&q.stats.DroppedRetries, 1)
+			log.Printf("LINK/error: %s (gave up after %d retries)", err, attempt)
+			return
+		}
+
+		atomic.AddUint64(&q.stats.Retried, 1)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			atomic.AddUint64(&q.stats.DroppedClosed, 1)
+			return
+		}
+
+		backoff *= 2
+		if backoff > egressMaxBackoff {
+			backoff = egressMaxBackoff
+		}
+
+		_, err = q.link.WritePacket(f.buf, 0)
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (q *egressQueue) Stats() EgressStats {
+	return EgressStats{
+		Written:          atomic.LoadUint64(&q.stats.Written),
+		Retried:          atomic.LoadUint64(&q.stats.Retried),
+		DroppedQueueFull: atomic.LoadUint64(&q.stats.DroppedQueueFull),
+		DroppedLinkError: atomic.LoadUint64(&q.stats.DroppedLinkError),
+		DroppedRetries:   atomic.LoadUint64(&q.stats.DroppedRetries),
+		DroppedClosed:    atomic.LoadUint64(&q.stats.DroppedClosed),
+		DroppedShutdown:  atomic.LoadUint64(&q.stats.DroppedShutdown),
+	}
+}
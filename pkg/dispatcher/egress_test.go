@@ -0,0 +1,146 @@
+package dispatcher
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/fd/switchboard/pkg/link"
+	"golang.org/x/net/context"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyLink fails each write with the next error in errs.
+type flakyLink struct {
+	testLink
+	errs []error
+}
+
+func (l *flakyLink) WritePacket(p []byte, flags uint32) (int, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		if err != nil {
+			return 0, err
+		}
+	}
+	return l.testLink.WritePacket(p, flags)
+}
+
+var _ link.Link = (*flakyLink)(nil)
+
+func TestEgressQueue(t *testing.T) {
+	l := &flakyLink{errs: []error{
+		temporaryError{}, temporaryError{}, nil, // retried
+		errors.New("broken"), // dropped
+		io.EOF,               // dropped
+	}}
+	for i := 0; i <= egressMaxRetries; i++ {
+		l.errs = append(l.errs, temporaryError{}) // given up
+	}
+
+	q := newEgressQueue(l, 2)
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		if err := q.enqueue([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		q.write(ctx, <-q.frames)
+	}
+
+	q.enqueue(nil)
+	q.enqueue(nil)
+	if err := q.enqueue(nil); err != errEgressQueueFull {
+		t.Fatalf("expected a full queue, got %v", err)
+	}
+
+	stats := q.Stats()
+	expected := EgressStats{
+		Written:          1,
+		Retried:          2 + egressMaxRetries,
+		DroppedQueueFull: 1,
+		DroppedLinkError: 1,
+		DroppedRetries:   1,
+		DroppedClosed:    1,
+	}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if len(l.frame) != 1 || l.frame[0] != 0 {
+		t.Fatalf("unexpected frame: %v", l.frame)
+	}
+}
+
+// batchLink writes at most limit frames per batch and fails the next one with
+// a temporary error.
+type batchLink struct {
+	testLink
+	limit   int
+	batches []int
+	singles int
+}
+
+func (l *batchLink) WritePackets(frames [][]byte, flags uint32) (int, error) {
+	l.batches = append(l.batches, len(frames))
+	if len(frames) > l.limit {
+		return l.limit, temporaryError{}
+	}
+	return len(frames), nil
+}
+
+func (l *batchLink) WritePacket(p []byte, flags uint32) (int, error) {
+	l.singles++
+	return l.testLink.WritePacket(p, flags)
+}
+
+var _ link.BatchWriter = (*batchLink)(nil)
+
+func TestEgressQueueBatch(t *testing.T) {
+	l := &batchLink{limit: 3}
+	q := newEgressQueue(l, 8)
+
+	for i := 0; i < 5; i++ {
+		q.enqueue([]byte{byte(i)})
+	}
+
+	var batch []*egressFrame
+	for i := 0; i < 5; i++ {
+		batch = append(batch, <-q.frames)
+	}
+	q.writeBatch(context.Background(), batch)
+
+	// frame 3 is retried on its own, frame 4 is the last of the batch
+	if len(l.batches) != 1 || l.batches[0] != 5 || l.singles != 2 {
+		t.Fatalf("unexpected writes: batches=%v singles=%d", l.batches, l.singles)
+	}
+	if stats := q.Stats(); stats.Written != 5 || stats.Retried != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if len(l.frame) != 1 || l.frame[0] != 4 {
+		t.Fatalf("unexpected frame: %v", l.frame)
+	}
+}
+
+func TestEgressQueueShutdown(t *testing.T) {
+	l := &testLink{}
+	q := newEgressQueue(l, 8)
+
+	for i := 0; i < 3; i++ {
+		q.enqueue([]byte{byte(i)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.run(ctx)
+
+	// run may write some frames before it notices the shutdown
+	stats := q.Stats()
+	if stats.Written+stats.DroppedShutdown != 3 || len(q.frames) != 0 {
+		t.Fatalf("expected all frames to be accounted for: %+v (%d queued)", stats, len(q.frames))
+	}
+}
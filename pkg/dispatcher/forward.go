@@ -0,0 +1,261 @@
+package dispatcher
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+
+	"github.com/fd/switchboard/pkg/fragments"
+	"github.com/fd/switchboard/pkg/routes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var errPacketTooBig = errors.New("packet too big")
+
+// transportLayer is a rewritten TCP or UDP header.
+type transportLayer interface {
+	gopacket.SerializableLayer
+	LayerContents() []byte
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}
+
+// forward writes pkt (a TCP or UDP packet) to the link as a packet of stream.
+// The headers are rewritten in place when possible, otherwise the packet is
+// serialized again.
+func (vnet *VNET) forward(pkt *Packet, srcMAC, dstMAC net.HardwareAddr, stream *routes.Stream) error {
+	if canRewriteInPlace(pkt, stream) {
+		rewriteInPlace(pkt, srcMAC, dstMAC, stream)
+		return vnet.writeFrame(pkt.data)
+	}
+
+	eth := *pkt.Eth
+	eth.SrcMAC = srcMAC
+	eth.DstMAC = dstMAC
+
+	if pkt.TCP != nil {
+		tcp := *pkt.TCP
+		tcp.SrcPort = layers.TCPPort(stream.SrcPort)
+		tcp.DstPort = layers.TCPPort(stream.DstPort)
+		return vnet.writeForwarded(pkt, &eth, stream.SrcIP, stream.DstIP, &tcp, pkt.TCP.Payload)
+	}
+
+	udp := *pkt.UDP
+	udp.SrcPort = layers.UDPPort(stream.SrcPort)
+	udp.DstPort = layers.UDPPort(stream.DstPort)
+	return vnet.writeForwarded(pkt, &eth, stream.SrcIP, stream.DstIP, &udp, pkt.UDP.Payload)
+}
+
+// canRewriteInPlace returns true when the frame of pkt can be turned into the
+// packet of stream without changing its size.
+func canRewriteInPlace(pkt *Packet, stream *routes.Stream) bool {
+	if pkt.reassembled || pkt.data == nil || pkt.Eth == nil {
+		return false
+	}
+	if pkt.TCP == nil && pkt.UDP == nil {
+		return false
+	}
+
+	v4 := stream.DstIP.To4() != nil
+	if v4 != (stream.SrcIP.To4() != nil) {
+		return false
+	}
+	if v4 {
+		return pkt.IPv4 != nil
+	}
+	return pkt.IPv6 != nil
+}
+
+// rewriteInPlace rewrites the addresses and ports in the frame of pkt and
+// updates the checksums incrementally.
+func rewriteInPlace(pkt *Packet, srcMAC, dstMAC net.HardwareAddr, stream *routes.Stream) {
+	var (
+		l4     []byte
+		sum    []byte
+		unused bool
+		ports  [4]byte
+	)
+
+	if pkt.TCP != nil {
+		l4 = pkt.TCP.Contents
+		sum = l4[16:18]
+	} else {
+		l4 = pkt.UDP.Contents
+		sum = l4[6:8]
+		// IPv4 UDP packets may omit the checksum
+		unused = sum[0] == 0 && sum[1] == 0 && pkt.IPv4 != nil
+	}
+
+	l4sum := binary.BigEndian.Uint16(sum)
+
+	binary.BigEndian.PutUint16(ports[0:], stream.SrcPort)
+	binary.BigEndian.PutUint16(ports[2:], stream.DstPort)
+	l4sum = checksumReplace(l4sum, l4[0:4], ports[:])
+	copy(l4[0:4], ports[:])
+
+	if pkt.IPv4 != nil {
+		var (
+			ip  = pkt.IPv4.Contents
+			src = stream.SrcIP.To4()
+			dst = stream.DstIP.To4()
+			ttl = [2]byte{64, ip[9]}
+		)
+
+		ipsum := binary.BigEndian.Uint16(ip[10:12])
+		ipsum = checksumReplace(ipsum, ip[8:10], ttl[:])
+		ipsum = checksumReplace(ipsum, ip[12:16], src)
+		ipsum = checksumReplace(ipsum, ip[16:20], dst)
+		l4sum = checksumReplace(l4sum, ip[12:16], src)
+		l4sum = checksumReplace(l4sum, ip[16:20], dst)
+
+		copy(ip[8:10], ttl[:])
+		copy(ip[12:16], src)
+		copy(ip[16:20], dst)
+		binary.BigEndian.PutUint16(ip[10:12], ipsum)
+
+	} else {
+		var (
+			ip  = pkt.IPv6.Contents
+			src = stream.SrcIP.To16()
+			dst = stream.DstIP.To16()
+		)
+
+		l4sum = checksumReplace(l4sum, ip[8:24], src)
+		l4sum = checksumReplace(l4sum, ip[24:40], dst)
+
+		ip[7] = 64
+		copy(ip[8:24], src)
+		copy(ip[24:40], dst)
+	}
+
+	if !unused {
+		if l4sum == 0 && pkt.UDP != nil {
+			l4sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(sum, l4sum)
+	}
+
+	// the addresses may refer to the frame itself
+	var macs [12]byte
+	copy(macs[0:6], dstMAC)
+	copy(macs[6:12], srcMAC)
+	copy(pkt.Eth.Contents[0:12], macs[:])
+}
+
+// checksumReplace updates the internet checksum sum for replacing old with
+// new (RFC 1624). old and new must have the same even length.
+func checksumReplace(sum uint16, old, new []byte) uint16 {
+	acc := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for acc > 0xffff {
+		acc = acc>>16 + acc&0xffff
+	}
+	return ^uint16(acc)
+}
+
+// writeForwarded writes the rewritten transport layer l4 (and its payload)
+// of pkt from srcIP to dstIP. The IP header fields of pkt which are not
+// rewritten are preserved. IPv4 packets which don't fit the link are
+// fragmented, unless fragmentation is not allowed, in which case the sender
+// is told the MTU.
+func (vnet *VNET) writeForwarded(pkt *Packet, eth *layers.Ethernet, srcIP, dstIP net.IP, l4 transportLayer, payload []byte) error {
+	var (
+		proto = layers.IPProtocolTCP
+		mtu   = vnet.link.MaxPacketSize() - 14
+		size  = len(l4.LayerContents()) + len(payload)
+	)
+
+	if l4.LayerType() == layers.LayerTypeUDP {
+		proto = layers.IPProtocolUDP
+	}
+
+	if dstIP.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip := layers.IPv4{
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+			Version:  4,
+			Protocol: proto,
+			TTL:      64,
+		}
+		if pkt.IPv4 != nil {
+			ip.TOS = pkt.IPv4.TOS
+			ip.Id = pkt.IPv4.Id
+			ip.Flags = pkt.IPv4.Flags & layers.IPv4DontFragment
+		}
+
+		l4.SetNetworkLayerForChecksum(&ip)
+
+		if 20+size <= mtu {
+			return vnet.writePacket(eth, &ip, l4, gopacket.Payload(payload))
+		}
+
+		if ip.Flags&layers.IPv4DontFragment != 0 {
+			vnet.writeICMPv4Error(pkt, vnet.system.ControllerIPv4(),
+				layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+				uint32(mtu))
+			return errPacketTooBig
+		}
+
+		return vnet.writeFragments(eth, &ip, l4, payload, mtu)
+	}
+
+	eth.EthernetType = layers.EthernetTypeIPv6
+	ip := layers.IPv6{
+		SrcIP:      srcIP.To16(),
+		DstIP:      dstIP.To16(),
+		Version:    6,
+		NextHeader: proto,
+		HopLimit:   64,
+	}
+	if pkt.IPv6 != nil {
+		ip.TrafficClass = pkt.IPv6.TrafficClass
+		ip.FlowLabel = pkt.IPv6.FlowLabel
+	}
+
+	l4.SetNetworkLayerForChecksum(&ip)
+
+	if 40+size > mtu {
+		vnet.writeICMPv6Error(pkt, vnet.network.ControllerIPv6(),
+			layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0),
+			uint32(mtu))
+		return errPacketTooBig
+	}
+
+	return vnet.writePacket(eth, &ip, l4, gopacket.Payload(payload))
+}
+
+// writeFragments fragments the datagram ip (carrying l4 and payload) so
+// each fragment fits in mtu.
+func (vnet *VNET) writeFragments(eth *layers.Ethernet, ip *layers.IPv4, l4 transportLayer, payload []byte, mtu int) error {
+	buf := getSerializeBuffer()
+	defer putSerializeBuffer(buf)
+
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	err := gopacket.SerializeLayers(buf, opts, l4, gopacket.Payload(payload))
+	if err != nil {
+		return err
+	}
+
+	if ip.Id == 0 {
+		ip.Id = uint16(rand.Intn(0xffff) + 1)
+	}
+
+	headers, payloads := fragments.Split(ip, buf.Bytes(), mtu)
+	for i := range headers {
+		err = vnet.writePacket(eth, &headers[i], gopacket.Payload(payloads[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
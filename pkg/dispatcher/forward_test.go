@@ -0,0 +1,370 @@
+package dispatcher
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/capture"
+	"github.com/fd/switchboard/pkg/config"
+	"github.com/fd/switchboard/pkg/fragments"
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/fd/switchboard/pkg/link"
+	"github.com/fd/switchboard/pkg/peers"
+	"github.com/fd/switchboard/pkg/ports"
+	"github.com/fd/switchboard/pkg/protocols"
+	"github.com/fd/switchboard/pkg/routes"
+	"github.com/fd/switchboard/pkg/rules"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+// testLink keeps the last frame written to it.
+type testLink struct {
+	frame []byte
+}
+
+func (l *testLink) ReadPacket(p []byte) (int, uint32, error) { return 0, 0, io.EOF }
+func (l *testLink) WritePacket(p []byte, flags uint32) (int, error) {
+	l.frame = append(l.frame[:0], p...)
+	return len(p), nil
+}
+func (l *testLink) MaxPacketSize() int             { return 1514 }
+func (l *testLink) HardwareAddr() net.HardwareAddr { return testControllerMAC }
+func (l *testLink) Events() <-chan link.Event      { return nil }
+func (l *testLink) Close() error                   { return nil }
+
+var (
+	testControllerMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	testGatewayMAC    = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+)
+
+func newTestVNET(t testing.TB) (*VNET, *testLink) {
+	_, ipv4, _ := net.ParseCIDR("172.18.0.0/16")
+	_, ipv6, _ := net.ParseCIDR("fd00:1::/48")
+
+	l := &testLink{}
+	p := ports.NewMapper()
+	vnet := &VNET{
+		link:    l,
+		ports:   p,
+		hosts:   hosts.NewController(p, ipv4, ipv6),
+		routes:  routes.NewController(p),
+		rules:   rules.NewController(p),
+		peers:   peers.NewController(),
+		system:  &System{},
+		capture: capture.NewHub(nil),
+		egress:  newEgressQueue(l, egressQueueSize),
+	}
+
+	vnet.system.SetControllerMAC(testControllerMAC)
+	vnet.system.SetGatewayMAC(testGatewayMAC)
+
+	_, err := vnet.hosts.AddHost(&hosts.Host{
+		ID:        "host",
+		Name:      "host",
+		IPv4Addrs: []net.IP{net.IPv4(172, 18, 0, 7).To4()},
+		IPv6Addrs: []net.IP{net.ParseIP("fd00:1::7")},
+		Up:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return vnet, l
+}
+
+// testNetwork returns the configuration of the network newTestVNET sets
+// up, with the given reject policy.
+func testNetwork(t testing.TB, policy string) config.Network {
+	conf, err := config.Parse(`network {
+  ipv4   = "172.18.0.0/16"
+  ipv6   = "fd00:1::/48"
+  policy = "` + policy + `"
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf.Network
+}
+
+func addTestRoute(t testing.TB, vnet *VNET, proto protocols.Protocol, src, dst, out net.IP) *routes.Route {
+	var r routes.Route
+	r.Protocol = proto
+	r.HostID = "host"
+	r.SetInboundSource(src, 50000)
+	r.SetInboundDestination(dst, 80)
+	r.SetOutboundDestination(out, 8080)
+
+	route, err := vnet.routes.AddRoute(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return route
+}
+
+func testFrame(t testing.TB, src, dst net.IP, l4 gopacket.SerializableLayer, size int) []byte {
+	eth := &layers.Ethernet{SrcMAC: testGatewayMAC, DstMAC: testControllerMAC}
+
+	var ip gopacket.NetworkLayer
+	if src.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip = &layers.IPv4{Version: 4, TTL: 12, TOS: 0x28, Id: 99, SrcIP: src.To4(), DstIP: dst.To4()}
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 12, FlowLabel: 7, SrcIP: src, DstIP: dst}
+	}
+
+	switch l := l4.(type) {
+	case *layers.TCP:
+		l.SetNetworkLayerForChecksum(ip)
+		if v4, ok := ip.(*layers.IPv4); ok {
+			v4.Protocol = layers.IPProtocolTCP
+		} else {
+			ip.(*layers.IPv6).NextHeader = layers.IPProtocolTCP
+		}
+	case *layers.UDP:
+		l.SetNetworkLayerForChecksum(ip)
+		if v4, ok := ip.(*layers.IPv4); ok {
+			v4.Protocol = layers.IPProtocolUDP
+		} else {
+			ip.(*layers.IPv6).NextHeader = layers.IPProtocolUDP
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		eth, ip.(gopacket.SerializableLayer), l4, gopacket.Payload(bytes.Repeat([]byte{0x5a}, size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeQueued writes the next queued frame to the link.
+func writeQueued(vnet *VNET) {
+	vnet.egress.write(context.Background(), <-vnet.egress.frames)
+}
+
+// nextFrame writes the next queued frame to the link and returns it.
+func nextFrame(t *testing.T, vnet *VNET, l *testLink) gopacket.Packet {
+	select {
+	case f := <-vnet.egress.frames:
+		vnet.egress.write(context.Background(), f)
+	case <-time.After(time.Second):
+		t.Fatal("expected a frame")
+	}
+	return gopacket.NewPacket(l.frame, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func decodeTestFrame(vnet *VNET, frame []byte) *Packet {
+	pkt := NewPacket(len(frame))
+	n := copy(pkt.buf, frame)
+	pkt.decode(pkt.buf[:n])
+	if pkt.IPv4 != nil {
+		pkt.DstHost = vnet.hosts.GetTable().LookupByIPv4(pkt.IPv4.DstIP)
+	} else if pkt.IPv6 != nil {
+		pkt.DstHost = vnet.hosts.GetTable().LookupByIPv6(pkt.IPv6.DstIP)
+	}
+	return pkt
+}
+
+// checkChecksums verifies the checksums of frame by serializing it again.
+func checkChecksums(t *testing.T, frame []byte) gopacket.Packet {
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+
+	var ls []gopacket.SerializableLayer
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		}
+		if s, ok := l.(gopacket.SerializableLayer); ok {
+			ls = append(ls, s)
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), frame[:len(buf.Bytes())]) {
+		t.Fatalf("bad checksums:\n%s", p.Dump())
+	}
+
+	return p
+}
+
+func TestForwardInPlaceTCPv4(t *testing.T) {
+	vnet, l := newTestVNET(t)
+
+	route := addTestRoute(t, vnet, protocols.TCP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), net.IPv4(10, 0, 0, 1))
+
+	frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true, Seq: 1, Ack: 2}, 100)
+
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+	writeQueued(vnet)
+
+	p := checkChecksums(t, l.frame)
+	eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	if !bytes.Equal(eth.SrcMAC, testControllerMAC) || !bytes.Equal(eth.DstMAC, testGatewayMAC) {
+		t.Fatalf("unexpected MACs: %s", eth.SrcMAC)
+	}
+	if !ip.SrcIP.Equal(route.Outbound.SrcIP) || !ip.DstIP.Equal(route.Outbound.DstIP) {
+		t.Fatalf("unexpected addresses: %s -> %s", ip.SrcIP, ip.DstIP)
+	}
+	if ip.TOS != 0x28 || ip.Id != 99 || ip.TTL != 64 {
+		t.Fatalf("unexpected header: %+v", ip)
+	}
+	if uint16(tcp.SrcPort) != route.Outbound.SrcPort || tcp.DstPort != 8080 {
+		t.Fatalf("unexpected ports: %d -> %d", tcp.SrcPort, tcp.DstPort)
+	}
+	if stats := route.Flow().Stats(); stats.RxBytes+stats.TxBytes != uint64(len(frame)) {
+		t.Fatalf("expected %d bytes, got %+v", len(frame), stats)
+	}
+}
+
+func TestForwardInPlaceUDPv6(t *testing.T) {
+	vnet, l := newTestVNET(t)
+
+	route := addTestRoute(t, vnet, protocols.UDP,
+		net.ParseIP("fd00:2::1"), net.ParseIP("fd00:1::7"), net.ParseIP("fd00:3::1"))
+
+	frame := testFrame(t, net.ParseIP("fd00:2::1"), net.ParseIP("fd00:1::7"),
+		&layers.UDP{SrcPort: 50000, DstPort: 80}, 33)
+
+	vnet.handleUDPForward(decodeTestFrame(vnet, frame), time.Now())
+	writeQueued(vnet)
+
+	p := checkChecksums(t, l.frame)
+	ip := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	udp := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+
+	if !ip.SrcIP.Equal(route.Outbound.SrcIP) || !ip.DstIP.Equal(route.Outbound.DstIP) {
+		t.Fatalf("unexpected addresses: %s -> %s", ip.SrcIP, ip.DstIP)
+	}
+	if ip.FlowLabel != 7 || ip.HopLimit != 64 {
+		t.Fatalf("unexpected header: %+v", ip)
+	}
+	if uint16(udp.SrcPort) != route.Outbound.SrcPort || udp.DstPort != 8080 {
+		t.Fatalf("unexpected ports: %d -> %d", udp.SrcPort, udp.DstPort)
+	}
+}
+
+func TestForwardReassembledUDPv4(t *testing.T) {
+	vnet, _ := newTestVNET(t)
+	vnet.fragments = fragments.NewReassembler(0)
+
+	route := addTestRoute(t, vnet, protocols.UDP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), net.IPv4(10, 0, 0, 1))
+
+	frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.UDP{SrcPort: 50000, DstPort: 80}, 3000)
+
+	vnet.handleUDPForward(reassembleTestFrame(t, vnet, frame), time.Now())
+
+	// the whole datagram is counted, not just its last fragment
+	if stats := route.Flow().Stats(); stats.RxBytes+stats.TxBytes != uint64(len(frame)) {
+		t.Fatalf("expected %d bytes, got %+v", len(frame), stats)
+	}
+	if n := len(vnet.egress.frames); n != 3 {
+		t.Fatalf("expected the datagram to be fragmented, got %d frames", n)
+	}
+}
+
+func TestDecodeIPv6HopByHop(t *testing.T) {
+	vnet, _ := newTestVNET(t)
+
+	eth := &layers.Ethernet{SrcMAC: testGatewayMAC, DstMAC: testControllerMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolIPv6HopByHop,
+		SrcIP: net.ParseIP("fd00:2::1"), DstIP: net.ParseIP("fd00:1::7")}
+	ip.HopByHop = &layers.IPv6HopByHop{}
+	ip.HopByHop.NextHeader = layers.IPProtocolUDP
+	ip.HopByHop.Options = []*layers.IPv6HopByHopOption{
+		{OptionType: 5, OptionData: []byte{0, 0}}, // router alert
+		{OptionType: 1}, // PadN
+	}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 80}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := decodeTestFrame(vnet, buf.Bytes())
+	if pkt.IPv6 == nil || pkt.UDP == nil || pkt.UDP.DstPort != 80 {
+		t.Fatalf("expected an IPv6 UDP packet, got %v", pkt.layers)
+	}
+	if pkt.DstHost == nil || pkt.DstHost.ID != "host" {
+		t.Fatalf("expected the packet to be for host")
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	vnet, _ := newTestVNET(b)
+
+	frame := testFrame(b, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true}, 1400)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		decodeTestFrame(vnet, frame).Release()
+	}
+}
+
+func BenchmarkForwardTCP(b *testing.B) {
+	vnet, _ := newTestVNET(b)
+
+	addTestRoute(b, vnet, protocols.TCP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), net.IPv4(10, 0, 0, 1))
+
+	frame := testFrame(b, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true}, 1400)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vnet.handleTCP(decodeTestFrame(vnet, frame), now)
+		writeQueued(vnet)
+	}
+}
+
+func BenchmarkForwardUDP(b *testing.B) {
+	vnet, _ := newTestVNET(b)
+
+	addTestRoute(b, vnet, protocols.UDP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), net.IPv4(10, 0, 0, 1))
+
+	frame := testFrame(b, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.UDP{SrcPort: 50000, DstPort: 80}, 1400)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vnet.handleUDPForward(decodeTestFrame(vnet, frame), now)
+		writeQueued(vnet)
+	}
+}
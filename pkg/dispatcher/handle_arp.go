@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"log"
 	"net"
-	"time"
 
 	"github.com/google/gopacket/layers"
 	"golang.org/x/net/context"
@@ -49,8 +48,9 @@ func (vnet *VNET) handleARPRequest(pkt *Packet) {
 	defer pkt.Release()
 	// log.Printf("ARP REQ: %08x %s\n", pkt.Flags, pkt.Dump())
 
-	if !bytes.Equal(pkt.Eth.DstMAC, layers.EthernetBroadcast[:]) {
-		// ignore; expect broadcast
+	if !bytes.Equal(pkt.Eth.DstMAC, layers.EthernetBroadcast[:]) &&
+		!bytes.Equal(pkt.Eth.DstMAC, vnet.system.ControllerMAC()) {
+		// ignore; expect broadcast or unicast (cache refresh) to the controller
 		return
 	}
 
@@ -69,25 +69,22 @@ func (vnet *VNET) handleARPRequest(pkt *Packet) {
 		return
 	}
 
-	if vnet.system.ControllerMAC() == nil {
-		return
-	}
-	if vnet.system.ControllerIPv4() == nil {
-		return
-	}
-	if vnet.system.GatewayMAC() == nil {
-		return
+	if vnet.system.GatewayMAC() == nil &&
+		bytes.Equal(pkt.ARP.SourceProtAddress, vnet.system.GatewayIPv4()) {
+		// the gateway address is known up front; learn its MAC
+		vnet.system.SetGatewayMAC(pkt.ARP.SourceHwAddress)
 	}
-	if vnet.system.GatewayIPv4() == nil {
+
+	if vnet.system.ControllerMAC() == nil {
 		return
 	}
-	if !bytes.Equal(pkt.ARP.DstProtAddress, vnet.system.ControllerIPv4()) {
+	if !vnet.ownsIPv4(pkt.ARP.DstProtAddress) {
 		return
 	}
 
 	eth := layers.Ethernet{
 		SrcMAC:       vnet.system.ControllerMAC(),
-		DstMAC:       vnet.system.GatewayMAC(),
+		DstMAC:       pkt.Eth.SrcMAC,
 		EthernetType: layers.EthernetTypeARP,
 	}
 	arp := layers.ARP{
@@ -98,35 +95,97 @@ func (vnet *VNET) handleARPRequest(pkt *Packet) {
 		DstHwAddress:      pkt.ARP.SourceHwAddress,
 		DstProtAddress:    pkt.ARP.SourceProtAddress,
 		SourceHwAddress:   vnet.system.ControllerMAC(),
-		SourceProtAddress: vnet.system.ControllerIPv4(),
+		SourceProtAddress: pkt.ARP.DstProtAddress,
 		Operation:         layers.ARPReply,
 	}
 
-	vnet.writePacket(&eth, &arp)
+	err := vnet.writePacket(&eth, &arp)
+	if err != nil {
+		log.Printf("ARP/error: %s", err)
+	}
 }
 
-func (vnet *VNET) handleARPReply(pkt *Packet) {
-	defer pkt.Release()
-	log.Printf("ARP REP: %08x %s\n", pkt.Flags, pkt.Dump())
+// ownsIPv4 returns true when the controller answers ARP requests for ip.
+// This is the controller address and the address of every host which is up,
+// except the gateway's (which belongs to the host OS).
+func (vnet *VNET) ownsIPv4(ip net.IP) bool {
+	if bytes.Equal(ip, vnet.system.ControllerIPv4()) {
+		return true
+	}
 
-	vnet.peers.AddPeer(
-		CloneIP(pkt.ARP.SourceProtAddress),
-		CloneHwAddress(pkt.ARP.SourceHwAddress))
+	host := vnet.hosts.GetTable().LookupByIPv4(ip)
+	return host != nil && host.Up && host.ID != vnet.network.GatewayID
 }
 
-func (vnet *VNET) lookupHarwareAddrForIP(ip net.IP) net.HardwareAddr {
-	addr := vnet.peers.Lookup(ip)
+// announceHosts sends a gratuitous ARP for every IPv4 address the controller
+// answers for, each time a host comes up or gets a new address.
+func (vnet *VNET) announceHosts(ctx context.Context) {
+	defer vnet.wg.Done()
+
+	vnet.system.WaitForControllerMAC()
+
+	announced := make(map[string]bool)
+
+	for {
+		changed := vnet.hosts.Changed()
 
-	for i := 0; i < 3 && addr == nil; i++ {
-		vnet.sendARPReuest(ip)
+		owned := make(map[string]bool, len(announced))
+		for _, host := range vnet.hosts.GetTable().Hosts() {
+			for _, ip := range host.IPv4Addrs {
+				if !vnet.ownsIPv4(ip) {
+					continue
+				}
 
-		for i := 0; i < 100 && addr == nil; i++ {
-			time.Sleep(10 * time.Millisecond)
-			addr = vnet.peers.Lookup(ip)
+				key := string(ip.To4())
+				owned[key] = true
+				if !announced[key] {
+					vnet.sendGratuitousARP(ip)
+				}
+			}
+		}
+		announced = owned
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
 		}
 	}
+}
+
+// sendGratuitousARP announces that ip is at the controller MAC.
+func (vnet *VNET) sendGratuitousARP(ip net.IP) {
+	eth := layers.Ethernet{
+		SrcMAC:       vnet.system.ControllerMAC(),
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+		SourceHwAddress:   vnet.system.ControllerMAC(),
+		SourceProtAddress: ip.To4(),
+		Operation:         layers.ARPRequest,
+	}
+
+	err := vnet.writePacket(&eth, &arp)
+	if err != nil {
+		log.Printf("ARP/error: %s", err)
+	}
+}
+
+func (vnet *VNET) handleARPReply(pkt *Packet) {
+	defer pkt.Release()
+	log.Printf("ARP REP: %08x %s is at %s\n", pkt.Flags,
+		net.IP(pkt.ARP.SourceProtAddress), net.HardwareAddr(pkt.ARP.SourceHwAddress))
 
-	return addr
+	ip := CloneIP(pkt.ARP.SourceProtAddress)
+	vnet.peers.AddPeer(ip, CloneHwAddress(pkt.ARP.SourceHwAddress))
+	vnet.neighborResolved(ip)
 }
 
 func (vnet *VNET) sendARPReuest(ip net.IP) {
@@ -15,6 +15,62 @@ import (
 	"golang.org/x/net/context"
 )
 
+// dhcpState is the state of the DHCP client (RFC 2131 section 4.4).
+type dhcpState uint8
+
+const (
+	dhcpInit dhcpState = iota
+	dhcpSelecting
+	dhcpRequesting
+	dhcpBound
+	dhcpRenewing
+	dhcpRebinding
+)
+
+var dhcpStateNames = [...]string{
+	dhcpInit:       "INIT",
+	dhcpSelecting:  "SELECTING",
+	dhcpRequesting: "REQUESTING",
+	dhcpBound:      "BOUND",
+	dhcpRenewing:   "RENEWING",
+	dhcpRebinding:  "REBINDING",
+}
+
+func (s dhcpState) String() string { return dhcpStateNames[s] }
+
+const (
+	// options which are not defined by godhcp
+	dhcpOptionLeaseTime     uint8 = 51
+	dhcpOptionRenewalTime   uint8 = 58
+	dhcpOptionRebindingTime uint8 = 59
+
+	// dhcpDefaultLeaseTime is used when the server doesn't send a lease time
+	dhcpDefaultLeaseTime = 1 * time.Hour
+	// dhcpInfiniteLeaseTime is the lease time of leases which never expire
+	dhcpInfiniteLeaseTime = 0xffffffff
+
+	dhcpMinBackoff = 4 * time.Second
+	dhcpMaxBackoff = 64 * time.Second
+	// dhcpMinRenewInterval is the minimum time between retransmissions while
+	// renewing or rebinding
+	dhcpMinRenewInterval = 60 * time.Second
+	// dhcpRequestAttempts is the number of times a REQUEST is sent before
+	// starting over
+	dhcpRequestAttempts = 4
+)
+
+// dhcpClient is the state of the DHCP client of the controller. It is only
+// used from the DHCP goroutine.
+type dhcpClient struct {
+	state    dhcpState
+	xid      uint32
+	started  time.Time // start of the current exchange
+	retry    time.Time // next retransmission
+	attempts int
+	offer    *dhcp.Message
+	lease    *DHCPLease
+}
+
 func (vnet *VNET) dispatchDHCP(ctx context.Context) chan<- *Packet {
 	var in = make(chan *Packet)
 
@@ -28,19 +84,17 @@ func (vnet *VNET) dispatchDHCP(ctx context.Context) chan<- *Packet {
 		ticker := time.NewTicker(100 * time.Millisecond)
 		defer ticker.Stop()
 
-	LOOP:
 		for {
 			select {
 
 			case pkt := <-in:
-				vnet.handleDHCP(pkt)
+				vnet.handleDHCP(pkt, time.Now())
 
 			case now := <-ticker.C:
-				if vnet.system.ControllerLastDHCPRenew().After(now.Add(-1 * time.Hour)) {
-					continue LOOP
+				if vnet.staticIPv4 {
+					continue
 				}
-
-				vnet.requestDHCPLease()
+				vnet.dhcpTick(now)
 
 			case <-ctx.Done():
 				return
@@ -51,30 +105,30 @@ func (vnet *VNET) dispatchDHCP(ctx context.Context) chan<- *Packet {
 	return in
 }
 
-func (vnet *VNET) handleDHCP(pkt *Packet) {
+func (vnet *VNET) handleDHCP(pkt *Packet, now time.Time) {
 	if pkt == nil || pkt.Eth == nil {
 		return
 	}
 
 	defer pkt.Release()
 
-	// tab := vnet.hosts.GetTable()
-	// controller := tab.LookupByName("controller")
-	// if controller == nil {
-	// 	return
-	// }
-
 	if !bytes.Equal(vnet.system.ControllerMAC(), pkt.Eth.DstMAC) {
 		return
 	}
 
 	msg, err := dhcp.ReadMessage(pkt.UDP.Payload)
 	if err != nil {
-		log.Printf("DCHP/error: %s", err)
+		log.Printf("DHCP/error: %s", err)
 		return
 	}
 
-	if msg.Type != dhcp.MessageTypeReply {
+	vnet.handleDHCPMessage(msg, pkt.Eth.SrcMAC, now)
+}
+
+func (vnet *VNET) handleDHCPMessage(msg *dhcp.Message, srcMAC net.HardwareAddr, now time.Time) {
+	c := &vnet.dhcp
+
+	if msg.Type != dhcp.MessageTypeReply || msg.TransactionID != c.xid {
 		return
 	}
 
@@ -85,122 +139,275 @@ func (vnet *VNET) handleDHCP(pkt *Packet) {
 
 	switch opt.Value[0] {
 	case dhcp.DHCPMessageTypeOffer:
-		log.Printf("DHCP/OFFER")
-		vnet.handleDHCPOffer(pkt, msg)
+		if c.state != dhcpSelecting || msg.YourIPAddress == nil {
+			return
+		}
+		log.Printf("DHCP/OFFER %s", msg.YourIPAddress)
+		c.offer = msg
+		c.state = dhcpRequesting
+		c.attempts = 0
+		vnet.sendDHCPRequest(now)
+
 	case dhcp.DHCPMessageTypeAck:
-		log.Printf("DHCP/ACK")
-		vnet.handleDHCPAck(pkt, msg)
+		if c.state != dhcpRequesting && c.state != dhcpRenewing && c.state != dhcpRebinding {
+			return
+		}
+		if msg.YourIPAddress == nil {
+			return
+		}
+		log.Printf("DHCP/ACK %s", msg.YourIPAddress)
+		vnet.bindDHCPLease(msg, srcMAC)
+
+	case dhcp.DHCPMessageTypeNak:
+		if c.state != dhcpRequesting && c.state != dhcpRenewing && c.state != dhcpRebinding {
+			return
+		}
+		log.Printf("DHCP/NAK while %s", c.state)
+		vnet.restartDHCP()
 	}
 }
 
-func (vnet *VNET) handleDHCPOffer(pkt *Packet, offer *dhcp.Message) {
-	if offer.YourIPAddress == nil {
-		return
-	}
+// dhcpTick retransmits messages and moves between the BOUND, RENEWING and
+// REBINDING states as the lease times pass.
+func (vnet *VNET) dhcpTick(now time.Time) {
+	c := &vnet.dhcp
 
-	msg := &dhcp.Message{}
+	switch c.state {
 
-	msg.ClientMAC = vnet.system.ControllerMAC()
+	case dhcpInit:
+		c.xid = rand.Uint32()
+		c.started = now
+		c.attempts = 0
+		c.state = dhcpSelecting
+		vnet.sendDHCPDiscover(now)
 
-	msg.Type = dhcp.MessageTypeRequest
-	msg.HardwareType = dhcp.MessageHardwareTypeEthernet
-	msg.HardwareAddressLength = 6
-	msg.Hops = 0
-	msg.TransactionID = offer.TransactionID
-	msg.Options = map[uint8]*dhcp.Option{
+	case dhcpSelecting:
+		if now.Before(c.retry) {
+			return
+		}
+		vnet.sendDHCPDiscover(now)
 
-		dhcp.OptionCodeDHCPMessageType: {
-			Value: []byte{dhcp.DHCPMessageTypeRequest},
-		},
+	case dhcpRequesting:
+		if now.Before(c.retry) {
+			return
+		}
+		if c.attempts >= dhcpRequestAttempts {
+			log.Printf("DHCP/error: no answer from %s", dhcpServerID(c.offer))
+			vnet.restartDHCP()
+			return
+		}
+		vnet.sendDHCPRequest(now)
 
-		dhcp.OptionCodeDHCPClientidentifier: {
-			Value: append([]byte{1}, msg.ClientMAC[:6]...),
-		},
+	case dhcpBound:
+		if c.lease.Renew.IsZero() || now.Before(c.lease.Renew) {
+			return
+		}
+		c.xid = rand.Uint32()
+		c.started = now
+		c.state = dhcpRenewing
+		vnet.sendDHCPRequest(now)
+
+	case dhcpRenewing:
+		if !now.Before(c.lease.Rebind) {
+			c.xid = rand.Uint32()
+			c.started = now
+			c.state = dhcpRebinding
+			vnet.sendDHCPRequest(now)
+			return
+		}
+		if now.Before(c.retry) {
+			return
+		}
+		vnet.sendDHCPRequest(now)
 
-		dhcp.OptionCodeDHCPRequestedIPAddress: {
-			Value: offer.YourIPAddress.To4(),
-		},
+	case dhcpRebinding:
+		if !now.Before(c.lease.Expiry) {
+			log.Printf("DHCP/error: lease of %s expired", c.lease.Addr)
+			vnet.restartDHCP()
+			return
+		}
+		if now.Before(c.retry) {
+			return
+		}
+		vnet.sendDHCPRequest(now)
 
-		dhcp.OptionCodeDHCPServerIdentifier: offer.Options[dhcp.OptionCodeDHCPServerIdentifier],
+	}
+}
 
-		dhcp.OptionCodeDHCPMaximumMessageSize: {
-			Value: []byte{2, 64}, // 576
-		},
+// restartDHCP drops the lease and starts over from the INIT state.
+func (vnet *VNET) restartDHCP() {
+	vnet.dhcp = dhcpClient{}
+	vnet.system.SetDHCPLease(nil)
+}
 
-		dhcp.OptionCodeDHCPParameterRequestList: {
-			Value: []byte{
-				dhcp.OptionCodeSubnetMask,
-				dhcp.OptionCodeRouter,
-				dhcp.OptionCodeDomainNameServer,
-				dhcp.OptionCodeHostName,
-				dhcp.OptionCodeDomainName,
-				dhcp.OptionCodeBroadcastAddress,
-				dhcp.OptionCodeNetworkTimeProtocolServers,
-			},
-		},
+func (vnet *VNET) bindDHCPLease(ack *dhcp.Message, srcMAC net.HardwareAddr) {
+	c := &vnet.dhcp
 
-		dhcp.OptionCodeDHCPVendorclassidentifier: {
-			Value: []byte("swtchbrd 1.23.1"),
-		},
+	lease := &DHCPLease{
+		Addr:      CloneIP(ack.YourIPAddress),
+		Server:    dhcpServerID(ack),
+		Obtained:  c.started,
+		serverMAC: CloneHwAddress(srcMAC),
+	}
+	if lease.Server == nil && c.lease != nil {
+		lease.Server = c.lease.Server
+	}
 
-		dhcp.OptionCodeEnd: {},
+	if opt := ack.Options[dhcp.OptionCodeSubnetMask]; opt != nil && len(opt.Value) == 4 {
+		lease.Mask = net.IPMask(append([]byte(nil), opt.Value...))
 	}
+	if ips := dhcpOptionIPs(ack, dhcp.OptionCodeRouter); len(ips) > 0 {
+		lease.Router = ips[0]
+	}
+	lease.DNS = dhcpOptionIPs(ack, dhcp.OptionCodeDomainNameServer)
 
-	ipv4 := &layers.IPv4{
-		SrcIP:    net.IPv4(0, 0, 0, 0),
-		DstIP:    net.IPv4(255, 255, 255, 255),
-		Version:  4,
-		Protocol: layers.IPProtocolUDP,
-		TTL:      64,
+	leaseTime, ok := dhcpOptionDuration(ack, dhcpOptionLeaseTime)
+	if !ok {
+		leaseTime = dhcpDefaultLeaseTime
+	}
+	if leaseTime >= 0 {
+		t1, ok := dhcpOptionDuration(ack, dhcpOptionRenewalTime)
+		if !ok || t1 < 0 || t1 > leaseTime {
+			t1 = leaseTime / 2
+		}
+		t2, ok := dhcpOptionDuration(ack, dhcpOptionRebindingTime)
+		if !ok || t2 < t1 || t2 > leaseTime {
+			t2 = leaseTime * 7 / 8
+		}
+		lease.Renew = lease.Obtained.Add(t1)
+		lease.Rebind = lease.Obtained.Add(t2)
+		lease.Expiry = lease.Obtained.Add(leaseTime)
 	}
 
-	udp := &layers.UDP{
-		SrcPort: layers.UDPPort(68),
-		DstPort: layers.UDPPort(67),
+	c.state = dhcpBound
+	c.offer = nil
+	c.lease = lease
+	vnet.system.SetDHCPLease(lease)
+
+	if lease.Expiry.IsZero() {
+		log.Printf("DHCP leased: %s", lease.Addr)
+	} else {
+		log.Printf("DHCP leased: %s (until %s)", lease.Addr, lease.Expiry.Format(time.RFC3339))
 	}
+}
 
-	udp.SetNetworkLayerForChecksum(ipv4)
+func (vnet *VNET) sendDHCPDiscover(now time.Time) {
+	c := &vnet.dhcp
 
-	err := vnet.writePacket(
-		&layers.Ethernet{
-			SrcMAC:       msg.ClientMAC,
-			DstMAC:       layers.EthernetBroadcast,
-			EthernetType: layers.EthernetTypeIPv4,
+	msg := vnet.newDHCPMessage(dhcp.DHCPMessageTypeDiscover, now)
+	msg.Options[dhcp.OptionCodeHostName] = &dhcp.Option{
+		Value: []byte("controller"),
+	}
+
+	c.attempts++
+	c.retry = now.Add(dhcpBackoff(c.attempts))
+
+	vnet.sendDHCPMessage(msg, layers.EthernetBroadcast, net.IPv4zero, net.IPv4bcast)
+}
+
+// sendDHCPRequest sends (or retransmits) the REQUEST of the current state.
+func (vnet *VNET) sendDHCPRequest(now time.Time) {
+	c := &vnet.dhcp
+
+	msg := vnet.newDHCPMessage(dhcp.DHCPMessageTypeRequest, now)
+	c.attempts++
+
+	switch c.state {
+
+	case dhcpRequesting:
+		msg.Options[dhcp.OptionCodeDHCPRequestedIPAddress] = &dhcp.Option{
+			Value: c.offer.YourIPAddress.To4(),
+		}
+		msg.Options[dhcp.OptionCodeDHCPServerIdentifier] = c.offer.Options[dhcp.OptionCodeDHCPServerIdentifier]
+		c.retry = now.Add(dhcpBackoff(c.attempts))
+		vnet.sendDHCPMessage(msg, layers.EthernetBroadcast, net.IPv4zero, net.IPv4bcast)
+
+	case dhcpRenewing:
+		// renew with the server which granted the lease
+		msg.ClientIPAdress = c.lease.Addr
+		c.retry = now.Add(dhcpRenewInterval(now, c.lease.Rebind))
+		vnet.sendDHCPMessage(msg, c.lease.serverMAC, c.lease.Addr, c.lease.Server)
+
+	case dhcpRebinding:
+		// renew with any server
+		msg.ClientIPAdress = c.lease.Addr
+		c.retry = now.Add(dhcpRenewInterval(now, c.lease.Expiry))
+		vnet.sendDHCPMessage(msg, layers.EthernetBroadcast, c.lease.Addr, net.IPv4bcast)
+
+	}
+}
+
+// releaseDHCPLease gives the lease back to the server. The frame is written
+// directly to the link as it is sent while shutting down.
+func (vnet *VNET) releaseDHCPLease() {
+	lease := vnet.system.DHCPLease()
+	if lease == nil || lease.Server == nil {
+		return
+	}
+
+	msg := newDHCPMessage(dhcp.DHCPMessageTypeRelease, vnet.system.ControllerMAC(), rand.Uint32())
+	msg.ClientIPAdress = lease.Addr
+	msg.Options = map[uint8]*dhcp.Option{
+		dhcp.OptionCodeDHCPMessageType: {
+			Value: []byte{dhcp.DHCPMessageTypeRelease},
 		},
-		ipv4,
-		udp,
-		gopacket.Payload(writeDHCPMessage(msg)))
+		dhcp.OptionCodeDHCPServerIdentifier: {
+			Value: lease.Server.To4(),
+		},
+		dhcp.OptionCodeDHCPClientidentifier: {
+			Value: append([]byte{1}, msg.ClientMAC[:6]...),
+		},
+		dhcp.OptionCodeEnd: {},
+	}
+
+	buf := getSerializeBuffer()
+	defer putSerializeBuffer(buf)
+
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		dhcpLayers(msg, lease.serverMAC, lease.Addr, lease.Server)...)
 	if err != nil {
-		log.Printf("DCHP/error: %s", err)
+		log.Printf("DHCP/error: %s", err)
 		return
 	}
 
-	return
+	_, err = vnet.link.WritePacket(buf.Bytes(), 0)
+	if err != nil {
+		log.Printf("DHCP/error: %s", err)
+		return
+	}
+
+	log.Printf("DHCP released: %s", lease.Addr)
 }
 
-func (vnet *VNET) handleDHCPAck(pkt *Packet, ack *dhcp.Message) {
-	if ack.YourIPAddress == nil {
-		return
+// newDHCPMessage returns a message of the client of the current exchange.
+func (vnet *VNET) newDHCPMessage(typ uint8, now time.Time) *dhcp.Message {
+	c := &vnet.dhcp
+
+	msg := newDHCPMessage(typ, vnet.system.ControllerMAC(), c.xid)
+
+	secs := now.Sub(c.started) / time.Second
+	if secs > 0xffff {
+		secs = 0xffff
 	}
+	msg.SecondsElapsed = uint16(secs)
 
-	vnet.system.SetControllerIPv4(ack.YourIPAddress)
-	log.Printf("DCHP leased: %s", ack.YourIPAddress)
+	return msg
 }
 
-func (vnet *VNET) requestDHCPLease() {
+func newDHCPMessage(typ uint8, clientMAC net.HardwareAddr, xid uint32) *dhcp.Message {
 	msg := &dhcp.Message{}
 
-	msg.ClientMAC = vnet.system.ControllerMAC()
+	msg.ClientMAC = clientMAC
 
 	msg.Type = dhcp.MessageTypeRequest
 	msg.HardwareType = dhcp.MessageHardwareTypeEthernet
 	msg.HardwareAddressLength = 6
 	msg.Hops = 0
-	msg.TransactionID = rand.Uint32()
+	msg.TransactionID = xid
 	msg.Options = map[uint8]*dhcp.Option{
 
 		dhcp.OptionCodeDHCPMessageType: {
-			Value: []byte{dhcp.DHCPMessageTypeDiscover},
+			Value: []byte{typ},
 		},
 
 		dhcp.OptionCodeDHCPMaximumMessageSize: {
@@ -211,10 +418,6 @@ func (vnet *VNET) requestDHCPLease() {
 			Value: append([]byte{1}, msg.ClientMAC[:6]...),
 		},
 
-		dhcp.OptionCodeHostName: {
-			Value: []byte("controller"),
-		},
-
 		dhcp.OptionCodeDHCPParameterRequestList: {
 			Value: []byte{
 				dhcp.OptionCodeSubnetMask,
@@ -224,6 +427,9 @@ func (vnet *VNET) requestDHCPLease() {
 				dhcp.OptionCodeDomainName,
 				dhcp.OptionCodeBroadcastAddress,
 				dhcp.OptionCodeNetworkTimeProtocolServers,
+				dhcpOptionLeaseTime,
+				dhcpOptionRenewalTime,
+				dhcpOptionRebindingTime,
 			},
 		},
 
@@ -234,9 +440,20 @@ func (vnet *VNET) requestDHCPLease() {
 		dhcp.OptionCodeEnd: {},
 	}
 
+	return msg
+}
+
+func (vnet *VNET) sendDHCPMessage(msg *dhcp.Message, dstMAC net.HardwareAddr, srcIP, dstIP net.IP) {
+	err := vnet.writePacket(dhcpLayers(msg, dstMAC, srcIP, dstIP)...)
+	if err != nil {
+		log.Printf("DHCP/error: %s", err)
+	}
+}
+
+func dhcpLayers(msg *dhcp.Message, dstMAC net.HardwareAddr, srcIP, dstIP net.IP) []gopacket.SerializableLayer {
 	ipv4 := &layers.IPv4{
-		SrcIP:    net.IPv4(0, 0, 0, 0),
-		DstIP:    net.IPv4(255, 255, 255, 255),
+		SrcIP:    srcIP.To4(),
+		DstIP:    dstIP.To4(),
 		Version:  4,
 		Protocol: layers.IPProtocolUDP,
 		TTL:      64,
@@ -249,21 +466,75 @@ func (vnet *VNET) requestDHCPLease() {
 
 	udp.SetNetworkLayerForChecksum(ipv4)
 
-	err := vnet.writePacket(
+	return []gopacket.SerializableLayer{
 		&layers.Ethernet{
 			SrcMAC:       msg.ClientMAC,
-			DstMAC:       layers.EthernetBroadcast,
+			DstMAC:       dstMAC,
 			EthernetType: layers.EthernetTypeIPv4,
 		},
 		ipv4,
 		udp,
-		gopacket.Payload(writeDHCPMessage(msg)))
-	if err != nil {
-		log.Printf("DCHP/error: %s", err)
-		return
+		gopacket.Payload(writeDHCPMessage(msg)),
+	}
+}
+
+// dhcpBackoff is the time to wait before retransmitting for the nth time
+// (4s, 8s, ... up to 64s, randomized by one second).
+func dhcpBackoff(n int) time.Duration {
+	d := dhcpMinBackoff
+	for i := 1; i < n && d < dhcpMaxBackoff; i++ {
+		d *= 2
+	}
+	return d - time.Second + time.Duration(rand.Int63n(int64(2*time.Second)))
+}
+
+// dhcpRenewInterval is the time to wait before retransmitting a renewal:
+// half the time left until deadline but at least a minute.
+func dhcpRenewInterval(now, deadline time.Time) time.Duration {
+	d := deadline.Sub(now) / 2
+	if d < dhcpMinRenewInterval {
+		d = dhcpMinRenewInterval
+	}
+	return d
+}
+
+func dhcpServerID(msg *dhcp.Message) net.IP {
+	if msg == nil {
+		return nil
+	}
+	if ips := dhcpOptionIPs(msg, dhcp.OptionCodeDHCPServerIdentifier); len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
+
+// dhcpOptionIPs returns the list of IPv4 addresses in option code.
+func dhcpOptionIPs(msg *dhcp.Message, code uint8) []net.IP {
+	opt := msg.Options[code]
+	if opt == nil || len(opt.Value) < 4 {
+		return nil
 	}
 
-	return
+	ips := make([]net.IP, 0, len(opt.Value)/4)
+	for v := opt.Value; len(v) >= 4; v = v[4:] {
+		ips = append(ips, CloneIP(net.IP(v[:4])))
+	}
+	return ips
+}
+
+// dhcpOptionDuration returns the time in seconds in option code. Infinite
+// times are returned as -1.
+func dhcpOptionDuration(msg *dhcp.Message, code uint8) (time.Duration, bool) {
+	opt := msg.Options[code]
+	if opt == nil || len(opt.Value) != 4 {
+		return 0, false
+	}
+
+	secs := binary.BigEndian.Uint32(opt.Value)
+	if secs == dhcpInfiniteLeaseTime {
+		return -1, true
+	}
+	return time.Duration(secs) * time.Second, true
 }
 
 func writeUint32(w io.Writer, i uint32) {
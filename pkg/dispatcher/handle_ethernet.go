@@ -1,26 +1,13 @@
 package dispatcher
 
-import "golang.org/x/net/context"
+import (
+	"time"
 
-func (vnet *VNET) dispatchEthernet(ctx context.Context) chan<- *Packet {
-	var in = make(chan *Packet)
+	"golang.org/x/net/context"
+)
 
-	vnet.wg.Add(1)
-	go func() {
-		defer vnet.wg.Done()
-
-		for {
-			var pkt *Packet
-
-			select {
-			case pkt = <-in:
-			case <-ctx.Done():
-				return
-			}
-
-			vnet.dispatch(ctx, pkt)
-		}
-	}()
-
-	return in
+func (vnet *VNET) dispatchEthernet(ctx context.Context) *workerPool {
+	return vnet.startWorkers(ctx, networkHash, func(pkt *Packet, now time.Time) {
+		vnet.dispatch(ctx, pkt)
+	})
 }
@@ -2,6 +2,7 @@ package dispatcher
 
 import (
 	"log"
+	"net"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -41,7 +42,115 @@ func (vnet *VNET) handleICMP(pkt *Packet) {
 	if pkt.ICMPv4 != nil {
 		vnet.handleICMPv4(pkt)
 	} else if pkt.ICMPv6 != nil {
-		// vnet.handleICMPv6(pkt)
+		vnet.handleICMPv6(pkt)
+	}
+}
+
+func (vnet *VNET) handleICMPv6(pkt *Packet) {
+	switch pkt.ICMPv6.TypeCode.Type() {
+	case layers.ICMPv6TypeNeighborSolicitation:
+		vnet.handleNDPSolicitation(pkt)
+	case layers.ICMPv6TypeNeighborAdvertisement:
+		vnet.handleNDPAdvertisement(pkt)
+	case layers.ICMPv6TypeEchoRequest:
+		log.Printf("ICMPv6/ping/req: %s -> %s\n", pkt.IPv6.SrcIP, pkt.IPv6.DstIP)
+		vnet.handleICMPv6EchoRequest(pkt)
+	}
+}
+
+func (vnet *VNET) handleICMPv6EchoRequest(pkt *Packet) {
+	host := vnet.hosts.GetTable().LookupByIPv6(pkt.IPv6.DstIP)
+	if host == nil {
+		vnet.drop(pkt, DropNoHost, "")
+		vnet.writeICMPv6Unreachable(pkt, vnet.network.ControllerIPv6(), layers.ICMPv6CodeAddressUnreachable)
+		return
+	}
+	if !host.Up {
+		vnet.drop(pkt, DropHostDown, "")
+		vnet.writeICMPv6Unreachable(pkt, vnet.network.ControllerIPv6(), layers.ICMPv6CodeAddressUnreachable)
+		return
+	}
+
+	ip := layers.IPv6{
+		SrcIP:      pkt.IPv6.DstIP,
+		DstIP:      pkt.IPv6.SrcIP,
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   64,
+	}
+	icmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(&ip)
+
+	err := vnet.writePacket(
+		&layers.Ethernet{
+			SrcMAC:       vnet.system.ControllerMAC(),
+			DstMAC:       pkt.Eth.SrcMAC,
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		&ip,
+		&icmp,
+		gopacket.Payload(pkt.ICMPv6.Payload)) // identifier, sequence number and data
+	if err != nil {
+		log.Printf("ICMPv6/error: %s", err)
+		return
+	}
+}
+
+// writeICMPv6Unreachable sends a destination unreachable error (from src)
+// for pkt back to its sender.
+func (vnet *VNET) writeICMPv6Unreachable(pkt *Packet, src net.IP, code uint8) {
+	vnet.writeICMPv6Error(pkt, src,
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, code), 0)
+}
+
+// writeICMPv6Error sends an ICMPv6 error (from src) for pkt back to its
+// sender. rest is the type specific second word of the ICMPv6 header.
+func (vnet *VNET) writeICMPv6Error(pkt *Packet, src net.IP, tc layers.ICMPv6TypeCode, rest uint32) {
+	if pkt.IPv6 == nil || !vnet.network.IPv6Net().Contains(pkt.IPv6.DstIP) {
+		// only report on addresses we are responsible for
+		return
+	}
+	if pkt.IPv6.SrcIP.IsUnspecified() || pkt.IPv6.SrcIP.IsMulticast() {
+		return
+	}
+	if pkt.ICMPv6 != nil && pkt.ICMPv6.TypeCode.Type() < layers.ICMPv6TypeEchoRequest {
+		// never report errors about errors
+		return
+	}
+
+	// include as much of the offending packet as fits in the minimum MTU
+	invoking := pkt.IPv6.Contents
+	invoking = append(invoking[:len(invoking):len(invoking)], pkt.IPv6.Payload...)
+	if max := 1280 - 40 - 8; len(invoking) > max {
+		invoking = invoking[:max]
+	}
+
+	ip := layers.IPv6{
+		SrcIP:      src,
+		DstIP:      pkt.IPv6.SrcIP,
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   64,
+	}
+	icmp := layers.ICMPv6{
+		TypeCode: tc,
+	}
+	icmp.SetNetworkLayerForChecksum(&ip)
+
+	err := vnet.writePacket(
+		&layers.Ethernet{
+			SrcMAC:       vnet.system.ControllerMAC(),
+			DstMAC:       pkt.Eth.SrcMAC,
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		&ip,
+		&icmp,
+		gopacket.Payload([]byte{byte(rest >> 24), byte(rest >> 16), byte(rest >> 8), byte(rest)}),
+		gopacket.Payload(invoking))
+	if err != nil {
+		log.Printf("ICMPv6/error: %s", err)
 	}
 }
 
@@ -59,19 +168,14 @@ func (vnet *VNET) handleICMPv4(pkt *Packet) {
 
 func (vnet *VNET) handleICMPv4EchoRequest(pkt *Packet) {
 	host := vnet.hosts.GetTable().LookupByIPv4(pkt.IPv4.DstIP)
-	if host == nil {
-		log.Printf("ICMPv4: DST: %s (unknown)\n", pkt.IPv4.DstIP)
+	if host == nil || len(host.IPv4Addrs) == 0 {
+		vnet.drop(pkt, DropNoHost, "")
 		return
 	}
 	if !host.Up {
-		log.Printf("ICMPv4: DST: %s (down)\n", pkt.IPv4.DstIP)
-		return
-	}
-	if len(host.IPv4Addrs) == 0 {
-		log.Printf("ICMPv4: DST: %s (unknown)\n", pkt.IPv4.DstIP)
+		vnet.drop(pkt, DropHostDown, "")
 		return
 	}
-	log.Printf("ICMPv4: DST: %s (up)\n", pkt.IPv4.DstIP)
 
 	err := vnet.writePacket(
 		&layers.Ethernet{
@@ -2,39 +2,67 @@ package dispatcher
 
 import (
 	"bytes"
+	"log"
+	"time"
+
+	"github.com/fd/switchboard/pkg/fragments"
 
 	"golang.org/x/net/context"
 )
 
-func (vnet *VNET) dispatchIPv4(ctx context.Context) chan<- *Packet {
-	var in = make(chan *Packet)
-
-	vnet.wg.Add(1)
-	go func() {
-		defer vnet.wg.Done()
-
-		for {
-			var pkt *Packet
-
-			select {
-			case pkt = <-in:
-			case <-ctx.Done():
+func (vnet *VNET) dispatchIPv4(ctx context.Context) *workerPool {
+	return vnet.startWorkers(ctx, networkHash, func(pkt *Packet, now time.Time) {
+		if fragments.IsFragment(pkt.IPv4) {
+			if !vnet.reassemble(pkt, now) {
+				pkt.Release()
 				return
 			}
+		}
 
-			host := vnet.hosts.GetTable().LookupByIPv4(pkt.IPv4.DstIP)
-			if host == nil {
-				if bytes.Equal(pkt.IPv4.DstIP, vnet.system.ControllerIPv4()) {
-					pkt.DstHost = vnet.hosts.GetTable().LookupByName("controller")
-				}
-			} else {
-				pkt.DstHost = host
+		host := vnet.hosts.GetTable().LookupByIPv4(pkt.IPv4.DstIP)
+		if host == nil {
+			if bytes.Equal(pkt.IPv4.DstIP, vnet.system.ControllerIPv4()) {
+				pkt.DstHost = vnet.hosts.GetTable().LookupByName("controller")
 			}
+		} else {
+			pkt.DstHost = host
+		}
 
-			// fmt.Printf("IPv4: %08x %s\n", pkt.Flags, pkt.String())
-			vnet.dispatch(ctx, pkt)
+		if pkt.trace != nil {
+			pkt.trace.lookup(pkt.IPv4.DstIP, pkt.DstHost)
 		}
-	}()
 
-	return in
+		// fmt.Printf("IPv4: %08x %s\n", pkt.Flags, pkt.String())
+		vnet.dispatch(ctx, pkt)
+	})
+}
+
+// reassemble adds the fragment in pkt to the reassembler. It returns true
+// when pkt was replaced by the complete datagram.
+func (vnet *VNET) reassemble(pkt *Packet, now time.Time) bool {
+	ip, err := vnet.fragments.Add(pkt.IPv4, now)
+	if err != nil {
+		log.Printf("IPv4/error: %s", err)
+		vnet.drop(pkt, DropFragment, "")
+		return false
+	}
+	if ip == nil {
+		if pkt.trace != nil {
+			pkt.trace.step("fragment: waiting for the rest of the datagram")
+		}
+		return false
+	}
+
+	if pkt.trace != nil {
+		pkt.trace.step("fragment: reassembled %d bytes", len(ip.Payload))
+	}
+
+	pkt.IPv4 = ip
+	pkt.reassembled = true
+
+	err = pkt.decodeFrom(ip.NextLayerType(), ip.Payload)
+	if err != nil {
+		log.Printf("IPv4/error: %s", err)
+	}
+	return true
 }
@@ -0,0 +1,19 @@
+package dispatcher
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func (vnet *VNET) dispatchIPv6(ctx context.Context) *workerPool {
+	return vnet.startWorkers(ctx, networkHash, func(pkt *Packet, now time.Time) {
+		pkt.DstHost = vnet.hosts.GetTable().LookupByIPv6(pkt.IPv6.DstIP)
+
+		if pkt.trace != nil {
+			pkt.trace.lookup(pkt.IPv6.DstIP, pkt.DstHost)
+		}
+
+		vnet.dispatch(ctx, pkt)
+	})
+}
@@ -0,0 +1,217 @@
+package dispatcher
+
+import (
+	"bytes"
+	"log"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ndpFlagRouter    = 0x80
+	ndpFlagSolicited = 0x40
+	ndpFlagOverride  = 0x20
+)
+
+var (
+	ipv6Unspecified   = net.IPv6unspecified
+	ipv6AllNodes      = net.IPv6linklocalallnodes
+	ethIPv6AllNodes   = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+	ndpSolicitedNodes = net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, 0, 0, 0}
+)
+
+func (vnet *VNET) handleNDPSolicitation(pkt *Packet) {
+	ns, ok := pkt.neighborSolicitation()
+	if !ok {
+		return
+	}
+	if pkt.IPv6.HopLimit != 255 {
+		// ignore; not sent by a neighbor
+		return
+	}
+
+	var (
+		target = CloneIP(ns.TargetAddress)
+		srcMAC = ndpLinkLayerAddr(ns.Options, layers.ICMPv6OptSourceAddress)
+		dad    = pkt.IPv6.SrcIP.Equal(ipv6Unspecified)
+	)
+
+	if !dad && srcMAC != nil {
+		vnet.peers.AddPeer(CloneIP(pkt.IPv6.SrcIP), CloneHwAddress(srcMAC))
+	}
+
+	if vnet.system.ControllerMAC() == nil {
+		return
+	}
+	if !vnet.ownsIPv6(target) {
+		return
+	}
+
+	var (
+		dstIP  net.IP
+		dstMAC net.HardwareAddr
+		flags  uint8
+	)
+
+	if dad {
+		// somebody is probing one of our addresses; defend it
+		log.Printf("NDP/dad: %s probed by %s", target, pkt.Eth.SrcMAC)
+		dstIP = ipv6AllNodes
+		dstMAC = ethIPv6AllNodes
+		flags = ndpFlagOverride
+	} else {
+		dstIP = CloneIP(pkt.IPv6.SrcIP)
+		dstMAC = srcMAC
+		if dstMAC == nil {
+			dstMAC = pkt.Eth.SrcMAC
+		}
+		flags = ndpFlagSolicited | ndpFlagOverride
+	}
+
+	vnet.sendNDPAdvertisement(target, dstIP, CloneHwAddress(dstMAC), flags)
+}
+
+func (vnet *VNET) handleNDPAdvertisement(pkt *Packet) {
+	na, ok := pkt.neighborAdvertisement()
+	if !ok {
+		return
+	}
+	if pkt.IPv6.HopLimit != 255 {
+		// ignore; not sent by a neighbor
+		return
+	}
+
+	target := CloneIP(na.TargetAddress)
+	mac := ndpLinkLayerAddr(na.Options, layers.ICMPv6OptTargetAddress)
+	if mac == nil {
+		mac = pkt.Eth.SrcMAC
+	}
+
+	if bytes.Equal(mac, vnet.system.ControllerMAC()) {
+		// ignore; our own advertisement
+		return
+	}
+
+	if vnet.ownsIPv6(target) {
+		log.Printf("NDP/error: duplicate address %s (claimed by %s)", target, mac)
+		return
+	}
+
+	if vnet.system.GatewayMAC() == nil && target.Equal(vnet.network.GatewayIPv6()) {
+		// the gateway address is known up front; learn its MAC
+		vnet.system.SetGatewayMAC(mac)
+	}
+
+	vnet.peers.AddPeer(target, CloneHwAddress(mac))
+	vnet.neighborResolved(target)
+}
+
+// ownsIPv6 returns true when the controller answers neighbor solicitations
+// for ip. This is any host address except the gateway's (which belongs to
+// the host OS).
+//
+// Unlike ownsIPv4 this includes hosts which are down. IPv4 packets for a
+// down host still reach the controller through the subnet route to the
+// controller address, but IPv6 hosts are on-link and each address is
+// resolved with NDP. Without an answer the sender never sends the packets
+// the controller rejects with an ICMPv6 unreachable error. Their addresses
+// also stay reserved, so probes for them are defended.
+func (vnet *VNET) ownsIPv6(ip net.IP) bool {
+	host := vnet.hosts.GetTable().LookupByIPv6(ip)
+	return host != nil && host.ID != vnet.network.GatewayID
+}
+
+func (vnet *VNET) sendNDPAdvertisement(target, dstIP net.IP, dstMAC net.HardwareAddr, flags uint8) {
+	eth := layers.Ethernet{
+		SrcMAC:       vnet.system.ControllerMAC(),
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := layers.IPv6{
+		Version:    6,
+		SrcIP:      target,
+		DstIP:      dstIP,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+	}
+	icmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(&ip)
+	na := layers.ICMPv6NeighborAdvertisement{
+		Flags:         flags,
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptTargetAddress, Data: vnet.system.ControllerMAC()},
+		},
+	}
+
+	err := vnet.writePacket(&eth, &ip, &icmp, &na)
+	if err != nil {
+		log.Printf("NDP/error: %s", err)
+	}
+}
+
+// sendNDPSolicitation asks for the MAC address of target. When src is nil the
+// solicitation is a duplicate address detection probe.
+func (vnet *VNET) sendNDPSolicitation(src, target net.IP) {
+	dstIP := make(net.IP, net.IPv6len)
+	copy(dstIP, ndpSolicitedNodes)
+	copy(dstIP[13:], target.To16()[13:])
+
+	dstMAC := net.HardwareAddr{0x33, 0x33, dstIP[12], dstIP[13], dstIP[14], dstIP[15]}
+
+	eth := layers.Ethernet{
+		SrcMAC:       vnet.system.ControllerMAC(),
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := layers.IPv6{
+		Version:    6,
+		SrcIP:      src,
+		DstIP:      dstIP,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+	}
+	icmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(&ip)
+	ns := layers.ICMPv6NeighborSolicitation{
+		TargetAddress: target.To16(),
+	}
+
+	if src == nil {
+		// probes must not carry a source link-layer address
+		ip.SrcIP = ipv6Unspecified
+	} else {
+		ns.Options = layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: vnet.system.ControllerMAC()},
+		}
+	}
+
+	err := vnet.writePacket(&eth, &ip, &icmp, &ns)
+	if err != nil {
+		log.Printf("NDP/error: %s", err)
+	}
+}
+
+// detectDuplicateIPv6 probes the controller's IPv6 address. Conflicting
+// advertisements are logged by handleNDPAdvertisement.
+func (vnet *VNET) detectDuplicateIPv6() {
+	defer vnet.wg.Done()
+
+	vnet.system.WaitForControllerMAC()
+
+	vnet.sendNDPSolicitation(nil, vnet.network.ControllerIPv6())
+}
+
+func ndpLinkLayerAddr(opts layers.ICMPv6Options, typ layers.ICMPv6Opt) net.HardwareAddr {
+	for _, opt := range opts {
+		if opt.Type == typ && len(opt.Data) >= 6 {
+			return net.HardwareAddr(opt.Data[:6])
+		}
+	}
+	return nil
+}
@@ -6,40 +6,18 @@ import (
 	"net"
 	"time"
 
+	"github.com/fd/switchboard/pkg/ports"
 	"github.com/fd/switchboard/pkg/protocols"
 	"github.com/fd/switchboard/pkg/routes"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 
 	"golang.org/x/net/context"
 )
 
-func (vnet *VNET) dispatchTCP(ctx context.Context) chan<- *Packet {
-	var in = make(chan *Packet)
-
-	vnet.wg.Add(1)
-	go func() {
-		defer vnet.wg.Done()
-
-		var (
-			now    time.Time
-			ticker = time.NewTicker(1 * time.Second)
-		)
-
-		defer ticker.Stop()
-
-		for {
-			select {
-			case now = <-ticker.C:
-			case pkt := <-in:
-				vnet.handleTCP(pkt, now)
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	return in
+func (vnet *VNET) dispatchTCP(ctx context.Context) *workerPool {
+	return vnet.startWorkers(ctx, flowHash, func(pkt *Packet, now time.Time) {
+		vnet.handleTCP(pkt, now)
+	})
 }
 
 func (vnet *VNET) handleTCP(pkt *Packet, now time.Time) {
@@ -55,30 +33,23 @@ func (vnet *VNET) handleTCP(pkt *Packet, now time.Time) {
 	}
 
 	if pkt.DstHost == nil {
-		// ignore
+		vnet.drop(pkt, DropNoHost, "")
+		vnet.reject(pkt, nil, rejectHost)
 		return
 	}
 	if !pkt.DstHost.Up {
-		log.Printf("destination is down: %s", pkt.DstHost.Name)
-		// ignore
+		vnet.drop(pkt, DropHostDown, "")
+		vnet.reject(pkt, pkt.DstHost, rejectHost)
 		return
 	}
 
 	var (
-		srcIP   net.IP
-		dstIP   net.IP
-		srcPort = uint16(pkt.TCP.SrcPort)
-		dstPort = uint16(pkt.TCP.DstPort)
+		srcIP, dstIP = pkt.addrs()
+		srcPort      = uint16(pkt.TCP.SrcPort)
+		dstPort      = uint16(pkt.TCP.DstPort)
 	)
 
-	if pkt.IPv4 != nil {
-		srcIP = CloneIP(pkt.IPv4.SrcIP.To16())
-		dstIP = CloneIP(pkt.IPv4.DstIP.To16())
-	} else if pkt.IPv6 != nil {
-		srcIP = CloneIP(pkt.IPv6.SrcIP.To16())
-		dstIP = CloneIP(pkt.IPv6.DstIP.To16())
-	} else {
-		log.Printf("invalid protocol")
+	if srcIP == nil {
 		// ignore
 		return
 	}
@@ -88,51 +59,66 @@ func (vnet *VNET) handleTCP(pkt *Packet, now time.Time) {
 		srcIP, dstIP, srcPort, dstPort)
 
 	if route == nil {
+		// the addresses are kept by the new route
+		srcIP = CloneIP(srcIP)
+		dstIP = CloneIP(dstIP)
+
 		rule, found := vnet.rules.GetTable().Lookup(protocols.TCP, pkt.DstHost.ID, dstPort)
 		if !found {
-			log.Printf("no rule")
-			// ignore
+			vnet.drop(pkt, DropNoRule, "")
+			vnet.reject(pkt, pkt.DstHost, rejectPort)
 			return
 		}
 
+		if pkt.trace != nil {
+			pkt.trace.step("rule: matched %s", rule.ID)
+		}
+
 		var (
 			ruleDstIP   = rule.DstIP
 			ruleDstPort = rule.DstPort
 			hostIP      net.IP
 			hostPort    uint16
+			proxyRoute  *routes.Route
 		)
 
 		if ruleDstIP != nil {
 			hostIP = dstIP
-			hostPort, err = vnet.ports.Allocate(pkt.DstHost.ID, protocols.TCP, 0)
+			hostPort, err = vnet.ports.Allocate(pkt.DstHost.ID, protocols.TCP, 0, ports.OwnerRoute)
 			if err != nil {
-				// ignore
 				log.Printf("TCP/error: %s", err)
+				vnet.drop(pkt, DropRouteFailed, rule.ID)
 				return
 			}
 
 			var r routes.Route
 			r.Protocol = protocols.TCP
 			r.HostID = pkt.DstHost.ID
+			r.RuleID = rule.ID
 			r.SetInboundSource(hostIP, hostPort)
-			r.SetInboundDestination(vnet.system.GatewayIPv4(), vnet.proxy.TCPPort)
+			r.SetInboundDestination(vnet.gatewayIP(hostIP), vnet.proxy.TCPPort)
 			r.SetOutboundDestination(ruleDstIP, rule.DstPort)
-			route, err = vnet.routes.AddRoute(&r)
+			proxyRoute, err = vnet.routes.AddRoute(&r)
 			if err != nil {
-				// ignore
 				log.Printf("TCP/error: %s", err)
+				vnet.ports.Release(pkt.DstHost.ID, protocols.TCP, hostPort)
+				vnet.drop(pkt, DropRouteFailed, rule.ID)
 				return
 			}
 
-			ruleDstIP = vnet.system.GatewayIPv4()
+			if pkt.trace != nil {
+				pkt.trace.route("created proxy", proxyRoute)
+			}
+
+			ruleDstIP = vnet.gatewayIP(hostIP)
 			ruleDstPort = vnet.proxy.TCPPort
 		}
 
 		if ruleDstIP == nil {
 			gateway := vnet.hosts.GetTable().LookupByName("gateway")
 			if gateway == nil || !gateway.Up {
-				log.Printf("no gateway")
-				// ignore
+				vnet.drop(pkt, DropNoGateway, rule.ID)
+				vnet.reject(pkt, pkt.DstHost, rejectPort)
 				return
 			}
 
@@ -147,86 +133,75 @@ func (vnet *VNET) handleTCP(pkt *Packet, now time.Time) {
 			}
 		}
 		if ruleDstIP == nil {
-			log.Printf("no destination ip")
-			// ignore
+			vnet.drop(pkt, DropNoDestination, rule.ID)
+			vnet.reject(pkt, pkt.DstHost, rejectPort)
 			return
 		}
 
 		var r routes.Route
 		r.Protocol = protocols.TCP
 		r.HostID = pkt.DstHost.ID
+		r.RuleID = rule.ID
 		r.SetInboundSource(srcIP, srcPort)
 		r.SetInboundDestination(dstIP, dstPort)
 		r.SetOutboundSource(hostIP, hostPort)
 		r.SetOutboundDestination(ruleDstIP, ruleDstPort)
 		route, err = vnet.routes.AddRoute(&r)
 		if err != nil {
-			// ignore
 			log.Printf("TCP/error: %s", err)
+			if proxyRoute != nil {
+				// hostPort is the source of the proxy route; remove the
+				// route before the port can be handed out again
+				vnet.routes.Kill(proxyRoute)
+				vnet.ports.Release(pkt.DstHost.ID, protocols.TCP, hostPort)
+			}
+			vnet.drop(pkt, DropRouteFailed, rule.ID)
 			return
 		}
+
+		if pkt.trace != nil {
+			pkt.trace.route("created", route)
+		}
+	} else if pkt.trace != nil {
+		pkt.trace.route("reused", route)
 	}
 
-	if route == nil {
-		log.Printf("no route")
-		// ignore
+	dstMAC := vnet.nextHopMAC(route.Outbound.DstIP, pkt, vnet.workersTCP)
+	if dstMAC == nil {
 		return
 	}
 
-	var (
-		eth layers.Ethernet
-		tcp layers.TCP
-	)
-
-	eth = *pkt.Eth
-	eth.SrcMAC = vnet.system.ControllerMAC()
-	eth.DstMAC = vnet.system.GatewayMAC()
-
-	tcp = *pkt.TCP
-	tcp.SrcPort = layers.TCPPort(route.Outbound.SrcPort)
-	tcp.DstPort = layers.TCPPort(route.Outbound.DstPort)
-
-	if route.Outbound.DstIP.To4() != nil {
-		ip := layers.IPv4{
-			SrcIP:    route.Outbound.SrcIP.To4(),
-			DstIP:    route.Outbound.DstIP.To4(),
-			Version:  4,
-			Protocol: layers.IPProtocolTCP,
-			TTL:      64,
-		}
-
-		tcp.SetNetworkLayerForChecksum(&ip)
-
-		err = vnet.writePacket(
-			&eth,
-			&ip,
-			&tcp,
-			gopacket.Payload(pkt.TCP.Payload))
-		if err != nil {
-			log.Printf("TCP/error: %s", err)
-			return
-		}
+	err = vnet.forward(pkt, vnet.system.ControllerMAC(), dstMAC, &route.Outbound)
+	if err == errPacketTooBig {
+		vnet.drop(pkt, DropTooBig, "")
+		return
+	}
+	if err != nil {
+		log.Printf("TCP/error: %s", err)
+		vnet.drop(pkt, DropWriteFailed, "")
+		return
+	}
 
-	} else {
-		ip := layers.IPv6{
-			SrcIP:      route.Outbound.SrcIP.To16(),
-			DstIP:      route.Outbound.DstIP.To16(),
-			Version:    4,
-			NextHeader: layers.IPProtocolTCP,
-		}
+	if pkt.trace != nil {
+		pkt.trace.rewritten(&route.Outbound)
+	}
 
-		tcp.SetNetworkLayerForChecksum(&ip)
+	route.RoutedTCPPacket(now, pkt.size(), tcpFlags(pkt.TCP))
+}
 
-		err = vnet.writePacket(
-			&eth,
-			&ip,
-			&tcp,
-			gopacket.Payload(pkt.TCP.Payload))
-		if err != nil {
-			log.Printf("TCP/error: %s", err)
-			return
-		}
+func tcpFlags(tcp *layers.TCP) routes.TCPFlags {
+	var flags routes.TCPFlags
+	if tcp.SYN {
+		flags |= routes.TCPSyn
 	}
-
-	route.RoutedPacket(now, len(pkt.buf))
+	if tcp.ACK {
+		flags |= routes.TCPAck
+	}
+	if tcp.FIN {
+		flags |= routes.TCPFin
+	}
+	if tcp.RST {
+		flags |= routes.TCPRst
+	}
+	return flags
 }
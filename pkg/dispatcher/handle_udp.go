@@ -3,48 +3,24 @@ package dispatcher
 import (
 	"bytes"
 	"log"
-	"net"
 	"time"
 
 	"github.com/fd/switchboard/pkg/protocols"
 	"github.com/fd/switchboard/pkg/routes"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"golang.org/x/net/context"
 )
 
-func (vnet *VNET) dispatchUDP(ctx context.Context) chan<- *Packet {
-	var in = make(chan *Packet)
-
-	vnet.wg.Add(1)
-	go func() {
-		defer vnet.wg.Done()
-
-		var (
-			now    time.Time
-			ticker = time.NewTicker(1 * time.Second)
-		)
-
-		defer ticker.Stop()
-
-		for {
-			select {
-			case now = <-ticker.C:
-			case pkt := <-in:
-				vnet.handleUDP(ctx, pkt, now)
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	return in
+func (vnet *VNET) dispatchUDP(ctx context.Context) *workerPool {
+	return vnet.startWorkers(ctx, flowHash, func(pkt *Packet, now time.Time) {
+		vnet.handleUDP(ctx, pkt, now)
+	})
 }
 
 func (vnet *VNET) handleUDP(ctx context.Context, pkt *Packet, now time.Time) {
 
 	// DHCP
-	if pkt.UDP.DstPort == 68 {
+	if pkt.IPv4 != nil && pkt.UDP.DstPort == 68 {
 		select {
 		case vnet.chanDHCP <- pkt:
 		case <-ctx.Done():
@@ -68,30 +44,23 @@ func (vnet *VNET) handleUDPForward(pkt *Packet, now time.Time) {
 	}
 
 	if pkt.DstHost == nil {
-		// ignore
+		vnet.drop(pkt, DropNoHost, "")
+		vnet.reject(pkt, nil, rejectHost)
 		return
 	}
 	if !pkt.DstHost.Up {
-		log.Printf("destination is down: %s", pkt.DstHost.Name)
-		// ignore
+		vnet.drop(pkt, DropHostDown, "")
+		vnet.reject(pkt, pkt.DstHost, rejectHost)
 		return
 	}
 
 	var (
-		srcIP   net.IP
-		dstIP   net.IP
-		srcPort = uint16(pkt.UDP.SrcPort)
-		dstPort = uint16(pkt.UDP.DstPort)
+		srcIP, dstIP = pkt.addrs()
+		srcPort      = uint16(pkt.UDP.SrcPort)
+		dstPort      = uint16(pkt.UDP.DstPort)
 	)
 
-	if pkt.IPv4 != nil {
-		srcIP = CloneIP(pkt.IPv4.SrcIP.To16())
-		dstIP = CloneIP(pkt.IPv4.DstIP.To16())
-	} else if pkt.IPv6 != nil {
-		srcIP = CloneIP(pkt.IPv6.SrcIP.To16())
-		dstIP = CloneIP(pkt.IPv6.DstIP.To16())
-	} else {
-		log.Printf("invalid protocol")
+	if srcIP == nil {
 		// ignore
 		return
 	}
@@ -101,20 +70,28 @@ func (vnet *VNET) handleUDPForward(pkt *Packet, now time.Time) {
 		srcIP, dstIP, srcPort, dstPort)
 
 	if route == nil {
+		// the addresses are kept by the new route
+		srcIP = CloneIP(srcIP)
+		dstIP = CloneIP(dstIP)
+
 		rule, found := vnet.rules.GetTable().Lookup(protocols.UDP, pkt.DstHost.ID, dstPort)
 		if !found {
-			log.Printf("no rule")
-			// ignore
+			vnet.drop(pkt, DropNoRule, "")
+			vnet.reject(pkt, pkt.DstHost, rejectPort)
 			return
 		}
 
+		if pkt.trace != nil {
+			pkt.trace.step("rule: matched %s", rule.ID)
+		}
+
 		var ruleDstIP = rule.DstIP
 
 		if ruleDstIP == nil {
 			gateway := vnet.hosts.GetTable().LookupByName("gateway")
 			if gateway == nil || !gateway.Up {
-				log.Printf("no gateway")
-				// ignore
+				vnet.drop(pkt, DropNoGateway, rule.ID)
+				vnet.reject(pkt, pkt.DstHost, rejectPort)
 				return
 			}
 
@@ -129,84 +106,55 @@ func (vnet *VNET) handleUDPForward(pkt *Packet, now time.Time) {
 			}
 		}
 		if ruleDstIP == nil {
-			log.Printf("no destination ip")
-			// ignore
+			vnet.drop(pkt, DropNoDestination, rule.ID)
+			vnet.reject(pkt, pkt.DstHost, rejectPort)
+			return
+		}
+		if (ruleDstIP.To4() == nil) != (dstIP.To4() == nil) {
+			vnet.drop(pkt, DropFamilyMismatch, rule.ID)
 			return
 		}
 
 		var r routes.Route
 		r.Protocol = protocols.UDP
 		r.HostID = pkt.DstHost.ID
+		r.RuleID = rule.ID
 		r.SetInboundSource(srcIP, srcPort)
 		r.SetInboundDestination(dstIP, dstPort)
 		r.SetOutboundDestination(ruleDstIP, rule.DstPort)
 		route, err = vnet.routes.AddRoute(&r)
 		if err != nil {
-			// ignore
 			log.Printf("UDP/error: %s", err)
+			vnet.drop(pkt, DropRouteFailed, rule.ID)
 			return
 		}
+
+		if pkt.trace != nil {
+			pkt.trace.route("created", route)
+		}
+	} else if pkt.trace != nil {
+		pkt.trace.route("reused", route)
 	}
 
-	if route == nil {
-		log.Printf("no route")
-		// ignore
+	dstMAC := vnet.nextHopMAC(route.Outbound.DstIP, pkt, vnet.workersUDP)
+	if dstMAC == nil {
 		return
 	}
 
-	var (
-		eth layers.Ethernet
-		udp layers.UDP
-	)
-
-	eth = *pkt.Eth
-	eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
-
-	udp = *pkt.UDP
-	udp.SrcPort = layers.UDPPort(route.Outbound.SrcPort)
-	udp.DstPort = layers.UDPPort(route.Outbound.DstPort)
-
-	if route.Outbound.DstIP.To4() != nil {
-		ip := layers.IPv4{
-			SrcIP:    route.Outbound.SrcIP.To4(),
-			DstIP:    route.Outbound.DstIP.To4(),
-			Version:  4,
-			Protocol: layers.IPProtocolUDP,
-			TTL:      64,
-		}
-
-		udp.SetNetworkLayerForChecksum(&ip)
-
-		err = vnet.writePacket(
-			&eth,
-			&ip,
-			&udp,
-			gopacket.Payload(pkt.UDP.Payload))
-		if err != nil {
-			log.Printf("UDP/error: %s", err)
-			return
-		}
-
-	} else {
-		ip := layers.IPv6{
-			SrcIP:      route.Outbound.SrcIP.To16(),
-			DstIP:      route.Outbound.DstIP.To16(),
-			Version:    4,
-			NextHeader: layers.IPProtocolUDP,
-		}
-
-		udp.SetNetworkLayerForChecksum(&ip)
+	err = vnet.forward(pkt, vnet.system.ControllerMAC(), dstMAC, &route.Outbound)
+	if err == errPacketTooBig {
+		vnet.drop(pkt, DropTooBig, "")
+		return
+	}
+	if err != nil {
+		log.Printf("UDP/error: %s", err)
+		vnet.drop(pkt, DropWriteFailed, "")
+		return
+	}
 
-		err = vnet.writePacket(
-			&eth,
-			&ip,
-			&udp,
-			gopacket.Payload(pkt.UDP.Payload))
-		if err != nil {
-			log.Printf("UDP/error: %s", err)
-			return
-		}
+	if pkt.trace != nil {
+		pkt.trace.rewritten(&route.Outbound)
 	}
 
-	route.RoutedPacket(now, len(pkt.buf))
+	route.RoutedPacket(now, pkt.size())
 }
@@ -0,0 +1,62 @@
+//go:build darwin
+// +build darwin
+
+package dispatcher
+
+import (
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func hostAddIPv6Address(ifaceName string, ip string, prefixLen int) error {
+	// sudo ifconfig bridge100 inet6 fd4c:bd56:5cee:8000::1 prefixlen 48
+	return sudo("ifconfig", ifaceName, "inet6", ip, "prefixlen", strconv.Itoa(prefixLen))
+}
+
+func hostRouteIPv4Subnet(ifaceName string, subnet string, prev, via net.IP) error {
+	if prev != nil {
+		// the controller address changed; remove the route to the old one
+		// sudo route -n delete -net 172.18.0.0/16 192.168.128.7
+		err := sudo("route", "-n", "delete", "-net", subnet, prev.String())
+		if err != nil {
+			log.Printf("ROUTE/error: unable to remove the route via %s: %s", prev, err)
+		}
+	}
+
+	// sudo route -n add -net 172.18.0.0/16 192.168.128.8
+	err := sudo("route", "-n", "add", "-net", subnet, via.String())
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("ifconfig", ifaceName).Output()
+	if err != nil {
+		return err
+	}
+
+	var coIfaceName string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "member:") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "member:")
+		line = strings.TrimSpace(line)
+		if idx := strings.IndexByte(line, ' '); idx > 0 {
+			line = line[:idx]
+		}
+		coIfaceName = line
+		break
+	}
+
+	// sudo ifconfig bridge100 -hostfilter en4
+	return sudo("ifconfig", ifaceName, "-hostfilter", coIfaceName)
+}
+
+func sudo(args ...string) error {
+	log.Printf("exec: %v", args)
+	return exec.Command("sudo", args...).Run()
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package dispatcher
+
+import (
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+)
+
+func hostAddIPv6Address(ifaceName string, ip string, prefixLen int) error {
+	// sudo ip -6 addr replace fd4c:bd56:5cee:8000::1/48 dev tap0
+	return sudo("ip", "-6", "addr", "replace", ip+"/"+strconv.Itoa(prefixLen), "dev", ifaceName)
+}
+
+func hostRouteIPv4Subnet(ifaceName string, subnet string, prev, via net.IP) error {
+	// replacing the route also removes the one via prev
+	// sudo ip route replace 172.18.0.0/16 via 192.168.164.2 dev tap0
+	return sudo("ip", "route", "replace", subnet, "via", via.String(), "dev", ifaceName)
+}
+
+func sudo(args ...string) error {
+	log.Printf("exec: %v", args)
+	return exec.Command("sudo", args...).Run()
+}
@@ -0,0 +1,110 @@
+package dispatcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testICMPv6Echo(t *testing.T, vnet *VNET, src, dst net.IP) *Packet {
+	ip := &layers.IPv6{
+		Version:    6,
+		SrcIP:      src,
+		DstIP:      dst,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   64,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ip)
+
+	return decodeTestFrame(vnet, serializeTestLayers(t,
+		&layers.Ethernet{SrcMAC: testGatewayMAC, DstMAC: testControllerMAC, EthernetType: layers.EthernetTypeIPv6},
+		ip, icmp,
+		&layers.ICMPv6Echo{Identifier: 7, SeqNumber: 3},
+		gopacket.Payload("ping")))
+}
+
+func TestICMPv6Echo(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	vnet.network = testNetwork(t, "drop")
+
+	vnet.handleICMPv6(testICMPv6Echo(t, vnet, net.ParseIP("fd00:2::1"), net.ParseIP("fd00:1::7")))
+
+	p := nextFrame(t, vnet, l)
+	eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	icmp := p.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+
+	if !bytes.Equal(eth.SrcMAC, testControllerMAC) || !bytes.Equal(eth.DstMAC, testGatewayMAC) {
+		t.Fatalf("unexpected MACs: %s -> %s", eth.SrcMAC, eth.DstMAC)
+	}
+	if !ip.SrcIP.Equal(net.ParseIP("fd00:1::7")) || !ip.DstIP.Equal(net.ParseIP("fd00:2::1")) {
+		t.Fatalf("unexpected addresses: %s -> %s", ip.SrcIP, ip.DstIP)
+	}
+
+	// identifier 7, sequence number 3 and the data
+	if icmp.TypeCode.Type() != layers.ICMPv6TypeEchoReply ||
+		!bytes.Equal(icmp.Payload, []byte{0, 7, 0, 3, 'p', 'i', 'n', 'g'}) {
+		t.Fatalf("unexpected reply:\n%s", p.Dump())
+	}
+
+	checksum := icmp.Checksum
+	icmp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true},
+		icmp, gopacket.Payload(icmp.Payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icmp.Checksum != checksum {
+		t.Fatalf("bad checksum %04x (expected %04x)", checksum, icmp.Checksum)
+	}
+}
+
+func TestICMPv6Unreachable(t *testing.T) {
+	tests := []struct {
+		name   string
+		dst    net.IP
+		reason DropReason
+	}{
+		{"down", net.ParseIP("fd00:1::7"), DropHostDown},
+		{"unknown", net.ParseIP("fd00:1::8"), DropNoHost},
+	}
+
+	for _, test := range tests {
+		vnet, l := newTestVNET(t)
+		vnet.network = testNetwork(t, "drop")
+		if err := vnet.hosts.HostSetState("host", false); err != nil {
+			t.Fatal(err)
+		}
+
+		vnet.handleICMPv6(testICMPv6Echo(t, vnet, net.ParseIP("fd00:2::1"), test.dst))
+
+		p := nextFrame(t, vnet, l)
+		ip := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		icmp, _ := p.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		if icmp == nil || icmp.TypeCode != layers.CreateICMPv6TypeCode(
+			layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAddressUnreachable) {
+			t.Fatalf("%s: expected an address unreachable error:\n%s", test.name, p.Dump())
+		}
+		if !ip.SrcIP.Equal(vnet.network.ControllerIPv6()) || !ip.DstIP.Equal(net.ParseIP("fd00:2::1")) {
+			t.Fatalf("%s: unexpected addresses: %s -> %s", test.name, ip.SrcIP, ip.DstIP)
+		}
+
+		// the error carries the offending packet (after the unused word)
+		invoking := gopacket.NewPacket(icmp.Payload[4:], layers.LayerTypeIPv6, gopacket.Default)
+		if ip, _ := invoking.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ip == nil || !ip.DstIP.Equal(test.dst) {
+			t.Fatalf("%s: unexpected invoking packet:\n%s", test.name, invoking.Dump())
+		}
+
+		drops := vnet.Drops("")
+		if len(drops) != 1 || drops[0].Reason != test.reason {
+			t.Fatalf("%s: unexpected drops: %+v", test.name, drops)
+		}
+	}
+}
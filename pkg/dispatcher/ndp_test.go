@@ -0,0 +1,222 @@
+package dispatcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/config"
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/fd/switchboard/pkg/protocols"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+var testPeerIPv6 = net.ParseIP("fd00:1::9")
+
+func testNDPSolicitation(t *testing.T, vnet *VNET, src, target net.IP) *Packet {
+	dstIP := make(net.IP, net.IPv6len)
+	copy(dstIP, ndpSolicitedNodes)
+	copy(dstIP[13:], target[13:])
+
+	eth := &layers.Ethernet{
+		SrcMAC:       testPeerMAC,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, dstIP[12], dstIP[13], dstIP[14], dstIP[15]},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		SrcIP:      src,
+		DstIP:      dstIP,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ip)
+	ns := &layers.ICMPv6NeighborSolicitation{TargetAddress: target}
+	if !src.IsUnspecified() {
+		ns.Options = layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: testPeerMAC}}
+	}
+
+	return decodeTestFrame(vnet, serializeTestLayers(t, eth, ip, icmp, ns))
+}
+
+func testNDPAdvertisement(t *testing.T, vnet *VNET, target net.IP, mac net.HardwareAddr) *Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       testControllerMAC,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		SrcIP:      target,
+		DstIP:      vnet.network.ControllerIPv6(),
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ip)
+	na := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         ndpFlagSolicited | ndpFlagOverride,
+		TargetAddress: target,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: mac}},
+	}
+
+	return decodeTestFrame(vnet, serializeTestLayers(t, eth, ip, icmp, na))
+}
+
+func serializeTestLayers(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// nextNDPAdvertisement returns the next neighbor advertisement written by
+// vnet.
+func nextNDPAdvertisement(t *testing.T, vnet *VNET, l *testLink) (*layers.Ethernet, *layers.IPv6, *layers.ICMPv6NeighborAdvertisement) {
+	p := nextFrame(t, vnet, l)
+	na, _ := p.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if na == nil {
+		t.Fatalf("expected a neighbor advertisement:\n%s", p.Dump())
+	}
+	return p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet), p.Layer(layers.LayerTypeIPv6).(*layers.IPv6), na
+}
+
+func TestNDPSolicitation(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	vnet.network = config.Default().Network
+
+	_, err := vnet.hosts.AddHost(&hosts.Host{
+		ID:        vnet.network.GatewayID,
+		Name:      "gateway",
+		IPv6Addrs: []net.IP{net.ParseIP("fd00:1::1")},
+		Up:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vnet.handleNDPSolicitation(testNDPSolicitation(t, vnet, testPeerIPv6, net.ParseIP("fd00:1::7")))
+
+	eth, ip, na := nextNDPAdvertisement(t, vnet, l)
+	if !bytes.Equal(eth.SrcMAC, testControllerMAC) || !bytes.Equal(eth.DstMAC, testPeerMAC) {
+		t.Fatalf("unexpected MACs: %s -> %s", eth.SrcMAC, eth.DstMAC)
+	}
+	if !ip.SrcIP.Equal(net.ParseIP("fd00:1::7")) || !ip.DstIP.Equal(testPeerIPv6) || ip.HopLimit != 255 {
+		t.Fatalf("unexpected header: %+v", ip)
+	}
+	if !na.TargetAddress.Equal(net.ParseIP("fd00:1::7")) ||
+		na.Flags != ndpFlagSolicited|ndpFlagOverride ||
+		!bytes.Equal(ndpLinkLayerAddr(na.Options, layers.ICMPv6OptTargetAddress), testControllerMAC) {
+		t.Fatalf("unexpected advertisement: %+v", na)
+	}
+
+	// the sender is learned from the solicitation
+	if mac := vnet.peers.Lookup(testPeerIPv6); !bytes.Equal(mac, testPeerMAC) {
+		t.Fatalf("expected the peer to be learned, got %s", mac)
+	}
+
+	// addresses of hosts which are down are still answered (see ownsIPv6)
+	if err := vnet.hosts.HostSetState("host", false); err != nil {
+		t.Fatal(err)
+	}
+	vnet.handleNDPSolicitation(testNDPSolicitation(t, vnet, testPeerIPv6, net.ParseIP("fd00:1::7")))
+	if _, _, na := nextNDPAdvertisement(t, vnet, l); !na.TargetAddress.Equal(net.ParseIP("fd00:1::7")) {
+		t.Fatalf("unexpected advertisement: %+v", na)
+	}
+
+	// the gateway's and unknown addresses are not answered
+	vnet.handleNDPSolicitation(testNDPSolicitation(t, vnet, testPeerIPv6, net.ParseIP("fd00:1::1")))
+	vnet.handleNDPSolicitation(testNDPSolicitation(t, vnet, testPeerIPv6, net.ParseIP("fd00:1::8")))
+
+	if n := len(vnet.egress.frames); n != 0 {
+		t.Fatalf("expected no replies, got %d", n)
+	}
+}
+
+func TestNDPDuplicateAddress(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	vnet.network = config.Default().Network
+
+	// probes for our addresses are defended
+	vnet.handleNDPSolicitation(testNDPSolicitation(t, vnet, ipv6Unspecified, net.ParseIP("fd00:1::7")))
+
+	eth, ip, na := nextNDPAdvertisement(t, vnet, l)
+	if !bytes.Equal(eth.DstMAC, ethIPv6AllNodes) || !ip.DstIP.Equal(ipv6AllNodes) {
+		t.Fatalf("expected the advertisement to go to all nodes: %s %s", eth.DstMAC, ip.DstIP)
+	}
+	if !na.TargetAddress.Equal(net.ParseIP("fd00:1::7")) || na.Flags != ndpFlagOverride {
+		t.Fatalf("unexpected advertisement: %+v", na)
+	}
+
+	// the controller probes its own address
+	vnet.wg.Add(1)
+	go vnet.detectDuplicateIPv6()
+
+	p := nextFrame(t, vnet, l)
+	vnet.wg.Wait()
+
+	ns, _ := p.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if ns == nil || !ns.TargetAddress.Equal(vnet.network.ControllerIPv6()) || len(ns.Options) != 0 {
+		t.Fatalf("expected a probe for the controller address:\n%s", p.Dump())
+	}
+	if ip := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6); !ip.SrcIP.Equal(ipv6Unspecified) {
+		t.Fatalf("expected the probe to come from the unspecified address, got %s", ip.SrcIP)
+	}
+
+	// advertisements for our addresses by others are not learned
+	vnet.handleNDPAdvertisement(testNDPAdvertisement(t, vnet, net.ParseIP("fd00:1::7"), testPeerMAC))
+	if mac := vnet.peers.Lookup(net.ParseIP("fd00:1::7")); mac != nil {
+		t.Fatalf("expected the duplicate to be ignored, got %s", mac)
+	}
+}
+
+func TestNDPResolveNeighbor(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	vnet.network = config.Default().Network
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer vnet.wg.Wait()
+	defer cancel()
+	vnet.workersTCP = vnet.startWorkersN(ctx, 1, flowHash, vnet.handleTCP)
+
+	neighbor := net.ParseIP("fd4c:bd56:5cee::50")
+	addTestRoute(t, vnet, protocols.TCP,
+		net.ParseIP("fd00:2::1"), net.ParseIP("fd00:1::7"), neighbor)
+
+	frame := testFrame(t, net.ParseIP("fd00:2::1"), net.ParseIP("fd00:1::7"),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true}, 10)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	// the packet waits for the neighbor to answer
+	p := nextFrame(t, vnet, l)
+	ns, _ := p.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if ns == nil || !ns.TargetAddress.Equal(neighbor) ||
+		!bytes.Equal(ndpLinkLayerAddr(ns.Options, layers.ICMPv6OptSourceAddress), testControllerMAC) {
+		t.Fatalf("expected a solicitation for %s:\n%s", neighbor, p.Dump())
+	}
+
+	vnet.handleNDPAdvertisement(testNDPAdvertisement(t, vnet, neighbor, testPeerMAC))
+
+	if mac := vnet.peers.Lookup(neighbor); !bytes.Equal(mac, testPeerMAC) {
+		t.Fatalf("expected the neighbor to be learned, got %s", mac)
+	}
+
+	// the queued packet is sent to the neighbor
+	writeQueued(vnet)
+	p = checkChecksums(t, l.frame)
+	eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !bytes.Equal(eth.DstMAC, testPeerMAC) || !ip.DstIP.Equal(neighbor) {
+		t.Fatalf("unexpected frame:\n%s", p.Dump())
+	}
+}
@@ -9,15 +9,13 @@ import (
 	"github.com/google/gopacket/layers"
 )
 
-var bufPool sync.Pool
 var pktPool sync.Pool
 
 type Packet struct {
 	DstHost *hosts.Host
 	Flags   uint32
 
-	gopacket.Packet
-	layers []gopacket.Layer
+	layers []gopacket.LayerType
 	Eth    *layers.Ethernet
 	ARP    *layers.ARP
 	IPv4   *layers.IPv4
@@ -27,20 +25,58 @@ type Packet struct {
 	UDP    *layers.UDP
 	TCP    *layers.TCP
 	buf    []byte
+
+	// data is the frame in buf
+	data []byte
+	// reassembled is set when the network layer no longer refers to data
+	reassembled bool
+
+	// trace is set when the decisions for the packet are traced
+	trace *packetTrace
+
+	// the decoded layers are preallocated and reused with the packet
+	parser   *gopacket.DecodingLayerParser
+	decoders gopacket.DecodingLayerContainer
+	decoded  []gopacket.LayerType
+	decoding packetLayers
+
+	// scratch space for the IPv4-in-IPv6 form of the addresses
+	srcIP16 [16]byte
+	dstIP16 [16]byte
 }
 
+type packetLayers struct {
+	eth    layers.Ethernet
+	arp    layers.ARP
+	ipv4   layers.IPv4
+	ipv6   layers.IPv6
+	hbh    ipv6HopByHop
+	icmpv4 layers.ICMPv4
+	icmpv6 layers.ICMPv6
+	ns     layers.ICMPv6NeighborSolicitation
+	na     layers.ICMPv6NeighborAdvertisement
+	udp    layers.UDP
+	tcp    layers.TCP
+}
+
+// ipv6HopByHop makes layers.IPv6HopByHop a gopacket.DecodingLayer.
+type ipv6HopByHop struct {
+	layers.IPv6HopByHop
+}
+
+func (h *ipv6HopByHop) CanDecode() gopacket.LayerClass    { return layers.LayerTypeIPv6HopByHop }
+func (h *ipv6HopByHop) NextLayerType() gopacket.LayerType { return h.NextHeader.LayerType() }
+
 func NewPacket(bufSize int) *Packet {
 	pkt, _ := pktPool.Get().(*Packet)
 	if pkt == nil {
 		pkt = &Packet{}
 	}
 
-	buf, _ := bufPool.Get().([]byte)
-	if buf == nil || len(buf) < bufSize {
-		buf = make([]byte, bufSize)
+	if len(pkt.buf) < bufSize {
+		pkt.buf = make([]byte, bufSize)
 	}
 
-	pkt.buf = buf
 	return pkt
 }
 
@@ -49,15 +85,179 @@ func (pkt *Packet) Release() {
 		return
 	}
 
-	if pkt.buf != nil {
-		bufPool.Put(pkt.buf[:cap(pkt.buf)])
-		pkt.buf = nil
+	if pkt.trace != nil {
+		pkt.trace.finish(pkt)
+		pkt.trace = nil
 	}
 
-	*pkt = Packet{}
+	pkt.DstHost = nil
+	pkt.Flags = 0
+	pkt.layers = nil
+	pkt.Eth = nil
+	pkt.ARP = nil
+	pkt.IPv4 = nil
+	pkt.IPv6 = nil
+	pkt.ICMPv4 = nil
+	pkt.ICMPv6 = nil
+	pkt.UDP = nil
+	pkt.TCP = nil
+	pkt.data = nil
+	pkt.reassembled = false
+
 	pktPool.Put(pkt)
 }
 
+// clone returns a copy of pkt which shares no memory with it.
+func (pkt *Packet) clone() *Packet {
+	if pkt.data == nil {
+		return nil
+	}
+
+	size := len(pkt.data)
+	if pkt.reassembled {
+		size += len(pkt.IPv4.Contents) + len(pkt.IPv4.Payload)
+	}
+
+	c := NewPacket(size)
+	n := copy(c.buf, pkt.data)
+	c.decode(c.buf[:n])
+
+	if pkt.reassembled {
+		// the datagram is copied behind the frame it was completed by
+		dgram := c.buf[n:]
+		m := copy(dgram, pkt.IPv4.Contents)
+		m += copy(dgram[m:], pkt.IPv4.Payload)
+
+		ip := &c.decoding.ipv4
+		err := ip.DecodeFromBytes(dgram[:m], gopacket.NilDecodeFeedback)
+		if err != nil {
+			c.Release()
+			return nil
+		}
+		c.IPv4 = ip
+		c.reassembled = true
+		c.decodeFrom(ip.NextLayerType(), ip.Payload)
+	}
+
+	c.Flags = pkt.Flags
+	c.DstHost = pkt.DstHost
+	return c
+}
+
+// size returns the length of the frame pkt was received in. A reassembled
+// datagram counts as a single frame carrying all of it.
+func (pkt *Packet) size() int {
+	if pkt.reassembled {
+		return len(pkt.Eth.Contents) + len(pkt.IPv4.Contents) + len(pkt.IPv4.Payload)
+	}
+	return len(pkt.data)
+}
+
+// decode decodes the frame in data (which must be in buf) without
+// allocating new layers.
+func (pkt *Packet) decode(data []byte) error {
+	if pkt.parser == nil {
+		l := &pkt.decoding
+		pkt.decoders = gopacket.DecodingLayerArray(nil).
+			Put(&l.eth).Put(&l.arp).
+			Put(&l.ipv4).Put(&l.ipv6).Put(&l.hbh).
+			Put(&l.icmpv4).Put(&l.icmpv6).Put(&l.ns).Put(&l.na).
+			Put(&l.udp).Put(&l.tcp)
+		pkt.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet)
+		pkt.parser.SetDecodingLayerContainer(pkt.decoders)
+		pkt.parser.IgnoreUnsupported = true
+	}
+
+	pkt.data = data
+
+	err := pkt.parser.DecodeLayers(data, &pkt.decoded)
+	pkt.setLayers()
+	return err
+}
+
+// decodeFrom decodes data as a typ layer (and the layers it contains). It is
+// used to decode the payload of reassembled datagrams.
+func (pkt *Packet) decodeFrom(typ gopacket.LayerType, data []byte) error {
+	if pkt.decoders == nil {
+		return nil
+	}
+
+	_, err := pkt.decoders.LayersDecoder(typ, gopacket.NilDecodeFeedback)(data, &pkt.decoded)
+	pkt.setLayers()
+	return err
+}
+
+func (pkt *Packet) setLayers() {
+	l := &pkt.decoding
+
+	for _, typ := range pkt.decoded {
+		switch typ {
+		case layers.LayerTypeEthernet:
+			pkt.Eth = &l.eth
+		case layers.LayerTypeARP:
+			pkt.ARP = &l.arp
+		case layers.LayerTypeIPv4:
+			pkt.IPv4 = &l.ipv4
+		case layers.LayerTypeIPv6:
+			pkt.IPv6 = &l.ipv6
+		case layers.LayerTypeICMPv4:
+			pkt.ICMPv4 = &l.icmpv4
+		case layers.LayerTypeICMPv6:
+			pkt.ICMPv6 = &l.icmpv6
+		case layers.LayerTypeUDP:
+			pkt.UDP = &l.udp
+		case layers.LayerTypeTCP:
+			pkt.TCP = &l.tcp
+		}
+	}
+
+	pkt.layers = pkt.decoded
+}
+
+func (pkt *Packet) hasLayer(typ gopacket.LayerType) bool {
+	for _, t := range pkt.decoded {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// neighborSolicitation returns the decoded NDP neighbor solicitation.
+func (pkt *Packet) neighborSolicitation() (*layers.ICMPv6NeighborSolicitation, bool) {
+	return &pkt.decoding.ns, pkt.hasLayer(layers.LayerTypeICMPv6NeighborSolicitation)
+}
+
+// neighborAdvertisement returns the decoded NDP neighbor advertisement.
+func (pkt *Packet) neighborAdvertisement() (*layers.ICMPv6NeighborAdvertisement, bool) {
+	return &pkt.decoding.na, pkt.hasLayer(layers.LayerTypeICMPv6NeighborAdvertisement)
+}
+
+// addrs returns the source and destination addresses of pkt in their 16 byte
+// form. The addresses refer to pkt; clone them before keeping them.
+func (pkt *Packet) addrs() (src, dst net.IP) {
+	switch {
+	case pkt.IPv4 != nil:
+		src = ipv4To16(pkt.srcIP16[:], pkt.IPv4.SrcIP)
+		dst = ipv4To16(pkt.dstIP16[:], pkt.IPv4.DstIP)
+	case pkt.IPv6 != nil:
+		src = pkt.IPv6.SrcIP.To16()
+		dst = pkt.IPv6.DstIP.To16()
+	}
+	return src, dst
+}
+
+func ipv4To16(dst []byte, ip net.IP) net.IP {
+	if len(ip) == net.IPv6len {
+		return ip
+	}
+	copy(dst, v4InV6Prefix)
+	copy(dst[12:], ip)
+	return net.IP(dst)
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
 func CloneIP(ip net.IP) net.IP {
 	var dst net.IP
 
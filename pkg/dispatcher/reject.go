@@ -0,0 +1,200 @@
+package dispatcher
+
+import (
+	"log"
+	"net"
+
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type rejectReason uint8
+
+const (
+	// rejectHost is used when the destination host is unknown or down
+	rejectHost rejectReason = iota
+	// rejectPort is used when the host doesn't accept the port
+	rejectPort
+)
+
+// reject answers an undeliverable packet when the policy of host (or the
+// global policy for unknown hosts) is to reject. Refused TCP connections
+// are reset, all other packets get an ICMP unreachable error.
+func (vnet *VNET) reject(pkt *Packet, host *hosts.Host, reason rejectReason) {
+	policy := hosts.PolicyDefault
+	if host != nil {
+		policy = host.Policy
+	}
+	if policy == hosts.PolicyDefault {
+		policy = vnet.policy
+	}
+	if policy != hosts.PolicyReject {
+		return
+	}
+
+	if pkt.trace != nil {
+		pkt.trace.step("rejected")
+	}
+
+	if vnet.system.ControllerMAC() == nil {
+		return
+	}
+
+	switch {
+	case reason == rejectPort && pkt.TCP != nil:
+		vnet.writeTCPReset(pkt)
+
+	case pkt.IPv4 != nil:
+		if reason == rejectPort {
+			vnet.writeICMPv4Unreachable(pkt, pkt.IPv4.DstIP, layers.ICMPv4CodePort)
+		} else {
+			vnet.writeICMPv4Unreachable(pkt, vnet.system.ControllerIPv4(), layers.ICMPv4CodeHost)
+		}
+
+	case pkt.IPv6 != nil:
+		if reason == rejectPort {
+			vnet.writeICMPv6Unreachable(pkt, pkt.IPv6.DstIP, layers.ICMPv6CodePortUnreachable)
+		} else {
+			vnet.writeICMPv6Unreachable(pkt, vnet.network.ControllerIPv6(), layers.ICMPv6CodeAddressUnreachable)
+		}
+	}
+}
+
+// writeTCPReset resets the connection pkt belongs to.
+func (vnet *VNET) writeTCPReset(pkt *Packet) {
+	if pkt.IPv4 != nil && !vnet.network.IPv4Net().Contains(pkt.IPv4.DstIP) ||
+		pkt.IPv6 != nil && !vnet.network.IPv6Net().Contains(pkt.IPv6.DstIP) {
+		// only reset connections to addresses we are responsible for
+		return
+	}
+	if pkt.TCP.RST {
+		// never reset a reset
+		return
+	}
+
+	tcp := layers.TCP{
+		SrcPort: pkt.TCP.DstPort,
+		DstPort: pkt.TCP.SrcPort,
+		RST:     true,
+		Window:  0,
+	}
+
+	if pkt.TCP.ACK {
+		tcp.Seq = pkt.TCP.Ack
+	} else {
+		tcp.ACK = true
+		tcp.Ack = pkt.TCP.Seq + uint32(len(pkt.TCP.Payload))
+		if pkt.TCP.SYN {
+			tcp.Ack++
+		}
+		if pkt.TCP.FIN {
+			tcp.Ack++
+		}
+	}
+
+	eth := layers.Ethernet{
+		SrcMAC: vnet.system.ControllerMAC(),
+		DstMAC: pkt.Eth.SrcMAC,
+	}
+
+	var ip gopacket.SerializableLayer
+	if pkt.IPv4 != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{
+			SrcIP:    pkt.IPv4.DstIP,
+			DstIP:    pkt.IPv4.SrcIP,
+			Version:  4,
+			Protocol: layers.IPProtocolTCP,
+			TTL:      64,
+		}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{
+			SrcIP:      pkt.IPv6.DstIP,
+			DstIP:      pkt.IPv6.SrcIP,
+			Version:    6,
+			NextHeader: layers.IPProtocolTCP,
+			HopLimit:   64,
+		}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	}
+
+	err := vnet.writePacket(&eth, ip, &tcp)
+	if err != nil {
+		log.Printf("TCP/error: %s", err)
+	}
+}
+
+// writeICMPv4Unreachable sends a destination unreachable error (from src)
+// for pkt back to its sender.
+func (vnet *VNET) writeICMPv4Unreachable(pkt *Packet, src net.IP, code uint8) {
+	vnet.writeICMPv4Error(pkt, src,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, code), 0)
+}
+
+// writeICMPv4Error sends an ICMP error (from src) for pkt back to its sender.
+// rest is the type specific second word of the ICMP header.
+func (vnet *VNET) writeICMPv4Error(pkt *Packet, src net.IP, tc layers.ICMPv4TypeCode, rest uint32) {
+	if pkt.IPv4 == nil || !vnet.network.IPv4Net().Contains(pkt.IPv4.DstIP) {
+		// only report on addresses we are responsible for
+		return
+	}
+	if pkt.IPv4.SrcIP.IsUnspecified() || pkt.IPv4.SrcIP.IsMulticast() ||
+		pkt.IPv4.DstIP.IsMulticast() || pkt.IPv4.DstIP.Equal(net.IPv4bcast) {
+		return
+	}
+	if pkt.IPv4.FragOffset != 0 {
+		// only report on the first fragment
+		return
+	}
+	if pkt.ICMPv4 != nil && !icmpv4IsQuery(pkt.ICMPv4.TypeCode) {
+		// never report errors about errors
+		return
+	}
+
+	// include as much of the offending packet as fits in 576 bytes
+	invoking := pkt.IPv4.Contents
+	invoking = append(invoking[:len(invoking):len(invoking)], pkt.IPv4.Payload...)
+	if max := 576 - 20 - 8; len(invoking) > max {
+		invoking = invoking[:max]
+	}
+
+	err := vnet.writePacket(
+		&layers.Ethernet{
+			SrcMAC:       vnet.system.ControllerMAC(),
+			DstMAC:       pkt.Eth.SrcMAC,
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		&layers.IPv4{
+			SrcIP:    src,
+			DstIP:    pkt.IPv4.SrcIP,
+			Version:  4,
+			Protocol: layers.IPProtocolICMPv4,
+			TTL:      64,
+		},
+		&layers.ICMPv4{
+			TypeCode: tc,
+			Id:       uint16(rest >> 16),
+			Seq:      uint16(rest),
+		},
+		gopacket.Payload(invoking))
+	if err != nil {
+		log.Printf("ICMPv4/error: %s", err)
+	}
+}
+
+func icmpv4IsQuery(tc layers.ICMPv4TypeCode) bool {
+	switch tc.Type() {
+	case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply,
+		layers.ICMPv4TypeTimestampRequest, layers.ICMPv4TypeTimestampReply,
+		layers.ICMPv4TypeInfoRequest, layers.ICMPv4TypeInfoReply,
+		layers.ICMPv4TypeAddressMaskRequest, layers.ICMPv4TypeAddressMaskReply:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,200 @@
+package dispatcher
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testClientIP = net.IPv4(192, 168, 200, 1)
+
+// newTestRejectVNET returns a vnet with the global policy and the policy of
+// its host set.
+func newTestRejectVNET(t *testing.T, global string, policy hosts.Policy) (*VNET, *testLink) {
+	vnet, l := newTestVNET(t)
+	vnet.network = testNetwork(t, global)
+	vnet.policy, _ = hosts.ParsePolicy(global)
+	vnet.system.SetControllerIPv4(net.IPv4(172, 18, 0, 1))
+
+	if err := vnet.hosts.HostSetPolicy("host", policy); err != nil {
+		t.Fatal(err)
+	}
+	return vnet, l
+}
+
+func expectNoFrames(t *testing.T, vnet *VNET, what string) {
+	if n := len(vnet.egress.frames); n != 0 {
+		t.Fatalf("%s: expected no frames, got %d", what, n)
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	tests := []struct {
+		global string
+		host   hosts.Policy
+		reject bool
+	}{
+		{"drop", hosts.PolicyDefault, false},
+		{"reject", hosts.PolicyDefault, true},
+		{"drop", hosts.PolicyReject, true},
+		{"reject", hosts.PolicyDrop, false},
+	}
+
+	for _, test := range tests {
+		vnet, _ := newTestRejectVNET(t, test.global, test.host)
+
+		frame := testFrame(t, testClientIP, net.IPv4(172, 18, 0, 7),
+			&layers.TCP{SrcPort: 50000, DstPort: 81, SYN: true}, 0)
+		vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+		if n := len(vnet.egress.frames); (n == 1) != test.reject {
+			t.Errorf("global %s, host %s: expected reject=%v, got %d frames", test.global, test.host, test.reject, n)
+		}
+	}
+
+	// unknown hosts use the global policy
+	vnet, l := newTestRejectVNET(t, "reject", hosts.PolicyDrop)
+	frame := testFrame(t, testClientIP, net.IPv4(172, 18, 0, 8),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, SYN: true}, 0)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	p := nextFrame(t, vnet, l)
+	icmp, _ := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if icmp == nil || icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost) {
+		t.Fatalf("expected a host unreachable error:\n%s", p.Dump())
+	}
+}
+
+func TestRejectTCPReset(t *testing.T) {
+	vnet, l := newTestRejectVNET(t, "reject", hosts.PolicyDefault)
+
+	// connection attempts are refused
+	frame := testFrame(t, testClientIP, net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 81, SYN: true, Seq: 100}, 0)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	nextFrame(t, vnet, l)
+	p := checkChecksums(t, l.frame)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ip.SrcIP.Equal(net.IPv4(172, 18, 0, 7)) || !ip.DstIP.Equal(testClientIP) {
+		t.Fatalf("unexpected addresses: %s -> %s", ip.SrcIP, ip.DstIP)
+	}
+	if !tcp.RST || !tcp.ACK || tcp.Seq != 0 || tcp.Ack != 101 || tcp.SrcPort != 81 || tcp.DstPort != 50000 {
+		t.Fatalf("unexpected reset: %+v", tcp)
+	}
+
+	// segments of unknown connections are reset with their acknowledgment
+	frame = testFrame(t, testClientIP, net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 81, ACK: true, Seq: 100, Ack: 555}, 10)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	p = nextFrame(t, vnet, l)
+	tcp = p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !tcp.RST || tcp.ACK || tcp.Seq != 555 {
+		t.Fatalf("unexpected reset: %+v", tcp)
+	}
+
+	// resets are never reset
+	frame = testFrame(t, testClientIP, net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 81, RST: true}, 0)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+	expectNoFrames(t, vnet, "reset")
+
+	// connections to addresses outside the network are not ours to reset
+	frame = testFrame(t, testClientIP, net.IPv4(10, 0, 0, 1),
+		&layers.TCP{SrcPort: 50000, DstPort: 81, SYN: true}, 0)
+	pkt := decodeTestFrame(vnet, frame)
+	vnet.reject(pkt, vnet.hosts.GetTable().LookupByName("host"), rejectPort)
+	pkt.Release()
+	expectNoFrames(t, vnet, "outside address")
+}
+
+func TestRejectUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.IP
+		dst  net.IP
+		l4   gopacket.SerializableLayer
+		down bool
+
+		from net.IP // nil for the controller's IPv6 address
+		tc   gopacket.LayerType
+		code uint8
+	}{
+		{
+			name: "udp port",
+			src:  testClientIP, dst: net.IPv4(172, 18, 0, 7),
+			l4:   &layers.UDP{SrcPort: 50000, DstPort: 81},
+			from: net.IPv4(172, 18, 0, 7), tc: layers.LayerTypeICMPv4, code: layers.ICMPv4CodePort,
+		},
+		{
+			name: "udp6 port",
+			src:  net.ParseIP("fd00:2::1"), dst: net.ParseIP("fd00:1::7"),
+			l4:   &layers.UDP{SrcPort: 50000, DstPort: 81},
+			from: net.ParseIP("fd00:1::7"), tc: layers.LayerTypeICMPv6, code: layers.ICMPv6CodePortUnreachable,
+		},
+		{
+			name: "tcp down host",
+			src:  testClientIP, dst: net.IPv4(172, 18, 0, 7),
+			l4:   &layers.TCP{SrcPort: 50000, DstPort: 80, SYN: true},
+			down: true,
+			from: net.IPv4(172, 18, 0, 1), tc: layers.LayerTypeICMPv4, code: layers.ICMPv4CodeHost,
+		},
+		{
+			name: "udp6 down host",
+			src:  net.ParseIP("fd00:2::1"), dst: net.ParseIP("fd00:1::7"),
+			l4:   &layers.UDP{SrcPort: 50000, DstPort: 80},
+			down: true,
+			tc:   layers.LayerTypeICMPv6, code: layers.ICMPv6CodeAddressUnreachable,
+		},
+	}
+
+	for _, test := range tests {
+		vnet, l := newTestRejectVNET(t, "reject", hosts.PolicyDefault)
+		if test.down {
+			if err := vnet.hosts.HostSetState("host", false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pkt := decodeTestFrame(vnet, testFrame(t, test.src, test.dst, test.l4, 10))
+		if pkt.TCP != nil {
+			vnet.handleTCP(pkt, time.Now())
+		} else {
+			vnet.handleUDPForward(pkt, time.Now())
+		}
+
+		if test.from == nil {
+			test.from = vnet.network.ControllerIPv6()
+		}
+
+		p := nextFrame(t, vnet, l)
+		var (
+			from net.IP
+			code uint8
+			ok   bool
+		)
+		switch test.tc {
+		case layers.LayerTypeICMPv4:
+			icmp, _ := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			if ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ip != nil && icmp != nil {
+				from, code = ip.SrcIP, icmp.TypeCode.Code()
+				ok = icmp.TypeCode.Type() == layers.ICMPv4TypeDestinationUnreachable
+			}
+		case layers.LayerTypeICMPv6:
+			icmp, _ := p.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			if ip, _ := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ip != nil && icmp != nil {
+				from, code = ip.SrcIP, icmp.TypeCode.Code()
+				ok = icmp.TypeCode.Type() == layers.ICMPv6TypeDestinationUnreachable
+			}
+		}
+		if !ok || code != test.code || !from.Equal(test.from) {
+			t.Fatalf("%s: expected unreachable code %d from %s:\n%s", test.name, test.code, test.from, p.Dump())
+		}
+	}
+}
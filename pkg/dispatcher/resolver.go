@@ -0,0 +1,228 @@
+package dispatcher
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+const (
+	// resolveAttempts is the number of requests sent for an address
+	resolveAttempts = 3
+	// resolveInterval is the time between two requests for an address
+	resolveInterval = 1 * time.Second
+	// resolveQueueSize is the number of packets queued per address
+	resolveQueueSize = 32
+	// peerRefresh is how long before they expire peers are asked again
+	peerRefresh = 30 * time.Second
+)
+
+// resolver holds the packets waiting for the MAC address of their next hop.
+type resolver struct {
+	mtx     sync.Mutex
+	pending map[string]*resolution
+}
+
+type resolution struct {
+	ip       net.IP
+	attempts int
+	next     time.Time
+	queue    []pendingPacket
+}
+
+type pendingPacket struct {
+	pkt     *Packet
+	workers *workerPool
+}
+
+// nextHopMAC returns the MAC address a packet for ip is sent to. Neighbors
+// on the link are resolved, everything else goes through the gateway. When
+// the neighbor is not known yet a copy of pkt is queued, it is dispatched to
+// workers again once the neighbor answers and nil is returned.
+func (vnet *VNET) nextHopMAC(ip net.IP, pkt *Packet, workers *workerPool) net.HardwareAddr {
+	if !vnet.isNeighbor(ip) {
+		mac := vnet.system.GatewayMAC()
+		if mac == nil {
+			vnet.drop(pkt, DropNoNeighbor, "")
+		}
+		return mac
+	}
+
+	if mac := vnet.peers.Lookup(ip); mac != nil {
+		return mac
+	}
+
+	vnet.queueForResolution(ip, pkt, workers)
+	return nil
+}
+
+// isNeighbor returns true when ip is in the network but belongs to neither
+// a host nor the controller.
+func (vnet *VNET) isNeighbor(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ipnet := vnet.network.IPv4Net()
+		return ipnet != nil && ipnet.Contains(ip4) &&
+			!ip4.Equal(vnet.system.ControllerIPv4()) &&
+			vnet.hosts.GetTable().LookupByIPv4(ip4) == nil
+	}
+
+	ipnet := vnet.network.IPv6Net()
+	return ipnet != nil && ipnet.Contains(ip) &&
+		vnet.hosts.GetTable().LookupByIPv6(ip) == nil
+}
+
+func (vnet *VNET) queueForResolution(ip net.IP, pkt *Packet, workers *workerPool) {
+	clone := pkt.clone()
+	if clone == nil {
+		vnet.drop(pkt, DropNoNeighbor, "")
+		return
+	}
+
+	var (
+		r   = &vnet.resolver
+		key = string(ip.To16())
+	)
+
+	r.mtx.Lock()
+	res := r.pending[key]
+	first := res == nil
+	if first {
+		if r.pending == nil {
+			r.pending = make(map[string]*resolution)
+		}
+		res = &resolution{
+			ip:       CloneIP(ip),
+			attempts: 1,
+			next:     time.Now().Add(resolveInterval),
+		}
+		r.pending[key] = res
+	}
+	full := len(res.queue) >= resolveQueueSize
+	if !full {
+		res.queue = append(res.queue, pendingPacket{clone, workers})
+	}
+	r.mtx.Unlock()
+
+	if full {
+		clone.Release()
+		vnet.drop(pkt, DropQueueFull, "")
+		return
+	}
+
+	if pkt.trace != nil {
+		pkt.trace.step("neighbor: waiting for %s", ip)
+	}
+
+	if first {
+		vnet.sendNeighborRequest(ip)
+	}
+}
+
+// neighborResolved dispatches the packets which were waiting for ip to the
+// workers of their flow again.
+func (vnet *VNET) neighborResolved(ip net.IP) {
+	r := &vnet.resolver
+
+	r.mtx.Lock()
+	res := r.pending[string(ip.To16())]
+	if res != nil {
+		delete(r.pending, string(ip.To16()))
+	}
+	r.mtx.Unlock()
+
+	if res == nil {
+		return
+	}
+
+	for _, p := range res.queue {
+		if !p.workers.dispatch(p.pkt) {
+			vnet.drop(p.pkt, DropQueueFull, "")
+			p.pkt.Release()
+		}
+	}
+}
+
+// runResolver repeats the requests for unresolved neighbors, gives up on
+// them after resolveAttempts and keeps the known peers fresh.
+func (vnet *VNET) runResolver(ctx context.Context) {
+	defer vnet.wg.Done()
+
+	ticker := time.NewTicker(resolveInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			vnet.resolveTick(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (vnet *VNET) resolveTick(now time.Time) {
+	var (
+		r      = &vnet.resolver
+		retry  []net.IP
+		failed []*resolution
+	)
+
+	r.mtx.Lock()
+	for key, res := range r.pending {
+		if now.Before(res.next) {
+			continue
+		}
+		if res.attempts >= resolveAttempts {
+			delete(r.pending, key)
+			failed = append(failed, res)
+			continue
+		}
+		res.attempts++
+		res.next = now.Add(resolveInterval)
+		retry = append(retry, res.ip)
+	}
+	r.mtx.Unlock()
+
+	for _, ip := range retry {
+		vnet.sendNeighborRequest(ip)
+	}
+
+	for _, res := range failed {
+		for _, p := range res.queue {
+			vnet.neighborUnreachable(p.pkt)
+		}
+	}
+
+	if vnet.system.ControllerMAC() != nil {
+		for _, peer := range vnet.peers.Stale(now, peerRefresh) {
+			vnet.sendNeighborRequest(peer.IP)
+		}
+	}
+	vnet.peers.Sweep(now)
+}
+
+// neighborUnreachable drops pkt and tells its sender the destination is
+// unreachable.
+func (vnet *VNET) neighborUnreachable(pkt *Packet) {
+	defer pkt.Release()
+
+	vnet.drop(pkt, DropNoNeighbor, "")
+
+	switch {
+	case pkt.IPv4 != nil:
+		vnet.writeICMPv4Unreachable(pkt, vnet.system.ControllerIPv4(), layers.ICMPv4CodeHost)
+	case pkt.IPv6 != nil:
+		vnet.writeICMPv6Unreachable(pkt, vnet.network.ControllerIPv6(), layers.ICMPv6CodeAddressUnreachable)
+	}
+}
+
+func (vnet *VNET) sendNeighborRequest(ip net.IP) {
+	if ip.To4() != nil {
+		vnet.sendARPReuest(ip)
+	} else {
+		vnet.sendNDPSolicitation(vnet.network.ControllerIPv6(), ip)
+	}
+}
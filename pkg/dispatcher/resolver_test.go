@@ -0,0 +1,192 @@
+package dispatcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/config"
+	"github.com/fd/switchboard/pkg/fragments"
+	"github.com/fd/switchboard/pkg/protocols"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+var testNeighborIP = net.IPv4(172, 18, 0, 50)
+
+// newTestResolverVNET returns a vnet with a TCP packet waiting for
+// testNeighborIP. Resolved packets are handled by a TCP worker; cancel stops
+// it.
+func newTestResolverVNET(t *testing.T) (vnet *VNET, l *testLink, cancel func()) {
+	vnet, l = newTestVNET(t)
+	vnet.network = config.Default().Network
+	vnet.system.SetControllerIPv4(net.IPv4(172, 18, 0, 1))
+
+	ctx, stop := context.WithCancel(context.Background())
+	vnet.workersTCP = vnet.startWorkersN(ctx, 1, flowHash, vnet.handleTCP)
+	cancel = func() {
+		stop()
+		vnet.wg.Wait()
+	}
+
+	addTestRoute(t, vnet, protocols.TCP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), testNeighborIP)
+
+	frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true}, 10)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	// the packet waits for the neighbor to answer
+	arp := nextARP(t, vnet, l)
+	if arp.Operation != layers.ARPRequest || !net.IP(arp.DstProtAddress).Equal(testNeighborIP) {
+		t.Fatalf("unexpected request: %+v", arp)
+	}
+	if n := len(vnet.egress.frames); n != 0 {
+		t.Fatalf("expected no other frames, got %d", n)
+	}
+
+	return vnet, l, cancel
+}
+
+func TestResolveNeighbor(t *testing.T) {
+	vnet, l, cancel := newTestResolverVNET(t)
+	defer cancel()
+
+	reply := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   testPeerMAC,
+		SourceProtAddress: testNeighborIP.To4(),
+		DstHwAddress:      testControllerMAC,
+		DstProtAddress:    net.IPv4(172, 18, 0, 1).To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{},
+		&layers.Ethernet{SrcMAC: testPeerMAC, DstMAC: testControllerMAC, EthernetType: layers.EthernetTypeARP},
+		reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vnet.handleARPReply(decodeTestFrame(vnet, buf.Bytes()))
+
+	// the queued packet is sent to the neighbor by the worker of its flow
+	writeQueued(vnet)
+	p := checkChecksums(t, l.frame)
+	eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !bytes.Equal(eth.DstMAC, testPeerMAC) || !ip.DstIP.Equal(testNeighborIP) {
+		t.Fatalf("unexpected frame:\n%s", p.Dump())
+	}
+}
+
+func TestResolveNeighborTimeout(t *testing.T) {
+	vnet, l, cancel := newTestResolverVNET(t)
+	defer cancel()
+
+	now := time.Now()
+	for i := 1; i < resolveAttempts; i++ {
+		now = now.Add(resolveInterval)
+		vnet.resolveTick(now)
+		nextARP(t, vnet, l)
+	}
+
+	now = now.Add(resolveInterval)
+	vnet.resolveTick(now)
+
+	writeQueued(vnet)
+	p := gopacket.NewPacket(l.frame, layers.LayerTypeEthernet, gopacket.Default)
+	icmp, _ := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if icmp == nil || icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost) {
+		t.Fatalf("expected a host unreachable error:\n%s", p.Dump())
+	}
+
+	drops := vnet.Drops("host")
+	if len(drops) != 1 || drops[0].Reason != DropNoNeighbor {
+		t.Fatalf("unexpected drops: %+v", drops)
+	}
+}
+
+func TestNoGatewayMAC(t *testing.T) {
+	vnet, _ := newTestVNET(t)
+	vnet.network = config.Default().Network
+	vnet.system = &System{}
+	vnet.system.SetControllerMAC(testControllerMAC)
+
+	addTestRoute(t, vnet, protocols.TCP,
+		net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7), net.IPv4(8, 8, 8, 8))
+
+	frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true}, 10)
+	vnet.handleTCP(decodeTestFrame(vnet, frame), time.Now())
+
+	drops := vnet.Drops("host")
+	if len(drops) != 1 || drops[0].Reason != DropNoNeighbor {
+		t.Fatalf("unexpected drops: %+v", drops)
+	}
+}
+
+// reassembleTestFrame fragments the IPv4 datagram in frame and returns the
+// packet it is reassembled into.
+func reassembleTestFrame(t testing.TB, vnet *VNET, frame []byte) *Packet {
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+
+	headers, payloads := fragments.Split(ip, ip.Payload, 1500)
+	for i := range headers {
+		buf := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{SrcMAC: testGatewayMAC, DstMAC: testControllerMAC, EthernetType: layers.EthernetTypeIPv4},
+			&headers[i], gopacket.Payload(payloads[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkt := decodeTestFrame(vnet, buf.Bytes())
+		if vnet.reassemble(pkt, time.Now()) {
+			if !pkt.reassembled {
+				t.Fatal("expected a reassembled packet")
+			}
+			return pkt
+		}
+		pkt.Release()
+	}
+	t.Fatal("expected a reassembled packet")
+	return nil
+}
+
+func TestCloneReassembled(t *testing.T) {
+	vnet, _ := newTestVNET(t)
+	vnet.fragments = fragments.NewReassembler(0)
+
+	frame := testFrame(t, net.IPv4(192, 168, 200, 1), net.IPv4(172, 18, 0, 7),
+		&layers.UDP{SrcPort: 50000, DstPort: 53}, 3000)
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	datagram := ip.Payload
+
+	pkt := reassembleTestFrame(t, vnet, frame)
+
+	c := pkt.clone()
+	if c == nil {
+		t.Fatal("expected a clone")
+	}
+
+	// the clone doesn't refer to the datagram of the original
+	for i := range pkt.IPv4.Payload {
+		pkt.IPv4.Payload[i] = 0
+	}
+	pkt.Release()
+
+	if c.UDP == nil || c.UDP.DstPort != 53 || !c.IPv4.DstIP.Equal(net.IPv4(172, 18, 0, 7)) {
+		t.Fatalf("unexpected clone: %+v", c.IPv4)
+	}
+	if !bytes.Equal(c.UDP.Payload, datagram[8:]) {
+		t.Fatal("payload mismatch")
+	}
+	c.Release()
+}
@@ -15,6 +15,32 @@ type System struct {
 	controllerMAC           net.HardwareAddr
 	controllerIPv4          net.IP
 	controllerLastDHCPRenew time.Time
+	gatewayRemote           bool
+	dhcpLease               *DHCPLease
+
+	// controllerIPv4Changed is closed when the controller IPv4 address changes
+	controllerIPv4Changed chan struct{}
+}
+
+// DHCPLease is the lease of the controller IPv4 address.
+type DHCPLease struct {
+	Addr   net.IP
+	Mask   net.IPMask
+	Server net.IP
+	Router net.IP
+	DNS    []net.IP
+
+	// Obtained is the time the lease was requested
+	Obtained time.Time
+	// Renew is the time the lease is renewed with the server (T1)
+	Renew time.Time
+	// Rebind is the time the lease is renewed with any server (T2)
+	Rebind time.Time
+	// Expiry is the time the lease expires (zero for infinite leases)
+	Expiry time.Time
+
+	// serverMAC is the MAC address the ACK was received from
+	serverMAC net.HardwareAddr
 }
 
 // WaitForGatewayMAC waits until the gateway MAC addresses is known
@@ -85,6 +111,20 @@ func (sys *System) SetGatewayIPv4(addr net.IP) {
 	sys.cnd.Broadcast()
 }
 
+// GatewayRemote returns true when the gateway is not an interface of this host
+func (sys *System) GatewayRemote() bool {
+	sys.mtx.RLock()
+	defer sys.mtx.RUnlock()
+	return sys.gatewayRemote
+}
+
+// SetGatewayRemote marks the gateway as not being an interface of this host
+func (sys *System) SetGatewayRemote(remote bool) {
+	sys.mtx.Lock()
+	defer sys.mtx.Unlock()
+	sys.gatewayRemote = remote
+}
+
 // WaitForControllerMAC waits until the controller MAC addresses is known
 func (sys *System) WaitForControllerMAC() {
 	sys.mtx.RLock()
@@ -149,11 +189,37 @@ func (sys *System) SetControllerIPv4(addr net.IP) {
 		sys.cnd = sync.NewCond(sys.mtx.RLocker())
 	}
 
-	sys.controllerIPv4 = CloneIP(addr).To4()
+	sys.setControllerIPv4(addr)
 	sys.controllerLastDHCPRenew = time.Now()
 	sys.cnd.Broadcast()
 }
 
+// ControllerIPv4Changed returns a channel which is closed the next time the
+// controller IPv4 address changes.
+func (sys *System) ControllerIPv4Changed() <-chan struct{} {
+	sys.mtx.Lock()
+	defer sys.mtx.Unlock()
+
+	if sys.controllerIPv4Changed == nil {
+		sys.controllerIPv4Changed = make(chan struct{})
+	}
+	return sys.controllerIPv4Changed
+}
+
+// setControllerIPv4 must be called with the write lock held.
+func (sys *System) setControllerIPv4(addr net.IP) {
+	addr = CloneIP(addr).To4()
+	if addr.Equal(sys.controllerIPv4) {
+		return
+	}
+
+	sys.controllerIPv4 = addr
+	if sys.controllerIPv4Changed != nil {
+		close(sys.controllerIPv4Changed)
+		sys.controllerIPv4Changed = nil
+	}
+}
+
 // ControllerLastDHCPRenew returns the last time a DHCP negotiation was performed
 func (sys *System) ControllerLastDHCPRenew() time.Time {
 	sys.mtx.RLock()
@@ -161,6 +227,42 @@ func (sys *System) ControllerLastDHCPRenew() time.Time {
 	return sys.controllerLastDHCPRenew
 }
 
+// DHCPLease returns the lease of the controller IPv4 address (nil when the
+// address was not leased)
+func (sys *System) DHCPLease() *DHCPLease {
+	sys.mtx.RLock()
+	defer sys.mtx.RUnlock()
+
+	if sys.dhcpLease == nil {
+		return nil
+	}
+	lease := *sys.dhcpLease
+	return &lease
+}
+
+// SetDHCPLease sets the lease of the controller IPv4 address and the address
+// itself. When lease is nil the controller keeps its last address until a
+// new lease is acquired.
+func (sys *System) SetDHCPLease(lease *DHCPLease) {
+	sys.mtx.Lock()
+	defer sys.mtx.Unlock()
+
+	if sys.cnd == nil {
+		sys.cnd = sync.NewCond(sys.mtx.RLocker())
+	}
+
+	if lease == nil {
+		sys.dhcpLease = nil
+		return
+	}
+
+	l := *lease
+	sys.dhcpLease = &l
+	sys.setControllerIPv4(lease.Addr)
+	sys.controllerLastDHCPRenew = lease.Obtained
+	sys.cnd.Broadcast()
+}
+
 func (sys *System) ensureCondExistsInRLocker() {
 	sys.mtx.RUnlock()
 	sys.mtx.Lock()
@@ -0,0 +1,81 @@
+package dispatcher
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/config"
+	"github.com/fd/switchboard/pkg/hosts"
+	"golang.org/x/net/context"
+)
+
+func TestControllerIPv4Changed(t *testing.T) {
+	sys := &System{}
+
+	changed := sys.ControllerIPv4Changed()
+	sys.SetControllerIPv4(net.IPv4(192, 168, 64, 5))
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected the channel to be closed")
+	}
+
+	// setting the same address is not a change
+	changed = sys.ControllerIPv4Changed()
+	sys.SetDHCPLease(&DHCPLease{Addr: net.IPv4(192, 168, 64, 5)})
+
+	select {
+	case <-changed:
+		t.Fatal("expected the channel to stay open")
+	default:
+	}
+}
+
+func TestReconfigureControllerIPv4(t *testing.T) {
+	vnet, l := newTestVNET(t)
+	vnet.network = config.Default().Network
+	vnet.remoteGateway = true
+
+	_, err := vnet.hosts.AddHost(&hosts.Host{
+		ID:    vnet.network.ControllerID,
+		Name:  "controller",
+		Local: true,
+		Up:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer vnet.wg.Wait()
+	defer cancel()
+
+	vnet.system.SetControllerIPv4(net.IPv4(192, 168, 64, 5))
+	vnet.wg.Add(1)
+	go vnet.configureControllerIPv4(ctx)
+
+	arp := nextARP(t, vnet, l)
+	if !net.IP(arp.SourceProtAddress).Equal(net.IPv4(192, 168, 64, 5)) {
+		t.Fatalf("unexpected announcement: %+v", arp)
+	}
+
+	vnet.system.SetDHCPLease(&DHCPLease{Addr: net.IPv4(192, 168, 64, 9)})
+
+	arp = nextARP(t, vnet, l)
+	if !net.IP(arp.SourceProtAddress).Equal(net.IPv4(192, 168, 64, 9)) {
+		t.Fatalf("unexpected announcement: %+v", arp)
+	}
+
+	controller := vnet.hosts.GetTable().LookupByName("controller")
+	if len(controller.IPv4Addrs) != 1 || !controller.IPv4Addrs[0].Equal(vnet.network.ControllerIPv4()) {
+		t.Fatalf("unexpected controller addresses: %v", controller.IPv4Addrs)
+	}
+
+	select {
+	case <-vnet.egress.frames:
+		t.Fatal("expected no other frames")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
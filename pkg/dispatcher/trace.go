@@ -0,0 +1,200 @@
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fd/switchboard/pkg/capture"
+	"github.com/fd/switchboard/pkg/hosts"
+	"github.com/fd/switchboard/pkg/routes"
+)
+
+// Trace is the decision path of a single packet.
+type Trace struct {
+	Time    time.Time
+	HostID  string
+	Summary string
+	Steps   []string
+	Dropped DropReason
+}
+
+// TraceSubscription receives the traces of packets matching a filter.
+type TraceSubscription struct {
+	tracer  *tracer
+	filter  capture.Filter
+	c       chan *Trace
+	dropped uint64
+}
+
+type tracer struct {
+	active int32
+
+	mtx  sync.RWMutex
+	subs map[*TraceSubscription]struct{}
+}
+
+type packetTrace struct {
+	Trace
+	subs []*TraceSubscription
+}
+
+// Trace records the decision path of packets matching filter (all packets
+// when nil). At most size traces are buffered; when the subscriber falls
+// behind traces are dropped.
+func (vnet *VNET) Trace(filter capture.Filter, size int) *TraceSubscription {
+	return vnet.tracer.subscribe(filter, size)
+}
+
+func (t *tracer) subscribe(filter capture.Filter, size int) *TraceSubscription {
+	sub := &TraceSubscription{
+		tracer: t,
+		filter: filter,
+		c:      make(chan *Trace, size),
+	}
+
+	t.mtx.Lock()
+	if t.subs == nil {
+		t.subs = make(map[*TraceSubscription]struct{})
+	}
+	t.subs[sub] = struct{}{}
+	atomic.StoreInt32(&t.active, int32(len(t.subs)))
+	t.mtx.Unlock()
+
+	return sub
+}
+
+func (t *tracer) Active() bool {
+	return atomic.LoadInt32(&t.active) > 0
+}
+
+// start starts tracing pkt when it matches any of the subscriptions.
+func (t *tracer) start(pkt *Packet) {
+	var subs []*TraceSubscription
+
+	t.mtx.RLock()
+	for sub := range t.subs {
+		if sub.filter != nil && !sub.filter.Match(pkt.data) {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	t.mtx.RUnlock()
+
+	if len(subs) == 0 {
+		return
+	}
+
+	pkt.trace = &packetTrace{
+		Trace: Trace{
+			Time:    time.Now(),
+			Summary: summarizePacket(pkt),
+		},
+		subs: subs,
+	}
+}
+
+// C returns the channel the traces are delivered on.
+func (sub *TraceSubscription) C() <-chan *Trace {
+	return sub.c
+}
+
+// Dropped returns the number of traces dropped because the subscriber was
+// too slow.
+func (sub *TraceSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close stops the subscription.
+func (sub *TraceSubscription) Close() {
+	t := sub.tracer
+
+	t.mtx.Lock()
+	delete(t.subs, sub)
+	atomic.StoreInt32(&t.active, int32(len(t.subs)))
+	t.mtx.Unlock()
+}
+
+func (pt *packetTrace) step(format string, args ...interface{}) {
+	pt.Steps = append(pt.Steps, fmt.Sprintf(format, args...))
+}
+
+func (pt *packetTrace) lookup(ip net.IP, host *hosts.Host) {
+	switch {
+	case host == nil:
+		pt.step("host: %s is unknown", ip)
+	case host.Up:
+		pt.step("host: %s is %s (up)", ip, host.Name)
+	default:
+		pt.step("host: %s is %s (down)", ip, host.Name)
+	}
+}
+
+func (pt *packetTrace) route(action string, route *routes.Route) {
+	pt.step("route: %s %s", action, route)
+}
+
+func (pt *packetTrace) rewritten(stream *routes.Stream) {
+	pt.step("rewritten: %s > %s",
+		hostPort(stream.SrcIP, stream.SrcPort),
+		hostPort(stream.DstIP, stream.DstPort))
+}
+
+func (pt *packetTrace) drop(reason DropReason) {
+	pt.Dropped = reason
+	pt.step("dropped: %s", reason)
+}
+
+// finish delivers the trace to the subscribers.
+func (pt *packetTrace) finish(pkt *Packet) {
+	if pkt.DstHost != nil {
+		pt.HostID = pkt.DstHost.ID
+	}
+
+	for _, sub := range pt.subs {
+		trace := pt.Trace
+		select {
+		case sub.c <- &trace:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func summarizePacket(pkt *Packet) string {
+	var src, dst net.IP
+
+	switch {
+	case pkt.IPv4 != nil:
+		src, dst = pkt.IPv4.SrcIP, pkt.IPv4.DstIP
+	case pkt.IPv6 != nil:
+		src, dst = pkt.IPv6.SrcIP, pkt.IPv6.DstIP
+	case pkt.ARP != nil:
+		return fmt.Sprintf("ARP %s > %s", net.IP(pkt.ARP.SourceProtAddress), net.IP(pkt.ARP.DstProtAddress))
+	case pkt.Eth != nil:
+		return fmt.Sprintf("%s %s > %s", pkt.Eth.EthernetType, pkt.Eth.SrcMAC, pkt.Eth.DstMAC)
+	default:
+		return "unknown"
+	}
+
+	switch {
+	case pkt.TCP != nil:
+		return fmt.Sprintf("TCP %s > %s", hostPort(src, uint16(pkt.TCP.SrcPort)), hostPort(dst, uint16(pkt.TCP.DstPort)))
+	case pkt.UDP != nil:
+		return fmt.Sprintf("UDP %s > %s", hostPort(src, uint16(pkt.UDP.SrcPort)), hostPort(dst, uint16(pkt.UDP.DstPort)))
+	case pkt.ICMPv4 != nil:
+		return fmt.Sprintf("ICMPv4 %s > %s %s", src, dst, pkt.ICMPv4.TypeCode)
+	case pkt.ICMPv6 != nil:
+		return fmt.Sprintf("ICMPv6 %s > %s %s", src, dst, pkt.ICMPv6.TypeCode)
+	case pkt.IPv4 != nil:
+		return fmt.Sprintf("IPv4 %s > %s %s", src, dst, pkt.IPv4.Protocol)
+	default:
+		return fmt.Sprintf("IPv6 %s > %s %s", src, dst, pkt.IPv6.NextHeader)
+	}
+}
+
+func hostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), fmt.Sprint(port))
+}
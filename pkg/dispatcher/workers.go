@@ -0,0 +1,105 @@
+package dispatcher
+
+import (
+	"runtime"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// workerQueueSize is the number of packets a single worker can have pending.
+const workerQueueSize = 256
+
+// workerPool handles packets on a fixed number of workers. Packets are
+// assigned to a worker by hashing their flow, so packets of the same flow are
+// always handled in order by the same worker.
+type workerPool struct {
+	queues []chan *Packet
+	hash   func(pkt *Packet) uint64
+}
+
+// startWorkers starts a worker pool with one worker per CPU.
+func (vnet *VNET) startWorkers(ctx context.Context, hash func(pkt *Packet) uint64, handle func(pkt *Packet, now time.Time)) *workerPool {
+	return vnet.startWorkersN(ctx, runtime.GOMAXPROCS(0), hash, handle)
+}
+
+func (vnet *VNET) startWorkersN(ctx context.Context, n int, hash func(pkt *Packet) uint64, handle func(pkt *Packet, now time.Time)) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+
+	pool := &workerPool{
+		queues: make([]chan *Packet, n),
+		hash:   hash,
+	}
+
+	vnet.wg.Add(n)
+	for i := range pool.queues {
+		in := make(chan *Packet, workerQueueSize)
+		pool.queues[i] = in
+		go vnet.runWorker(ctx, in, handle)
+	}
+
+	return pool
+}
+
+func (vnet *VNET) runWorker(ctx context.Context, in <-chan *Packet, handle func(pkt *Packet, now time.Time)) {
+	defer vnet.wg.Done()
+
+	var (
+		now    = time.Now()
+		ticker = time.NewTicker(1 * time.Second)
+	)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now = <-ticker.C:
+		case pkt := <-in:
+			handle(pkt, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch queues pkt on the worker for its flow. It returns false when the
+// queue of that worker is full.
+func (pool *workerPool) dispatch(pkt *Packet) bool {
+	var idx int
+	if len(pool.queues) > 1 {
+		idx = int(pool.hash(pkt) % uint64(len(pool.queues)))
+	}
+
+	select {
+	case pool.queues[idx] <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+// networkHash hashes the source and destination addresses of pkt. The hash
+// is symmetric.
+func networkHash(pkt *Packet) uint64 {
+	switch {
+	case pkt.IPv4 != nil:
+		return pkt.IPv4.NetworkFlow().FastHash()
+	case pkt.IPv6 != nil:
+		return pkt.IPv6.NetworkFlow().FastHash()
+	}
+	return 0
+}
+
+// flowHash hashes the addresses and ports of pkt.
+func flowHash(pkt *Packet) uint64 {
+	h := networkHash(pkt)
+	switch {
+	case pkt.TCP != nil:
+		h = h*1099511628211 ^ pkt.TCP.TransportFlow().FastHash()
+	case pkt.UDP != nil:
+		h = h*1099511628211 ^ pkt.UDP.TransportFlow().FastHash()
+	}
+	return h
+}
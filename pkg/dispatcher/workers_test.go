@@ -0,0 +1,146 @@
+package dispatcher
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+func testPackets(tb testing.TB, flows, size int) []*Packet {
+	pkts := make([]*Packet, flows)
+
+	for i := range pkts {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+			DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.IPv4(192, 168, 200, 1).To4(),
+			DstIP:    net.IPv4(172, 18, byte(i>>8), byte(i)).To4(),
+		}
+		tcp := &layers.TCP{
+			SrcPort: layers.TCPPort(10000 + i),
+			DstPort: 80,
+			ACK:     true,
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(make([]byte, size)))
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		pkt := NewPacket(len(buf.Bytes()))
+		n := copy(pkt.buf, buf.Bytes())
+		err = pkt.decode(pkt.buf[:n])
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pkts[i] = pkt
+	}
+
+	return pkts
+}
+
+// dispatchWait is like dispatch but waits for room in the queue.
+func (pool *workerPool) dispatchWait(pkt *Packet) {
+	pool.queues[pool.hash(pkt)%uint64(len(pool.queues))] <- pkt
+}
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		vnet  VNET
+		pkts  = testPackets(t, 64, 0)
+		mtx   sync.Mutex
+		order = make(map[uint64][]uint32)
+		done  sync.WaitGroup
+	)
+
+	pool := vnet.startWorkersN(ctx, 8, flowHash, func(pkt *Packet, now time.Time) {
+		mtx.Lock()
+		h := flowHash(pkt)
+		order[h] = append(order[h], pkt.Flags)
+		mtx.Unlock()
+		done.Done()
+	})
+
+	for round := 0; round < 100; round++ {
+		for _, pkt := range pkts {
+			p := *pkt
+			p.Flags = uint32(round)
+
+			done.Add(1)
+			pool.dispatchWait(&p)
+		}
+	}
+
+	done.Wait()
+
+	if len(order) != len(pkts) {
+		t.Fatalf("expected %d flows, got %d", len(pkts), len(order))
+	}
+	for _, rounds := range order {
+		for i, round := range rounds {
+			if round != uint32(i) {
+				t.Fatalf("packets of a flow were reordered: %v", rounds)
+			}
+		}
+	}
+}
+
+// BenchmarkWorkerPool measures forwarding throughput; compare with -cpu 1,2,4,8.
+func BenchmarkWorkerPool(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		vnet VNET
+		pkts = testPackets(b, 1024, 1400)
+		done sync.WaitGroup
+	)
+
+	// simulate the work of forwarding a packet
+	pool := vnet.startWorkers(ctx, flowHash, func(pkt *Packet, now time.Time) {
+		var sum uint32
+		data := pkt.TCP.Payload
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(data[i])<<8 | uint32(data[i+1])
+		}
+		pkt.Flags = sum
+		done.Done()
+	})
+
+	b.SetBytes(int64(len(pkts[0].data)))
+	b.ResetTimer()
+
+	done.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		pool.dispatchWait(pkts[i%len(pkts)])
+	}
+	done.Wait()
+}
+
+func BenchmarkFlowHash(b *testing.B) {
+	pkts := testPackets(b, 1024, 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		flowHash(pkts[i%len(pkts)])
+	}
+}
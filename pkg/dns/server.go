@@ -21,6 +21,12 @@ func Run(ctx context.Context, vnet *dispatcher.VNET) <-chan error {
 		system := vnet.System()
 		system.WaitForGatewayIPv4()
 
+		if system.GatewayRemote() {
+			// the gateway is not on this host so DNS requests can't be forwarded to us
+			log.Printf("DNS: disabled (remote gateway)")
+			return
+		}
+
 		l, err := net.ListenUDP("udp", &net.UDPAddr{IP: system.GatewayIPv4()})
 		if err != nil {
 			log.Printf("error=%s", err)
@@ -0,0 +1,43 @@
+package fragments
+
+import "github.com/google/gopacket/layers"
+
+// Split splits payload into fragments of datagram ip which fit in mtu (the
+// maximum IPv4 packet size including the header). The returned headers are
+// copies of ip with the fragmentation fields set; the payload slices share
+// payload's backing array.
+func Split(ip *layers.IPv4, payload []byte, mtu int) ([]layers.IPv4, [][]byte) {
+	hdrLen := 20
+	for _, opt := range ip.Options {
+		hdrLen += int(opt.OptionLength)
+	}
+	hdrLen = (hdrLen + 3) &^ 3
+
+	size := (mtu - hdrLen) &^ 7
+	if size <= 0 {
+		return nil, nil
+	}
+
+	var (
+		headers  []layers.IPv4
+		payloads [][]byte
+	)
+
+	for offset := 0; offset < len(payload); offset += size {
+		end := offset + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		hdr := *ip
+		hdr.FragOffset = uint16((int(ip.FragOffset)*8 + offset) / 8)
+		if end < len(payload) {
+			hdr.Flags |= layers.IPv4MoreFragments
+		}
+
+		headers = append(headers, hdr)
+		payloads = append(payloads, payload[offset:end])
+	}
+
+	return headers, payloads
+}
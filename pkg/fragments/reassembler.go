@@ -0,0 +1,238 @@
+// Package fragments reassembles and creates fragmented IPv4 datagrams.
+package fragments
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultTimeout is the reassembly timeout recommended by RFC 791
+	DefaultTimeout = 15 * time.Second
+
+	maxDatagramSize = 65535 - 20
+	maxPending      = 1024
+)
+
+var (
+	ErrTooLarge   = errors.New("fragments: datagram too large")
+	ErrTooMany    = errors.New("fragments: too many pending datagrams")
+	ErrInvalid    = errors.New("fragments: invalid fragment")
+	ErrMismatched = errors.New("fragments: inconsistent fragments")
+)
+
+// Reassembler collects the fragments of IPv4 datagrams.
+type Reassembler struct {
+	mtx       sync.Mutex
+	timeout   time.Duration
+	datagrams map[key]*datagram
+}
+
+type key struct {
+	src, dst [4]byte
+	proto    layers.IPProtocol
+	id       uint16
+}
+
+type datagram struct {
+	header  layers.IPv4
+	data    []byte
+	total   int // -1 until the last fragment was seen
+	ranges  []span
+	expires time.Time
+}
+
+type span struct{ start, end int }
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Reassembler{
+		timeout:   timeout,
+		datagrams: make(map[key]*datagram),
+	}
+}
+
+// IsFragment returns true when ip is a fragment of a larger datagram.
+func IsFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// Add a fragment. The fragment is copied. Once all fragments of a datagram
+// are received the reassembled datagram is returned; its header is the
+// header of the first fragment (without the fragmentation fields) and its
+// Payload holds the complete payload.
+func (r *Reassembler) Add(ip *layers.IPv4, now time.Time) (*layers.IPv4, error) {
+	var (
+		start = int(ip.FragOffset) * 8
+		end   = start + len(ip.Payload)
+		more  = ip.Flags&layers.IPv4MoreFragments != 0
+	)
+
+	if more && len(ip.Payload)%8 != 0 {
+		return nil, ErrInvalid
+	}
+	if end > maxDatagramSize {
+		return nil, ErrTooLarge
+	}
+
+	k := key{proto: ip.Protocol, id: ip.Id}
+	copy(k.src[:], ip.SrcIP.To4())
+	copy(k.dst[:], ip.DstIP.To4())
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	d := r.datagrams[k]
+	if d != nil && d.expires.Before(now) {
+		delete(r.datagrams, k)
+		d = nil
+	}
+	if d == nil {
+		if len(r.datagrams) >= maxPending {
+			return nil, ErrTooMany
+		}
+		d = &datagram{total: -1}
+		r.datagrams[k] = d
+	}
+	d.expires = now.Add(r.timeout)
+
+	if !more {
+		if d.total >= 0 && d.total != end {
+			delete(r.datagrams, k)
+			return nil, ErrMismatched
+		}
+		d.total = end
+	}
+	if d.total >= 0 && end > d.total {
+		delete(r.datagrams, k)
+		return nil, ErrMismatched
+	}
+
+	if start == 0 {
+		d.header = copyHeader(ip)
+	}
+
+	if len(d.data) < end {
+		data := make([]byte, end)
+		copy(data, d.data)
+		d.data = data
+	}
+	copy(d.data[start:end], ip.Payload)
+	d.addSpan(start, end)
+
+	if d.total < 0 || len(d.ranges) != 1 || d.ranges[0].start != 0 || d.ranges[0].end != d.total {
+		return nil, nil
+	}
+
+	delete(r.datagrams, k)
+
+	out := d.header
+	out.Flags &^= layers.IPv4MoreFragments
+	out.FragOffset = 0
+	hdrLen := len(out.Contents)
+	if hdrLen == 0 {
+		hdrLen = int(out.IHL) * 4
+	}
+	out.Length = uint16(hdrLen + d.total)
+	out.Payload = d.data[:d.total]
+	fixHeader(&out)
+	return &out, nil
+}
+
+// Expire drops incomplete datagrams which timed out. It returns the number of
+// dropped datagrams.
+func (r *Reassembler) Expire(now time.Time) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	n := 0
+	for k, d := range r.datagrams {
+		if d.expires.Before(now) {
+			delete(r.datagrams, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Pending returns the number of incomplete datagrams.
+func (r *Reassembler) Pending() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.datagrams)
+}
+
+// copyHeader copies the header of ip so it outlives the packet buffer.
+func copyHeader(ip *layers.IPv4) layers.IPv4 {
+	hdr := *ip
+	hdr.Contents = append([]byte(nil), ip.Contents...)
+	hdr.Payload = nil
+	hdr.SrcIP = append(net.IP(nil), ip.SrcIP...)
+	hdr.DstIP = append(net.IP(nil), ip.DstIP...)
+	hdr.Options = make([]layers.IPv4Option, len(ip.Options))
+	for i, opt := range ip.Options {
+		opt.OptionData = append([]byte(nil), opt.OptionData...)
+		hdr.Options[i] = opt
+	}
+	return hdr
+}
+
+// fixHeader updates the raw header of a reassembled datagram to match its
+// fields.
+func fixHeader(ip *layers.IPv4) {
+	b := ip.Contents
+	if len(b) < 20 {
+		return
+	}
+
+	binary.BigEndian.PutUint16(b[2:], ip.Length)
+	binary.BigEndian.PutUint16(b[6:], uint16(ip.Flags)<<13|ip.FragOffset)
+	b[10], b[11] = 0, 0
+
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	ip.Checksum = ^uint16(sum)
+	binary.BigEndian.PutUint16(b[10:], ip.Checksum)
+}
+
+// addSpan merges [start, end) into the sorted list of received ranges.
+func (d *datagram) addSpan(start, end int) {
+	if start == end {
+		return
+	}
+
+	idx := sort.Search(len(d.ranges), func(i int) bool {
+		return d.ranges[i].end >= start
+	})
+
+	merged := span{start, end}
+	last := idx
+	for last < len(d.ranges) && d.ranges[last].start <= end {
+		if d.ranges[last].start < merged.start {
+			merged.start = d.ranges[last].start
+		}
+		if d.ranges[last].end > merged.end {
+			merged.end = d.ranges[last].end
+		}
+		last++
+	}
+
+	ranges := make([]span, 0, len(d.ranges)-(last-idx)+1)
+	ranges = append(ranges, d.ranges[:idx]...)
+	ranges = append(ranges, merged)
+	ranges = append(ranges, d.ranges[last:]...)
+	d.ranges = ranges
+}
@@ -0,0 +1,156 @@
+package fragments
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testDatagram(size int) (*layers.IPv4, []byte) {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TOS:      0x10,
+		Id:       4242,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1).To4(),
+		DstIP:    net.IPv4(172, 18, 0, 2).To4(),
+	}
+
+	return ip, payload
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	ip, payload := testDatagram(4000)
+
+	headers, payloads := Split(ip, payload, 1500)
+	if len(headers) != 3 {
+		t.Fatalf("expected 3 fragments, got %d", len(headers))
+	}
+	for i, p := range payloads[:len(payloads)-1] {
+		if len(p) != 1480 || headers[i].Flags&layers.IPv4MoreFragments == 0 {
+			t.Fatalf("fragment %d: unexpected size %d or flags %s", i, len(p), headers[i].Flags)
+		}
+	}
+
+	r := NewReassembler(0)
+	now := time.Now()
+
+	// deliver out of order, with a duplicate
+	order := []int{2, 0, 0, 1}
+	var out *layers.IPv4
+	for n, i := range order {
+		frag := headers[i]
+		frag.Payload = payloads[i]
+
+		var err error
+		out, err = r.Add(&frag, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < len(order)-1 && out != nil {
+			t.Fatalf("datagram completed too early")
+		}
+	}
+
+	if out == nil {
+		t.Fatal("expected a reassembled datagram")
+	}
+	if !bytes.Equal(out.Payload, payload) {
+		t.Fatal("payload mismatch")
+	}
+	if out.Id != 4242 || out.TOS != 0x10 || IsFragment(out) {
+		t.Fatalf("unexpected header: %+v", out)
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("expected no pending datagrams")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ip, payload := testDatagram(3000)
+	headers, payloads := Split(ip, payload, 1500)
+
+	r := NewReassembler(time.Second)
+	now := time.Now()
+
+	frag := headers[0]
+	frag.Payload = payloads[0]
+	if out, err := r.Add(&frag, now); out != nil || err != nil {
+		t.Fatalf("unexpected result: %v %v", out, err)
+	}
+
+	if n := r.Expire(now.Add(2 * time.Second)); n != 1 {
+		t.Fatalf("expected 1 expired datagram, got %d", n)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	ip, payload := testDatagram(100)
+	r := NewReassembler(0)
+
+	frag := *ip
+	frag.Flags = layers.IPv4MoreFragments
+	frag.Payload = payload[:13]
+	if _, err := r.Add(&frag, time.Now()); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+
+	frag = *ip
+	frag.FragOffset = 8190
+	frag.Payload = payload
+	if _, err := r.Add(&frag, time.Now()); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestReassembledHeader(t *testing.T) {
+	ip, payload := testDatagram(3000)
+	ip.Flags = 0
+	headers, payloads := Split(ip, payload, 1500)
+
+	r := NewReassembler(0)
+	var out *layers.IPv4
+	for i := range headers {
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		err := gopacket.SerializeLayers(buf, opts, &headers[i], gopacket.Payload(payloads[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frag := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		out, err = r.Add(frag, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out == nil {
+		t.Fatal("expected a reassembled datagram")
+	}
+
+	// the raw header must decode to the reassembled datagram
+	var hdr layers.IPv4
+	data := append(append([]byte(nil), out.Contents...), out.Payload...)
+	err := hdr.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsFragment(&hdr) || int(hdr.Length) != len(data) || hdr.Id != ip.Id {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	if !bytes.Equal(hdr.Payload, payload) {
+		t.Fatal("payload mismatch")
+	}
+}
@@ -13,19 +13,27 @@ import (
 
 type Controller struct {
 	ports *ports.Mapper
+	ipv4  *net.IPNet
+	ipv6  *net.IPNet
 
 	mtx   sync.Mutex
 	hosts map[string]*Host
 
 	tableMtx sync.RWMutex
 	table    *Table
+	changed  chan struct{}
 }
 
-func NewController(ports *ports.Mapper) *Controller {
+// NewController returns a controller which allocates host addresses in the
+// ipv4 and ipv6 (/48) networks.
+func NewController(ports *ports.Mapper, ipv4, ipv6 *net.IPNet) *Controller {
 	return &Controller{
-		ports: ports,
-		hosts: make(map[string]*Host),
-		table: &Table{},
+		ports:   ports,
+		ipv4:    ipv4,
+		ipv6:    ipv6,
+		hosts:   make(map[string]*Host),
+		table:   &Table{},
+		changed: make(chan struct{}),
 	}
 }
 
@@ -36,6 +44,14 @@ func (c *Controller) GetTable() *Table {
 	return c.table
 }
 
+// Changed returns a channel which is closed when the table is replaced.
+func (c *Controller) Changed() <-chan struct{} {
+	c.tableMtx.RLock()
+	defer c.tableMtx.RUnlock()
+
+	return c.changed
+}
+
 func (c *Controller) AddHost(host *Host) (*Host, error) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -80,7 +96,7 @@ func (c *Controller) AddHost(host *Host) (*Host, error) {
 	}
 	if len(host.IPv6Addrs) == 0 {
 		for {
-			ip, err := generateIPv6(host.Local)
+			ip, err := generateIPv6(c.ipv6, host.Local)
 			if err != nil {
 				return nil, err
 			}
@@ -139,7 +155,7 @@ func (c *Controller) HostAddIPv4(id string, ip net.IP) error {
 		host.IPv4Addrs = append(host.IPv4Addrs, ip.To4())
 	} else {
 		for {
-			ip, err := generateIPv4(host.Local)
+			ip, err := generateIPv4(c.ipv4, host.Local)
 			if err != nil {
 				return err
 			}
@@ -174,6 +190,21 @@ func (c *Controller) HostSetState(id string, up bool) error {
 	return nil
 }
 
+func (c *Controller) HostSetPolicy(id string, policy Policy) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	host := c.lookupByNameOrID(id)
+	if host == nil {
+		return errors.New("host not found")
+	}
+
+	host.Policy = policy
+	c.updateTable()
+
+	return nil
+}
+
 func (c *Controller) lookupByNameOrID(id string) *Host {
 	h := c.GetTable().LookupByNameOrID(id)
 	if h == nil {
@@ -197,5 +228,7 @@ func (c *Controller) updateTable() {
 
 	c.tableMtx.Lock()
 	c.table = tab
+	close(c.changed)
+	c.changed = make(chan struct{})
 	c.tableMtx.Unlock()
 }
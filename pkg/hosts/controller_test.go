@@ -8,7 +8,9 @@ import (
 )
 
 func ExampleIPv4List() {
-	ctrl := NewController(ports.NewMapper())
+	_, ipv4, _ := net.ParseCIDR("172.18.0.0/16")
+	_, ipv6, _ := net.ParseCIDR("fd4c:bd56:5cee::/48")
+	ctrl := NewController(ports.NewMapper(), ipv4, ipv6)
 	ctrl.AddHost(&Host{IPv4: net.IPv4(172, 18, 0, 3)})
 	ctrl.AddHost(&Host{IPv4: net.IPv4(172, 18, 0, 5)})
 	ctrl.AddHost(&Host{IPv4: net.IPv4(172, 18, 0, 4)})
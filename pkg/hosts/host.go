@@ -1,6 +1,9 @@
 package hosts
 
-import "net"
+import (
+	"fmt"
+	"net"
+)
 
 type Host struct {
 	ID    string
@@ -11,6 +14,47 @@ type Host struct {
 	IPv6Addrs []net.IP
 
 	Up bool
+
+	// Policy decides what happens to packets for this host which can't be
+	// delivered.
+	Policy Policy
+}
+
+// Policy for undeliverable packets
+type Policy uint8
+
+const (
+	// PolicyDefault uses the global policy
+	PolicyDefault Policy = iota
+	// PolicyDrop silently drops the packet
+	PolicyDrop
+	// PolicyReject answers with a TCP RST or an ICMP unreachable error
+	PolicyReject
+)
+
+// ParsePolicy parses "default", "drop" or "reject"
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "default":
+		return PolicyDefault, nil
+	case "drop":
+		return PolicyDrop, nil
+	case "reject":
+		return PolicyReject, nil
+	default:
+		return PolicyDefault, fmt.Errorf("invalid policy %q (expected drop or reject)", s)
+	}
+}
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyDrop:
+		return "drop"
+	case PolicyReject:
+		return "reject"
+	default:
+		return "default"
+	}
 }
 
 // Clone a host
@@ -7,19 +7,16 @@ import (
 	"net"
 )
 
-func generateIPv6(local bool) (net.IP, error) {
+// generateIPv6 returns a random address in PREFIX:8000::/64 for local hosts
+// and in PREFIX:0000::/64 for remote hosts (where PREFIX is the /48 network).
+func generateIPv6(network *net.IPNet, local bool) (net.IP, error) {
 	addr := make(net.IP, 16)
 	_, err := io.ReadFull(rand.Reader, addr[:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate IPv6: %s", err)
 	}
 
-	addr[0] = 0xfd
-	addr[1] = 0x4c
-	addr[2] = 0xbd
-	addr[3] = 0x56
-	addr[4] = 0x5c
-	addr[5] = 0xee
+	copy(addr[:6], network.IP.To16()[:6])
 
 	if local {
 		addr[6] = 0x80
@@ -32,15 +29,27 @@ func generateIPv6(local bool) (net.IP, error) {
 	return addr, nil
 }
 
-func generateIPv4(local bool) (net.IP, error) {
+// generateIPv4 returns a random address in network (at most a /24). Addresses
+// ending in .0 or .255 are never returned.
+func generateIPv4(network *net.IPNet, local bool) (net.IP, error) {
 	addr := make(net.IP, 4)
 	_, err := io.ReadFull(rand.Reader, addr[:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate IPv4: %s", err)
 	}
 
-	addr[0] = 172
-	addr[1] = 18
+	var (
+		prefix = network.IP.To4()
+		mask   = network.Mask
+	)
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+
+	for i := range addr {
+		addr[i] = prefix[i] | (addr[i] &^ mask[i])
+	}
+
 	if addr[3] == 0 {
 		addr[3] = addr[3] + 1
 	}
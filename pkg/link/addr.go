@@ -0,0 +1,33 @@
+package link
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+)
+
+// RandomMAC returns a random unicast, locally administered MAC address.
+func RandomMAC() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	_, err := io.ReadFull(rand.Reader, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	// unicast and locally administered
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac, nil
+}
+
+// NextIP returns the address following ip.
+func NextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,139 @@
+package link
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Link is a link-layer device which carries ethernet frames between the
+// dispatcher and the rest of the network.
+type Link interface {
+	// ReadPacket reads a single frame into p. p must be at least MaxPacketSize
+	// bytes long. io.EOF is returned once the link is closed.
+	ReadPacket(p []byte) (n int, flags uint32, err error)
+
+	// WritePacket writes a single frame.
+	WritePacket(p []byte, flags uint32) (n int, err error)
+
+	// MaxPacketSize returns the size of the largest frame the link can carry.
+	MaxPacketSize() int
+
+	// HardwareAddr returns the MAC address of the link.
+	HardwareAddr() net.HardwareAddr
+
+	// Events returns a channel of link events. The channel is closed when the
+	// link is closed.
+	Events() <-chan Event
+
+	Close() error
+}
+
+type EventType uint32
+
+type Event struct {
+	Type EventType
+}
+
+// OpenFunc opens a link identified by id. The meaning of id depends on the driver.
+type OpenFunc func(id string) (Link, error)
+
+var (
+	driversMtx sync.RWMutex
+	drivers    = map[string]OpenFunc{}
+)
+
+// Register makes a link driver available by name. It is meant to be called
+// from the init function of the package implementing the driver.
+func Register(name string, open OpenFunc) {
+	driversMtx.Lock()
+	defer driversMtx.Unlock()
+
+	if open == nil {
+		panic("link: Register open func is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("link: Register called twice for driver " + name)
+	}
+
+	drivers[name] = open
+}
+
+// Drivers returns the names of the registered drivers.
+func Drivers() []string {
+	driversMtx.RLock()
+	defer driversMtx.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens a link using the named driver.
+func Open(driver, id string) (Link, error) {
+	driversMtx.RLock()
+	open := drivers[driver]
+	driversMtx.RUnlock()
+
+	if open == nil {
+		return nil, fmt.Errorf("link: unknown driver %q (available: %v)", driver, Drivers())
+	}
+
+	return open(id)
+}
+
+// Config holds addressing a link knows up front. The zero value of a field
+// means it must be discovered on the link (through gateway announcements and
+// DHCP).
+type Config struct {
+	GatewayMAC     net.HardwareAddr
+	GatewayIPv4    net.IP
+	ControllerIPv4 net.IP
+
+	// RemoteGateway is set when the gateway is not an interface of this host
+	// (like a replayed capture). The host network configuration is left
+	// untouched.
+	RemoteGateway bool
+
+	// PeerName and PeerIPv4 describe a machine at the other end of the link
+	// (like a VM connected over a socket). It is registered as a host behind
+	// the controller.
+	PeerName string
+	PeerIPv4 net.IP
+}
+
+// Configurer is implemented by links which are not backed by an announcing
+// gateway and a DHCP server, like vmnet's shared mode is.
+type Configurer interface {
+	Config() Config
+}
+
+// BatchWriter is implemented by links which can write several frames in one
+// call, like vmnet.
+type BatchWriter interface {
+	// WritePackets writes frames in order and returns the number of frames
+	// written. When not all frames are written err is the error of
+	// frames[n].
+	WritePackets(frames [][]byte, flags uint32) (n int, err error)
+}
+
+// IsTemporary returns true when err is a transient link error; writing the
+// packet again may succeed.
+func IsTemporary(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if err == syscall.ENOBUFS {
+		return true
+	}
+	t, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && t.Temporary()
+}
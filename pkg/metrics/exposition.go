@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// family is a metric with all its samples.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+// exposition collects the metrics of a single scrape and writes them in the
+// Prometheus text format.
+type exposition struct {
+	families []*family
+	index    map[string]*family
+}
+
+func (e *exposition) gauge(name, help string, value float64, labels ...string) {
+	e.add("gauge", name, help, value, labels)
+}
+
+func (e *exposition) counter(name, help string, value float64, labels ...string) {
+	e.add("counter", name, help, value, labels)
+}
+
+func (e *exposition) add(typ, name, help string, value float64, labels []string) {
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be name, value pairs")
+	}
+
+	if e.index == nil {
+		e.index = make(map[string]*family)
+	}
+
+	f := e.index[name]
+	if f == nil {
+		f = &family{name: name, help: help, typ: typ}
+		e.index[name] = f
+		e.families = append(e.families, f)
+	}
+
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+func (e *exposition) WriteTo(out io.Writer) (int64, error) {
+	w := &countingWriter{w: out}
+	bw := bufio.NewWriter(w)
+
+	for _, f := range e.families {
+		bw.WriteString("# HELP ")
+		bw.WriteString(f.name)
+		bw.WriteByte(' ')
+		bw.WriteString(helpEscaper.Replace(f.help))
+		bw.WriteString("\n# TYPE ")
+		bw.WriteString(f.name)
+		bw.WriteByte(' ')
+		bw.WriteString(f.typ)
+		bw.WriteByte('\n')
+
+		for _, s := range f.samples {
+			bw.WriteString(f.name)
+			if len(s.labels) > 0 {
+				bw.WriteByte('{')
+				for i := 0; i < len(s.labels); i += 2 {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.WriteString(s.labels[i])
+					bw.WriteString(`="`)
+					bw.WriteString(labelEscaper.Replace(s.labels[i+1]))
+					bw.WriteByte('"')
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+			bw.WriteByte('\n')
+		}
+	}
+
+	err := bw.Flush()
+	return w.n, err
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	var e exposition
+	e.gauge("switchboard_routes_active", "Number of active routes.", 3, "protocol", "tcp")
+	e.counter("switchboard_flow_bytes_total", "Bytes routed.\nPer host.", 1500, "host", `a"b\c`, "direction", "rx")
+	e.gauge("switchboard_routes_active", "Number of active routes.", 0.5, "protocol", "udp")
+	e.gauge("switchboard_dhcp_lease_age_seconds", "Age of the lease.", 12)
+
+	var buf bytes.Buffer
+	n, err := e.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("expected %d bytes, got %d", buf.Len(), n)
+	}
+
+	expected := `# HELP switchboard_routes_active Number of active routes.
+# TYPE switchboard_routes_active gauge
+switchboard_routes_active{protocol="tcp"} 3
+switchboard_routes_active{protocol="udp"} 0.5
+# HELP switchboard_flow_bytes_total Bytes routed.\nPer host.
+# TYPE switchboard_flow_bytes_total counter
+switchboard_flow_bytes_total{host="a\"b\\c",direction="rx"} 1500
+# HELP switchboard_dhcp_lease_age_seconds Age of the lease.
+# TYPE switchboard_dhcp_lease_age_seconds gauge
+switchboard_dhcp_lease_age_seconds 12
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,111 @@
+// Package metrics serves the counters of the switch in the Prometheus text
+// format.
+package metrics
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fd/switchboard/pkg/config"
+	"github.com/fd/switchboard/pkg/dispatcher"
+	"github.com/fd/switchboard/pkg/hosts"
+	"golang.org/x/net/context"
+)
+
+// Run serves the metrics of vnet on /metrics until ctx is done.
+func Run(ctx context.Context, vnet *dispatcher.VNET, conf config.Metrics) error {
+	l, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("METRICS: http://%s/metrics", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(vnet))
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		err := http.Serve(l, mux)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("METRICS/error: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// Handler returns a handler which writes the metrics of vnet.
+func Handler(vnet *dispatcher.VNET) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e exposition
+		collect(&e, vnet, time.Now())
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		e.WriteTo(w)
+	})
+}
+
+func collect(e *exposition, vnet *dispatcher.VNET, now time.Time) {
+	hostTable := vnet.Hosts().GetTable()
+
+	for _, u := range vnet.Routes().Usage() {
+		var (
+			host  = hostName(hostTable, u.HostID)
+			proto = strings.ToLower(u.Protocol.String())
+		)
+
+		e.gauge("switchboard_routes_active", "Number of active routes.",
+			float64(u.Active), "host", host, "rule", u.RuleID, "protocol", proto)
+		e.counter("switchboard_flow_bytes_total", "Bytes routed (rx is sent by the host, tx is sent to the host).",
+			float64(u.RxBytes), "host", host, "rule", u.RuleID, "protocol", proto, "direction", "rx")
+		e.counter("switchboard_flow_bytes_total", "",
+			float64(u.TxBytes), "host", host, "rule", u.RuleID, "protocol", proto, "direction", "tx")
+		e.counter("switchboard_flow_packets_total", "Packets routed (rx is sent by the host, tx is sent to the host).",
+			float64(u.RxPackets), "host", host, "rule", u.RuleID, "protocol", proto, "direction", "rx")
+		e.counter("switchboard_flow_packets_total", "",
+			float64(u.TxPackets), "host", host, "rule", u.RuleID, "protocol", proto, "direction", "tx")
+	}
+
+	for _, a := range vnet.Ports().Allocations() {
+		host := hostName(hostTable, a.HostID)
+		e.gauge("switchboard_ports_allocated", "Number of allocated ports.",
+			float64(a.TCP), "host", host, "protocol", "tcp")
+		e.gauge("switchboard_ports_allocated", "",
+			float64(a.UDP), "host", host, "protocol", "udp")
+	}
+
+	for _, d := range vnet.Drops("") {
+		e.counter("switchboard_packets_dropped_total", "Packets dropped by the dispatcher.",
+			float64(d.Count), "reason", d.Reason.String(), "host", hostName(hostTable, d.HostID), "rule", d.RuleID)
+	}
+
+	if renewed := vnet.System().ControllerLastDHCPRenew(); !renewed.IsZero() {
+		e.gauge("switchboard_dhcp_lease_age_seconds", "Seconds since the controller address was last renewed.",
+			now.Sub(renewed).Seconds())
+	}
+
+	proxy := vnet.Proxy().Stats()
+	e.gauge("switchboard_proxy_connections_active", "Number of open proxy connections.",
+		float64(proxy.Active))
+	e.counter("switchboard_proxy_connections_total", "Proxy connections established.",
+		float64(proxy.Total))
+	e.counter("switchboard_proxy_connections_failed_total", "Proxy connections which could not be established.",
+		float64(proxy.Failed))
+}
+
+// hostName returns the name of the host with id (or the id when the host is
+// gone).
+func hostName(tab *hosts.Table, id string) string {
+	if host := tab.LookupByID(id); host != nil {
+		return host.Name
+	}
+	return id
+}
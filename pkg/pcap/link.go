@@ -0,0 +1,57 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/fd/switchboard/pkg/link"
+)
+
+func init() {
+	// id is a comma separated list of options:
+	//   in=FILE   capture to replay
+	//   out=FILE  capture to record written frames to
+	//   mac=MAC   hardware address of the link
+	// (eg. "in=bug-1234.pcapng,out=replay.pcap,mac=6a:00:c8:21:1f:04")
+	link.Register("pcap", func(id string) (link.Link, error) {
+		opts, err := parseID(id)
+		if err != nil {
+			return nil, err
+		}
+		return Open(opts)
+	})
+}
+
+func parseID(id string) (Options, error) {
+	var opts Options
+
+	for _, part := range strings.Split(id, ",") {
+		if part == "" {
+			continue
+		}
+
+		idx := strings.IndexByte(part, '=')
+		if idx < 0 {
+			return Options{}, fmt.Errorf("pcap: invalid option %q (expected KEY=VALUE)", part)
+		}
+
+		key, value := part[:idx], part[idx+1:]
+		switch key {
+		case "in":
+			opts.Input = value
+		case "out":
+			opts.Output = value
+		case "mac":
+			mac, err := net.ParseMAC(value)
+			if err != nil {
+				return Options{}, err
+			}
+			opts.HardwareAddr = mac
+		default:
+			return Options{}, fmt.Errorf("pcap: unknown option %q", key)
+		}
+	}
+
+	return opts, nil
+}
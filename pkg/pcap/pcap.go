@@ -0,0 +1,341 @@
+package pcap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fd/switchboard/pkg/link"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// MaxPacketSize is the largest frame read from or written to a capture.
+const MaxPacketSize = 65535
+
+var ngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+var ErrNoInput = errors.New("pcap: no input or output capture")
+
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// Writer writes ethernet frames to a pcap or pcapng file.
+type Writer struct {
+	mtx   sync.Mutex
+	file  *os.File
+	buf   *bufio.Writer
+	pcap  *pcapgo.Writer
+	ng    *pcapgo.NgWriter
+	count uint64
+}
+
+// Options for Open
+type Options struct {
+	// Input is the capture (pcap or pcapng) which is replayed.
+	Input string
+	// Output is the file all written frames are recorded to. Files ending in
+	// .pcapng are written as pcapng, all others as pcap.
+	Output string
+	// HardwareAddr is the MAC address of the link. Set it to the controller
+	// MAC of the replayed capture to have the dispatcher accept unicast frames.
+	HardwareAddr net.HardwareAddr
+}
+
+// Interface replays frames from a capture and records written frames to
+// another capture. It makes offline (and deterministic) runs of the
+// dispatcher possible.
+type Interface struct {
+	mtx    sync.Mutex
+	closed bool
+	done   chan struct{}
+	events chan link.Event
+
+	mac net.HardwareAddr
+
+	inFile *os.File
+	in     packetReader
+	out    *Writer
+}
+
+// Open a capture link
+func Open(opts Options) (*Interface, error) {
+	if opts.Input == "" && opts.Output == "" {
+		return nil, ErrNoInput
+	}
+
+	iface := &Interface{
+		done:   make(chan struct{}),
+		events: make(chan link.Event),
+		mac:    opts.HardwareAddr,
+	}
+
+	if iface.mac == nil {
+		mac, err := randomMAC()
+		if err != nil {
+			return nil, err
+		}
+		iface.mac = mac
+	}
+
+	if opts.Input != "" {
+		f, r, err := openReader(opts.Input)
+		if err != nil {
+			return nil, err
+		}
+		if r.LinkType() != layers.LinkTypeEthernet {
+			f.Close()
+			return nil, fmt.Errorf("pcap: %s: unsupported link type %s", opts.Input, r.LinkType())
+		}
+		iface.inFile = f
+		iface.in = r
+	}
+
+	if opts.Output != "" {
+		w, err := Create(opts.Output)
+		if err != nil {
+			if iface.inFile != nil {
+				iface.inFile.Close()
+			}
+			return nil, err
+		}
+		iface.out = w
+	}
+
+	return iface, nil
+}
+
+func (iface *Interface) MaxPacketSize() int {
+	return MaxPacketSize
+}
+
+func (iface *Interface) HardwareAddr() net.HardwareAddr {
+	return iface.mac
+}
+
+func (iface *Interface) Config() link.Config {
+	// never touch the host network during offline runs
+	return link.Config{RemoteGateway: true}
+}
+
+func (iface *Interface) Events() <-chan link.Event {
+	return iface.events
+}
+
+func (iface *Interface) Close() error {
+	iface.mtx.Lock()
+	if iface.closed {
+		iface.mtx.Unlock()
+		return nil
+	}
+	iface.closed = true
+	iface.mtx.Unlock()
+
+	close(iface.done)
+	close(iface.events)
+
+	var err error
+	if iface.inFile != nil {
+		err = iface.inFile.Close()
+	}
+	if iface.out != nil {
+		if e := iface.out.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ReadPacket returns the next frame from the input capture. Once the capture
+// is exhausted it blocks until the link is closed.
+func (iface *Interface) ReadPacket(p []byte) (n int, flags uint32, err error) {
+	if iface == nil {
+		return 0, 0, io.EOF
+	}
+
+	for iface.in != nil {
+		data, _, err := iface.in.ReadPacketData()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			log.Printf("PCAP: replay done")
+			iface.in = nil
+			break
+		}
+		if err != nil {
+			if iface.isClosed() {
+				return 0, 0, io.EOF
+			}
+			return 0, 0, err
+		}
+		if len(data) > len(p) {
+			return 0, 0, io.ErrShortBuffer
+		}
+
+		return copy(p, data), 0, nil
+	}
+
+	<-iface.done
+	return 0, 0, io.EOF
+}
+
+// WritePacket records the frame in the output capture (if any).
+func (iface *Interface) WritePacket(p []byte, flags uint32) (n int, err error) {
+	if iface == nil || iface.isClosed() {
+		return 0, io.EOF
+	}
+	if len(p) > MaxPacketSize {
+		return 0, io.ErrShortWrite
+	}
+	if iface.out == nil {
+		return len(p), nil
+	}
+
+	err = iface.out.WritePacket(time.Now(), p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (iface *Interface) isClosed() bool {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	return iface.closed
+}
+
+// Create a capture file for ethernet frames. Files ending in .pcapng are
+// written as pcapng, all others as pcap.
+func Create(name string) (*Writer, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewWriter(f, strings.HasSuffix(name, ".pcapng"))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w.file = f
+	return w, nil
+}
+
+// NewWriter writes a capture of ethernet frames to w.
+func NewWriter(w io.Writer, ng bool) (*Writer, error) {
+	cw := &Writer{}
+
+	if ng {
+		ngw, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+		if err != nil {
+			return nil, err
+		}
+		cw.ng = ngw
+		return cw, nil
+	}
+
+	cw.buf = bufio.NewWriter(w)
+	cw.pcap = pcapgo.NewWriter(cw.buf)
+	err := cw.pcap.WriteFileHeader(MaxPacketSize, layers.LinkTypeEthernet)
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// WritePacket appends a frame to the capture.
+func (w *Writer) WritePacket(ts time.Time, p []byte) error {
+	ci := gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(p),
+		Length:        len(p),
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.count++
+	if w.ng != nil {
+		return w.ng.WritePacket(ci, p)
+	}
+	return w.pcap.WritePacket(ci, p)
+}
+
+// Count returns the number of frames written
+func (w *Writer) Count() uint64 {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.count
+}
+
+// Flush buffered frames to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.ng != nil {
+		return w.ng.Flush()
+	}
+	return w.buf.Flush()
+}
+
+// Close flushes the capture and closes the file (when opened with Create).
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if w.file != nil {
+		if e := w.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func openReader(name string) (*os.File, packetReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	var r packetReader
+	if bytes.Equal(magic, ngMagic) {
+		r, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		r, err = pcapgo.NewReader(br)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, r, nil
+}
+
+func randomMAC() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	_, err := io.ReadFull(rand.Reader, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	// unicast and locally administered
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac, nil
+}
@@ -0,0 +1,89 @@
+package pcap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestReplayAndRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "switchboard-pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		in     = filepath.Join(dir, "in.pcap")
+		out    = filepath.Join(dir, "out.pcapng")
+		frameA = bytes.Repeat([]byte{0xaa}, 60)
+		frameB = bytes.Repeat([]byte{0xbb}, 42)
+	)
+
+	w, err := Create(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WritePacket(time.Now(), frameA)
+	w.WritePacket(time.Now(), frameB)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	iface, err := Open(Options{Input: in, Output: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, iface.MaxPacketSize())
+	for _, expected := range [][]byte{frameA, frameB} {
+		n, _, err := iface.ReadPacket(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("expected %x, got %x", expected, buf[:n])
+		}
+	}
+
+	if _, err := iface.WritePacket(frameB, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := iface.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := openReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*pcapgo.NgReader); !ok {
+		t.Fatalf("expected a pcapng capture, got %T", r)
+	}
+	data, _, err := r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, frameB) {
+		t.Fatalf("expected %x, got %x", frameB, data)
+	}
+}
+
+func TestParseID(t *testing.T) {
+	opts, err := parseID("in=a.pcap,out=b.pcap,mac=02:00:00:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Input != "a.pcap" || opts.Output != "b.pcap" || opts.HardwareAddr.String() != "02:00:00:00:00:01" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	if _, err := parseID("a.pcap"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
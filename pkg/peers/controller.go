@@ -8,6 +8,9 @@ import (
 	"time"
 )
 
+// TTL is the time a peer is remembered after it was last seen.
+const TTL = 5 * time.Minute
+
 type Controller struct {
 	mtx   sync.RWMutex
 	peers []Peer
@@ -28,7 +31,7 @@ func (c *Controller) AddPeer(ip net.IP, mac net.HardwareAddr) {
 		c.peers = append(c.peers, Peer{
 			IP:     ip,
 			MAC:    mac,
-			Expire: time.Now().Add(5 * time.Minute),
+			Expire: time.Now().Add(TTL),
 		})
 
 		sort.Sort(sortedByIP(c.peers))
@@ -36,7 +39,7 @@ func (c *Controller) AddPeer(ip net.IP, mac net.HardwareAddr) {
 		c.peers[idx] = Peer{
 			IP:     ip,
 			MAC:    mac,
-			Expire: time.Now().Add(5 * time.Minute),
+			Expire: time.Now().Add(TTL),
 		}
 	}
 }
@@ -58,6 +61,49 @@ func (c *Controller) Lookup(ip net.IP) net.HardwareAddr {
 	return peer.MAC
 }
 
+// Stale returns the peers which expire within d. Each peer is returned once
+// per d/4 so it can be refreshed without flooding the link.
+func (c *Controller) Stale(now time.Time, d time.Duration) []Peer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var stale []Peer
+	for i := range c.peers {
+		peer := &c.peers[i]
+		if peer.Expire.Before(now) || peer.Expire.Sub(now) > d {
+			continue
+		}
+		if now.Sub(peer.Refreshed) < d/4 {
+			continue
+		}
+
+		peer.Refreshed = now
+		stale = append(stale, *peer)
+	}
+	return stale
+}
+
+// Sweep forgets the expired peers. It returns the number of peers that were
+// removed.
+func (c *Controller) Sweep(now time.Time) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	peers := c.peers[:0]
+	for _, peer := range c.peers {
+		if !peer.Expire.Before(now) {
+			peers = append(peers, peer)
+		}
+	}
+
+	n := len(c.peers) - len(peers)
+	for i := len(peers); i < len(c.peers); i++ {
+		c.peers[i] = Peer{}
+	}
+	c.peers = peers
+	return n
+}
+
 func (c *Controller) lookup(ip net.IP) (int, bool) {
 	ip = ip.To16()
 
@@ -0,0 +1,39 @@
+package peers
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStaleAndSweep(t *testing.T) {
+	c := NewController()
+	c.AddPeer(net.IPv4(10, 0, 0, 1), net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	c.AddPeer(net.ParseIP("fd00::1"), net.HardwareAddr{2, 0, 0, 0, 0, 2})
+
+	now := time.Now()
+	if stale := c.Stale(now, 30*time.Second); len(stale) != 0 {
+		t.Fatalf("expected no stale peers, got %v", stale)
+	}
+
+	soon := now.Add(TTL - 10*time.Second)
+	if stale := c.Stale(soon, 30*time.Second); len(stale) != 2 {
+		t.Fatalf("expected 2 stale peers, got %v", stale)
+	}
+	if stale := c.Stale(soon.Add(time.Second), 30*time.Second); len(stale) != 0 {
+		t.Fatalf("expected stale peers to be returned once, got %v", stale)
+	}
+
+	idx, _ := c.lookup(net.ParseIP("fd00::1"))
+	c.peers[idx].Expire = now.Add(-time.Second)
+
+	if n := c.Sweep(now); n != 1 {
+		t.Fatalf("expected 1 peer to be swept, got %d", n)
+	}
+	if c.Lookup(net.IPv4(10, 0, 0, 1)) == nil {
+		t.Fatalf("expected the other peer to be kept")
+	}
+	if c.Lookup(net.ParseIP("fd00::1")) != nil {
+		t.Fatalf("expected the expired peer to be gone")
+	}
+}
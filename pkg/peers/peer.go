@@ -9,4 +9,7 @@ type Peer struct {
 	IP     net.IP
 	MAC    net.HardwareAddr
 	Expire time.Time
+
+	// Refreshed is the last time the peer was returned by Stale
+	Refreshed time.Time
 }
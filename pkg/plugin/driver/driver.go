@@ -13,7 +13,9 @@ import (
 	"golang.org/x/net/context"
 )
 
-func Run(ctx context.Context, name string, config interface{}) <-chan error {
+// Run runs the switchboard-NAME plugin. The plugin talks to the API at url
+// (like tcp://172.18.0.1:8080).
+func Run(ctx context.Context, name, url string, config interface{}) <-chan error {
 	out := make(chan error, 1)
 	go func() {
 		defer close(out)
@@ -32,7 +34,7 @@ func Run(ctx context.Context, name string, config interface{}) <-chan error {
 
 		cmd := exec.Command("switchboard-" + name)
 		cmd.Env = append(os.Environ(), []string{
-			"SWITCHBOARD_URL=" + "tcp://172.18.0.1:8080",
+			"SWITCHBOARD_URL=" + url,
 			"SWITCHBOARD_CONFIG=" + string(configData),
 		}...)
 		cmd.Stdin = nil
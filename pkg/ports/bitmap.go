@@ -0,0 +1,57 @@
+package ports
+
+// bitmap is a set of ports.
+type bitmap [1 << 16 / 64]uint64
+
+func (b *bitmap) has(port uint16) bool {
+	return b[port/64]&(1<<(port%64)) != 0
+}
+
+func (b *bitmap) set(port uint16) {
+	b[port/64] |= 1 << (port % 64)
+}
+
+func (b *bitmap) clear(port uint16) {
+	b[port/64] &^= 1 << (port % 64)
+}
+
+func (b *bitmap) setRange(r Range) {
+	for p := int(r.Min); p <= int(r.Max); p++ {
+		b.set(uint16(p))
+	}
+}
+
+func (b *bitmap) clearRange(r Range) {
+	for p := int(r.Min); p <= int(r.Max); p++ {
+		b.clear(uint16(p))
+	}
+}
+
+// lowestBit returns the index of the lowest set bit of x (x must not be 0).
+func lowestBit(x uint64) int {
+	n := 0
+	if x&0xffffffff == 0 {
+		n += 32
+		x >>= 32
+	}
+	if x&0xffff == 0 {
+		n += 16
+		x >>= 16
+	}
+	if x&0xff == 0 {
+		n += 8
+		x >>= 8
+	}
+	if x&0xf == 0 {
+		n += 4
+		x >>= 4
+	}
+	if x&0x3 == 0 {
+		n += 2
+		x >>= 2
+	}
+	if x&0x1 == 0 {
+		n++
+	}
+	return n
+}
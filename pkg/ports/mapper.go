@@ -1,38 +1,144 @@
+// Package ports allocates the ports hosts use on the outside of the virtual
+// network.
 package ports
 
 import (
 	"errors"
-	"math"
 	"sort"
 	"sync"
 
 	"github.com/fd/switchboard/pkg/protocols"
 )
 
+var (
+	ErrDepleted  = errors.New("port pool depleted")
+	ErrAllocated = errors.New("port already allocated")
+	ErrQuota     = errors.New("port quota exceeded")
+)
+
+// Owner is what a port is allocated for.
+type Owner uint8
+
+const (
+	OwnerRoute Owner = 1 + iota
+	OwnerRule
+)
+
+func (o Owner) String() string {
+	switch o {
+	case OwnerRoute:
+		return "route"
+	case OwnerRule:
+		return "rule"
+	default:
+		return "invalid"
+	}
+}
+
+// Range is an inclusive range of ports.
+type Range struct {
+	Min uint16
+	Max uint16
+}
+
+// DefaultEphemeral is the range ports are allocated from when no port is
+// requested (the IANA ephemeral range).
+var DefaultEphemeral = []Range{{49152, 65535}}
+
+// Quotas limit the number of ports allocated for each host; in total and
+// per protocol. Zero means unlimited.
+type Quotas struct {
+	Host int
+	TCP  int
+	UDP  int
+}
+
 type Mapper struct {
 	mtx   sync.RWMutex
 	hosts map[string]*host
+	pool  *pool
+}
+
+// pool is the configuration of a mapper. It is replaced (not modified) when
+// the configuration changes.
+type pool struct {
+	ephemeral []Range
+	reserved  []Range
+	free      bitmap // ephemeral ports which are not reserved
+	quotas    Quotas
 }
 
 type host struct {
-	mtx     sync.Mutex
-	NextUDP int
-	NextTCP int
-	UDP     []int
-	TCP     []int
+	mtx   sync.Mutex
+	count int
+	tcp   hostPorts
+	udp   hostPorts
+}
+
+type hostPorts struct {
+	used  *bitmap
+	rules *bitmap // the used ports owned by rules
+	count int
+	next  uint16 // the search for a free ephemeral port starts here
 }
 
 func NewMapper() *Mapper {
-	return &Mapper{}
+	m := &Mapper{}
+	m.pool = newPool(DefaultEphemeral, nil, Quotas{})
+	return m
+}
+
+func newPool(ephemeral, reserved []Range, quotas Quotas) *pool {
+	p := &pool{
+		ephemeral: ephemeral,
+		reserved:  reserved,
+		quotas:    quotas,
+	}
+	for _, r := range ephemeral {
+		p.free.setRange(r)
+	}
+	for _, r := range reserved {
+		p.free.clearRange(r)
+	}
+	p.free.clear(0)
+	return p
+}
+
+// SetEphemeral sets the ranges ports are allocated from when no port is
+// requested. It applies to later allocations.
+func (m *Mapper) SetEphemeral(ranges []Range) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.pool = newPool(ranges, m.pool.reserved, m.pool.quotas)
+}
+
+// SetReserved sets the ranges of ports which are never allocated from the
+// ephemeral ranges (they can still be requested explicitly).
+func (m *Mapper) SetReserved(ranges []Range) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.pool = newPool(m.pool.ephemeral, ranges, m.pool.quotas)
+}
+
+// SetQuotas sets the maximum number of ports allocated for each host. It
+// applies to later allocations.
+func (m *Mapper) SetQuotas(quotas Quotas) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.pool = newPool(m.pool.ephemeral, m.pool.reserved, quotas)
 }
 
-func (m *Mapper) getHost(hostID string) *host {
-	var h *host
+func (m *Mapper) getHost(hostID string) (*host, *pool) {
+	var (
+		h *host
+		p *pool
+	)
 
 	m.mtx.RLock()
 	if m.hosts != nil {
 		h = m.hosts[hostID]
 	}
+	p = m.pool
 	m.mtx.RUnlock()
 
 	if h == nil {
@@ -45,36 +151,33 @@ func (m *Mapper) getHost(hostID string) *host {
 			h = &host{}
 			m.hosts[hostID] = h
 		}
+		p = m.pool
 		m.mtx.Unlock()
 	}
 
-	return h
+	return h, p
 }
 
-func (m *Mapper) Allocate(hostID string, proto protocols.Protocol, port uint16) (uint16, error) {
-	h := m.getHost(hostID)
-
-	switch proto {
-	case protocols.TCP:
-		return h.allocateTCP(port)
-	case protocols.UDP:
-		return h.allocateUDP(port)
-	default:
+// Allocate allocates port for owner. When port is 0 a free port is taken
+// from the ephemeral ranges.
+func (m *Mapper) Allocate(hostID string, proto protocols.Protocol, port uint16, owner Owner) (uint16, error) {
+	if proto != protocols.TCP && proto != protocols.UDP {
 		return 0, errors.New("unknown protocol")
 	}
+
+	h, p := m.getHost(hostID)
+	return h.allocate(p, proto, port, owner)
 }
 
+// Release frees port. Releasing a port which is not allocated is a no-op.
 func (m *Mapper) Release(hostID string, proto protocols.Protocol, port uint16) error {
-	h := m.getHost(hostID)
-
-	switch proto {
-	case protocols.TCP:
-		return h.releaseTCP(port)
-	case protocols.UDP:
-		return h.releaseUDP(port)
-	default:
+	if proto != protocols.TCP && proto != protocols.UDP {
 		return errors.New("unknown protocol")
 	}
+
+	h, _ := m.getHost(hostID)
+	h.release(proto, port)
+	return nil
 }
 
 func (m *Mapper) ForgetHost(hostID string) {
@@ -86,100 +189,181 @@ func (m *Mapper) ForgetHost(hostID string) {
 	}
 }
 
-func (h *host) allocateTCP(port uint16) (uint16, error) {
-	h.mtx.Lock()
-	defer h.mtx.Unlock()
+// Allocation is the number of ports allocated for a host.
+type Allocation struct {
+	HostID string
+	TCP    int
+	UDP    int
+}
+
+// Allocations returns the number of allocated ports per host.
+func (m *Mapper) Allocations() []Allocation {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 
-	if len(h.TCP) == (math.MaxUint16 - 1) {
-		return 0, errors.New("port pool depleted")
+	allocs := make([]Allocation, 0, len(m.hosts))
+	for id, h := range m.hosts {
+		h.mtx.Lock()
+		allocs = append(allocs, Allocation{HostID: id, TCP: h.tcp.count, UDP: h.udp.count})
+		h.mtx.Unlock()
 	}
 
-	// Find next unused port
-	var wrapCount = 0
-	for port == 0 {
-		if h.NextTCP >= math.MaxUint16 {
-			h.NextTCP = 49152
-			wrapCount++
-			if wrapCount == 2 {
-				return 0, errors.New("port pool depleted")
-			}
-		} else if h.NextTCP < 49152 {
-			h.NextTCP = 49152
-		} else {
-			h.NextTCP++
-		}
+	sort.Sort(sortedAllocations(allocs))
+	return allocs
+}
 
-		if sort.SearchInts(h.TCP, h.NextTCP) == len(h.TCP) {
-			port = uint16(h.NextTCP)
-			break
+// Port is an allocated port.
+type Port struct {
+	HostID   string
+	Protocol protocols.Protocol
+	Port     uint16
+	Owner    Owner
+}
+
+// Ports returns the ports allocated for hostID (all hosts when empty) and
+// owner (all owners when 0) sorted by host, protocol and port.
+func (m *Mapper) Ports(hostID string, owner Owner) []Port {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	ids := make([]string, 0, len(m.hosts))
+	for id := range m.hosts {
+		if hostID == "" || id == hostID {
+			ids = append(ids, id)
 		}
 	}
+	sort.Strings(ids)
+
+	var ports []Port
+	for _, id := range ids {
+		h := m.hosts[id]
+		h.mtx.Lock()
+		ports = h.tcp.appendPorts(ports, id, protocols.TCP, owner)
+		ports = h.udp.appendPorts(ports, id, protocols.UDP, owner)
+		h.mtx.Unlock()
+	}
+	return ports
+}
 
-	h.TCP = append(h.TCP, int(port))
-	sort.Ints(h.TCP)
+type sortedAllocations []Allocation
 
-	return port, nil
+func (s sortedAllocations) Len() int           { return len(s) }
+func (s sortedAllocations) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortedAllocations) Less(i, j int) bool { return s[i].HostID < s[j].HostID }
+
+func (h *host) ports(proto protocols.Protocol) *hostPorts {
+	if proto == protocols.TCP {
+		return &h.tcp
+	}
+	return &h.udp
 }
 
-func (h *host) allocateUDP(port uint16) (uint16, error) {
+func (h *host) allocate(p *pool, proto protocols.Protocol, port uint16, owner Owner) (uint16, error) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 
-	if len(h.UDP) == (math.MaxUint16 - 1) {
-		return 0, errors.New("port pool depleted")
+	hp := h.ports(proto)
+
+	if p.quotas.Host > 0 && h.count >= p.quotas.Host {
+		return 0, ErrQuota
+	}
+	if q := p.quotas.protocol(proto); q > 0 && hp.count >= q {
+		return 0, ErrQuota
 	}
 
-	// Find next unused port
-	var wrapCount = 0
-	for port == 0 {
-		if h.NextUDP >= math.MaxUint16 {
-			h.NextUDP = 49152
-			wrapCount++
-			if wrapCount == 2 {
-				return 0, errors.New("port pool depleted")
-			}
-		} else if h.NextUDP < 49152 {
-			h.NextUDP = 49152
-		} else {
-			h.NextUDP++
-		}
+	if hp.used == nil {
+		hp.used = &bitmap{}
+	}
 
-		if sort.SearchInts(h.UDP, h.NextUDP) == len(h.UDP) {
-			port = uint16(h.NextUDP)
-			break
+	if port == 0 {
+		var found bool
+		port, found = hp.findFree(&p.free)
+		if !found {
+			return 0, ErrDepleted
 		}
+		hp.next = port + 1
+	} else if hp.used.has(port) {
+		return 0, ErrAllocated
 	}
 
-	h.UDP = append(h.UDP, int(port))
-	sort.Ints(h.UDP)
+	hp.used.set(port)
+	if owner == OwnerRule {
+		if hp.rules == nil {
+			hp.rules = &bitmap{}
+		}
+		hp.rules.set(port)
+	}
+	hp.count++
+	h.count++
 
 	return port, nil
 }
 
-func (h *host) releaseTCP(port uint16) error {
+func (h *host) release(proto protocols.Protocol, port uint16) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 
-	idx := sort.SearchInts(h.TCP, int(port))
-	if idx == len(h.TCP) {
-		return nil
+	hp := h.ports(proto)
+	if hp.used == nil || !hp.used.has(port) {
+		return
 	}
 
-	copy(h.TCP[idx:], h.TCP[idx+1:])
-	h.TCP = h.TCP[:len(h.TCP)-1]
-	return nil
+	hp.used.clear(port)
+	if hp.rules != nil {
+		hp.rules.clear(port)
+	}
+	hp.count--
+	h.count--
 }
 
-func (h *host) releaseUDP(port uint16) error {
-	h.mtx.Lock()
-	defer h.mtx.Unlock()
+func (q *Quotas) protocol(proto protocols.Protocol) int {
+	if proto == protocols.TCP {
+		return q.TCP
+	}
+	return q.UDP
+}
 
-	idx := sort.SearchInts(h.UDP, int(port))
-	if idx == len(h.UDP) {
-		return nil
+// findFree returns the first port at or after next which is free in pool and
+// not used (wrapping around once).
+func (hp *hostPorts) findFree(pool *bitmap) (uint16, bool) {
+	start := int(hp.next) / 64
+
+	for i := 0; i <= len(pool); i++ {
+		w := (start + i) % len(pool)
+
+		free := pool[w] &^ hp.used[w]
+		if i == 0 {
+			// skip the ports before next in its word; they are checked
+			// again at the end
+			free &= ^uint64(0) << (hp.next % 64)
+		}
+		if free != 0 {
+			return uint16(w*64 + lowestBit(free)), true
+		}
 	}
 
-	copy(h.UDP[idx:], h.UDP[idx+1:])
-	h.UDP = h.UDP[:len(h.UDP)-1]
-	return nil
+	return 0, false
+}
+
+func (hp *hostPorts) appendPorts(ports []Port, hostID string, proto protocols.Protocol, owner Owner) []Port {
+	if hp.used == nil {
+		return ports
+	}
+
+	for w, bits := range hp.used {
+		for ; bits != 0; bits &= bits - 1 {
+			port := uint16(w*64 + lowestBit(bits))
+
+			o := OwnerRoute
+			if hp.rules != nil && hp.rules.has(port) {
+				o = OwnerRule
+			}
+			if owner != 0 && o != owner {
+				continue
+			}
+
+			ports = append(ports, Port{HostID: hostID, Protocol: proto, Port: port, Owner: o})
+		}
+	}
+	return ports
 }
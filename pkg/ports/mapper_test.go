@@ -0,0 +1,135 @@
+package ports
+
+import (
+	"testing"
+
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+func allocate(t *testing.T, m *Mapper, proto protocols.Protocol, port uint16, owner Owner) uint16 {
+	p, err := m.Allocate("host-a", proto, port, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAllocateEphemeral(t *testing.T) {
+	m := NewMapper()
+	m.SetEphemeral([]Range{{1000, 1003}})
+	m.SetReserved([]Range{{1001, 1001}})
+
+	for _, expected := range []uint16{1000, 1002, 1003} {
+		if p := allocate(t, m, protocols.TCP, 0, OwnerRoute); p != expected {
+			t.Fatalf("expected port %d, got %d", expected, p)
+		}
+	}
+	if _, err := m.Allocate("host-a", protocols.TCP, 0, OwnerRoute); err != ErrDepleted {
+		t.Fatalf("expected %q, got %v", ErrDepleted, err)
+	}
+
+	// ports below the last allocated port are reused
+	m.Release("host-a", protocols.TCP, 1000)
+	if p := allocate(t, m, protocols.TCP, 0, OwnerRoute); p != 1000 {
+		t.Fatalf("expected port 1000, got %d", p)
+	}
+
+	// the protocols have their own ports
+	if p := allocate(t, m, protocols.UDP, 0, OwnerRoute); p != 1000 {
+		t.Fatalf("expected port 1000, got %d", p)
+	}
+
+	// reserved ports can be requested
+	allocate(t, m, protocols.TCP, 1001, OwnerRule)
+	if _, err := m.Allocate("host-a", protocols.TCP, 1001, OwnerRule); err != ErrAllocated {
+		t.Fatalf("expected %q, got %v", ErrAllocated, err)
+	}
+
+	if a := m.Allocations(); len(a) != 1 || a[0].TCP != 4 || a[0].UDP != 1 {
+		t.Fatalf("unexpected allocations: %+v", a)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	m := NewMapper()
+	m.SetQuotas(Quotas{Host: 3, TCP: 2})
+
+	allocate(t, m, protocols.TCP, 0, OwnerRoute)
+	allocate(t, m, protocols.TCP, 80, OwnerRule)
+	if _, err := m.Allocate("host-a", protocols.TCP, 0, OwnerRoute); err != ErrQuota {
+		t.Fatalf("expected %q, got %v", ErrQuota, err)
+	}
+
+	allocate(t, m, protocols.UDP, 0, OwnerRoute)
+	if _, err := m.Allocate("host-a", protocols.UDP, 0, OwnerRoute); err != ErrQuota {
+		t.Fatalf("expected %q, got %v", ErrQuota, err)
+	}
+
+	// other hosts have their own quota
+	if _, err := m.Allocate("host-b", protocols.TCP, 0, OwnerRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Release("host-a", protocols.TCP, 80)
+	allocate(t, m, protocols.TCP, 0, OwnerRoute)
+}
+
+func TestPorts(t *testing.T) {
+	m := NewMapper()
+
+	route := allocate(t, m, protocols.TCP, 0, OwnerRoute)
+	allocate(t, m, protocols.TCP, 80, OwnerRule)
+	allocate(t, m, protocols.UDP, 53, OwnerRule)
+	if _, err := m.Allocate("host-b", protocols.TCP, 0, OwnerRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := m.Ports("host-a", 0)
+	expected := []Port{
+		{"host-a", protocols.TCP, 80, OwnerRule},
+		{"host-a", protocols.TCP, route, OwnerRoute},
+		{"host-a", protocols.UDP, 53, OwnerRule},
+	}
+	if len(ports) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ports)
+	}
+	for i := range ports {
+		if ports[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, ports)
+		}
+	}
+
+	if ports := m.Ports("", OwnerRoute); len(ports) != 2 || ports[1].HostID != "host-b" {
+		t.Fatalf("unexpected route ports: %v", ports)
+	}
+
+	// a released rule port is reallocated for a route
+	m.SetEphemeral([]Range{{80, 80}})
+	m.Release("host-a", protocols.TCP, 80)
+	allocate(t, m, protocols.TCP, 0, OwnerRoute)
+	if ports := m.Ports("host-a", OwnerRule); len(ports) != 1 || ports[0].Port != 53 {
+		t.Fatalf("unexpected rule ports: %v", ports)
+	}
+}
+
+func BenchmarkAllocate(b *testing.B) {
+	m := NewMapper()
+
+	// keep most of the ephemeral range allocated
+	for i := 0; i < 15000; i++ {
+		if _, err := m.Allocate("host-a", protocols.TCP, 0, OwnerRoute); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p, err := m.Allocate("host-a", protocols.TCP, 0, OwnerRoute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Release("host-a", protocols.TCP, p)
+	}
+}
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/fd/switchboard/pkg/routes"
 	"golang.org/x/net/context"
@@ -13,6 +15,21 @@ type Proxy struct {
 
 	routes *routes.Controller
 	wg     sync.WaitGroup
+	stats  Stats
+
+	// conns holds the open connections by the address of the host
+	mtx   sync.Mutex
+	conns map[string]func()
+}
+
+// Stats are the connection counters of the proxy.
+type Stats struct {
+	// Active is the number of open connections
+	Active int64
+	// Total is the number of connections that were established
+	Total uint64
+	// Failed is the number of connections that could not be established
+	Failed uint64
 }
 
 func NewProxy(routes *routes.Controller) *Proxy {
@@ -30,5 +47,66 @@ func (p *Proxy) Run(ctx context.Context) error {
 		return err
 	}
 
+	p.wg.Add(1)
+	go p.closeKilled(ctx)
+
 	return nil
 }
+
+// closeKilled closes the connections of killed routes.
+func (p *Proxy) closeKilled(ctx context.Context) {
+	defer p.wg.Done()
+
+	sub := p.routes.Subscribe(64)
+	defer sub.Close()
+
+	for {
+		select {
+		case event := <-sub.C():
+			if event.Type != routes.RouteKilled {
+				continue
+			}
+			// the route from the host to the proxy or the route of the proxy
+			p.closeConn(event.Route.Outbound.SrcIP, event.Route.Outbound.SrcPort)
+			p.closeConn(event.Route.Inbound.SrcIP, event.Route.Inbound.SrcPort)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Proxy) addConn(addr *net.TCPAddr, close func()) {
+	p.mtx.Lock()
+	if p.conns == nil {
+		p.conns = make(map[string]func())
+	}
+	p.conns[addr.String()] = close
+	p.mtx.Unlock()
+}
+
+func (p *Proxy) removeConn(addr *net.TCPAddr) {
+	p.mtx.Lock()
+	delete(p.conns, addr.String())
+	p.mtx.Unlock()
+}
+
+func (p *Proxy) closeConn(ip net.IP, port uint16) {
+	addr := net.TCPAddr{IP: ip, Port: int(port)}
+
+	p.mtx.Lock()
+	close := p.conns[addr.String()]
+	p.mtx.Unlock()
+
+	if close != nil {
+		close()
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		Active: atomic.LoadInt64(&p.stats.Active),
+		Total:  atomic.LoadUint64(&p.stats.Total),
+		Failed: atomic.LoadUint64(&p.stats.Failed),
+	}
+}
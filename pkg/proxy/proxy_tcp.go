@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/fd/switchboard/pkg/protocols"
@@ -64,10 +65,28 @@ func (p *Proxy) proxyTCPStream(ctx context.Context, src *net.TCPConn) {
 
 		dst, err := net.DialTCP("tcp", nil, &dstAddr)
 		if err != nil {
+			atomic.AddUint64(&p.stats.Failed, 1)
 			src.Close()
 			return
 		}
 
+		atomic.AddUint64(&p.stats.Total, 1)
+		atomic.AddInt64(&p.stats.Active, 1)
+
+		p.addConn(srcRemoteAddr, func() {
+			src.Close()
+			dst.Close()
+		})
+
+		// the connection is closed when both directions are done
+		open := int32(2)
+		done := func() {
+			if atomic.AddInt32(&open, -1) == 0 {
+				atomic.AddInt64(&p.stats.Active, -1)
+				p.removeConn(srcRemoteAddr)
+			}
+		}
+
 		dst.SetKeepAlivePeriod(10 * time.Second)
 		src.SetKeepAlivePeriod(10 * time.Second)
 
@@ -78,12 +97,14 @@ func (p *Proxy) proxyTCPStream(ctx context.Context, src *net.TCPConn) {
 		}()
 
 		go func() {
+			defer done()
 			defer dst.CloseWrite()
 			defer src.CloseRead()
 			io.Copy(dst, src)
 		}()
 
 		go func() {
+			defer done()
 			defer src.CloseWrite()
 			defer dst.CloseRead()
 			io.Copy(src, dst)
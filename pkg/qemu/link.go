@@ -0,0 +1,14 @@
+package qemu
+
+import "github.com/fd/switchboard/pkg/link"
+
+func init() {
+	// id is "NETWORK:ADDRESS[,GATEWAY-CIDR]" (eg. "unix:/tmp/switchboard.sock")
+	link.Register("qemu", func(id string) (link.Link, error) {
+		network, address, addr, err := parseID(id)
+		if err != nil {
+			return nil, err
+		}
+		return Open(network, address, addr)
+	})
+}
@@ -0,0 +1,398 @@
+package qemu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fd/switchboard/pkg/link"
+)
+
+// MaxPacketSize is the largest frame exchanged with the peer (1500 MTU plus
+// the ethernet header).
+const MaxPacketSize = 1514
+
+// DefaultAddress is the address of the gateway (this host) when none is
+// given. The controller and the peer get the next addresses in the subnet;
+// the peer must be configured with its address and the controller as its
+// router.
+const DefaultAddress = "192.168.165.1/24"
+
+// PeerName is the name the peer is registered with.
+const PeerName = "qemu"
+
+var (
+	ErrNotConnected   = errors.New("qemu: no peer connected")
+	ErrInvalidAddress = errors.New("qemu: invalid gateway address")
+)
+
+// Interface is a link to a QEMU (or compatible) peer using the -netdev stream
+// or -netdev dgram socket protocol. The switchboard side listens, the peer
+// connects:
+//
+//	qemu ... -netdev stream,id=sb,server=off,addr.type=unix,addr.path=/tmp/switchboard.sock
+//
+// Stream sockets (unix, tcp) carry frames prefixed with their length as a
+// 32-bit big-endian integer. Datagram sockets (unixgram, udp) carry one frame
+// per datagram.
+type Interface struct {
+	mtx    sync.Mutex
+	cnd    *sync.Cond
+	closed bool
+
+	network string
+	address string
+
+	// stream sockets
+	listener net.Listener
+	conn     net.Conn
+	writeMtx sync.Mutex
+
+	// datagram sockets
+	pconn net.PacketConn
+	peer  net.Addr
+
+	events chan link.Event
+	mac    net.HardwareAddr
+
+	gatewayIPv4    net.IP
+	controllerIPv4 net.IP
+	peerIPv4       net.IP
+}
+
+// Open listens on network/address for a peer. addr is the address of the
+// gateway in CIDR notation, the controller and the peer get the next
+// addresses in the subnet.
+func Open(network, address, addr string) (*Interface, error) {
+	if addr == "" {
+		addr = DefaultAddress
+	}
+
+	gatewayIP, subnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	gatewayIP = gatewayIP.To4()
+	if gatewayIP == nil {
+		return nil, ErrInvalidAddress
+	}
+	controllerIP := link.NextIP(gatewayIP)
+	peerIP := link.NextIP(controllerIP)
+	if !subnet.Contains(peerIP) {
+		return nil, ErrInvalidAddress
+	}
+
+	iface := &Interface{
+		network:        network,
+		address:        address,
+		events:         make(chan link.Event),
+		gatewayIPv4:    gatewayIP,
+		controllerIPv4: controllerIP,
+		peerIPv4:       peerIP,
+	}
+	iface.cnd = sync.NewCond(&iface.mtx)
+
+	iface.mac, err = link.RandomMAC()
+	if err != nil {
+		return nil, err
+	}
+
+	switch network {
+	case "unix", "tcp", "tcp4", "tcp6":
+		if network == "unix" {
+			// remove a stale socket
+			os.Remove(address)
+		}
+		iface.listener, err = net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		go iface.acceptLoop()
+
+	case "unixgram", "udp", "udp4", "udp6":
+		if network == "unixgram" {
+			// remove a stale socket
+			os.Remove(address)
+		}
+		iface.pconn, err = net.ListenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("qemu: unsupported network %q", network)
+	}
+
+	return iface, nil
+}
+
+// Addr returns the address the interface is listening on
+func (iface *Interface) Addr() net.Addr {
+	if iface.listener != nil {
+		return iface.listener.Addr()
+	}
+	return iface.pconn.LocalAddr()
+}
+
+func (iface *Interface) MaxPacketSize() int {
+	return MaxPacketSize
+}
+
+func (iface *Interface) HardwareAddr() net.HardwareAddr {
+	return iface.mac
+}
+
+func (iface *Interface) Config() link.Config {
+	return link.Config{
+		GatewayIPv4:    iface.gatewayIPv4,
+		ControllerIPv4: iface.controllerIPv4,
+		PeerName:       PeerName,
+		PeerIPv4:       iface.peerIPv4,
+	}
+}
+
+func (iface *Interface) Events() <-chan link.Event {
+	return iface.events
+}
+
+func (iface *Interface) Close() error {
+	iface.mtx.Lock()
+	if iface.closed {
+		iface.mtx.Unlock()
+		return nil
+	}
+	iface.closed = true
+	conn := iface.conn
+	iface.conn = nil
+	iface.cnd.Broadcast()
+	iface.mtx.Unlock()
+
+	close(iface.events)
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	var err error
+	if iface.listener != nil {
+		err = iface.listener.Close()
+	}
+	if iface.pconn != nil {
+		err = iface.pconn.Close()
+	}
+	if iface.network == "unix" || iface.network == "unixgram" {
+		os.Remove(iface.address)
+	}
+	return err
+}
+
+func (iface *Interface) ReadPacket(p []byte) (n int, flags uint32, err error) {
+	if iface == nil {
+		return 0, 0, io.EOF
+	}
+	if len(p) < MaxPacketSize {
+		return 0, 0, io.ErrShortBuffer
+	}
+
+	if iface.pconn != nil {
+		return iface.readDatagram(p)
+	}
+	return iface.readStream(p)
+}
+
+func (iface *Interface) WritePacket(p []byte, flags uint32) (n int, err error) {
+	if iface == nil {
+		return 0, io.EOF
+	}
+	if len(p) > MaxPacketSize {
+		return 0, io.ErrShortWrite
+	}
+
+	if iface.pconn != nil {
+		return iface.writeDatagram(p)
+	}
+	return iface.writeStream(p)
+}
+
+func (iface *Interface) readDatagram(p []byte) (int, uint32, error) {
+	for {
+		n, addr, err := iface.pconn.ReadFrom(p)
+		if err != nil {
+			if iface.isClosed() {
+				return 0, 0, io.EOF
+			}
+			return 0, 0, err
+		}
+		if n == 0 {
+			continue
+		}
+
+		iface.mtx.Lock()
+		iface.peer = addr
+		iface.mtx.Unlock()
+
+		return n, 0, nil
+	}
+}
+
+func (iface *Interface) writeDatagram(p []byte) (int, error) {
+	iface.mtx.Lock()
+	closed, peer := iface.closed, iface.peer
+	iface.mtx.Unlock()
+
+	if closed {
+		return 0, io.EOF
+	}
+	if peer == nil {
+		return 0, ErrNotConnected
+	}
+
+	return iface.pconn.WriteTo(p, peer)
+}
+
+func (iface *Interface) readStream(p []byte) (int, uint32, error) {
+	var hdr [4]byte
+
+	for {
+		conn, err := iface.waitForConn()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		_, err = io.ReadFull(conn, hdr[:])
+		if err == nil {
+			size := int(binary.BigEndian.Uint32(hdr[:]))
+			if size > len(p) {
+				// skip oversized frames
+				_, err = io.CopyN(ioutil.Discard, conn, int64(size))
+				if err == nil {
+					log.Printf("QEMU/error: dropped frame of %d bytes", size)
+					continue
+				}
+			} else {
+				_, err = io.ReadFull(conn, p[:size])
+				if err == nil {
+					return size, 0, nil
+				}
+			}
+		}
+
+		iface.dropConn(conn, err)
+	}
+}
+
+func (iface *Interface) writeStream(p []byte) (int, error) {
+	iface.mtx.Lock()
+	closed, conn := iface.closed, iface.conn
+	iface.mtx.Unlock()
+
+	if closed {
+		return 0, io.EOF
+	}
+	if conn == nil {
+		return 0, ErrNotConnected
+	}
+
+	buf := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	copy(buf[4:], p)
+
+	iface.writeMtx.Lock()
+	_, err := conn.Write(buf)
+	iface.writeMtx.Unlock()
+	if err != nil {
+		iface.dropConn(conn, err)
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (iface *Interface) acceptLoop() {
+	for {
+		conn, err := iface.listener.Accept()
+		if err != nil {
+			if iface.isClosed() {
+				return
+			}
+			log.Printf("QEMU/error: %s", err)
+			continue
+		}
+
+		log.Printf("QEMU: peer connected (%s)", conn.RemoteAddr())
+
+		iface.mtx.Lock()
+		if iface.closed {
+			iface.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		prev := iface.conn
+		iface.conn = conn
+		iface.cnd.Broadcast()
+		iface.mtx.Unlock()
+
+		// a new peer replaces the previous one
+		if prev != nil {
+			prev.Close()
+		}
+	}
+}
+
+func (iface *Interface) waitForConn() (net.Conn, error) {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+
+	for iface.conn == nil && !iface.closed {
+		iface.cnd.Wait()
+	}
+	if iface.closed {
+		return nil, io.EOF
+	}
+	return iface.conn, nil
+}
+
+func (iface *Interface) dropConn(conn net.Conn, err error) {
+	iface.mtx.Lock()
+	if iface.conn == conn {
+		iface.conn = nil
+	}
+	closed := iface.closed
+	iface.mtx.Unlock()
+
+	conn.Close()
+
+	if !closed && err != io.EOF {
+		log.Printf("QEMU/error: %s", err)
+	}
+	if !closed {
+		log.Printf("QEMU: peer disconnected")
+	}
+}
+
+func (iface *Interface) isClosed() bool {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	return iface.closed
+}
+
+// parseID splits "NETWORK:ADDRESS[,GATEWAY-CIDR]"
+func parseID(id string) (network, address, addr string, err error) {
+	if idx := strings.LastIndexByte(id, ','); idx >= 0 {
+		id, addr = id[:idx], id[idx+1:]
+	}
+
+	idx := strings.IndexByte(id, ':')
+	if idx <= 0 {
+		return "", "", "", fmt.Errorf("qemu: invalid link id %q (expected NETWORK:ADDRESS)", id)
+	}
+
+	return id[:idx], id[idx+1:], addr, nil
+}
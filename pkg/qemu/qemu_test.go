@@ -0,0 +1,119 @@
+package qemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestStreamFraming(t *testing.T) {
+	iface, err := Open("tcp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iface.Close()
+
+	conn, err := net.Dial("tcp", iface.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	frame := bytes.Repeat([]byte{0xab}, 60)
+
+	// peer -> switchboard
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+	conn.Write(hdr[:])
+	conn.Write(frame)
+
+	buf := make([]byte, iface.MaxPacketSize())
+	n, _, err := iface.ReadPacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], frame) {
+		t.Fatalf("expected %x, got %x", frame, buf[:n])
+	}
+
+	// switchboard -> peer
+	_, err = iface.WritePacket(frame[:42], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.ReadFull(conn, hdr[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.BigEndian.Uint32(hdr[:]); size != 42 {
+		t.Fatalf("expected frame size 42, got %d", size)
+	}
+	out := make([]byte, 42)
+	_, err = io.ReadFull(conn, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, frame[:42]) {
+		t.Fatalf("expected %x, got %x", frame[:42], out)
+	}
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	iface, err := Open("tcp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := iface.ReadPacket(make([]byte, MaxPacketSize))
+		done <- err
+	}()
+
+	iface.Close()
+
+	if err := <-done; err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestParseID(t *testing.T) {
+	network, address, addr, err := parseID("unix:/tmp/switchboard.sock,10.0.0.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network != "unix" || address != "/tmp/switchboard.sock" || addr != "10.0.0.1/24" {
+		t.Fatalf("unexpected result: %q %q %q", network, address, addr)
+	}
+
+	_, _, _, err = parseID("/tmp/switchboard.sock")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	iface, err := Open("tcp", "127.0.0.1:0", "10.0.0.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iface.Close()
+
+	c := iface.Config()
+	if c.RemoteGateway {
+		t.Fatal("expected a local gateway")
+	}
+	if !c.GatewayIPv4.Equal(net.IPv4(10, 0, 0, 1)) ||
+		!c.ControllerIPv4.Equal(net.IPv4(10, 0, 0, 2)) ||
+		!c.PeerIPv4.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+
+	_, err = Open("tcp", "127.0.0.1:0", "10.0.0.1/31")
+	if err != ErrInvalidAddress {
+		t.Fatalf("expected %q, got %v", ErrInvalidAddress, err)
+	}
+}
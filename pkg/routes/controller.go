@@ -1,42 +1,90 @@
 package routes
 
 import (
+	"container/heap"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fd/switchboard/pkg/ports"
 )
 
+// DefaultCapacity is the default maximum number of flows.
+const DefaultCapacity = 1 << 18
+
 type Controller struct {
 	ports *ports.Mapper
+	table *Table
+
+	mtx      sync.Mutex
+	flows    flowList
+	expiry   expiryHeap
+	capacity int
+	timeouts *Timeouts
 
-	mtx    sync.Mutex
-	routes []*Route
+	// rescheduled holds the flows which must be put back in the expiry heap
+	// (their timeout changed)
+	rescheduledMtx sync.Mutex
+	rescheduled    []*Flow
 
-	tableMtx sync.RWMutex
-	table    *Table
+	// expired holds the counters of the expired and killed flows
+	expired map[usageKey]*Usage
+
+	subsMtx sync.RWMutex
+	subs    map[*Subscription]struct{}
 }
 
 func NewController(ports *ports.Mapper) *Controller {
+	timeouts := DefaultTimeouts()
 	return &Controller{
-		ports: ports,
-		table: &Table{},
+		ports:    ports,
+		table:    newTable(),
+		capacity: DefaultCapacity,
+		timeouts: &timeouts,
 	}
 }
 
-func (c *Controller) GetTable() *Table {
-	c.tableMtx.RLock()
-	defer c.tableMtx.RUnlock()
+// SetTimeouts sets the timeouts of new and existing flows.
+func (c *Controller) SetTimeouts(timeouts Timeouts) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.timeouts = &timeouts
+	for _, f := range c.expiry {
+		f.timeouts = c.timeouts
+		f.deadline = f.expiresAt()
+	}
+	heap.Init(&c.expiry)
+}
 
+// SetCapacity sets the maximum number of flows. When the table is full the
+// least recently used flows are evicted.
+func (c *Controller) SetCapacity(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.capacity = n
+
+	now := time.Now()
+	for c.flows.len > c.capacity && c.evict(now) {
+	}
+}
+
+// GetTable returns the table used to look up routes. The table is safe for
+// concurrent use.
+func (c *Controller) GetTable() *Table {
 	return c.table
 }
 
+// AddRoute adds route and its reverse. When the outbound source port is not
+// set a port is allocated for the host; otherwise the route takes ownership
+// of the port the caller allocated (once it was added). The port is released
+// when the route expires or is killed.
 func (c *Controller) AddRoute(route *Route) (*Route, error) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	tab := c.GetTable()
 	route = route.Clone()
 
 	if !route.Protocol.Valid() {
@@ -80,55 +128,152 @@ func (c *Controller) AddRoute(route *Route) (*Route, error) {
 		route.Outbound.DstIP = route.Outbound.DstIP.To16()
 	}
 
-	if p, err := c.ports.Allocate(route.HostID, route.Protocol, route.Outbound.SrcPort); err == nil {
+	now := time.Now()
+
+	if c.flows.len >= c.capacity && !c.evict(now) {
+		return nil, errors.New("flow table is full")
+	}
+
+	var allocated bool
+	if route.Outbound.SrcPort == 0 {
+		p, err := c.ports.Allocate(route.HostID, route.Protocol, 0, ports.OwnerRoute)
+		if err != nil {
+			return nil, err
+		}
 		route.Outbound.SrcPort = p
-	} else {
-		return nil, err
+		allocated = true
 	}
 
-	if tab.Lookup(route.Protocol,
+	if c.table.Lookup(route.Protocol,
 		route.Inbound.SrcIP, route.Inbound.DstIP,
 		route.Inbound.SrcPort, route.Inbound.DstPort) != nil {
-		c.ports.Release(route.HostID, route.Protocol, route.Outbound.SrcPort)
+		if allocated {
+			c.ports.Release(route.HostID, route.Protocol, route.Outbound.SrcPort)
+		}
 		return nil, errors.New("route already exists")
 	}
-	if tab.Lookup(route.Protocol,
+	if c.table.Lookup(route.Protocol,
 		route.Outbound.DstIP, route.Outbound.SrcIP,
 		route.Outbound.DstPort, route.Outbound.SrcPort) != nil {
-		c.ports.Release(route.HostID, route.Protocol, route.Outbound.SrcPort)
+		if allocated {
+			c.ports.Release(route.HostID, route.Protocol, route.Outbound.SrcPort)
+		}
 		return nil, errors.New("route already exists (reverse)")
 	}
 
-	route.buildFlow()
+	flow := route.buildFlow()
+	flow.timeouts = c.timeouts
+	flow.ctrl = c
+
+	c.table.insert(flow.rxRoute)
+	c.table.insert(flow.txRoute)
+	c.flows.pushFront(flow)
+	flow.deadline = flow.expiresAt()
+	heap.Push(&c.expiry, flow)
 
-	c.routes = append(c.routes, route)
-	c.routes = append(c.routes, route.reverse())
-	c.updateTable()
+	c.publish(RouteCreated, route, now)
 
 	return route, nil
 }
 
+// Expire removes the flows which were idle for longer than their timeout.
 func (c *Controller) Expire() {
+	c.expire(time.Now())
+}
+
+func (c *Controller) expire(now time.Time) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	now := time.Now()
+	c.rescheduledMtx.Lock()
+	for i, f := range c.rescheduled {
+		if f.index >= 0 {
+			f.deadline = f.expiresAt()
+			heap.Fix(&c.expiry, f.index)
+		}
+		c.rescheduled[i] = nil
+	}
+	c.rescheduled = c.rescheduled[:0]
+	c.rescheduledMtx.Unlock()
 
-	routes := make([]*Route, 0, len(c.routes))
-	for _, route := range c.routes {
-		if !route.flow.Expired(now) {
-			routes = append(routes, route)
+	t := now.Unix()
+	for len(c.expiry) > 0 {
+		f := c.expiry[0]
+		if f.deadline > t {
+			// the other flows expire later
+			return
 		}
+
+		if f.Expired(now) {
+			c.removeFlow(f, RouteExpired, now)
+			continue
+		}
+
+		// the flow was used since it was put in the heap
+		f.deadline = f.expiresAt()
+		heap.Fix(&c.expiry, 0)
+	}
+}
+
+// reschedule puts f back in the expiry heap on the next call to Expire.
+func (c *Controller) reschedule(f *Flow) {
+	c.rescheduledMtx.Lock()
+	c.rescheduled = append(c.rescheduled, f)
+	c.rescheduledMtx.Unlock()
+}
+
+// Kill removes the flow of route (in both directions). It returns false when
+// the flow was already removed.
+func (c *Controller) Kill(route *Route) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	flow := route.flow
+	if flow == nil || !flow.linked {
+		return false
 	}
 
-	c.routes = routes
-	c.updateTable()
+	c.removeFlow(flow, RouteKilled, time.Now())
+	return true
 }
 
-func (c *Controller) updateTable() {
-	tab := buildTable(c.routes)
+// evict removes the least recently used flow. Flows which were used since
+// they were put in the list get a second chance. It must be called with c.mtx
+// held.
+func (c *Controller) evict(now time.Time) bool {
+	for i := c.flows.len; i > 0; i-- {
+		f := c.flows.back()
+
+		if seen := atomic.LoadInt64(&f.lastSeen); seen > f.listed && i > 1 {
+			f.listed = seen
+			c.flows.moveToFront(f)
+			continue
+		}
+
+		c.removeFlow(f, RouteEvicted, now)
+		return true
+	}
+	return false
+}
+
+// removeFlow removes the routes of flow and releases its port. It must be
+// called with c.mtx held.
+func (c *Controller) removeFlow(flow *Flow, typ EventType, now time.Time) {
+	route := flow.rxRoute
+
+	c.table.remove(flow.rxRoute)
+	c.table.remove(flow.txRoute)
+	c.flows.remove(flow)
+	if flow.index >= 0 {
+		heap.Remove(&c.expiry, flow.index)
+	}
+
+	c.ports.Release(route.HostID, route.Protocol, route.Outbound.SrcPort)
+
+	if c.expired == nil {
+		c.expired = make(map[usageKey]*Usage)
+	}
+	addUsage(c.expired, route, false)
 
-	c.tableMtx.Lock()
-	c.table = tab
-	c.tableMtx.Unlock()
+	c.publish(typ, route, now)
 }
@@ -48,7 +48,7 @@ func Example() {
 		},
 	})
 
-	for _, route := range ctrl.GetTable().routes {
+	for _, route := range ctrl.GetTable().Routes() {
 		fmt.Printf("%s\n", route)
 	}
 
@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of change in the lifecycle of a route.
+type EventType uint8
+
+const (
+	RouteCreated EventType = 1 + iota
+	RouteExpired
+	RouteKilled
+	RouteEvicted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case RouteCreated:
+		return "created"
+	case RouteExpired:
+		return "expired"
+	case RouteKilled:
+		return "killed"
+	case RouteEvicted:
+		return "evicted"
+	default:
+		return "invalid"
+	}
+}
+
+// Event reports a route which was created or removed (routes are evicted
+// when the table is full). Route is the route as it was added (not its
+// reverse); Stats are the counters of its flow at the time of the event.
+// Routes must not be modified by subscribers.
+type Event struct {
+	Type  EventType
+	Time  time.Time
+	Route *Route
+	Stats Stats
+}
+
+// Subscription receives the route events of a controller.
+type Subscription struct {
+	ctrl      *Controller
+	c         chan Event
+	dropped   uint64
+	closeOnce sync.Once
+}
+
+// Subscribe to route events. At most size events are buffered, additional
+// events are dropped.
+func (c *Controller) Subscribe(size int) *Subscription {
+	sub := &Subscription{
+		ctrl: c,
+		c:    make(chan Event, size),
+	}
+
+	c.subsMtx.Lock()
+	if c.subs == nil {
+		c.subs = make(map[*Subscription]struct{})
+	}
+	c.subs[sub] = struct{}{}
+	c.subsMtx.Unlock()
+
+	return sub
+}
+
+func (c *Controller) publish(typ EventType, route *Route, now time.Time) {
+	c.subsMtx.RLock()
+	defer c.subsMtx.RUnlock()
+
+	if len(c.subs) == 0 {
+		return
+	}
+
+	event := Event{
+		Type:  typ,
+		Time:  now,
+		Route: route,
+		Stats: route.flow.Stats(),
+	}
+
+	for sub := range c.subs {
+		select {
+		case sub.c <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// C returns the channel events are delivered on
+func (sub *Subscription) C() <-chan Event {
+	return sub.c
+}
+
+// Dropped returns the number of events which were dropped because the
+// subscriber didn't keep up
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close the subscription
+func (sub *Subscription) Close() {
+	sub.closeOnce.Do(func() {
+		c := sub.ctrl
+
+		c.subsMtx.Lock()
+		delete(c.subs, sub)
+		c.subsMtx.Unlock()
+	})
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/ports"
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	select {
+	case event := <-sub.C():
+		return event
+	default:
+		t.Fatal("expected an event")
+		return Event{}
+	}
+}
+
+func allocatedPorts(pm *ports.Mapper, hostID string) int {
+	for _, a := range pm.Allocations() {
+		if a.HostID == hostID {
+			return a.TCP + a.UDP
+		}
+	}
+	return 0
+}
+
+func TestRouteEvents(t *testing.T) {
+	pm := ports.NewMapper()
+	ctrl := NewController(pm)
+
+	sub := ctrl.Subscribe(8)
+	defer sub.Close()
+
+	rx, tx := addTestFlow(t, ctrl, protocols.UDP)
+	if event := nextEvent(t, sub); event.Type != RouteCreated || event.Route != rx {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	// killing either direction removes the flow
+	if !ctrl.Kill(tx) {
+		t.Fatal("expected the flow to be killed")
+	}
+	if ctrl.Kill(rx) {
+		t.Fatal("expected the flow to be gone")
+	}
+	if event := nextEvent(t, sub); event.Type != RouteKilled || event.Route != rx {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if ctrl.GetTable().Len() != 0 {
+		t.Fatalf("expected no routes")
+	}
+
+	rx, _ = addTestFlow(t, ctrl, protocols.UDP)
+	nextEvent(t, sub)
+
+	ctrl.expire(time.Now().Add(time.Hour))
+	if event := nextEvent(t, sub); event.Type != RouteExpired || event.Route != rx {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
+
+func TestRouteReleasesPorts(t *testing.T) {
+	pm := ports.NewMapper()
+	ctrl := NewController(pm)
+
+	route, err := ctrl.AddRoute(&Route{
+		Protocol: protocols.TCP,
+		HostID:   "host-a",
+		Inbound: Stream{
+			SrcIP:   []byte{127, 0, 0, 1},
+			SrcPort: 22001,
+			DstIP:   []byte{127, 0, 0, 2},
+			DstPort: 1024,
+		},
+		Outbound: Stream{
+			DstIP:   []byte{127, 0, 0, 3},
+			DstPort: 1024,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := allocatedPorts(pm, "host-a"); n != 1 {
+		t.Fatalf("expected 1 allocated port, got %d", n)
+	}
+
+	ctrl.expire(time.Now().Add(time.Hour))
+	if n := allocatedPorts(pm, "host-a"); n != 0 {
+		t.Fatalf("expected the port to be released, got %d", n)
+	}
+
+	// ports allocated by the caller are owned by the route
+	port, err := pm.Allocate("host-a", protocols.TCP, 0, ports.OwnerRoute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err = ctrl.AddRoute(&Route{
+		Protocol: protocols.TCP,
+		HostID:   "host-a",
+		Inbound: Stream{
+			SrcIP:   []byte{127, 0, 0, 1},
+			SrcPort: 22001,
+			DstIP:   []byte{127, 0, 0, 2},
+			DstPort: 1024,
+		},
+		Outbound: Stream{
+			SrcIP:   []byte{127, 0, 0, 2},
+			SrcPort: port,
+			DstIP:   []byte{127, 0, 0, 3},
+			DstPort: 1024,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := allocatedPorts(pm, "host-a"); n != 1 {
+		t.Fatalf("expected 1 allocated port, got %d", n)
+	}
+
+	ctrl.Kill(route)
+	if n := allocatedPorts(pm, "host-a"); n != 0 {
+		t.Fatalf("expected the port to be released, got %d", n)
+	}
+}
@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// expiryHeap is a heap (see container/heap) of flows ordered by the time they
+// expire.
+type expiryHeap []*Flow
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	f := x.(*Flow)
+	f.index = len(*h)
+	*h = append(*h, f)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	f := old[n-1]
+	old[n-1] = nil
+	f.index = -1
+	*h = old[:n-1]
+	return f
+}
+
+// expiresAt returns the first second (unix time) at which the flow is
+// expired unless it is used again.
+func (f *Flow) expiresAt() int64 {
+	return atomic.LoadInt64(&f.lastSeen) + int64(f.Timeout()/time.Second) + 1
+}
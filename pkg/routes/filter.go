@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"net"
+
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+// Filter selects flows. The zero value of a field matches any flow; IP and
+// Port match either end of the inbound or the outbound stream.
+type Filter struct {
+	HostID   string
+	Protocol protocols.Protocol
+	IP       net.IP
+	Port     uint16
+}
+
+// Match returns true when the flow of route is selected by the filter.
+func (f *Filter) Match(route *Route) bool {
+	if f.HostID != "" && route.HostID != f.HostID {
+		return false
+	}
+	if f.Protocol != 0 && route.Protocol != f.Protocol {
+		return false
+	}
+	if f.IP == nil && f.Port == 0 {
+		return true
+	}
+
+	return f.matchEndpoint(route.Inbound.SrcIP, route.Inbound.SrcPort) ||
+		f.matchEndpoint(route.Inbound.DstIP, route.Inbound.DstPort) ||
+		f.matchEndpoint(route.Outbound.SrcIP, route.Outbound.SrcPort) ||
+		f.matchEndpoint(route.Outbound.DstIP, route.Outbound.DstPort)
+}
+
+func (f *Filter) matchEndpoint(ip net.IP, port uint16) bool {
+	if f.IP != nil && !f.IP.Equal(ip) {
+		return false
+	}
+	if f.Port != 0 && port != f.Port {
+		return false
+	}
+	return true
+}
+
+// Flows returns the routes of the flows selected by filter (as they were
+// added, not their reverse) sorted by their inbound 5-tuple.
+func (c *Controller) Flows(filter Filter) []*Route {
+	var routes []*Route
+	for _, route := range c.table.Routes() {
+		if route.flow.rxRoute == route && filter.Match(route) {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
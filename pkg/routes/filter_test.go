@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fd/switchboard/pkg/ports"
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+func TestFlows(t *testing.T) {
+	ctrl := NewController(ports.NewMapper())
+
+	add := func(proto protocols.Protocol, hostID string, src string, srcPort uint16) *Route {
+		route, err := ctrl.AddRoute(&Route{
+			Protocol: proto,
+			HostID:   hostID,
+			Inbound: Stream{
+				SrcIP:   net.ParseIP(src).To4(),
+				SrcPort: srcPort,
+				DstIP:   net.IPv4(172, 18, 0, 2).To4(),
+				DstPort: 80,
+			},
+			Outbound: Stream{
+				SrcIP:   net.IPv4(172, 18, 0, 2).To4(),
+				SrcPort: srcPort,
+				DstIP:   net.IPv4(172, 18, 0, 3).To4(),
+				DstPort: 8080,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return route
+	}
+
+	a := add(protocols.TCP, "host-a", "10.0.0.1", 40001)
+	b := add(protocols.UDP, "host-a", "10.0.0.2", 40002)
+	c := add(protocols.TCP, "host-b", "10.0.0.2", 40003)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		routes []*Route
+	}{
+		{"all", Filter{}, []*Route{a, c, b}},
+		{"host", Filter{HostID: "host-a"}, []*Route{a, b}},
+		{"protocol", Filter{Protocol: protocols.UDP}, []*Route{b}},
+		{"ip", Filter{IP: net.ParseIP("10.0.0.2")}, []*Route{c, b}},
+		{"ip and port", Filter{IP: net.ParseIP("10.0.0.2"), Port: 40003}, []*Route{c}},
+		{"outbound", Filter{IP: net.ParseIP("172.18.0.3"), Port: 8080}, []*Route{a, c, b}},
+		{"port", Filter{Port: 40001}, []*Route{a}},
+		{"mismatched port", Filter{IP: net.ParseIP("10.0.0.1"), Port: 80}, nil},
+		{"combined", Filter{HostID: "host-a", Protocol: protocols.TCP, IP: net.ParseIP("10.0.0.2")}, nil},
+	}
+
+	for _, test := range tests {
+		routes := ctrl.Flows(test.filter)
+		if len(routes) != len(test.routes) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.routes, routes)
+			continue
+		}
+		for i := range routes {
+			if routes[i] != test.routes[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.routes, routes)
+				break
+			}
+		}
+	}
+}
@@ -3,6 +3,8 @@ package routes
 import (
 	"sync/atomic"
 	"time"
+
+	"github.com/fd/switchboard/pkg/protocols"
 )
 
 type Stats struct {
@@ -14,15 +16,29 @@ type Stats struct {
 }
 
 type Flow struct {
-	timeout int64
-	rxRoute *Route
-	txRoute *Route
+	protocol protocols.Protocol
+	timeouts *Timeouts
+	rxRoute  *Route
+	txRoute  *Route
 
 	lastSeen  int64
+	tcpState  uint32
 	rxBytes   uint64
 	txBytes   uint64
 	rxPackets uint64
 	txPackets uint64
+
+	// the flows of a controller are kept in a list from the most to the
+	// least recently used (see Controller.evict)
+	prev, next *Flow
+	linked     bool
+	listed     int64 // lastSeen when the flow was put in front
+
+	// the flows of a controller are also kept in a heap ordered by the time
+	// they expire (see Controller.Expire)
+	ctrl     *Controller
+	index    int   // in the heap, -1 once removed
+	deadline int64 // expiresAt when the flow was put in the heap
 }
 
 func (f *Flow) Stats() Stats {
@@ -35,9 +51,62 @@ func (f *Flow) Stats() Stats {
 	}
 }
 
+// TCPState returns the state of the connection of a TCP flow.
+func (f *Flow) TCPState() TCPState {
+	return tcpState(atomic.LoadUint32(&f.tcpState))
+}
+
+// Timeout returns the time the flow is kept after its last packet.
+func (f *Flow) Timeout() time.Duration {
+	t := f.timeouts
+	if t == nil {
+		d := DefaultTimeouts()
+		t = &d
+	}
+
+	if f.protocol == protocols.TCP {
+		switch f.TCPState() {
+		case TCPEstablished:
+			return t.TCPEstablished
+		case TCPFinWait:
+			return t.TCPFinWait
+		case TCPTimeWait:
+			return t.TCPTimeWait
+		case TCPClosed:
+			return t.TCPClosed
+		default:
+			return t.TCPSynSent
+		}
+	}
+
+	rx := atomic.LoadUint64(&f.rxPackets)
+	tx := atomic.LoadUint64(&f.txPackets)
+	if rx > 0 && tx > 0 && rx+tx > 2 {
+		return t.UDPStream
+	}
+	return t.UDP
+}
+
 func (f *Flow) Expired(now time.Time) bool {
 	l := atomic.LoadInt64(&f.lastSeen)
-	return l < (now.Unix() - f.timeout)
+	return l < (now.Unix() - int64(f.Timeout()/time.Second))
+}
+
+func (f *Flow) trackTCP(rx bool, flags TCPFlags) {
+	for {
+		old := atomic.LoadUint32(&f.tcpState)
+		s := nextTCPState(old, rx, flags)
+		if s == old {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&f.tcpState, old, s) {
+			if tcpState(s) != tcpState(old) && f.ctrl != nil {
+				// the timeout of the flow may be shorter now
+				f.ctrl.reschedule(f)
+			}
+			return
+		}
+	}
 }
 
 func (f *Flow) touch(now time.Time) {
@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/ports"
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+func addTestFlow(t *testing.T, ctrl *Controller, proto protocols.Protocol) (rx, tx *Route) {
+	route, err := ctrl.AddRoute(&Route{
+		Protocol: proto,
+		HostID:   "host-a",
+		Inbound: Stream{
+			SrcIP:   net.IPv4(127, 0, 0, 1),
+			SrcPort: 22001,
+			DstIP:   net.IPv4(127, 0, 0, 2),
+			DstPort: 1024,
+		},
+		Outbound: Stream{
+			SrcIP:   net.IPv4(127, 0, 0, 2),
+			SrcPort: 22001,
+			DstIP:   net.IPv4(127, 0, 0, 3),
+			DstPort: 1024,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return route, route.reverse()
+}
+
+func TestTCPState(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []TCPFlags // alternating rx, tx
+		state   TCPState
+	}{
+		{"syn", []TCPFlags{TCPSyn}, TCPSynSent},
+		{"syn-ack", []TCPFlags{TCPSyn, TCPSyn | TCPAck}, TCPSynSent},
+		{"established", []TCPFlags{TCPSyn, TCPSyn | TCPAck, TCPAck}, TCPEstablished},
+		{"picked up", []TCPFlags{TCPAck, TCPAck}, TCPEstablished},
+		{"half picked up", []TCPFlags{TCPAck}, TCPSynSent},
+		{"fin", []TCPFlags{TCPSyn, TCPSyn | TCPAck, TCPAck, TCPFin | TCPAck}, TCPFinWait},
+		{"fin fin", []TCPFlags{TCPSyn, TCPSyn | TCPAck, TCPAck, TCPFin | TCPAck, TCPFin | TCPAck}, TCPTimeWait},
+		{"rst", []TCPFlags{TCPSyn, TCPRst}, TCPClosed},
+	}
+
+	for _, test := range tests {
+		ctrl := NewController(ports.NewMapper())
+		rx, tx := addTestFlow(t, ctrl, protocols.TCP)
+
+		for i, flags := range test.packets {
+			route := rx
+			if i%2 == 1 {
+				route = tx
+			}
+			route.RoutedTCPPacket(time.Now(), 60, flags)
+		}
+
+		if s := rx.Flow().TCPState(); s != test.state {
+			t.Errorf("%s: expected %s, got %s", test.name, test.state, s)
+		}
+	}
+}
+
+func TestFlowTimeout(t *testing.T) {
+	ctrl := NewController(ports.NewMapper())
+	ctrl.SetTimeouts(Timeouts{
+		TCPSynSent:     10 * time.Second,
+		TCPEstablished: 1000 * time.Second,
+		TCPClosed:      2 * time.Second,
+		UDP:            20 * time.Second,
+		UDPStream:      200 * time.Second,
+	})
+
+	now := time.Now()
+
+	rx, tx := addTestFlow(t, ctrl, protocols.TCP)
+	flow := rx.Flow()
+	rx.RoutedTCPPacket(now, 60, TCPSyn)
+	if d := flow.Timeout(); d != 10*time.Second {
+		t.Errorf("unexpected timeout: %s", d)
+	}
+	tx.RoutedTCPPacket(now, 60, TCPSyn|TCPAck)
+	rx.RoutedTCPPacket(now, 60, TCPAck)
+	if d := flow.Timeout(); d != 1000*time.Second {
+		t.Errorf("unexpected timeout: %s", d)
+	}
+	if flow.Expired(now.Add(500 * time.Second)) {
+		t.Errorf("expected an established flow to be kept")
+	}
+	tx.RoutedTCPPacket(now, 60, TCPRst)
+	if !flow.Expired(now.Add(5 * time.Second)) {
+		t.Errorf("expected a reset flow to expire")
+	}
+
+	ctrl = NewController(ports.NewMapper())
+	rx, tx = addTestFlow(t, ctrl, protocols.UDP)
+	flow = rx.Flow()
+	rx.RoutedPacket(now, 60)
+	tx.RoutedPacket(now, 60)
+	if d := flow.Timeout(); d != DefaultTimeouts().UDP {
+		t.Errorf("unexpected timeout: %s", d)
+	}
+	rx.RoutedPacket(now, 60)
+	if d := flow.Timeout(); d != DefaultTimeouts().UDPStream {
+		t.Errorf("unexpected timeout: %s", d)
+	}
+}
+
+func TestExpireOrder(t *testing.T) {
+	ctrl := NewController(ports.NewMapper())
+	ctrl.SetTimeouts(Timeouts{
+		TCPSynSent:     10 * time.Second,
+		TCPEstablished: 1000 * time.Second,
+		TCPClosed:      2 * time.Second,
+		UDP:            20 * time.Second,
+	})
+
+	now := time.Now()
+
+	rx, tx := addTestFlow(t, ctrl, protocols.TCP)
+	rx.RoutedTCPPacket(now, 60, TCPSyn)
+	tx.RoutedTCPPacket(now, 60, TCPSyn|TCPAck)
+	rx.RoutedTCPPacket(now, 60, TCPAck)
+	udp, _ := addTestFlow(t, ctrl, protocols.UDP)
+
+	// the established flow is kept after the UDP flow expired
+	ctrl.expire(now.Add(30 * time.Second))
+	if udp.Flow().linked || !rx.Flow().linked {
+		t.Fatal("expected only the UDP flow to expire")
+	}
+
+	// a reset moves the flow forward in the heap
+	tx.RoutedTCPPacket(now.Add(40*time.Second), 60, TCPRst)
+	ctrl.expire(now.Add(45 * time.Second))
+	if rx.Flow().linked {
+		t.Fatal("expected the reset flow to expire")
+	}
+	if len(ctrl.expiry) != 0 {
+		t.Fatalf("expected an empty heap, got %d flows", len(ctrl.expiry))
+	}
+}
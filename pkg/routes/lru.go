@@ -0,0 +1,55 @@
+package routes
+
+import "sync/atomic"
+
+// flowList is a doubly linked list of flows.
+type flowList struct {
+	head, tail *Flow
+	len        int
+}
+
+func (l *flowList) front() *Flow { return l.head }
+func (l *flowList) back() *Flow  { return l.tail }
+
+func (l *flowList) pushFront(f *Flow) {
+	f.prev = nil
+	f.next = l.head
+	if l.head != nil {
+		l.head.prev = f
+	} else {
+		l.tail = f
+	}
+	l.head = f
+	f.linked = true
+	f.listed = atomic.LoadInt64(&f.lastSeen)
+	l.len++
+}
+
+func (l *flowList) remove(f *Flow) {
+	if !f.linked {
+		return
+	}
+
+	if f.prev != nil {
+		f.prev.next = f.next
+	} else {
+		l.head = f.next
+	}
+	if f.next != nil {
+		f.next.prev = f.prev
+	} else {
+		l.tail = f.prev
+	}
+
+	f.prev, f.next = nil, nil
+	f.linked = false
+	l.len--
+}
+
+func (l *flowList) moveToFront(f *Flow) {
+	if l.head == f {
+		return
+	}
+	l.remove(f)
+	l.pushFront(f)
+}
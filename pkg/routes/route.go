@@ -12,6 +12,7 @@ import (
 type Route struct {
 	Protocol protocols.Protocol
 	HostID   string
+	RuleID   string
 
 	Inbound  Stream
 	Outbound Stream
@@ -64,6 +65,18 @@ func (r *Route) RoutedPacket(now time.Time, size int) {
 	}
 }
 
+// RoutedTCPPacket is RoutedPacket for TCP packets; flags move the
+// connection state of the flow.
+func (r *Route) RoutedTCPPacket(now time.Time, size int, flags TCPFlags) {
+	r.flow.trackTCP(r == r.flow.rxRoute, flags)
+	r.RoutedPacket(now, size)
+}
+
+// Flow returns the flow the route belongs to.
+func (r *Route) Flow() *Flow {
+	return r.flow
+}
+
 func (r *Route) Clone() *Route {
 	clone := new(Route)
 	*clone = *r
@@ -77,12 +90,12 @@ func (r *Route) buildFlow() *Flow {
 	}
 
 	flow := &Flow{}
+	flow.protocol = r.Protocol
 	flow.rxRoute = r
 	flow.txRoute = r.reverse()
 	flow.rxRoute.flow = flow
 	flow.txRoute.flow = flow
 
-	flow.timeout = 55 // 55 seconds
 	flow.touch(time.Now())
 
 	return flow
@@ -99,6 +112,7 @@ func (r *Route) reverse() *Route {
 	reverse := &Route{}
 	reverse.Protocol = r.Protocol
 	reverse.HostID = r.HostID
+	reverse.RuleID = r.RuleID
 
 	reverse.SetInboundSource(r.Outbound.DstIP, r.Outbound.DstPort)
 	reverse.SetInboundDestination(r.Outbound.SrcIP, r.Outbound.SrcPort)
@@ -1,52 +1,220 @@
 package routes
 
 import (
+	"encoding/binary"
 	"net"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/fd/switchboard/pkg/protocols"
 )
 
+// Table is a hash table of routes keyed by their inbound 5-tuple. Lookups
+// are lock-free: the buckets hold immutable chains of entries which are
+// replaced atomically by writers.
 type Table struct {
-	routes []*Route
+	mtx     sync.Mutex     // serializes writers
+	buckets unsafe.Pointer // *tableBuckets
+	count   int64
 }
 
-func buildTable(routes []*Route) *Table {
-	tab := &Table{
-		routes: make([]*Route, len(routes)),
-	}
+type tableBuckets struct {
+	mask  uint64
+	heads []unsafe.Pointer // *tableEntry
+}
 
-	copy(tab.routes, routes)
+type tableEntry struct {
+	key   flowKey
+	route *Route
+	next  *tableEntry
+}
 
-	sort.Sort(sortedByInbound(tab.routes))
+type flowKey struct {
+	proto   protocols.Protocol
+	srcPort uint16
+	dstPort uint16
+	srcIP   [16]byte
+	dstIP   [16]byte
+}
 
+const (
+	tableMinBuckets = 64
+	// tableMaxLoad is the average chain length at which the table grows
+	tableMaxLoad = 2
+)
+
+func newTable() *Table {
+	tab := &Table{}
+	atomic.StorePointer(&tab.buckets, unsafe.Pointer(newTableBuckets(tableMinBuckets)))
 	return tab
 }
 
+func newTableBuckets(n int) *tableBuckets {
+	return &tableBuckets{
+		mask:  uint64(n - 1),
+		heads: make([]unsafe.Pointer, n),
+	}
+}
+
+func makeFlowKey(proto protocols.Protocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) flowKey {
+	key := flowKey{proto: proto, srcPort: srcPort, dstPort: dstPort}
+	copyIP16(key.srcIP[:], srcIP)
+	copyIP16(key.dstIP[:], dstIP)
+	return key
+}
+
+// copyIP16 copies ip to dst in its 16 byte form (without allocating).
+func copyIP16(dst []byte, ip net.IP) {
+	if len(ip) == net.IPv4len {
+		copy(dst, v4InV6Prefix)
+		copy(dst[12:], ip)
+		return
+	}
+	copy(dst, ip)
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+func (k *flowKey) hash() uint64 {
+	const m = 0x9e3779b97f4a7c15
+
+	h := uint64(k.proto) | uint64(k.srcPort)<<8 | uint64(k.dstPort)<<24
+	for _, w := range [...]uint64{
+		binary.LittleEndian.Uint64(k.srcIP[:8]),
+		binary.LittleEndian.Uint64(k.srcIP[8:]),
+		binary.LittleEndian.Uint64(k.dstIP[:8]),
+		binary.LittleEndian.Uint64(k.dstIP[8:]),
+	} {
+		h = (h ^ w) * m
+		h ^= h >> 29
+	}
+	return h
+}
+
+func (b *tableBuckets) head(i uint64) *tableEntry {
+	return (*tableEntry)(atomic.LoadPointer(&b.heads[i]))
+}
+
+func (b *tableBuckets) setHead(i uint64, e *tableEntry) {
+	atomic.StorePointer(&b.heads[i], unsafe.Pointer(e))
+}
+
+func (tab *Table) load() *tableBuckets {
+	return (*tableBuckets)(atomic.LoadPointer(&tab.buckets))
+}
+
+// Lookup returns the route for a packet with the 5-tuple (nil when there is
+// none).
 func (tab *Table) Lookup(
 	proto protocols.Protocol,
 	srcIP, dstIP net.IP,
 	srcPort, dstPort uint16,
 ) *Route {
-	target := Route{}
-	target.Protocol = proto
-	target.SetInboundSource(srcIP.To16(), srcPort)
-	target.SetInboundDestination(dstIP.To16(), dstPort)
+	key := makeFlowKey(proto, srcIP, dstIP, srcPort, dstPort)
+	return tab.lookup(&key)
+}
+
+func (tab *Table) lookup(key *flowKey) *Route {
+	b := tab.load()
+	for e := b.head(key.hash() & b.mask); e != nil; e = e.next {
+		if e.key == *key {
+			return e.route
+		}
+	}
+	return nil
+}
+
+// Len returns the number of routes in the table.
+func (tab *Table) Len() int {
+	return int(atomic.LoadInt64(&tab.count))
+}
+
+// Routes returns the routes in the table sorted by their inbound 5-tuple.
+func (tab *Table) Routes() []*Route {
+	b := tab.load()
+
+	routes := make([]*Route, 0, tab.Len())
+	for i := range b.heads {
+		for e := b.head(uint64(i)); e != nil; e = e.next {
+			routes = append(routes, e.route)
+		}
+	}
+
+	sort.Sort(sortedByInbound(routes))
+	return routes
+}
+
+// insert adds route by its inbound 5-tuple. It returns false when there
+// already is a route for the 5-tuple.
+func (tab *Table) insert(route *Route) bool {
+	key := makeFlowKey(route.Protocol,
+		route.Inbound.SrcIP, route.Inbound.DstIP,
+		route.Inbound.SrcPort, route.Inbound.DstPort)
 
-	sze := len(tab.routes)
-	idx := sort.Search(sze, func(idx int) bool {
-		return !lessInbound(tab.routes[idx], &target)
-	})
+	tab.mtx.Lock()
+	defer tab.mtx.Unlock()
 
-	if idx >= sze {
-		return nil
+	if tab.lookup(&key) != nil {
+		return false
 	}
 
-	if lessInbound(&target, tab.routes[idx]) {
-		return nil
+	b := tab.load()
+	if n := atomic.LoadInt64(&tab.count) + 1; n > int64(len(b.heads))*tableMaxLoad {
+		b = tab.grow(b)
+	}
+
+	i := key.hash() & b.mask
+	b.setHead(i, &tableEntry{key: key, route: route, next: b.head(i)})
+	atomic.AddInt64(&tab.count, 1)
+	return true
+}
+
+// remove removes route. The entries in front of it in its chain are copied
+// so readers never see a partially updated chain.
+func (tab *Table) remove(route *Route) {
+	key := makeFlowKey(route.Protocol,
+		route.Inbound.SrcIP, route.Inbound.DstIP,
+		route.Inbound.SrcPort, route.Inbound.DstPort)
+
+	tab.mtx.Lock()
+	defer tab.mtx.Unlock()
+
+	b := tab.load()
+	i := key.hash() & b.mask
+
+	var prefix []*tableEntry
+	for e := b.head(i); e != nil; e = e.next {
+		if e.route != route {
+			prefix = append(prefix, e)
+			continue
+		}
+
+		next := e.next
+		for j := len(prefix) - 1; j >= 0; j-- {
+			next = &tableEntry{key: prefix[j].key, route: prefix[j].route, next: next}
+		}
+		b.setHead(i, next)
+		atomic.AddInt64(&tab.count, -1)
+		return
+	}
+}
+
+// grow doubles the number of buckets. Readers keep using the old buckets
+// until the new ones are published.
+func (tab *Table) grow(old *tableBuckets) *tableBuckets {
+	b := newTableBuckets(len(old.heads) * 2)
+
+	for i := range old.heads {
+		for e := old.head(uint64(i)); e != nil; e = e.next {
+			j := e.key.hash() & b.mask
+			b.heads[j] = unsafe.Pointer(&tableEntry{key: e.key, route: e.route, next: b.head(j)})
+		}
 	}
 
-	return tab.routes[idx]
+	atomic.StorePointer(&tab.buckets, unsafe.Pointer(b))
+	return b
 }
 
 type sortedByInbound []*Route
@@ -0,0 +1,213 @@
+package routes
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/ports"
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+// testRoute returns the i-th of a set of unique routes. Its outbound port is
+// set so no ports are allocated.
+func testRoute(i int) *Route {
+	ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()
+	port := uint16(1024 + i%50000)
+
+	return &Route{
+		Protocol: protocols.TCP,
+		HostID:   "host-a",
+		Inbound: Stream{
+			SrcIP:   ip,
+			SrcPort: port,
+			DstIP:   net.IPv4(172, 18, 0, 2).To4(),
+			DstPort: 80,
+		},
+		Outbound: Stream{
+			SrcIP:   ip,
+			SrcPort: port,
+			DstIP:   net.IPv4(172, 18, 0, 3).To4(),
+			DstPort: 8080,
+		},
+	}
+}
+
+func newTestController(tb testing.TB, n int) (*Controller, []*Route) {
+	ctrl := NewController(ports.NewMapper())
+
+	routes := make([]*Route, n)
+	for i := range routes {
+		route, err := ctrl.AddRoute(testRoute(i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		routes[i] = route
+	}
+
+	return ctrl, routes
+}
+
+func TestTable(t *testing.T) {
+	ctrl, routes := newTestController(t, 10000)
+	tab := ctrl.GetTable()
+
+	if n := tab.Len(); n != 20000 {
+		t.Fatalf("expected 20000 routes, got %d", n)
+	}
+
+	for i, route := range routes {
+		in := route.Inbound
+		if r := tab.Lookup(protocols.TCP, in.SrcIP, in.DstIP, in.SrcPort, in.DstPort); r != route {
+			t.Fatalf("%d: expected %s, got %s", i, route, r)
+		}
+		out := route.Outbound
+		if r := tab.Lookup(protocols.TCP, out.DstIP, out.SrcIP, out.DstPort, out.SrcPort); r != route.reverse() {
+			t.Fatalf("%d: expected the reverse of %s, got %s", i, route, r)
+		}
+	}
+
+	for _, route := range routes[:5000] {
+		ctrl.Kill(route)
+	}
+
+	if n := tab.Len(); n != 10000 {
+		t.Fatalf("expected 10000 routes, got %d", n)
+	}
+	for i, route := range routes {
+		in := route.Inbound
+		r := tab.Lookup(protocols.TCP, in.SrcIP, in.DstIP, in.SrcPort, in.DstPort)
+		if (i < 5000 && r != nil) || (i >= 5000 && r != route) {
+			t.Fatalf("%d: unexpected lookup result %s", i, r)
+		}
+	}
+}
+
+func TestTableConcurrentLookup(t *testing.T) {
+	ctrl, routes := newTestController(t, 1000)
+	tab := ctrl.GetTable()
+
+	var (
+		wg   sync.WaitGroup
+		stop int32
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				for _, route := range routes {
+					in := route.Inbound
+					if tab.Lookup(protocols.TCP, in.SrcIP, in.DstIP, in.SrcPort, in.DstPort) != route {
+						t.Errorf("lookup failed for %s", route)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// the table grows while it is read
+	for i := len(routes); i < 20000; i++ {
+		if _, err := ctrl.AddRoute(testRoute(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+func TestEvict(t *testing.T) {
+	ctrl, routes := newTestController(t, 3)
+	ctrl.SetCapacity(3)
+
+	sub := ctrl.Subscribe(8)
+	defer sub.Close()
+
+	// the oldest flow was used since it was added
+	atomic.AddInt64(&routes[0].flow.lastSeen, 1)
+
+	if _, err := ctrl.AddRoute(testRoute(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	event := nextEvent(t, sub)
+	if event.Type != RouteEvicted || event.Route != routes[1] {
+		t.Fatalf("expected %s to be evicted, got %s %s", routes[1], event.Type, event.Route)
+	}
+	if n := ctrl.GetTable().Len(); n != 6 {
+		t.Fatalf("expected 6 routes, got %d", n)
+	}
+
+	ctrl.SetCapacity(1)
+	if n := ctrl.GetTable().Len(); n != 2 {
+		t.Fatalf("expected 2 routes, got %d", n)
+	}
+}
+
+const benchmarkFlows = 100000
+
+func BenchmarkLookup(b *testing.B) {
+	ctrl, routes := newTestController(b, benchmarkFlows)
+	tab := ctrl.GetTable()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			in := routes[i%len(routes)].Inbound
+			if tab.Lookup(protocols.TCP, in.SrcIP, in.DstIP, in.SrcPort, in.DstPort) == nil {
+				b.Fatal("route not found")
+			}
+			i += 7919
+		}
+	})
+}
+
+func BenchmarkAddRoute(b *testing.B) {
+	ctrl, _ := newTestController(b, benchmarkFlows)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		route, err := ctrl.AddRoute(testRoute(benchmarkFlows + i%benchmarkFlows))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ctrl.Kill(route)
+	}
+}
+
+func BenchmarkAddRouteEvict(b *testing.B) {
+	ctrl, _ := newTestController(b, benchmarkFlows)
+	ctrl.SetCapacity(benchmarkFlows)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := ctrl.AddRoute(testRoute(benchmarkFlows + i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExpire(b *testing.B) {
+	ctrl, _ := newTestController(b, benchmarkFlows)
+	ctrl.SetTimeouts(Timeouts{TCPSynSent: time.Hour})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ctrl.Expire()
+	}
+}
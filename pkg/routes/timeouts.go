@@ -0,0 +1,136 @@
+package routes
+
+import "time"
+
+// Timeouts are the times a flow is kept after its last packet, by protocol
+// and connection state.
+type Timeouts struct {
+	// TCPSynSent is used while the handshake is in progress
+	TCPSynSent time.Duration
+	// TCPEstablished is used once the handshake completed
+	TCPEstablished time.Duration
+	// TCPFinWait is used after one side sent a FIN
+	TCPFinWait time.Duration
+	// TCPTimeWait is used after both sides sent a FIN
+	TCPTimeWait time.Duration
+	// TCPClosed is used after a RST
+	TCPClosed time.Duration
+
+	// UDP is used for flows with at most a request and a response
+	UDP time.Duration
+	// UDPStream is used once more packets were exchanged
+	UDPStream time.Duration
+}
+
+// DefaultTimeouts returns the default timeouts. The TCP timeouts follow
+// RFC 5382 and the UDP timeouts RFC 4787.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		TCPSynSent:     60 * time.Second,
+		TCPEstablished: 124 * time.Minute,
+		TCPFinWait:     120 * time.Second,
+		TCPTimeWait:    10 * time.Second,
+		TCPClosed:      5 * time.Second,
+		UDP:            30 * time.Second,
+		UDPStream:      180 * time.Second,
+	}
+}
+
+// TCPState is the state of a TCP connection as seen from the packets routed
+// through a flow.
+type TCPState uint8
+
+const (
+	TCPSynSent TCPState = iota
+	TCPEstablished
+	TCPFinWait
+	TCPTimeWait
+	TCPClosed
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case TCPSynSent:
+		return "SYN_SENT"
+	case TCPEstablished:
+		return "ESTABLISHED"
+	case TCPFinWait:
+		return "FIN_WAIT"
+	case TCPTimeWait:
+		return "TIME_WAIT"
+	case TCPClosed:
+		return "CLOSED"
+	default:
+		return "INVALID"
+	}
+}
+
+// TCPFlags are the TCP flags which move a connection between states.
+type TCPFlags uint8
+
+const (
+	TCPSyn TCPFlags = 1 << iota
+	TCPAck
+	TCPFin
+	TCPRst
+)
+
+// the TCP state of a flow is kept as the set of flags seen in each direction
+const (
+	tcpSynRx uint32 = 1 << iota
+	tcpSynTx
+	tcpAckRx
+	tcpAckTx
+	tcpFinRx
+	tcpFinTx
+	tcpReset
+	tcpEstablished
+)
+
+func tcpState(s uint32) TCPState {
+	switch {
+	case s&tcpReset != 0:
+		return TCPClosed
+	case s&(tcpFinRx|tcpFinTx) == tcpFinRx|tcpFinTx:
+		return TCPTimeWait
+	case s&(tcpFinRx|tcpFinTx) != 0:
+		return TCPFinWait
+	case s&tcpEstablished != 0:
+		return TCPEstablished
+	default:
+		return TCPSynSent
+	}
+}
+
+// nextTCPState adds the flags of a packet to s. rx is true for packets
+// routed by the rx route of the flow.
+func nextTCPState(s uint32, rx bool, flags TCPFlags) uint32 {
+	syn, ack, fin := tcpSynTx, tcpAckTx, tcpFinTx
+	if rx {
+		syn, ack, fin = tcpSynRx, tcpAckRx, tcpFinRx
+	}
+
+	if flags&TCPRst != 0 {
+		s |= tcpReset
+	}
+	if flags&TCPSyn != 0 {
+		s |= syn
+	}
+	if flags&TCPFin != 0 {
+		s |= fin
+	}
+	if flags&(TCPSyn|TCPAck) == TCPAck {
+		s |= ack
+	}
+
+	switch {
+	case s&(tcpSynRx|tcpSynTx) == tcpSynRx|tcpSynTx && s&(tcpAckRx|tcpAckTx) != 0:
+		// the handshake completed
+		s |= tcpEstablished
+	case s&(tcpSynRx|tcpSynTx) == 0 && s&(tcpAckRx|tcpAckTx) == tcpAckRx|tcpAckTx:
+		// the flow was picked up after the handshake (after a restart)
+		s |= tcpEstablished
+	}
+
+	return s
+}
@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"sort"
+
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+// Usage is the traffic of all flows (active and expired) of a host and
+// rule. Rx counts the traffic sent by the host, Tx the traffic sent to it.
+type Usage struct {
+	HostID   string
+	RuleID   string
+	Protocol protocols.Protocol
+
+	Active    int
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+}
+
+type usageKey struct {
+	hostID   string
+	ruleID   string
+	protocol protocols.Protocol
+}
+
+// Usage returns the traffic counters per host and rule.
+func (c *Controller) Usage() []Usage {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	usage := make(map[usageKey]*Usage, len(c.expired))
+	for key, u := range c.expired {
+		clone := *u
+		usage[key] = &clone
+	}
+
+	for f := c.flows.front(); f != nil; f = f.next {
+		addUsage(usage, f.rxRoute, true)
+	}
+
+	list := make([]Usage, 0, len(usage))
+	for _, u := range usage {
+		list = append(list, *u)
+	}
+	sort.Sort(sortedUsage(list))
+	return list
+}
+
+func addUsage(usage map[usageKey]*Usage, route *Route, active bool) {
+	key := usageKey{route.HostID, route.RuleID, route.Protocol}
+
+	u := usage[key]
+	if u == nil {
+		u = &Usage{HostID: route.HostID, RuleID: route.RuleID, Protocol: route.Protocol}
+		usage[key] = u
+	}
+
+	stats := route.flow.Stats()
+	if active {
+		u.Active++
+	}
+	u.RxBytes += stats.RxBytes
+	u.TxBytes += stats.TxBytes
+	u.RxPackets += stats.RxPackets
+	u.TxPackets += stats.TxPackets
+}
+
+type sortedUsage []Usage
+
+func (s sortedUsage) Len() int      { return len(s) }
+func (s sortedUsage) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortedUsage) Less(i, j int) bool {
+	if s[i].HostID != s[j].HostID {
+		return s[i].HostID < s[j].HostID
+	}
+	if s[i].RuleID != s[j].RuleID {
+		return s[i].RuleID < s[j].RuleID
+	}
+	return s[i].Protocol < s[j].Protocol
+}
@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fd/switchboard/pkg/ports"
+	"github.com/fd/switchboard/pkg/protocols"
+)
+
+func TestUsage(t *testing.T) {
+	ctrl := NewController(ports.NewMapper())
+
+	var routes []*Route
+	for i := 0; i < 2; i++ {
+		r, err := ctrl.AddRoute(&Route{
+			Protocol: protocols.TCP,
+			HostID:   "host-a",
+			RuleID:   "rule-a",
+			Inbound: Stream{
+				SrcIP:   net.IPv4(127, 0, 0, 1),
+				SrcPort: uint16(22001 + i),
+				DstIP:   net.IPv4(127, 0, 0, 2),
+				DstPort: 1024,
+			},
+			Outbound: Stream{
+				DstIP:   net.IPv4(127, 0, 0, 3),
+				DstPort: 1024,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, r)
+	}
+
+	now := time.Now()
+	routes[0].RoutedPacket(now, 100)
+	routes[1].RoutedPacket(now, 50)
+	routes[1].reverse().RoutedPacket(now, 20)
+
+	usage := ctrl.Usage()
+	if len(usage) != 1 {
+		t.Fatalf("expected 1 entry, got %+v", usage)
+	}
+	u := usage[0]
+	if u.HostID != "host-a" || u.RuleID != "rule-a" || u.Active != 2 {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+	if u.RxBytes != 150 || u.RxPackets != 2 || u.TxBytes != 20 || u.TxPackets != 1 {
+		t.Fatalf("unexpected counters: %+v", u)
+	}
+
+	// the counters of expired flows are kept
+	ctrl.expire(now.Add(time.Hour))
+
+	usage = ctrl.Usage()
+	if len(usage) != 1 || usage[0].Active != 0 || usage[0].RxBytes != 150 || usage[0].TxBytes != 20 {
+		t.Fatalf("unexpected usage after expiry: %+v", usage)
+	}
+}
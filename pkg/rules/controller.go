@@ -59,9 +59,16 @@ func (c *Controller) AddRule(rule Rule) (Rule, error) {
 		return Rule{}, fmt.Errorf("a rule already exists for %s:%s:%d", rule.SrcHostID, rule.Protocol, rule.SrcPort)
 	}
 
-	_, err := c.ports.Allocate(rule.SrcHostID, rule.Protocol, rule.SrcPort)
-	if err != nil {
-		return Rule{}, err
+	// a rule which is replaced keeps its port when it didn't change
+	old, replaced := c.rules[rule.ID]
+	if !replaced || old.SrcHostID != rule.SrcHostID || old.Protocol != rule.Protocol || old.SrcPort != rule.SrcPort {
+		_, err := c.ports.Allocate(rule.SrcHostID, rule.Protocol, rule.SrcPort, ports.OwnerRule)
+		if err != nil {
+			return Rule{}, err
+		}
+		if replaced {
+			c.ports.Release(old.SrcHostID, old.Protocol, old.SrcPort)
+		}
 	}
 
 	c.rules[rule.ID] = rule
@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package tap
+
+import (
+	"strings"
+
+	"github.com/fd/switchboard/pkg/link"
+)
+
+func init() {
+	// id is either "NAME" or "NAME,GATEWAY-CIDR" (eg. "tap0,192.168.164.1/24")
+	link.Register("tap", func(id string) (link.Link, error) {
+		var name, addr = id, ""
+		if idx := strings.IndexByte(id, ','); idx >= 0 {
+			name, addr = id[:idx], id[idx+1:]
+		}
+		return Open(name, addr)
+	})
+}
@@ -0,0 +1,218 @@
+//go:build linux
+// +build linux
+
+package tap
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/fd/switchboard/pkg/link"
+)
+
+const (
+	cIFF_TAP    = 0x0002
+	cIFF_NO_PI  = 0x1000
+	cTUNSETIFF  = 0x400454ca
+	cIFNAMSIZ   = 16
+	etherHdrLen = 14
+)
+
+var (
+	ErrInvalidName    = errors.New("tap: invalid interface name")
+	ErrInvalidAddress = errors.New("tap: invalid gateway address")
+)
+
+// DefaultAddress is the address assigned to the kernel side of the tap device
+// when none is given.
+const DefaultAddress = "192.168.164.1/24"
+
+type ifreq struct {
+	name  [cIFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// Interface is a TAP device. The kernel side of the device acts as the
+// gateway, the switchboard side (with its own MAC address) as the controller.
+type Interface struct {
+	mtx    sync.Mutex
+	closed bool
+
+	file   *os.File
+	events chan link.Event
+
+	name          string
+	mac           net.HardwareAddr
+	maxPacketSize int
+
+	gatewayMAC     net.HardwareAddr
+	gatewayIPv4    net.IP
+	controllerIPv4 net.IP
+}
+
+// Open creates (or attaches to) the TAP device name and assigns addr (in CIDR
+// notation) to the kernel side of the device. The controller gets the next
+// address in the subnet.
+func Open(name, addr string) (*Interface, error) {
+	if name == "" || len(name) >= cIFNAMSIZ {
+		return nil, ErrInvalidName
+	}
+	if addr == "" {
+		addr = DefaultAddress
+	}
+
+	gatewayIP, subnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	gatewayIP = gatewayIP.To4()
+	if gatewayIP == nil {
+		return nil, ErrInvalidAddress
+	}
+	controllerIP := link.NextIP(gatewayIP)
+	if !subnet.Contains(controllerIP) {
+		return nil, ErrInvalidAddress
+	}
+
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var req ifreq
+	copy(req.name[:], name)
+	req.flags = cIFF_TAP | cIFF_NO_PI
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cTUNSETIFF, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+
+	iface := &Interface{
+		// the fd is non-blocking so the runtime poller can interrupt reads on Close
+		file:           os.NewFile(uintptr(fd), "/dev/net/tun"),
+		events:         make(chan link.Event),
+		name:           name,
+		gatewayIPv4:    gatewayIP,
+		controllerIPv4: controllerIP,
+	}
+
+	iface.mac, err = link.RandomMAC()
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+
+	ones, _ := subnet.Mask.Size()
+	err = run("ip", "link", "set", "dev", name, "up")
+	if err == nil {
+		err = run("ip", "addr", "replace", gatewayIP.String()+"/"+strconv.Itoa(ones), "dev", name)
+	}
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+
+	netIface, err := net.InterfaceByName(name)
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+	iface.gatewayMAC = netIface.HardwareAddr
+	iface.maxPacketSize = netIface.MTU + etherHdrLen
+
+	return iface, nil
+}
+
+// Name returns the name of the TAP device
+func (iface *Interface) Name() string {
+	return iface.name
+}
+
+func (iface *Interface) MaxPacketSize() int {
+	return iface.maxPacketSize
+}
+
+func (iface *Interface) HardwareAddr() net.HardwareAddr {
+	return iface.mac
+}
+
+func (iface *Interface) Config() link.Config {
+	return link.Config{
+		GatewayMAC:     iface.gatewayMAC,
+		GatewayIPv4:    iface.gatewayIPv4,
+		ControllerIPv4: iface.controllerIPv4,
+	}
+}
+
+func (iface *Interface) Events() <-chan link.Event {
+	return iface.events
+}
+
+func (iface *Interface) Close() error {
+	iface.mtx.Lock()
+	if iface.closed {
+		iface.mtx.Unlock()
+		return nil
+	}
+	iface.closed = true
+	iface.mtx.Unlock()
+
+	close(iface.events)
+	return iface.file.Close()
+}
+
+func (iface *Interface) ReadPacket(p []byte) (n int, flags uint32, err error) {
+	if iface == nil {
+		return 0, 0, io.EOF
+	}
+	if len(p) < iface.maxPacketSize {
+		return 0, 0, io.ErrShortBuffer
+	}
+
+	n, err = iface.file.Read(p)
+	if err != nil && iface.isClosed() {
+		return 0, 0, io.EOF
+	}
+	return n, 0, err
+}
+
+func (iface *Interface) WritePacket(p []byte, flags uint32) (n int, err error) {
+	if iface == nil {
+		return 0, io.EOF
+	}
+	if len(p) > iface.maxPacketSize {
+		return 0, io.ErrShortWrite
+	}
+
+	n, err = iface.file.Write(p)
+	if err != nil && iface.isClosed() {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (iface *Interface) isClosed() bool {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	return iface.closed
+}
+
+func run(args ...string) error {
+	log.Printf("exec: %v", args)
+	output, err := exec.Command("sudo", args...).CombinedOutput()
+	if err != nil {
+		log.Printf("TAP/error: %s", output)
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+//go:build darwin
+// +build darwin
+
+package vmnet
+
+import "github.com/fd/switchboard/pkg/link"
+
+func init() {
+	link.Register("vmnet", func(id string) (link.Link, error) {
+		iface, err := Open(id)
+		if err != nil {
+			return nil, err
+		}
+		return newLink(iface), nil
+	})
+}
+
+var _ link.BatchWriter = (*vmnetLink)(nil)
+
+// vmnetLink adapts an Interface to the link.Link interface.
+type vmnetLink struct {
+	*Interface
+	events chan link.Event
+}
+
+func newLink(iface *Interface) *vmnetLink {
+	l := &vmnetLink{
+		Interface: iface,
+		events:    make(chan link.Event),
+	}
+
+	go func() {
+		defer close(l.events)
+		for event := range iface.Events() {
+			l.events <- link.Event{Type: link.EventType(event.Type)}
+		}
+	}()
+
+	return l
+}
+
+func (l *vmnetLink) Events() <-chan link.Event {
+	return l.events
+}
@@ -174,3 +174,36 @@ void VmnetWrite(void* goIface, void* msg) {
     cMsgSetStatus(msg, 2001);
   }
 }
+
+void VmnetWriteBatch(void* goIface, void* msg) {
+  interface_ref iface = (interface_ref)cInterfaceGetIfaceRef(goIface);
+
+  int count = cBatchMsgGetPacketCount(msg);
+  uint32_t flags = cBatchMsgGetPacketFlags(msg);
+
+  struct iovec iov[count];
+  struct vmpktdesc v[count];
+
+  for (int i = 0; i < count; i++) {
+    iov[i].iov_base = cBatchMsgGetBufPtr(msg, i);
+    iov[i].iov_len = cBatchMsgGetBufLen(msg, i);
+
+    v[i].vm_pkt_size = iov[i].iov_len;
+    v[i].vm_pkt_iov = &iov[i];
+    v[i].vm_pkt_iovcnt = 1;
+    v[i].vm_flags = flags;
+  }
+
+  int pktcnt = count;
+
+  vmnet_return_t status = vmnet_write(iface, v, &pktcnt);
+  cBatchMsgSetStatus(msg, status);
+
+  if (status == VMNET_SUCCESS && pktcnt <= 0) {
+    cBatchMsgSetStatus(msg, 2001);
+  }
+
+  if (status == VMNET_SUCCESS && pktcnt > 0) {
+    cBatchMsgSetPacketCount(msg, pktcnt);
+  }
+}
@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vmnet
 
 import (
@@ -15,6 +18,7 @@ import (
 // extern void VmnetClose(void* goIface, void* msg);
 // extern void VmnetRead(void* goIface, void* msg);
 // extern void VmnetWrite(void* goIface, void* msg);
+// extern void VmnetWriteBatch(void* goIface, void* msg);
 import "C"
 
 var (
@@ -24,12 +28,18 @@ var (
 	ErrInterfaceSetupIsNotComplete         = errors.New("vmnet: interface setup is not complete")
 	ErrPermissionDenied                    = errors.New("vmnet: permission denied")
 	ErrPacketSizeLargerThanMTU             = errors.New("vmnet: packet size larger than MTU")
-	ErrBuffersExhaustedTemporarilyInKernel = errors.New("vmnet: buffers exhausted temporarily in kernel")
+	ErrBuffersExhaustedTemporarilyInKernel = temporaryError("vmnet: buffers exhausted temporarily in kernel")
 	ErrPacketsLargerThanLimit              = errors.New("vmnet: packets larger than limit")
 	errNoMorePackets                       = errors.New("vmnet: no more packets")
 	errNotWritten                          = errors.New("vmnet: packet not written")
 )
 
+// temporaryError is returned for conditions which go away on their own.
+type temporaryError string
+
+func (e temporaryError) Error() string   { return string(e) }
+func (e temporaryError) Temporary() bool { return true }
+
 var errCodeToErr = map[int]error{
 	1001: ErrGenericFailure,
 	1002: ErrOutOfMemory,
@@ -58,6 +68,13 @@ type cMsg struct {
 	pktFlags uint32
 }
 
+type cBatchMsg struct {
+	status   int
+	bufs     [][]byte
+	pktCount int
+	pktFlags uint32
+}
+
 type Interface struct {
 	mtx sync.RWMutex
 
@@ -220,6 +237,54 @@ func (iface *Interface) WritePacket(p []byte, flags uint32) (n int, err error) {
 	return msg.pktSize, nil
 }
 
+// WritePackets writes frames with a single call to vmnet. It stops at the
+// first frame which is too large.
+func (iface *Interface) WritePackets(frames [][]byte, flags uint32) (n int, err error) {
+	if iface == nil {
+		return 0, io.EOF
+	}
+	for i, p := range frames {
+		if uint64(len(p)) > iface.maxPacketSize {
+			if i == 0 {
+				return 0, io.ErrShortWrite
+			}
+			frames = frames[:i]
+			break
+		}
+	}
+	if len(frames) == 0 {
+		return 0, nil
+	}
+
+	iface.mtx.RLock()
+	defer iface.mtx.RUnlock()
+
+	if iface.closed {
+		return 0, io.EOF
+	}
+
+	var msg cBatchMsg
+	msg.bufs = frames
+	msg.pktFlags = flags
+	msg.pktCount = len(frames)
+
+	C.VmnetWriteBatch(unsafe.Pointer(iface), unsafe.Pointer(&msg))
+
+	if msg.status != 1000 {
+		err := errCodeToErr[msg.status]
+		if err == nil {
+			err = ErrGenericFailure
+		}
+		return 0, err
+	}
+
+	if msg.pktCount < len(frames) {
+		// vmnet took fewer packets than it was given; its buffers are full
+		return msg.pktCount, ErrBuffersExhaustedTemporarilyInKernel
+	}
+	return msg.pktCount, nil
+}
+
 func (iface *Interface) readPacket() (packet, error) {
 	var pkt packet
 	var msg cMsg
@@ -370,3 +435,40 @@ func cMsgGetPacketFlags(ptr unsafe.Pointer) uint32 {
 	msg := (*cMsg)(ptr)
 	return msg.pktFlags
 }
+
+//export cBatchMsgSetStatus
+func cBatchMsgSetStatus(ptr unsafe.Pointer, x int) {
+	msg := (*cBatchMsg)(ptr)
+	msg.status = x
+}
+
+//export cBatchMsgGetPacketCount
+func cBatchMsgGetPacketCount(ptr unsafe.Pointer) C.int {
+	msg := (*cBatchMsg)(ptr)
+	return C.int(msg.pktCount)
+}
+
+//export cBatchMsgSetPacketCount
+func cBatchMsgSetPacketCount(ptr unsafe.Pointer, x C.int) {
+	msg := (*cBatchMsg)(ptr)
+	msg.pktCount = int(x)
+}
+
+//export cBatchMsgGetBufPtr
+func cBatchMsgGetBufPtr(ptr unsafe.Pointer, i C.int) unsafe.Pointer {
+	msg := (*cBatchMsg)(ptr)
+	hdrp := (*reflect.SliceHeader)(unsafe.Pointer(&msg.bufs[i]))
+	return unsafe.Pointer(hdrp.Data)
+}
+
+//export cBatchMsgGetBufLen
+func cBatchMsgGetBufLen(ptr unsafe.Pointer, i C.int) C.size_t {
+	msg := (*cBatchMsg)(ptr)
+	return C.size_t(len(msg.bufs[i]))
+}
+
+//export cBatchMsgGetPacketFlags
+func cBatchMsgGetPacketFlags(ptr unsafe.Pointer) uint32 {
+	msg := (*cBatchMsg)(ptr)
+	return msg.pktFlags
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"path/filepath"
 	"strings"
 
@@ -12,9 +15,10 @@ import (
 )
 
 type controller struct {
-	docker *docker.Client
-	plugin *plugin.Plugin
-	idMap  map[string]string
+	docker     *docker.Client
+	plugin     *plugin.Plugin
+	idMap      map[string]string
+	externalIP string
 }
 
 func watch(ctx context.Context, plugin *plugin.Plugin) error {
@@ -22,6 +26,10 @@ func watch(ctx context.Context, plugin *plugin.Plugin) error {
 		Host      string `hcl:"host"`
 		VerifyTLS bool   `hcl:"verify-tls"`
 		CertPath  string `hcl:"cert-path"`
+
+		// ExternalIP is the address published ports are reachable on
+		// (defaults to the address of the docker host)
+		ExternalIP string `hcl:"external-ip"`
 	}
 
 	err := plugin.ParseConfig(&config)
@@ -29,6 +37,18 @@ func watch(ctx context.Context, plugin *plugin.Plugin) error {
 		return err
 	}
 
+	if config.ExternalIP == "" {
+		u, err := url.Parse(config.Host)
+		if err != nil {
+			return err
+		}
+		host, _, err := net.SplitHostPort(u.Host)
+		if u.Scheme != "tcp" || err != nil {
+			return fmt.Errorf("external-ip is required when host is not a tcp:// address (got %q)", config.Host)
+		}
+		config.ExternalIP = host
+	}
+
 	var client *docker.Client
 	if config.VerifyTLS {
 		cert := filepath.Join(config.CertPath, "cert.pem")
@@ -55,9 +75,10 @@ func watch(ctx context.Context, plugin *plugin.Plugin) error {
 	}
 
 	ctrl := &controller{
-		docker: client,
-		plugin: plugin,
-		idMap:  make(map[string]string),
+		docker:     client,
+		plugin:     plugin,
+		idMap:      make(map[string]string),
+		externalIP: config.ExternalIP,
 	}
 
 	addExistingHosts(ctx, ctrl)
@@ -129,6 +150,11 @@ func addHost(ctx context.Context, ctrl *controller, containerID string) {
 		AllocateIPv4: true,
 	}
 
+	if policy := info.Config.Labels["switchboard.policy"]; policy != "" {
+		// drop or reject
+		in.Policy = protocol.HostPolicy(protocol.HostPolicy_value[strings.ToUpper(policy)])
+	}
+
 	out, err := ctrl.plugin.Hosts().Add(ctx, &in)
 	if err != nil {
 		log.Printf("error: %s", err)
@@ -229,7 +255,7 @@ func addRules(ctx context.Context, ctrl *controller, containerID string) {
 			Protocol:  proto,
 			SrcHostId: id,
 			SrcPort:   int32(mapping.PrivatePort),
-			DstIp:     "192.168.99.100",
+			DstIp:     ctrl.externalIP,
 			DstPort:   int32(mapping.PublicPort),
 		}
 